@@ -2,10 +2,13 @@ module github.com/bahodge/kgpmp-prototype
 
 go 1.22.0
 
+require (
+	github.com/fxamacker/cbor/v2 v2.6.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
+
 require (
 	capnproto.org/go/capnp/v3 v3.0.0-alpha-29 // indirect
-	github.com/fxamacker/cbor/v2 v2.6.0 // indirect
-	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9 // indirect
@@ -32,6 +32,7 @@ func SendMessage(conn net.Conn, message []byte) error {
 func RunCapn(iterations int) {
 	var sendBuf bytes.Buffer
 	sendBuf.Grow(1024 * 1024)
+	fw := protocol.NewFrameWriter(&sendBuf)
 
 	for i := 0; i < iterations; i++ {
 		arena := capnp.SingleSegment(nil)
@@ -58,45 +59,33 @@ func RunCapn(iterations int) {
 			log.Fatal("could not marshal message!", err)
 		}
 
-		b, err := protocol.PrefixWithLength(payload)
-		if err != nil {
-			log.Fatal("could not prefix", err)
-		}
-
-		_, err = sendBuf.Write(b)
+		err = fw.WriteFrame(payload)
 		if err != nil {
 			log.Fatal("could not write bytes to buffer")
 		}
 
 	}
 
+	if err := fw.Flush(); err != nil {
+		log.Fatal("could not flush buffer", err)
+	}
+
 	// parsingStart := time.Now()
 	var rawMessages [][]byte
-	parser := protocol.NewMessageParser()
+	fr := protocol.NewFrameReader(&sendBuf)
 
 	for {
-		// Read a chunk of data from the buffer
-		chunk := make([]byte, 1024*1024)
-		n, err := sendBuf.Read(chunk)
+		// Read the next complete message from the buffer
+		frame, err := fr.ReadFrame()
 		if err != nil {
 			if err == io.EOF {
 				// End of buffer reached, exit the loop
 				break
 			}
-			log.Fatal("could not read", err)
+			log.Fatal("unable to parse data", err)
 		}
 
-		// Process the chunk only if it contains data
-		if n > 0 {
-			// Parse the chunk to extract complete messages
-			messages, err := parser.Parse(chunk[:n]) // Pass only the portion of the chunk that contains valid data
-			if err != nil {
-				log.Fatal("unable to parse data", err)
-			}
-
-			// Update counters and append parsed messages
-			rawMessages = append(rawMessages, messages...)
-		}
+		rawMessages = append(rawMessages, frame)
 	}
 
 	deserializedMessages := []protos.KoboldMessage{}
@@ -117,6 +106,7 @@ func RunCapn(iterations int) {
 func RunMsgpack(iterations int) {
 	var sendBuf bytes.Buffer
 	sendBuf.Grow(1024 * 1024)
+	fw := protocol.NewFrameWriter(&sendBuf)
 
 	serializeCount := 0
 	for i := 0; i < iterations; i++ {
@@ -131,12 +121,12 @@ func RunMsgpack(iterations int) {
 			Timestamp:   time.Now().UnixMicro(),
 		}
 
-		s, err := protocol.SerializeMsgpack(m)
+		s, err := protocol.Msgpack.Marshal(m)
 		if err != nil {
 			log.Fatal("could not serialize message", err)
 		}
 
-		_, err = sendBuf.Write(s)
+		err = fw.WriteFrame(s)
 		if err != nil {
 			log.Fatal("could not write to buffer")
 		}
@@ -144,40 +134,33 @@ func RunMsgpack(iterations int) {
 		serializeCount++
 	}
 
-	parser := protocol.NewMessageParser()
+	if err := fw.Flush(); err != nil {
+		log.Fatal("could not flush buffer", err)
+	}
+
+	fr := protocol.NewFrameReader(&sendBuf)
 
 	// var rawMessages []protocol.KoboldMessage
 	var rawMessages [][]byte
 
 	for {
-		// Read a chunk of data from the buffer
-		chunk := make([]byte, 1024*1024)
-		n, err := sendBuf.Read(chunk)
+		// Read the next complete message from the buffer
+		frame, err := fr.ReadFrame()
 		if err != nil {
 			if err == io.EOF {
 				// End of buffer reached, exit the loop
 				break
 			}
-			log.Fatal("could not read", err)
+			log.Fatal("unable to parse data", err)
 		}
 
-		// Process the chunk only if it contains data
-		if n > 0 {
-			// Parse the chunk to extract complete messages
-			messages, err := parser.Parse(chunk[:n]) // Pass only the portion of the chunk that contains valid data
-			if err != nil {
-				log.Fatal("unable to parse data", err)
-			}
-
-			// Update counters and append parsed messages
-			rawMessages = append(rawMessages, messages...)
-		}
+		rawMessages = append(rawMessages, frame)
 	}
 
 	deserializedMessages := []protocol.Message{}
 	for _, msg := range rawMessages {
 		var deserializedMessage protocol.Message
-		err := protocol.DeserializeMsgpack(msg, &deserializedMessage)
+		err := protocol.Msgpack.Unmarshal(msg, &deserializedMessage)
 		if err != nil {
 			log.Fatal("could not deserialize message", err)
 		}
@@ -187,9 +170,35 @@ func RunMsgpack(iterations int) {
 }
 
 func RunCBOR(iterations int) {
+	runCBOR(iterations, func(fw *protocol.FrameWriter, fr *protocol.FrameReader) {})
+}
+
+// RunCBORChecksums is RunCBOR with every frame followed by its crc32c
+func RunCBORChecksums(iterations int) {
+	runCBOR(iterations, func(fw *protocol.FrameWriter, fr *protocol.FrameReader) {
+		fw.SetChecksums(true)
+		fr.SetChecksums(true)
+	})
+}
+
+// RunCBORCompressed is RunCBOR with every frame compressed, no matter how
+// small
+func RunCBORCompressed(iterations int, c protocol.Compressor) {
+	runCBOR(iterations, func(fw *protocol.FrameWriter, fr *protocol.FrameReader) {
+		fw.SetCompression(c, 0)
+		fr.SetCompression(c)
+	})
+}
+
+func runCBOR(iterations int, configure func(fw *protocol.FrameWriter, fr *protocol.FrameReader)) {
 	var sendBuf bytes.Buffer
 	sendBuf.Grow(1024 * 1024)
+	fw := protocol.NewFrameWriter(&sendBuf)
+	fr := protocol.NewFrameReader(&sendBuf)
+	configure(fw, fr)
 
+	// the frame writer copies the payload, one buffer does for every message
+	var payload []byte
 	serializeCount := 0
 	for i := 0; i < iterations; i++ {
 		m := protocol.Message{
@@ -203,12 +212,8 @@ func RunCBOR(iterations int) {
 			Timestamp:   time.Now().UnixMicro(),
 		}
 
-		s, err := protocol.SerializeCBOR(m)
-		if err != nil {
-			log.Fatal("could not serialize message", err)
-		}
-
-		_, err = sendBuf.Write(s)
+		payload = protocol.AppendCBOR(payload[:0], m)
+		err := fw.WriteFrame(payload)
 		if err != nil {
 			log.Fatal("could not write to buffer")
 		}
@@ -216,40 +221,31 @@ func RunCBOR(iterations int) {
 		serializeCount++
 	}
 
-	parser := protocol.NewMessageParser()
+	if err := fw.Flush(); err != nil {
+		log.Fatal("could not flush buffer", err)
+	}
 
 	// var rawMessages []protocol.KoboldMessage
 	var rawMessages [][]byte
 
 	for {
-		// Read a chunk of data from the buffer
-		chunk := make([]byte, 1024*1024)
-		n, err := sendBuf.Read(chunk)
+		// Read the next complete message from the buffer
+		frame, err := fr.ReadFrame()
 		if err != nil {
 			if err == io.EOF {
 				// End of buffer reached, exit the loop
 				break
 			}
-			log.Fatal("could not read", err)
+			log.Fatal("unable to parse data", err)
 		}
 
-		// Process the chunk only if it contains data
-		if n > 0 {
-			// Parse the chunk to extract complete messages
-			messages, err := parser.Parse(chunk[:n]) // Pass only the portion of the chunk that contains valid data
-			if err != nil {
-				log.Fatal("unable to parse data", err)
-			}
-
-			// Update counters and append parsed messages
-			rawMessages = append(rawMessages, messages...)
-		}
+		rawMessages = append(rawMessages, frame)
 	}
 
 	deserializedMessages := []protocol.Message{}
 	for _, msg := range rawMessages {
 		var deserializedMessage protocol.Message
-		err := protocol.DeserializeCBOR(msg, &deserializedMessage)
+		err := protocol.CBOR.Unmarshal(msg, &deserializedMessage)
 		if err != nil {
 			log.Fatal("could not deserialize message", err)
 		}
@@ -261,6 +257,7 @@ func RunCBOR(iterations int) {
 func RunJSON(iterations int) {
 	var sendBuf bytes.Buffer
 	sendBuf.Grow(1024 * 1024)
+	fw := protocol.NewFrameWriter(&sendBuf)
 
 	for i := 0; i < iterations; i++ {
 		m := protocol.Message{
@@ -274,51 +271,44 @@ func RunJSON(iterations int) {
 			Timestamp:   time.Now().UnixMicro(),
 		}
 
-		s, err := protocol.SerializeJSON(m)
+		s, err := protocol.JSON.Marshal(m)
 		if err != nil {
 			log.Fatal("could not serialize message", err)
 		}
 
-		_, err = sendBuf.Write(s)
+		err = fw.WriteFrame(s)
 		if err != nil {
 			log.Fatal("could not write to buffer")
 		}
 
 	}
 
-	parser := protocol.NewMessageParser()
+	if err := fw.Flush(); err != nil {
+		log.Fatal("could not flush buffer", err)
+	}
+
+	fr := protocol.NewFrameReader(&sendBuf)
 
 	var rawMessages [][]byte
 
 	for {
-		// Read a chunk of data from the buffer
-		chunk := make([]byte, 1024*1024)
-		n, err := sendBuf.Read(chunk)
+		// Read the next complete message from the buffer
+		frame, err := fr.ReadFrame()
 		if err != nil {
 			if err == io.EOF {
 				// End of buffer reached, exit the loop
 				break
 			}
-			log.Fatal("could not read", err)
+			log.Fatal("unable to parse data", err)
 		}
 
-		// Process the chunk only if it contains data
-		if n > 0 {
-			// Parse the chunk to extract complete messages
-			messages, err := parser.Parse(chunk[:n]) // Pass only the portion of the chunk that contains valid data
-			if err != nil {
-				log.Fatal("unable to parse data", err)
-			}
-
-			// Update counters and append parsed messages
-			rawMessages = append(rawMessages, messages...)
-		}
+		rawMessages = append(rawMessages, frame)
 	}
 
 	deserializedMessages := []protocol.Message{}
 	for _, msg := range rawMessages {
 		var deserializedMessage protocol.Message
-		err := protocol.DeserializeJSON(msg, &deserializedMessage)
+		err := protocol.JSON.Unmarshal(msg, &deserializedMessage)
 		if err != nil {
 			log.Fatal("could not deserialize message", err)
 		}
@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
 
 const ITERATIONS = 100
 
@@ -16,6 +20,30 @@ func BenchmarkRunCBOR10000(b *testing.B)   { benchmarkRunCBOR(10_000, b) }
 func BenchmarkRunCBOR100000(b *testing.B)  { benchmarkRunCBOR(100_000, b) }
 func BenchmarkRunCBOR1000000(b *testing.B) { benchmarkRunCBOR(1_000_000, b) }
 
+func BenchmarkRunCBORChecksums1(b *testing.B)       { benchmarkRunCBORChecksums(1, b) }
+func BenchmarkRunCBORChecksums100(b *testing.B)     { benchmarkRunCBORChecksums(100, b) }
+func BenchmarkRunCBORChecksums10000(b *testing.B)   { benchmarkRunCBORChecksums(10_000, b) }
+func BenchmarkRunCBORChecksums100000(b *testing.B)  { benchmarkRunCBORChecksums(100_000, b) }
+func BenchmarkRunCBORChecksums1000000(b *testing.B) { benchmarkRunCBORChecksums(1_000_000, b) }
+
+func BenchmarkRunCBORFlate1(b *testing.B)     { benchmarkRunCBORCompressed(1, protocol.Flate, b) }
+func BenchmarkRunCBORFlate100(b *testing.B)   { benchmarkRunCBORCompressed(100, protocol.Flate, b) }
+func BenchmarkRunCBORFlate10000(b *testing.B) { benchmarkRunCBORCompressed(10_000, protocol.Flate, b) }
+func BenchmarkRunCBORFlate100000(b *testing.B) {
+	benchmarkRunCBORCompressed(100_000, protocol.Flate, b)
+}
+func BenchmarkRunCBORFlate1000000(b *testing.B) {
+	benchmarkRunCBORCompressed(1_000_000, protocol.Flate, b)
+}
+
+func BenchmarkRunCBORGzip1(b *testing.B)      { benchmarkRunCBORCompressed(1, protocol.Gzip, b) }
+func BenchmarkRunCBORGzip100(b *testing.B)    { benchmarkRunCBORCompressed(100, protocol.Gzip, b) }
+func BenchmarkRunCBORGzip10000(b *testing.B)  { benchmarkRunCBORCompressed(10_000, protocol.Gzip, b) }
+func BenchmarkRunCBORGzip100000(b *testing.B) { benchmarkRunCBORCompressed(100_000, protocol.Gzip, b) }
+func BenchmarkRunCBORGzip1000000(b *testing.B) {
+	benchmarkRunCBORCompressed(1_000_000, protocol.Gzip, b)
+}
+
 func BenchmarkRunMsgpack1(b *testing.B)       { benchmarkRunMsgpack(1, b) }
 func BenchmarkRunMsgpack100(b *testing.B)     { benchmarkRunMsgpack(100, b) }
 func BenchmarkRunMsgpack10000(b *testing.B)   { benchmarkRunMsgpack(10_000, b) }
@@ -46,6 +74,18 @@ func benchmarkRunCBOR(iters int, b *testing.B) {
 	}
 }
 
+func benchmarkRunCBORChecksums(iters int, b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		RunCBORChecksums(iters)
+	}
+}
+
+func benchmarkRunCBORCompressed(iters int, c protocol.Compressor, b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		RunCBORCompressed(iters, c)
+	}
+}
+
 func benchmarkRunJSON(iters int, b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		RunJSON(iters)
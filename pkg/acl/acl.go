@@ -0,0 +1,161 @@
+// Package acl decides which topics a client may publish to, subscribe to,
+// advertise, send requests to and use as queues.
+//
+// A Policy is loaded from a JSON file that lists, per subject, the topic
+// patterns each action is allowed and denied on. The rules under "default"
+// apply to every subject on top of its own.
+//
+//	{
+//	  "default": {
+//	    "subscribe": {"allow": ["/public/>"]}
+//	  },
+//	  "subjects": {
+//	    "alice": {
+//	      "publish":   {"allow": ["/hello/>"], "deny": ["/hello/admin"]},
+//	      "subscribe": {"allow": ["/>"], "deny": ["/secret/>"]},
+//	      "advertise": {"allow": ["/echo"]},
+//	      "request":   {"allow": ["/echo"]}
+//	    }
+//	  }
+//	}
+//
+// An action is allowed when an allow pattern covers the topic or pattern it
+// is performed on and no deny pattern does. Subjects without rules and
+// actions without allow patterns are denied.
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+type Action string
+
+const (
+	Publish   Action = "publish"
+	Subscribe Action = "subscribe"
+	Advertise Action = "advertise"
+	Request   Action = "request"
+	Enqueue   Action = "enqueue"
+	Dequeue   Action = "dequeue"
+)
+
+var actions = map[Action]bool{
+	Publish:   true,
+	Subscribe: true,
+	Advertise: true,
+	Request:   true,
+	Enqueue:   true,
+	Dequeue:   true,
+}
+
+var (
+	ErrorInvalidPolicy = errors.New("invalid acl policy")
+	ErrorDenied        = errors.New("denied by acl")
+)
+
+// Permissions are the patterns an action is allowed and denied on
+type Permissions struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Rules are the permissions of a subject per action
+type Rules map[Action]Permissions
+
+type Policy struct {
+	// Default rules apply to every subject
+	Default Rules `json:"default,omitempty"`
+	// Subjects maps an identity, or the client id of connections that did
+	// not authenticate, to its rules
+	Subjects map[string]Rules `json:"subjects,omitempty"`
+}
+
+// LoadFile reads and validates the policy in the file
+func LoadFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Parse decodes and validates a JSON policy
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidPolicy, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks that every action is known and every pattern is legal
+func (p *Policy) Validate() error {
+	if err := validateRules("default", p.Default); err != nil {
+		return err
+	}
+	for subject, rules := range p.Subjects {
+		if err := validateRules(subject, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateRules(subject string, rules Rules) error {
+	for action, perms := range rules {
+		if !actions[action] {
+			return fmt.Errorf("%w: %s: unknown action %q", ErrorInvalidPolicy, subject, action)
+		}
+		for _, pattern := range slices.Concat(perms.Allow, perms.Deny) {
+			if err := topic.ValidatePattern(pattern); err != nil {
+				return fmt.Errorf("%w: %s: %s: %w", ErrorInvalidPolicy, subject, action, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether the subject may perform the action on the topic.
+// For subscriptions the topic is the pattern subscribed to.
+func (p *Policy) Allowed(subject string, action Action, topicName string) bool {
+	rules := []Rules{p.Default, p.Subjects[subject]}
+
+	for _, r := range rules {
+		for _, pattern := range r[action].Deny {
+			if topic.Covers(pattern, topicName) {
+				return false
+			}
+		}
+	}
+
+	for _, r := range rules {
+		for _, pattern := range r[action].Allow {
+			if topic.Covers(pattern, topicName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check is like Allowed but returns an error describing what was denied
+func (p *Policy) Check(subject string, action Action, topicName string) error {
+	if p.Allowed(subject, action, topicName) {
+		return nil
+	}
+	return fmt.Errorf("%w: %q may not %s %s", ErrorDenied, subject, action, topicName)
+}
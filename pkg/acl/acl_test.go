@@ -0,0 +1,142 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicy = `{
+	"default": {
+		"subscribe": {"allow": ["/public/>"]}
+	},
+	"subjects": {
+		"alice": {
+			"publish":   {"allow": ["/hello/>"], "deny": ["/hello/admin"]},
+			"subscribe": {"allow": ["/>"], "deny": ["/secret/>"]},
+			"request":   {"allow": ["/echo"]}
+		},
+		"bob": {
+			"advertise": {"allow": ["/echo", "/svc/*"]},
+			"subscribe": {"deny": ["/public/noisy"]}
+		}
+	}
+}`
+
+func TestAllowed(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		subject string
+		action  Action
+		topic   string
+		allowed bool
+	}{
+		{"alice", Publish, "/hello/world", true},
+		{"alice", Publish, "/hello/admin", false},
+		{"alice", Publish, "/other", false},
+		{"alice", Subscribe, "/>", true},
+		{"alice", Subscribe, "/hello/*", true},
+		{"alice", Subscribe, "/secret/*", false},
+		{"alice", Subscribe, "/secret/plans", false},
+		{"alice", Request, "/echo", true},
+		{"alice", Advertise, "/echo", false},
+		{"bob", Advertise, "/svc/a", true},
+		{"bob", Advertise, "/svc/a/b", false},
+		{"bob", Subscribe, "/public/news", true},
+		{"bob", Subscribe, "/public/noisy", false},
+		// a pattern wider than the allow patterns is denied
+		{"bob", Subscribe, "/public/>", true},
+		{"bob", Subscribe, "/>", false},
+		{"carol", Subscribe, "/public/*", true},
+		{"carol", Publish, "/public/news", false},
+		{"", Subscribe, "/public/news", true},
+	}
+
+	for _, tt := range tests {
+		if got := p.Allowed(tt.subject, tt.action, tt.topic); got != tt.allowed {
+			t.Errorf("Allowed(%q, %s, %q) = %v, want %v", tt.subject, tt.action, tt.topic, got, tt.allowed)
+		}
+	}
+
+	if err := p.Check("carol", Publish, "/x"); !errors.Is(err, ErrorDenied) {
+		t.Fatalf("expected denied, got %v", err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, policy := range []string{
+		`{"default": []}`,
+		`{"default": {"delete": {"allow": ["/a"]}}}`,
+		`{"subjects": {"alice": {"publish": {"allow": ["no-slash"]}}}}`,
+		`{"subjects": {"alice": {"publish": {"deny": ["/a/>/b"]}}}}`,
+	} {
+		if _, err := Parse([]byte(policy)); !errors.Is(err, ErrorInvalidPolicy) {
+			t.Errorf("expected %s to be invalid, got %v", policy, err)
+		}
+	}
+}
+
+// replaceFile swaps in the new content at once, the watcher could see a
+// file that is only partly written otherwise
+func replaceFile(t *testing.T, path string, content string) {
+	t.Helper()
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		policy *Policy
+		err    error
+	}
+	results := make(chan result, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchFile(ctx, path, 10*time.Millisecond, func(p *Policy, err error) {
+		results <- result{p, err}
+	})
+
+	next := func() result {
+		t.Helper()
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting on reload")
+		}
+		return result{}
+	}
+
+	// let the watcher see the file as it was first
+	time.Sleep(50 * time.Millisecond)
+
+	// mod times can be coarse, the size changing is enough to be noticed
+	replaceFile(t, path, testPolicy)
+	if r := next(); r.err != nil || !r.policy.Allowed("alice", Publish, "/hello/world") {
+		t.Fatalf("unexpected reload %+v", r)
+	}
+
+	replaceFile(t, path, `{"default": 1}`)
+	if r := next(); !errors.Is(r.err, ErrorInvalidPolicy) || r.policy != nil {
+		t.Fatalf("expected invalid policy, got %+v", r)
+	}
+}
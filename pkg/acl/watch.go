@@ -0,0 +1,41 @@
+package acl
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchFile polls the policy file every interval and calls reload with the
+// new policy whenever the file changed, or with the error when the changed
+// file could not be loaded. The caller keeps using the previous policy in
+// that case. It blocks until the context is done.
+func WatchFile(ctx context.Context, path string, interval time.Duration, reload func(*Policy, error)) {
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			if last != nil {
+				reload(nil, err)
+			}
+			last = nil
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+
+		reload(LoadFile(path))
+	}
+}
@@ -0,0 +1,50 @@
+// Package auth verifies the tokens clients present to a node.
+//
+// A node configured with an Authenticator only routes messages for a
+// connection once it sent an Authenticate message carrying a token in
+// Headers.AuthToken that the authenticator accepts. Three authenticators are
+// provided:
+//
+//	StaticTokens  tokens listed in a file, each mapped to a subject
+//	HMAC          compact tokens signed with a shared key
+//	JWT           HS256 JSON web tokens signed with a shared key
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrorMissingToken   = errors.New("missing token")
+	ErrorMalformedToken = errors.New("malformed token")
+	ErrorInvalidToken   = errors.New("invalid token")
+	ErrorExpiredToken   = errors.New("token expired")
+	// ErrorNotAuthenticated is returned for connections that have not
+	// presented a token yet
+	ErrorNotAuthenticated = errors.New("not authenticated")
+)
+
+// Authenticator checks a token and returns who it belongs to
+type Authenticator interface {
+	Authenticate(token string) (Identity, error)
+}
+
+// AuthenticatorFunc lets an ordinary function be used as an Authenticator
+type AuthenticatorFunc func(token string) (Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(token string) (Identity, error) {
+	return f(token)
+}
+
+// Identity is who a connection authenticated as
+type Identity struct {
+	Subject string
+	// Expires is when the token stops being valid, zero if it never does
+	Expires time.Time
+}
+
+// Expired reports whether the identity is no longer valid at the given time
+func (id Identity) Expired(now time.Time) bool {
+	return !id.Expires.IsZero() && !now.Before(id.Expires)
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticTokens(t *testing.T) {
+	tokens, err := ParseTokens(strings.NewReader(`
+# subject token
+alice   a-token
+bob     b-token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := tokens.Authenticate("b-token")
+	if err != nil || id.Subject != "bob" || !id.Expires.IsZero() {
+		t.Fatalf("unexpected identity %+v, %v", id, err)
+	}
+	if _, err := tokens.Authenticate(""); !errors.Is(err, ErrorMissingToken) {
+		t.Fatalf("expected missing token, got %v", err)
+	}
+	if _, err := tokens.Authenticate("c-token"); !errors.Is(err, ErrorInvalidToken) {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+
+	for _, file := range []string{"alice", "alice a b", "alice a\nbob a"} {
+		if _, err := ParseTokens(strings.NewReader(file)); err == nil {
+			t.Fatalf("expected %q to be rejected", file)
+		}
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	h := NewHMAC([]byte("key"))
+	h.now = func() time.Time { return now }
+
+	valid := h.Sign("alice", now.Add(time.Minute))
+	forever := h.Sign("bob", time.Time{})
+	expired := h.Sign("alice", now)
+	forged := NewHMAC([]byte("other key")).Sign("alice", now.Add(time.Minute))
+	// swapping the subject has to break the signature
+	parts := strings.Split(valid, ".")
+	tampered := base64.RawURLEncoding.EncodeToString([]byte("bob")) + "." + parts[1] + "." + parts[2]
+
+	tests := []struct {
+		token   string
+		subject string
+		err     error
+	}{
+		{valid, "alice", nil},
+		{forever, "bob", nil},
+		{"", "", ErrorMissingToken},
+		{"garbage", "", ErrorMalformedToken},
+		{"a.b.c.d", "", ErrorMalformedToken},
+		{parts[0] + ".soon." + parts[2], "", ErrorMalformedToken},
+		{parts[0] + "." + parts[1] + ".!!", "", ErrorMalformedToken},
+		{expired, "", ErrorExpiredToken},
+		{forged, "", ErrorInvalidToken},
+		{tampered, "", ErrorInvalidToken},
+	}
+
+	for i, tt := range tests {
+		id, err := h.Authenticate(tt.token)
+		if !errors.Is(err, tt.err) || (tt.err != nil) != (err != nil) {
+			t.Fatalf("%d: expected %v, got %v", i, tt.err, err)
+		}
+		if id.Subject != tt.subject {
+			t.Fatalf("%d: expected subject %q, got %q", i, tt.subject, id.Subject)
+		}
+	}
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	j := NewJWT([]byte("key"))
+	j.Issuer = "kgpmp"
+	j.now = func() time.Time { return now }
+
+	sign := func(signer *JWT, claims Claims) string {
+		t.Helper()
+		token, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := sign(j, Claims{Subject: "alice", Issuer: "kgpmp", ExpiresAt: now.Add(time.Minute).Unix()})
+	parts := strings.Split(valid, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"no expiry", sign(j, Claims{Subject: "alice", Issuer: "kgpmp"}), nil},
+		{"missing", "", ErrorMissingToken},
+		{"two segments", parts[0] + "." + parts[1], ErrorMalformedToken},
+		{"bad header", "e30K!." + parts[1] + "." + parts[2], ErrorMalformedToken},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".%%", ErrorMalformedToken},
+		{"no subject", sign(j, Claims{Issuer: "kgpmp"}), ErrorMalformedToken},
+		{"expired", sign(j, Claims{Subject: "alice", Issuer: "kgpmp", ExpiresAt: now.Add(-time.Second).Unix()}), ErrorExpiredToken},
+		{"not yet valid", sign(j, Claims{Subject: "alice", Issuer: "kgpmp", NotBefore: now.Add(time.Hour).Unix()}), ErrorInvalidToken},
+		{"wrong issuer", sign(j, Claims{Subject: "alice", Issuer: "someone"}), ErrorInvalidToken},
+		{"wrong key", sign(NewJWT([]byte("other")), Claims{Subject: "alice", Issuer: "kgpmp"}), ErrorInvalidToken},
+		{"alg none", none, ErrorInvalidToken},
+	}
+
+	for _, tt := range tests {
+		id, err := j.Authenticate(tt.token)
+		if !errors.Is(err, tt.err) || (tt.err != nil) != (err != nil) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+		if err == nil && id.Subject != "alice" {
+			t.Fatalf("%s: unexpected identity %+v", tt.name, id)
+		}
+	}
+
+	id, _ := j.Authenticate(valid)
+	if !id.Expires.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected expiry of the token, got %v", id.Expires)
+	}
+
+	// leeway lets a token that just expired through
+	j.Leeway = 5 * time.Second
+	if _, err := j.Authenticate(sign(j, Claims{Subject: "alice", Issuer: "kgpmp", ExpiresAt: now.Add(-time.Second).Unix()})); err != nil {
+		t.Fatalf("expected leeway to accept the token, got %v", err)
+	}
+}
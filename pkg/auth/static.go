@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// StaticTokens accepts a fixed set of tokens that never expire
+type StaticTokens struct {
+	// sha256 of the token -> subject, so lookups do not leak tokens through
+	// timing
+	subjects map[[sha256.Size]byte]string
+}
+
+// NewStaticTokens accepts the tokens in the map, which maps a token to the
+// subject it authenticates as
+func NewStaticTokens(tokens map[string]string) *StaticTokens {
+	s := &StaticTokens{subjects: map[[sha256.Size]byte]string{}}
+	for token, subject := range tokens {
+		s.subjects[sha256.Sum256([]byte(token))] = subject
+	}
+	return s
+}
+
+// LoadTokenFile reads a token file. Every line holds a subject and its token
+// separated by whitespace, empty lines and lines starting with # are
+// skipped.
+//
+//	# subject  token
+//	alice      s3cr3t
+func LoadTokenFile(path string) (*StaticTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseTokens(f)
+}
+
+// ParseTokens reads tokens in the format of LoadTokenFile
+func ParseTokens(r io.Reader) (*StaticTokens, error) {
+	tokens := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a subject and a token", line)
+		}
+		if _, ok := tokens[fields[1]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate token", line)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewStaticTokens(tokens), nil
+}
+
+func (s *StaticTokens) Authenticate(token string) (Identity, error) {
+	if token == "" {
+		return Identity{}, ErrorMissingToken
+	}
+
+	subject, ok := s.subjects[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Identity{}, ErrorInvalidToken
+	}
+	return Identity{Subject: subject}, nil
+}
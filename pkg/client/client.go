@@ -0,0 +1,779 @@
+// Package client is a Go client for KGPMP nodes. A single Conn multiplexes
+// publishes, subscriptions, requests and advertised services over one
+// connection that is read by a background goroutine.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+var ErrorConnClosed = errors.New("connection closed")
+
+type Options struct {
+	// ClientId is sent in the headers of every message
+	ClientId string
+	// TLSConfig makes Dial connect with tls, see TLSConfig
+	TLSConfig *tls.Config
+	// AuthToken is presented to the node right after the handshake when set
+	AuthToken string
+	// Codec the client asks the node to use during the handshake. Defaults
+	// to CBOR
+	Codec protocol.Codec
+	// Timeout bounds how long the handshake, Subscribe, Advertise and
+	// friends wait on the node. Defaults to 5 seconds
+	Timeout time.Duration
+	// ErrorHandler is called with errors the node reports for messages that
+	// nobody is waiting on, e.g. a publish to an invalid topic, with chunked
+	// messages that could not be reassembled and with
+	// protocol.ErrorShuttingDown when the node starts shutting down
+	ErrorHandler func(err error)
+
+	// MaxFrameSize is the largest frame the client accepts, the node may
+	// lower it during the handshake. Larger messages are chunked into parts.
+	// Defaults to protocol.MAX_MSG_SIZE
+	MaxFrameSize int
+	// PartTimeout is how long to wait on the missing parts of a chunked
+	// message. Defaults to 30 seconds
+	PartTimeout time.Duration
+	// MaxPartialBytes caps the content of incomplete chunked messages held
+	// in memory. Defaults to 64 MiB
+	MaxPartialBytes int
+
+	// MaxPendingDeliveries is how many publishes may wait on the
+	// subscription handlers. Further publishes are dropped and reported to
+	// the ErrorHandler with ErrorSlowSubscriber until the handlers caught
+	// up. Defaults to 65536
+	MaxPendingDeliveries int
+
+	// StreamWindow is how many bytes of each stream are buffered before the
+	// other end has to wait on reads. Defaults to 256 KiB
+	StreamWindow int
+
+	// HeartbeatInterval is how long the connection may be idle before the
+	// client pings the node. Defaults to 15 seconds
+	HeartbeatInterval time.Duration
+	// ReadTimeout closes the connection once nothing was read from the node
+	// for that long, with protocol.ErrorHeartbeatTimeout. Defaults to three
+	// HeartbeatIntervals
+	ReadTimeout time.Duration
+	// WriteTimeout bounds how long sending a message may take. Defaults to
+	// 10 seconds
+	WriteTimeout time.Duration
+	// Checksums asks the node to follow every frame with a CRC32C, see
+	// protocol.FeatureChecksums. Nodes that do not offer it are talked to
+	// without.
+	Checksums bool
+	// Compressors the client would like to use in order of preference, the
+	// node picks the first one it accepts. None by default
+	Compressors []protocol.Compressor
+	// CompressionThreshold is the size from which on frames are compressed.
+	// Defaults to protocol.DEFAULT_COMPRESSION_THRESHOLD
+	CompressionThreshold int
+
+	// Reconnect makes a Conn made with Dial reconnect when the connection to
+	// the node is lost. Once it is back the token, subscriptions, services
+	// and stream listeners are restored. Requests in flight and open streams
+	// fail with ErrorDisconnected.
+	Reconnect bool
+	// ReconnectWait is how long to wait before the first attempt to
+	// reconnect, every failed attempt doubles it up to MaxReconnectWait.
+	// Each wait is picked at random from its upper half. Defaults to 100
+	// milliseconds
+	ReconnectWait time.Duration
+	// MaxReconnectWait defaults to 10 seconds
+	MaxReconnectWait time.Duration
+	// MaxReconnects is how many attempts in a row may fail before the Conn
+	// gives up and closes, 0 tries forever
+	MaxReconnects int
+	// ReconnectBufferSize caps the bytes of topics and contents of the
+	// publishes held on to while reconnecting, they are sent once the
+	// connection is restored. Defaults to 8 MiB
+	ReconnectBufferSize int
+	// StateHandler is called whenever the state of the Conn changes, with
+	// the error that caused it if there was one
+	StateHandler func(state State, err error)
+}
+
+// Conn is a connection to a node. It is safe for concurrent use.
+type Conn struct {
+	opts Options
+	// dials the node again when reconnecting, nil for a Conn made with
+	// NewConn
+	dial  func() (net.Conn, error)
+	codec protocol.Codec
+
+	// replaced when reconnecting, guarded by both mu and writeMu. Only the
+	// read loop touches fr.
+	nc net.Conn
+	fr *protocol.FrameReader
+
+	writeMu sync.Mutex
+	fw      *protocol.FrameWriter
+
+	mu sync.Mutex
+	// settings agreed on with the node during the handshake
+	hello protocol.Hello
+	state State
+	// set by Close, no reconnecting anymore
+	closing bool
+	// closed when a connection is lost, replaced when reconnecting
+	lost chan struct{}
+	// bumped by every reconnect
+	generation uint64
+	// token the connection authenticated with, presented again after
+	// reconnecting
+	token string
+	// publishes waiting on the connection to be restored
+	buffered      []protocol.Message
+	bufferedBytes int
+	// publishes are buffered until the ones waiting were sent
+	flushing bool
+
+	// subscriptions by pattern, matched against incoming publishes
+	subs *topic.Trie[*Subscription]
+	// number of subscriptions per pattern, the node only knows about one
+	subCount map[string]int
+	services map[string]*Service
+	// topic -> listener accepting streams opened to it
+	listeners map[string]*StreamListener
+	// open streams by the id this end knows them by
+	streams map[string]*Stream
+	// tx id -> caller waiting on the reply
+	pending map[string]chan protocol.Message
+	err     error
+	// why the client closed the connection, if it did
+	reason error
+
+	// unix nanoseconds of the last frame read
+	lastRead atomic.Int64
+
+	// publishes waiting to be handed to subscription handlers. The read
+	// loop never waits on them, replies and pings get through no matter how
+	// slow the handlers are.
+	deliveryMu sync.Mutex
+	deliveries []delivery
+	// wakes up the dispatch loop once there are deliveries
+	delivered chan struct{}
+	// chunked messages waiting on their remaining parts
+	parts *protocol.Reassembler
+
+	lastId   atomic.Uint64
+	lastTxId atomic.Uint64
+
+	lastStreamId atomic.Uint64
+
+	done     chan struct{}
+	readDone chan struct{}
+	// closed by Close, stops waiting on the next reconnect attempt
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type delivery struct {
+	subs []*Subscription
+	msg  protocol.Message
+}
+
+// Dial connects to the node at addr
+func Dial(addr string, opts Options) (*Conn, error) {
+	dial := func() (net.Conn, error) {
+		if opts.TLSConfig != nil {
+			return tls.Dial("tcp", addr, opts.TLSConfig)
+		}
+		return net.Dial("tcp", addr)
+	}
+
+	nc, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newConn(nc, opts, dial)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// TLSConfig trusts the CAs in caFile, or the system roots when it is empty,
+// and presents the client certificate in certFile and keyFile when they are
+// set, which nodes requiring mutual tls ask for
+func TLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// NewConn performs the handshake on an established connection to a node.
+// Such a Conn can not reconnect, see Dial.
+func NewConn(nc net.Conn, opts Options) (*Conn, error) {
+	return newConn(nc, opts, nil)
+}
+
+func newConn(nc net.Conn, opts Options, dial func() (net.Conn, error)) (*Conn, error) {
+	if opts.Codec == nil {
+		opts.Codec = protocol.CBOR
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = protocol.MAX_MSG_SIZE
+	}
+	if opts.PartTimeout == 0 {
+		opts.PartTimeout = 30 * time.Second
+	}
+	if opts.MaxPartialBytes == 0 {
+		opts.MaxPartialBytes = 64 * 1024 * 1024
+	}
+	if opts.MaxPendingDeliveries == 0 {
+		opts.MaxPendingDeliveries = 65536
+	}
+	if opts.StreamWindow == 0 {
+		opts.StreamWindow = 256 * 1024
+	}
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = 15 * time.Second
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = 3 * opts.HeartbeatInterval
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 10 * time.Second
+	}
+	if opts.CompressionThreshold == 0 {
+		opts.CompressionThreshold = protocol.DEFAULT_COMPRESSION_THRESHOLD
+	}
+	if opts.ReconnectWait == 0 {
+		opts.ReconnectWait = 100 * time.Millisecond
+	}
+	if opts.MaxReconnectWait == 0 {
+		opts.MaxReconnectWait = 10 * time.Second
+	}
+	if opts.ReconnectBufferSize == 0 {
+		opts.ReconnectBufferSize = 8 * 1024 * 1024
+	}
+
+	c := &Conn{
+		opts:      opts,
+		dial:      dial,
+		codec:     opts.Codec,
+		subs:      topic.NewTrie[*Subscription](),
+		subCount:  map[string]int{},
+		services:  map[string]*Service{},
+		listeners: map[string]*StreamListener{},
+		streams:   map[string]*Stream{},
+		pending:   map[string]chan protocol.Message{},
+		delivered: make(chan struct{}, 1),
+		parts:     protocol.NewReassembler(opts.PartTimeout, opts.MaxPartialBytes),
+		lost:      make(chan struct{}),
+		done:      make(chan struct{}),
+		readDone:  make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+
+	if err := c.handshake(nc); err != nil {
+		return nil, err
+	}
+
+	go c.readLoop()
+	go c.dispatchLoop()
+	go c.heartbeatLoop()
+
+	if opts.AuthToken != "" {
+		if err := c.Authenticate(opts.AuthToken); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// handshake exchanges hellos on a new connection to the node and makes it
+// the one the Conn uses
+func (c *Conn) handshake(nc net.Conn) error {
+	nc.SetDeadline(time.Now().Add(c.opts.Timeout))
+	defer nc.SetDeadline(time.Time{})
+
+	features := protocol.DefaultFeatures
+	if c.opts.Checksums {
+		features |= protocol.FeatureChecksums
+	}
+
+	fr := protocol.NewFrameReader(nc)
+	fw := protocol.NewFrameWriter(nc)
+	err := protocol.WriteHello(fw, protocol.Hello{
+		Version:      protocol.PROTOCOL_VERSION,
+		MinVersion:   protocol.MIN_PROTOCOL_VERSION,
+		Codecs:       []string{c.opts.Codec.Name()},
+		ClientId:     c.opts.ClientId,
+		MaxFrameSize: uint32(c.opts.MaxFrameSize),
+		Features:     features,
+		Compression:  protocol.CompressionNames(c.opts.Compressors),
+	})
+	if err != nil {
+		return err
+	}
+
+	hello, err := protocol.ReadHello(fr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := hello.Codec(); err != nil {
+		return fmt.Errorf("%w: %w", protocol.ErrorHandshakeFailed, err)
+	}
+	compressor, err := hello.Compressor()
+	if err != nil {
+		return fmt.Errorf("%w: %w", protocol.ErrorHandshakeFailed, err)
+	}
+	fr.SetMaxFrameSize(int(hello.MaxFrameSize))
+	fw.SetMaxFrameSize(int(hello.MaxFrameSize))
+	fr.SetChecksums(hello.Features.Has(protocol.FeatureChecksums))
+	fw.SetChecksums(hello.Features.Has(protocol.FeatureChecksums))
+	fr.SetCompression(compressor)
+	fw.SetCompression(compressor, c.opts.CompressionThreshold)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return ErrorConnClosed
+	}
+	c.nc, c.fr, c.fw = nc, fr, fw
+	c.hello = hello
+	c.lastRead.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Hello returns the settings agreed on with the node
+func (c *Conn) Hello() protocol.Hello {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hello
+}
+
+// Authenticate presents the token to the node. Until a node that requires
+// authentication accepted a token every other call fails with
+// protocol.ErrorUnauthorized. It can be called again to swap in a fresh token
+// before the current one expires.
+func (c *Conn) Authenticate(token string) error {
+	err := c.restorable(protocol.Message{
+		MessageType: protocol.Authenticate,
+		Headers:     protocol.Headers{AuthToken: token},
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+	return nil
+}
+
+// Close closes the connection and waits for the background goroutines to stop
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	nc := c.nc
+	c.mu.Unlock()
+
+	c.closeOnce.Do(func() { close(c.closed) })
+	err := nc.Close()
+	<-c.readDone
+	return err
+}
+
+// Done is closed once the connection is gone for good
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection was closed
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Publish sends data to every subscriber of the topic
+func (c *Conn) Publish(topicName string, data []byte) error {
+	if err := topic.Validate(topicName); err != nil {
+		return err
+	}
+
+	msg := protocol.Message{
+		MessageType: protocol.Publish,
+		Topic:       topicName,
+		Content:     data,
+	}
+	if buffered, err := c.buffer(msg); buffered {
+		return err
+	}
+
+	err := c.send(msg)
+	if errors.Is(err, ErrorDisconnected) {
+		// lost while sending, it goes out once the connection is back
+		// unless the loss was not noticed yet
+		if buffered, berr := c.buffer(msg); buffered {
+			return berr
+		}
+	}
+	return err
+}
+
+// Request sends data to the service advertising the topic and waits for its
+// reply. Errors reported by the node or the service are returned alongside
+// the reply.
+func (c *Conn) Request(ctx context.Context, topicName string, data []byte) (protocol.Message, error) {
+	if err := topic.Validate(topicName); err != nil {
+		return protocol.Message{}, err
+	}
+
+	return c.call(ctx, protocol.Message{
+		MessageType: protocol.Request,
+		Topic:       topicName,
+		Content:     data,
+	})
+}
+
+// call sends the message with a fresh tx id and waits for the reply
+func (c *Conn) call(ctx context.Context, msg protocol.Message) (protocol.Message, error) {
+	return c.roundTrip(ctx, msg, c.send)
+}
+
+// roundTrip sends the message with send and waits for the reply
+func (c *Conn) roundTrip(ctx context.Context, msg protocol.Message, send func(protocol.Message) error) (protocol.Message, error) {
+	msg.TxId = strconv.FormatUint(c.lastTxId.Add(1), 10)
+
+	ch := make(chan protocol.Message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return protocol.Message{}, c.err
+	}
+	c.pending[msg.TxId] = ch
+	lost := c.lost
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.TxId)
+		c.mu.Unlock()
+	}()
+
+	if err := send(msg); err != nil {
+		return protocol.Message{}, err
+	}
+
+	select {
+	case rep := <-ch:
+		return rep, replyErr(rep)
+	case <-ctx.Done():
+		return protocol.Message{}, ctx.Err()
+	case <-lost:
+		return protocol.Message{}, ErrorDisconnected
+	case <-c.done:
+		return protocol.Message{}, c.Err()
+	}
+}
+
+// ack sends a message the node acknowledges and waits for the acknowledgment
+func (c *Conn) ack(msg protocol.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+
+	_, err := c.call(ctx, msg)
+	return err
+}
+
+func replyErr(rep protocol.Message) error {
+	var errs []error
+	for _, e := range rep.Errors {
+		errs = append(errs, e.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// send writes the message unless the connection is being restored
+func (c *Conn) send(msg protocol.Message) error {
+	c.mu.Lock()
+	state, err := c.state, c.err
+	c.mu.Unlock()
+
+	switch state {
+	case Reconnecting:
+		return ErrorDisconnected
+	case Closed:
+		return err
+	}
+	return c.write(msg)
+}
+
+// write fills in the id, client id and timestamp and writes the message.
+// Messages that do not fit in a frame are sent in parts.
+func (c *Conn) write(msg protocol.Message) error {
+	if msg.Id == "" {
+		msg.Id = strconv.FormatUint(c.lastId.Add(1), 10)
+	}
+	if msg.Headers.ClientId == "" {
+		msg.Headers.ClientId = c.opts.ClientId
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixMicro()
+	}
+
+	hello := c.Hello()
+	var payloads [][]byte
+	if hello.Features.Has(protocol.FeatureChunking) {
+		chunks, err := protocol.Chunk(c.codec, msg, int(hello.MaxFrameSize)-protocol.CHUNK_HEADROOM)
+		if err != nil {
+			return err
+		}
+		payloads = chunks
+	} else {
+		// the frame writer copies the payload, the buffer can be reused
+		// right after
+		buf := protocol.GetBuffer()
+		defer protocol.PutBuffer(buf)
+
+		payload, err := protocol.AppendMarshal(c.codec, *buf, msg)
+		if err != nil {
+			return err
+		}
+		*buf = payload
+		payloads = [][]byte{payload}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.nc.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+	for _, payload := range payloads {
+		if err := c.fw.WriteFrame(payload); err != nil {
+			if errors.Is(err, protocol.ErrorFrameTooLarge) {
+				return err
+			}
+			return fmt.Errorf("%w: %w", c.lostErr(), err)
+		}
+	}
+	if err := c.fw.Flush(); err != nil {
+		return fmt.Errorf("%w: %w", c.lostErr(), err)
+	}
+	return nil
+}
+
+// lostErr is what a failed write means for the Conn
+func (c *Conn) lostErr() error {
+	if c.dial != nil && c.opts.Reconnect {
+		return ErrorDisconnected
+	}
+	return ErrorConnClosed
+}
+
+// readLoop reads from the node. A lost connection is reestablished when the
+// Conn reconnects, otherwise the Conn is closed for good.
+func (c *Conn) readLoop() {
+	defer close(c.readDone)
+
+	for {
+		err := c.read()
+
+		c.mu.Lock()
+		if c.reason != nil {
+			err, c.reason = c.reason, nil
+		}
+		c.mu.Unlock()
+
+		if err = c.reconnect(err); err != nil {
+			c.terminate(err)
+			return
+		}
+	}
+}
+
+// read handles the messages of the current connection until it fails
+func (c *Conn) read() error {
+	for {
+		frame, err := c.fr.ReadFrame()
+		if err != nil {
+			return err
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+
+		var msg protocol.Message
+		if err := c.codec.Unmarshal(frame, &msg); err != nil {
+			return err
+		}
+		c.handle(msg)
+	}
+}
+
+// terminate closes the Conn for good
+func (c *Conn) terminate(err error) {
+	c.mu.Lock()
+	c.err = fmt.Errorf("%w: %w", ErrorConnClosed, err)
+	c.state = Closed
+	c.buffered, c.bufferedBytes = nil, 0
+	nc := c.nc
+	c.mu.Unlock()
+
+	nc.Close()
+	c.closeStreams(c.Err())
+	close(c.done)
+	c.changed(Closed, c.Err())
+}
+
+func (c *Conn) handle(msg protocol.Message) {
+	if msg.IsPart() {
+		full, ok, err := c.parts.Add(msg)
+		if err != nil {
+			c.reportError(err)
+		}
+		if !ok {
+			return
+		}
+		msg = full
+	}
+
+	switch msg.MessageType {
+	// key/value watch events arrive as puts and deletes
+	case protocol.Publish, protocol.Put, protocol.Delete:
+		subs := c.subs.Match(msg.Topic)
+		if len(subs) > 0 {
+			c.enqueue(delivery{subs: subs, msg: msg})
+		}
+	case protocol.Request:
+		c.serve(msg)
+	case protocol.StreamOpen:
+		c.acceptStream(msg)
+	case protocol.StreamData, protocol.StreamWindow, protocol.StreamClose:
+		c.handleStream(msg)
+	case protocol.Ping:
+		go c.pong(msg)
+	case protocol.Shutdown:
+		// the node closes the connection once what is in flight drained
+		c.reportError(protocol.ErrorShuttingDown)
+	case protocol.Reply:
+		c.mu.Lock()
+		ch, ok := c.pending[msg.TxId]
+		c.mu.Unlock()
+
+		if ok {
+			ch <- msg
+		} else if msg.Headers.Receipt != "" {
+			// the dequeue gave up before the message arrived
+			go c.release(msg)
+		} else if err := replyErr(msg); err != nil {
+			c.reportError(err)
+		}
+	}
+}
+
+func (c *Conn) reportError(err error) {
+	if c.opts.ErrorHandler != nil {
+		c.opts.ErrorHandler(err)
+	}
+}
+
+// enqueue queues a publish for the dispatch loop, or drops it when the
+// handlers fell MaxPendingDeliveries behind
+func (c *Conn) enqueue(d delivery) {
+	c.deliveryMu.Lock()
+	if len(c.deliveries) >= c.opts.MaxPendingDeliveries {
+		c.deliveryMu.Unlock()
+		c.reportError(fmt.Errorf("%w: dropped a message to %s", ErrorSlowSubscriber, d.msg.Topic))
+		return
+	}
+	c.deliveries = append(c.deliveries, d)
+	c.deliveryMu.Unlock()
+
+	select {
+	case c.delivered <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue takes the oldest publish waiting on the handlers
+func (c *Conn) dequeue() (delivery, bool) {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	if len(c.deliveries) == 0 {
+		return delivery{}, false
+	}
+	d := c.deliveries[0]
+	c.deliveries[0] = delivery{}
+	c.deliveries = c.deliveries[1:]
+	if len(c.deliveries) == 0 {
+		c.deliveries = nil
+	}
+	return d, true
+}
+
+// dispatchLoop hands publishes to subscription handlers in the order they
+// arrived. Handlers run on this goroutine so a slow handler holds up the
+// others but never the replies to outstanding requests. It also expires
+// chunked messages that never completed.
+func (c *Conn) dispatchLoop() {
+	ticker := time.NewTicker(c.opts.PartTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.delivered:
+			for d, ok := c.dequeue(); ok; d, ok = c.dequeue() {
+				for _, sub := range d.subs {
+					sub.deliver(d.msg)
+				}
+			}
+		case <-ticker.C:
+			for _, err := range c.parts.Expire() {
+				c.reportError(err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
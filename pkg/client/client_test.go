@@ -0,0 +1,721 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/internal/testcert"
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/node"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+func startNode(t *testing.T, opts node.Options) string {
+	t.Helper()
+
+	n := node.New(opts)
+	if err := n.Start(context.Background(), "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		n.Shutdown(ctx)
+	})
+
+	return n.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *Conn {
+	t.Helper()
+
+	c, err := Dial(addr, Options{ClientId: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func receive(t *testing.T, ch <-chan protocol.Message) protocol.Message {
+	t.Helper()
+
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting on message")
+	}
+	return protocol.Message{}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	addr := startNode(t, node.Options{})
+	sub := dial(t, addr)
+	pub := dial(t, addr)
+
+	exact := make(chan protocol.Message, 10)
+	s1, err := sub.Subscribe("/hello/world", func(msg protocol.Message) { exact <- msg })
+	if err != nil {
+		t.Fatal(err)
+	}
+	wild := make(chan protocol.Message, 10)
+	if _, err := sub.Subscribe("/hello/*", func(msg protocol.Message) { wild <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pub.Publish("/hello/world", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ch := range []chan protocol.Message{exact, wild} {
+		m := receive(t, ch)
+		if m.Topic != "/hello/world" || string(m.Content) != "hi" || m.Headers.ClientId != "TestPublishSubscribe" {
+			t.Fatalf("unexpected message %+v", m)
+		}
+	}
+
+	if err := s1.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("/hello/again", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("/hello/world", []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := receive(t, wild); string(m.Content) != "again" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if m := receive(t, wild); string(m.Content) != "bye" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	select {
+	case m := <-exact:
+		t.Fatalf("unsubscribed handler received %+v", m)
+	default:
+	}
+}
+
+func TestRequestAdvertise(t *testing.T) {
+	addr := startNode(t, node.Options{})
+	svcConn := dial(t, addr)
+	reqConn := dial(t, addr)
+
+	svc, err := svcConn.Advertise("/echo", func(req protocol.Message) ([]byte, error) {
+		if string(req.Content) == "fail" {
+			return nil, errors.New("boom")
+		}
+		return append([]byte("echo "), req.Content...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	rep, err := reqConn.Request(ctx, "/echo", []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rep.Content) != "echo hi" {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+
+	if _, err := reqConn.Request(ctx, "/echo", []byte("fail")); !errors.Is(err, protocol.ErrorCouldNotHandleMessage) {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+
+	if err := svc.Unadvertise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reqConn.Request(ctx, "/echo", []byte("hi")); !errors.Is(err, protocol.ErrorServiceTopicNotFound) {
+		t.Fatalf("expected service topic not found, got %v", err)
+	}
+}
+
+func TestRequestCanceled(t *testing.T) {
+	addr := startNode(t, node.Options{})
+	svcConn := dial(t, addr)
+	reqConn := dial(t, addr)
+
+	block := make(chan struct{})
+	defer close(block)
+	_, err := svcConn.Advertise("/slow", func(req protocol.Message) ([]byte, error) {
+		<-block
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := reqConn.Request(ctx, "/slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	addr := startNode(t, node.Options{})
+	pub := dial(t, addr)
+
+	errs := make(chan error, 64)
+	c, err := Dial(addr, Options{
+		ClientId:             t.Name(),
+		MaxPendingDeliveries: 4,
+		ErrorHandler:         func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	block := make(chan struct{})
+	received := make(chan protocol.Message, 64)
+	_, err = c.Subscribe("/updates", func(msg protocol.Message) {
+		<-block
+		received <- msg
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Advertise("/echo", func(req protocol.Message) ([]byte, error) { return req.Content, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 20 {
+		if err := pub.Publish("/updates", []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrorSlowSubscriber) {
+			t.Fatalf("expected a slow subscriber, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting on publishes to be dropped")
+	}
+
+	// the blocked handler does not hold up replies
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rep, err := c.Request(ctx, "/echo", []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rep.Content) != "hi" {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+
+	// the first ones made it into the queue
+	close(block)
+	for i := range 4 {
+		if m := receive(t, received); m.Content[0] != byte(i) {
+			t.Fatalf("expected message %d, got %d", i, m.Content[0])
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	addr := startNode(t, node.Options{})
+	c := dial(t, addr)
+	c.Close()
+
+	<-c.Done()
+	if err := c.Publish("/hello", nil); !errors.Is(err, ErrorConnClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+	if _, err := c.Request(context.Background(), "/hello", nil); !errors.Is(err, ErrorConnClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+}
+
+func TestLargeMessages(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 300_000)
+
+	for _, validate := range []bool{false, true} {
+		addr := startNode(t, node.Options{ValidateParts: validate})
+		sub := dial(t, addr)
+		pub := dial(t, addr)
+
+		received := make(chan protocol.Message, 1)
+		if _, err := sub.Subscribe("/big", func(msg protocol.Message) { received <- msg }); err != nil {
+			t.Fatal(err)
+		}
+		_, err := sub.Advertise("/big", func(req protocol.Message) ([]byte, error) {
+			return append(req.Content, req.Content...), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := pub.Publish("/big", content); err != nil {
+			t.Fatal(err)
+		}
+		if m := receive(t, received); !bytes.Equal(m.Content, content) {
+			t.Fatalf("validate=%v: published message was not reassembled, got %d bytes", validate, len(m.Content))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rep, err := pub.Request(ctx, "/big", content)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rep.Content) != 2*len(content) || !bytes.Equal(rep.Content[len(content):], content) {
+			t.Fatalf("validate=%v: reply was not reassembled, got %d bytes", validate, len(rep.Content))
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	addr := startNode(t, node.Options{Checksums: true})
+
+	c, err := Dial(addr, Options{ClientId: t.Name(), Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Hello().Features.Has(protocol.FeatureChecksums) {
+		t.Fatal("expected checksums to be agreed on")
+	}
+	if dial(t, addr).Hello().Features.Has(protocol.FeatureChecksums) {
+		t.Fatal("expected checksums only for clients that ask for them")
+	}
+
+	received := make(chan protocol.Message, 1)
+	if _, err := c.Subscribe("/checked", func(msg protocol.Message) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("x"), 3*protocol.MAX_MSG_SIZE)
+	if err := c.Publish("/checked", large); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, received); !bytes.Equal(m.Content, large) {
+		t.Fatalf("unexpected message of %d bytes", len(m.Content))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	addr := startNode(t, node.Options{Compressors: []protocol.Compressor{protocol.Flate}})
+
+	c, err := Dial(addr, Options{ClientId: t.Name(), Compressors: []protocol.Compressor{protocol.Gzip, protocol.Flate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if compression := c.Hello().Compression; len(compression) != 1 || compression[0] != "flate" {
+		t.Fatalf("expected flate to be agreed on, got %v", compression)
+	}
+
+	// clients that compress and ones that do not talk to each other as usual
+	plain := dial(t, addr)
+	received := make(chan protocol.Message, 2)
+	if _, err := plain.Subscribe("/logs", func(msg protocol.Message) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("GET /index.html 200\n"), 200_000)
+	for _, content := range [][]byte{[]byte("small"), large} {
+		if err := c.Publish("/logs", content); err != nil {
+			t.Fatal(err)
+		}
+		if m := receive(t, received); !bytes.Equal(m.Content, content) {
+			t.Fatalf("unexpected message of %d bytes", len(m.Content))
+		}
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	addr := startNode(t, node.Options{Authenticator: auth.NewStaticTokens(map[string]string{"s3cr3t": "alice"})})
+
+	anonymous := dial(t, addr)
+	if _, err := anonymous.Subscribe("/hello", func(protocol.Message) {}); !errors.Is(err, protocol.ErrorUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	if _, err := Dial(addr, Options{AuthToken: "wrong"}); !errors.Is(err, protocol.ErrorUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	c, err := Dial(addr, Options{AuthToken: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Subscribe("/hello", func(protocol.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// authenticating later works just as well
+	if err := anonymous.Authenticate("s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonymous.Subscribe("/hello", func(protocol.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca := testcert.NewCA("ca")
+	server := ca.Issue("node", "127.0.0.1")
+	alice := ca.Issue("alice")
+
+	addr := startNode(t, node.Options{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{server.TLS},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}})
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{"ca.pem": ca.CertPEM, "cert.pem": alice.CertPEM, "key.pem": alice.KeyPEM} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := TLSConfig(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial(addr, Options{TLSConfig: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	received := make(chan protocol.Message, 1)
+	if _, err := c.Subscribe("/hello", func(msg protocol.Message) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("/hello", []byte("over tls")); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, received); string(m.Content) != "over tls" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	// the node has to be trusted and wants a certificate
+	for _, config := range []*tls.Config{
+		{RootCAs: ca.Pool()},
+		{RootCAs: testcert.NewCA("other ca").Pool(), Certificates: []tls.Certificate{alice.TLS}},
+	} {
+		if c, err := Dial(addr, Options{TLSConfig: config, Timeout: time.Second}); err == nil {
+			c.Close()
+			t.Fatal("expected dial to fail")
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	addr := startNode(t, node.Options{QueueVisibilityTimeout: time.Second})
+	producer := dial(t, addr)
+	consumer := dial(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := consumer.Dequeue(ctx, "/jobs"); !errors.Is(err, protocol.ErrorQueueEmpty) {
+		t.Fatalf("expected empty queue, got %v", err)
+	}
+
+	// the dequeue waits for the enqueue
+	received := make(chan *QueueMessage, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		m, err := consumer.Dequeue(ctx, "/jobs")
+		if err != nil {
+			t.Error(err)
+		}
+		received <- m
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := producer.Enqueue("/jobs", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	m := <-received
+	if m == nil || string(m.Content) != "one" || m.Headers.Deliveries != 1 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if err := m.Nack(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	m, err := consumer.Dequeue(ctx, "/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Content) != "one" || m.Headers.Deliveries != 2 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if err := m.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Ack(); !errors.Is(err, protocol.ErrorUnknownReceipt) {
+		t.Fatalf("expected unknown receipt, got %v", err)
+	}
+}
+
+func TestKV(t *testing.T) {
+	addr := startNode(t, node.Options{})
+	c := dial(t, addr)
+
+	kv, err := c.KV("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.KV("no/slash"); err == nil {
+		t.Fatal("expected bucket with separator to be rejected")
+	}
+
+	events := make(chan KVEvent, 10)
+	if _, err := kv.Watch(">", func(e KVEvent) { events <- e }); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	rev, err := kv.Put(ctx, "db/host", []byte("localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.CompareAndSwap(ctx, "db/host", []byte("remote"), rev+1); !errors.Is(err, protocol.ErrorRevisionMismatch) {
+		t.Fatalf("expected revision mismatch, got %v", err)
+	}
+	if _, err := kv.CompareAndSwap(ctx, "db/host", []byte("remote"), rev); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.PutTTL(ctx, "lock", []byte("me"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := kv.Get(ctx, "db/host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Key != "db/host" || string(entry.Value) != "remote" || entry.Revision <= rev || !entry.Expires.IsZero() {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	entries, err := kv.List(ctx, ">")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "db/host" || entries[1].Key != "lock" || entries[1].Expires.IsZero() {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	if err := kv.Delete(ctx, "lock"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get(ctx, "lock"); !errors.Is(err, protocol.ErrorKeyNotFound) {
+		t.Fatalf("expected key not found, got %v", err)
+	}
+
+	var last uint64
+	for i, want := range []string{"db/host", "db/host", "lock", "lock"} {
+		e := <-events
+		if e.Key != want || e.Revision <= last || e.Deleted != (i == 3) {
+			t.Fatalf("unexpected event %d %+v", i, e)
+		}
+		last = e.Revision
+	}
+}
+
+func TestStream(t *testing.T) {
+	addr := startNode(t, node.Options{})
+	opener := dial(t, addr)
+
+	// a small window makes the writer wait on the reader many times over
+	acceptor, err := Dial(addr, Options{StreamWindow: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acceptor.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := opener.OpenStream(ctx, "/files"); !errors.Is(err, protocol.ErrorServiceTopicNotFound) {
+		t.Fatalf("expected service not found, got %v", err)
+	}
+
+	l, err := acceptor.Listen("/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	written := make(chan error, 1)
+	go func() {
+		s, err := opener.OpenStream(ctx, "/files")
+		if err != nil {
+			written <- err
+			return
+		}
+		if _, err := s.Write(data); err != nil {
+			written <- err
+			return
+		}
+		written <- s.Close()
+	}()
+
+	s, err := l.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+	if _, err := s.Write([]byte("too late")); !errors.Is(err, ErrorStreamClosed) {
+		t.Fatalf("expected write to a closed stream to fail, got %v", err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opener.OpenStream(ctx, "/files"); !errors.Is(err, protocol.ErrorServiceTopicNotFound) {
+		t.Fatalf("expected service not found after close, got %v", err)
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	addr := startNode(t, node.Options{NodeId: "info"})
+
+	// the info comes in the codec of the connection
+	c, err := Dial(addr, Options{ClientId: t.Name(), Codec: protocol.JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Subscribe("/news", func(protocol.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	info, err := c.NodeInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NodeId != "info" || len(info.Conns) != 1 || info.Conns[0].ClientId != t.Name() || info.Conns[0].Codec != "json" || info.Subscriptions["/news"] != 1 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+}
+
+// silentNode completes the handshake of the first client and then reads
+// without ever answering, like a node that hangs. It returns the address
+// and the messages it read.
+func silentNode(t *testing.T) (string, chan protocol.Message) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	read := make(chan protocol.Message, 16)
+	go func() {
+		nc, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+
+		fr := protocol.NewFrameReader(nc)
+		remote, err := protocol.ReadHello(fr)
+		if err != nil {
+			return
+		}
+		local := protocol.Hello{Version: protocol.PROTOCOL_VERSION, Codecs: []string{"cbor"}, MaxFrameSize: protocol.MAX_MSG_SIZE, Features: protocol.DefaultFeatures}
+		hello, _, err := protocol.Negotiate(local, remote)
+		if err != nil || protocol.WriteHello(protocol.NewFrameWriter(nc), hello) != nil {
+			return
+		}
+
+		for {
+			frame, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			var msg protocol.Message
+			if protocol.CBOR.Unmarshal(frame, &msg) == nil {
+				select {
+				case read <- msg:
+				default:
+				}
+			}
+		}
+	}()
+
+	return listener.Addr().String(), read
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	addr, read := silentNode(t)
+
+	c, err := Dial(addr, Options{ClientId: t.Name(), HeartbeatInterval: 20 * time.Millisecond, ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the client to give up on a node that does not answer")
+	}
+	if !errors.Is(c.Err(), protocol.ErrorHeartbeatTimeout) || !errors.Is(c.Err(), ErrorConnClosed) {
+		t.Fatalf("unexpected error %v", c.Err())
+	}
+	if m := <-read; m.MessageType != protocol.Ping {
+		t.Fatalf("expected the node to be pinged, got %+v", m)
+	}
+}
+
+func TestHeartbeatKeepsAlive(t *testing.T) {
+	opts := node.Options{HeartbeatInterval: 20 * time.Millisecond, ReadTimeout: 100 * time.Millisecond}
+	addr := startNode(t, opts)
+
+	c, err := Dial(addr, Options{ClientId: t.Name(), HeartbeatInterval: opts.HeartbeatInterval, ReadTimeout: opts.ReadTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// both sides ping the idle connection and answer the pings of the other
+	time.Sleep(300 * time.Millisecond)
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Subscribe("/alive", func(protocol.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// heartbeatLoop pings the node once nothing was read from it for a
+// HeartbeatInterval and closes the connection once nothing was read for
+// ReadTimeout, the node or the way to it is gone. Connections to nodes that
+// did not agree on heartbeats are left alone.
+func (c *Conn) heartbeatLoop() {
+	ticker := time.NewTicker(c.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		c.mu.Lock()
+		skip := c.state != Connected || !c.hello.Features.Has(protocol.FeatureHeartbeats)
+		generation := c.generation
+		c.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		idle := time.Since(time.Unix(0, c.lastRead.Load()))
+		switch {
+		case idle >= c.opts.ReadTimeout:
+			c.closeWith(generation, protocol.ErrorHeartbeatTimeout)
+		case idle >= c.opts.HeartbeatInterval:
+			c.send(protocol.Message{
+				MessageType: protocol.Ping,
+				Topic:       topic.NodeKeyword,
+				TxId:        strconv.FormatUint(c.lastTxId.Add(1), 10),
+			})
+		}
+	}
+}
+
+func (c *Conn) pong(ping protocol.Message) {
+	if err := c.send(protocol.Message{MessageType: protocol.Pong, Topic: topic.NodeKeyword, TxId: ping.TxId}); err != nil {
+		c.reportError(err)
+	}
+}
+
+// closeWith closes the connection with err as the reason it was lost,
+// unless the connection of that generation is already gone
+func (c *Conn) closeWith(generation uint64, err error) {
+	c.mu.Lock()
+	if c.generation != generation {
+		c.mu.Unlock()
+		return
+	}
+	if c.reason == nil {
+		c.reason = err
+	}
+	nc := c.nc
+	c.mu.Unlock()
+
+	nc.Close()
+}
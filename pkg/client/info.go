@@ -0,0 +1,18 @@
+package client
+
+import (
+	"context"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// NodeInfo asks the node the connection is on about itself, its connections
+// and the members of its cluster
+func (c *Conn) NodeInfo(ctx context.Context) (protocol.Info, error) {
+	rep, err := c.call(ctx, protocol.Message{MessageType: protocol.NodeInfo, Topic: topic.NodeKeyword})
+	if err != nil {
+		return protocol.Info{}, err
+	}
+	return protocol.UnmarshalInfo(c.codec, rep.Content)
+}
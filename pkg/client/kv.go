@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// KV is a bucket of the key/value store of the node. Keys are topic
+// segments, e.g. "users/alice", and patterns may use wildcards like
+// subscriptions do.
+type KV struct {
+	conn   *Conn
+	bucket string
+	// prefix of the topics of the keys in the bucket
+	prefix string
+}
+
+// KVEntry is a key of a bucket
+type KVEntry struct {
+	Key      string
+	Value    []byte
+	Revision uint64
+	// Expires is when the key expires, zero if it never does
+	Expires time.Time
+}
+
+// KVEvent is a change of a watched key
+type KVEvent struct {
+	KVEntry
+	// Deleted is set for keys that were deleted or expired
+	Deleted bool
+}
+
+// KV returns a handle on the bucket
+func (c *Conn) KV(bucket string) (*KV, error) {
+	if strings.Contains(bucket, topic.Separator) {
+		return nil, fmt.Errorf("%w: bucket %q has to be a single segment", topic.ErrorInvalidTopic, bucket)
+	}
+	if err := topic.Validate(topic.KV(bucket, "key")); err != nil {
+		return nil, err
+	}
+
+	return &KV{conn: c, bucket: bucket, prefix: topic.KV(bucket, "")}, nil
+}
+
+// Bucket returns the name of the bucket
+func (kv *KV) Bucket() string {
+	return kv.bucket
+}
+
+// Get reads the key, protocol.ErrorKeyNotFound is returned for keys that do
+// not exist
+func (kv *KV) Get(ctx context.Context, key string) (KVEntry, error) {
+	rep, err := kv.call(ctx, protocol.Get, key, nil, protocol.Headers{})
+	if err != nil {
+		return KVEntry{}, err
+	}
+
+	entry := KVEntry{Key: key, Value: rep.Content, Revision: rep.Headers.Revision}
+	if rep.Headers.TTL > 0 {
+		entry.Expires = time.Now().Add(time.Duration(rep.Headers.TTL) * time.Millisecond)
+	}
+	return entry, nil
+}
+
+// Put writes the key and returns its new revision
+func (kv *KV) Put(ctx context.Context, key string, value []byte) (uint64, error) {
+	return kv.PutTTL(ctx, key, value, 0)
+}
+
+// PutTTL writes a key that is deleted once the ttl ran out, unless it is
+// written again before that
+func (kv *KV) PutTTL(ctx context.Context, key string, value []byte, ttl time.Duration) (uint64, error) {
+	rep, err := kv.call(ctx, protocol.Put, key, value, protocol.Headers{TTL: uint32(ttl / time.Millisecond)})
+	return rep.Headers.Revision, err
+}
+
+// CompareAndSwap writes the key only if its revision still is the given
+// one, 0 meaning the key must not exist yet. protocol.ErrorRevisionMismatch
+// is returned otherwise.
+func (kv *KV) CompareAndSwap(ctx context.Context, key string, value []byte, revision uint64) (uint64, error) {
+	rep, err := kv.call(ctx, protocol.CompareAndSwap, key, value, protocol.Headers{Revision: revision})
+	return rep.Headers.Revision, err
+}
+
+// Delete removes the key, deleting a key that does not exist is not an error
+func (kv *KV) Delete(ctx context.Context, key string) error {
+	_, err := kv.call(ctx, protocol.Delete, key, nil, protocol.Headers{})
+	return err
+}
+
+// List reads every key matching the pattern, sorted by key. Use ">" for the
+// whole bucket.
+func (kv *KV) List(ctx context.Context, pattern string) ([]KVEntry, error) {
+	rep, err := kv.call(ctx, protocol.List, pattern, nil, protocol.Headers{})
+	if err != nil {
+		return nil, err
+	}
+
+	listed, err := protocol.UnmarshalKVEntries(rep.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]KVEntry, 0, len(listed))
+	for _, e := range listed {
+		entry := KVEntry{Key: strings.TrimPrefix(e.Key, kv.prefix), Value: e.Value, Revision: e.Revision}
+		if e.Expires != 0 {
+			entry.Expires = time.UnixMicro(e.Expires)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Watch calls handler with every change to a key matching the pattern.
+// Changes are delivered in revision order.
+func (kv *KV) Watch(pattern string, handler func(KVEvent)) (*Subscription, error) {
+	return kv.conn.Subscribe(kv.prefix+pattern, func(msg protocol.Message) {
+		event := KVEvent{
+			KVEntry: KVEntry{
+				Key:      strings.TrimPrefix(msg.Topic, kv.prefix),
+				Value:    msg.Content,
+				Revision: msg.Headers.Revision,
+			},
+			Deleted: msg.MessageType == protocol.Delete,
+		}
+		if msg.Headers.TTL > 0 {
+			event.Expires = time.UnixMicro(msg.Timestamp).Add(time.Duration(msg.Headers.TTL) * time.Millisecond)
+		}
+		handler(event)
+	})
+}
+
+func (kv *KV) call(ctx context.Context, op protocol.MessageType, key string, value []byte, headers protocol.Headers) (protocol.Message, error) {
+	return kv.conn.call(ctx, protocol.Message{
+		MessageType: op,
+		Topic:       kv.prefix + key,
+		Headers:     headers,
+		Content:     value,
+	})
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// maxDequeueWait caps how long a single dequeue waits on the node, longer
+// waits are made of several dequeues
+const maxDequeueWait = 30 * time.Second
+
+// QueueMessage is a message taken from a queue. It has to be acked once it is
+// handled, or nacked to hand it to the next consumer, before the visibility
+// timeout of the node runs out. Otherwise the node hands it out again.
+type QueueMessage struct {
+	protocol.Message
+	conn *Conn
+}
+
+// Enqueue adds data to the queue and waits for the node to store it
+func (c *Conn) Enqueue(queue string, data []byte) error {
+	if err := topic.Validate(queue); err != nil {
+		return err
+	}
+
+	return c.ack(protocol.Message{
+		MessageType: protocol.Enqueue,
+		Topic:       queue,
+		Content:     data,
+	})
+}
+
+// Dequeue takes the next message from the queue, waiting for one to be
+// enqueued until the context is done. protocol.ErrorQueueEmpty is returned
+// when nothing arrived before the deadline of the context.
+func (c *Conn) Dequeue(ctx context.Context, queue string) (*QueueMessage, error) {
+	if err := topic.Validate(queue); err != nil {
+		return nil, err
+	}
+
+	for {
+		// stop waiting on the node a little early so the empty reply beats
+		// the deadline of the context
+		wait := maxDequeueWait
+		if deadline, ok := ctx.Deadline(); ok {
+			wait = min(wait, time.Until(deadline)-c.opts.Timeout/10)
+		}
+		wait = max(wait, 0)
+
+		rep, err := c.call(ctx, protocol.Message{
+			MessageType: protocol.Dequeue,
+			Topic:       queue,
+			Headers:     protocol.Headers{Wait: uint32(wait / time.Millisecond)},
+		})
+		if errors.Is(err, protocol.ErrorQueueEmpty) && wait == maxDequeueWait {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &QueueMessage{Message: rep, conn: c}, nil
+	}
+}
+
+// Ack tells the node the message was handled and can be forgotten
+func (m *QueueMessage) Ack() error {
+	return m.conn.ack(protocol.Message{
+		MessageType: protocol.Ack,
+		Topic:       m.Topic,
+		Headers:     protocol.Headers{Receipt: m.Headers.Receipt},
+	})
+}
+
+// Nack hands the message back to the queue right away. Messages that were
+// handed out too often end up in the dead letter queue instead.
+func (m *QueueMessage) Nack() error {
+	return m.conn.ack(protocol.Message{
+		MessageType: protocol.Nack,
+		Topic:       m.Topic,
+		Headers:     protocol.Headers{Receipt: m.Headers.Receipt},
+	})
+}
+
+// release nacks a dequeued message that arrived after its caller gave up
+func (c *Conn) release(msg protocol.Message) {
+	err := c.send(protocol.Message{
+		MessageType: protocol.Nack,
+		Topic:       msg.Topic,
+		Headers:     protocol.Headers{Receipt: msg.Headers.Receipt},
+	})
+	if err != nil {
+		c.reportError(err)
+	}
+}
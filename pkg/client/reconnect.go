@@ -0,0 +1,249 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+var (
+	// ErrorDisconnected is returned while the connection to the node is
+	// lost and the client reconnects
+	ErrorDisconnected = errors.New("disconnected")
+	// ErrorReconnectBufferFull is returned by Publish once the publishes
+	// waiting on the connection to be restored use up ReconnectBufferSize
+	ErrorReconnectBufferFull = errors.New("reconnect buffer full")
+)
+
+// State of a Conn
+type State uint8
+
+const (
+	Connected State = iota
+	// Reconnecting waits on the connection to the node to be restored
+	Reconnecting
+	// Closed is final, the Conn was closed or gave up reconnecting
+	Closed
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	default:
+		return fmt.Sprintf("State(%d)", s)
+	}
+}
+
+// State returns the current state of the connection
+func (c *Conn) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *Conn) changed(state State, err error) {
+	if c.opts.StateHandler != nil {
+		c.opts.StateHandler(state, err)
+	}
+}
+
+// reconnect dials the node until a connection is established again. It
+// returns why the Conn has to be closed instead.
+func (c *Conn) reconnect(cause error) error {
+	c.mu.Lock()
+	if c.dial == nil || !c.opts.Reconnect || c.closing {
+		c.mu.Unlock()
+		return cause
+	}
+	c.state = Reconnecting
+	c.generation++
+	generation := c.generation
+	close(c.lost)
+	c.lost = make(chan struct{})
+	nc := c.nc
+	c.mu.Unlock()
+
+	nc.Close()
+	c.closeStreams(fmt.Errorf("%w: %w", ErrorDisconnected, cause))
+	c.changed(Reconnecting, cause)
+
+	for attempt := 0; c.opts.MaxReconnects == 0 || attempt < c.opts.MaxReconnects; attempt++ {
+		timer := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return ErrorConnClosed
+		}
+
+		nc, err := c.dial()
+		if err != nil {
+			cause = err
+			continue
+		}
+		if err := c.handshake(nc); err != nil {
+			nc.Close()
+			if errors.Is(err, ErrorConnClosed) {
+				return err
+			}
+			cause = err
+			continue
+		}
+
+		go c.restore(generation)
+		return nil
+	}
+
+	return fmt.Errorf("gave up reconnecting: %w", cause)
+}
+
+// backoff is how long to wait before an attempt to reconnect. The wait
+// doubles with every attempt and is picked at random from its upper half so
+// clients that lost the same node do not all come back at once.
+func (c *Conn) backoff(attempt int) time.Duration {
+	wait := min(c.opts.ReconnectWait<<min(attempt, 20), c.opts.MaxReconnectWait)
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// restore authenticates the new connection again, resends the
+// subscriptions, services and stream listeners and then the publishes that
+// were buffered. The node treats subscribing and advertising again as
+// harmless, so racing with the user doing the same is fine.
+func (c *Conn) restore(generation uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	if token != "" {
+		_, err := c.roundTrip(ctx, protocol.Message{
+			MessageType: protocol.Authenticate,
+			Headers:     protocol.Headers{AuthToken: token},
+		}, c.write)
+		if errors.Is(err, ErrorDisconnected) {
+			return
+		}
+		if err != nil {
+			// the node does not take the token anymore, nothing can be
+			// restored
+			c.mu.Lock()
+			c.closing = true
+			c.mu.Unlock()
+			c.closeWith(generation, err)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	if c.generation != generation {
+		c.mu.Unlock()
+		return
+	}
+	var restores []protocol.Message
+	for pattern := range c.subCount {
+		restores = append(restores, protocol.Message{MessageType: protocol.Subscribe, Topic: pattern})
+	}
+	for topicName := range c.services {
+		restores = append(restores, protocol.Message{MessageType: protocol.Advertise, Topic: topicName})
+	}
+	for topicName := range c.listeners {
+		restores = append(restores, protocol.Message{MessageType: protocol.Advertise, Topic: topicName})
+	}
+	c.state = Connected
+	c.flushing = true
+	c.mu.Unlock()
+
+	for _, msg := range restores {
+		_, err := c.roundTrip(ctx, msg, c.write)
+		if errors.Is(err, ErrorDisconnected) {
+			return
+		}
+		if err != nil {
+			c.reportError(fmt.Errorf("could not restore %s: %w", msg.Topic, err))
+		}
+	}
+
+	if c.flush(generation) {
+		c.changed(Connected, nil)
+	}
+}
+
+// buffer holds on to the publish while the connection is restored and
+// reports whether it did
+func (c *Conn) buffer(msg protocol.Message) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != Reconnecting && !c.flushing {
+		return false, nil
+	}
+
+	size := len(msg.Topic) + len(msg.Content)
+	if c.bufferedBytes+size > c.opts.ReconnectBufferSize {
+		return true, ErrorReconnectBufferFull
+	}
+	c.buffered = append(c.buffered, msg)
+	c.bufferedBytes += size
+	return true, nil
+}
+
+// flush sends the buffered publishes in order until none are left. It
+// reports false when the connection was lost again in the meantime.
+func (c *Conn) flush(generation uint64) bool {
+	for {
+		c.mu.Lock()
+		if c.generation != generation {
+			c.mu.Unlock()
+			return false
+		}
+		msgs := c.buffered
+		c.buffered, c.bufferedBytes = nil, 0
+		if len(msgs) == 0 {
+			c.flushing = false
+			c.mu.Unlock()
+			return true
+		}
+		c.mu.Unlock()
+
+		for i, msg := range msgs {
+			err := c.write(msg)
+			if err != nil && !errors.Is(err, ErrorDisconnected) {
+				c.reportError(err)
+				continue
+			}
+			if err != nil {
+				// keep what was not sent for the next connection
+				c.mu.Lock()
+				c.buffered = append(msgs[i:], c.buffered...)
+				for _, msg := range msgs[i:] {
+					c.bufferedBytes += len(msg.Topic) + len(msg.Content)
+				}
+				c.mu.Unlock()
+				return false
+			}
+		}
+	}
+}
+
+// restorable sends a message changing state that is restored after
+// reconnecting. Losing the connection while sending it is no error, the
+// message is effectively resent once the connection is back.
+func (c *Conn) restorable(msg protocol.Message) error {
+	err := c.ack(msg)
+	if errors.Is(err, ErrorDisconnected) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/node"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// restartingNode runs a node on the same address every time it is started
+type restartingNode struct {
+	t    *testing.T
+	opts node.Options
+	addr string
+	node *node.Node
+}
+
+func startRestartingNode(t *testing.T, opts node.Options) *restartingNode {
+	t.Helper()
+
+	r := &restartingNode{t: t, opts: opts, addr: "127.0.0.1:0"}
+	r.start()
+	r.addr = r.node.Addr().String()
+	t.Cleanup(r.stop)
+
+	return r
+}
+
+func (r *restartingNode) start() {
+	r.t.Helper()
+
+	n := node.New(r.opts)
+	if err := n.Start(context.Background(), r.addr); err != nil {
+		r.t.Fatal(err)
+	}
+	r.node = n
+}
+
+func (r *restartingNode) stop() {
+	if r.node == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r.node.Shutdown(ctx)
+	r.node = nil
+}
+
+func watchStates(opts *Options) chan State {
+	states := make(chan State, 64)
+	opts.StateHandler = func(state State, err error) { states <- state }
+	return states
+}
+
+func expectState(t *testing.T, states chan State, want State) {
+	t.Helper()
+
+	select {
+	case state := <-states:
+		if state != want {
+			t.Fatalf("expected state %s, got %s", want, state)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting on state %s", want)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	r := startRestartingNode(t, node.Options{Authenticator: auth.NewStaticTokens(map[string]string{"s3cr3t": "alice"})})
+
+	opts := Options{
+		ClientId:         t.Name(),
+		AuthToken:        "s3cr3t",
+		Reconnect:        true,
+		ReconnectWait:    10 * time.Millisecond,
+		MaxReconnectWait: 50 * time.Millisecond,
+	}
+	states := watchStates(&opts)
+	c, err := Dial(r.addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	received := make(chan protocol.Message, 16)
+	if _, err := c.Subscribe("/updates", func(msg protocol.Message) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Advertise("/echo", func(req protocol.Message) ([]byte, error) { return req.Content, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		r.stop()
+		expectState(t, states, Reconnecting)
+
+		// requests fail right away while publishes wait on the node to come
+		// back
+		if _, err := c.Request(context.Background(), "/echo", nil); !errors.Is(err, ErrorDisconnected) {
+			t.Fatalf("expected the request to fail while disconnected, got %v", err)
+		}
+		update := fmt.Sprintf("update %d", i)
+		if err := c.Publish("/updates", []byte(update)); err != nil {
+			t.Fatal(err)
+		}
+
+		// the new node only lets the client subscribe and advertise again
+		// once it authenticated again
+		r.start()
+		expectState(t, states, Connected)
+		if m := receive(t, received); string(m.Content) != update {
+			t.Fatalf("unexpected message %+v", m)
+		}
+		rep, err := c.Request(context.Background(), "/echo", []byte(update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rep.Content) != update {
+			t.Fatalf("unexpected reply %+v", rep)
+		}
+	}
+
+	c.Close()
+	expectState(t, states, Closed)
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	r := startRestartingNode(t, node.Options{})
+
+	opts := Options{
+		ClientId:            t.Name(),
+		Reconnect:           true,
+		ReconnectWait:       100 * time.Millisecond,
+		MaxReconnects:       2,
+		ReconnectBufferSize: 16,
+	}
+	states := watchStates(&opts)
+	c, err := Dial(r.addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r.stop()
+	expectState(t, states, Reconnecting)
+
+	if err := c.Publish("/small", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("/large", []byte("does not fit in the buffer")); !errors.Is(err, ErrorReconnectBufferFull) {
+		t.Fatalf("expected the buffer to be full, got %v", err)
+	}
+
+	expectState(t, states, Closed)
+	<-c.Done()
+	if !errors.Is(c.Err(), ErrorConnClosed) || !strings.Contains(c.Err().Error(), "gave up reconnecting") {
+		t.Fatalf("unexpected error %v", c.Err())
+	}
+	if err := c.Publish("/small", nil); !errors.Is(err, ErrorConnClosed) {
+		t.Fatalf("expected publishing to fail once closed, got %v", err)
+	}
+}
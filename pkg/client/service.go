@@ -0,0 +1,98 @@
+package client
+
+import (
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// Handler answers a request with the content of the reply. A returned error
+// is sent to the requester instead.
+type Handler func(req protocol.Message) ([]byte, error)
+
+// Service answers requests sent to an advertised topic
+type Service struct {
+	conn    *Conn
+	topic   string
+	handler Handler
+}
+
+// Advertise registers the connection as a service for the topic. Every
+// request is handled in its own goroutine.
+func (c *Conn) Advertise(topicName string, handler Handler) (*Service, error) {
+	if err := topic.Validate(topicName); err != nil {
+		return nil, err
+	}
+
+	svc := &Service{conn: c, topic: topicName, handler: handler}
+
+	c.mu.Lock()
+	_, listening := c.listeners[topicName]
+	if _, ok := c.services[topicName]; ok || listening {
+		c.mu.Unlock()
+		return nil, topic.ErrorInvalidTopic
+	}
+	c.services[topicName] = svc
+	c.mu.Unlock()
+
+	err := c.restorable(protocol.Message{MessageType: protocol.Advertise, Topic: topicName})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.services, topicName)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	return svc, nil
+}
+
+// Topic returns the advertised topic
+func (s *Service) Topic() string {
+	return s.topic
+}
+
+// Unadvertise stops the service from receiving new requests
+func (s *Service) Unadvertise() error {
+	s.conn.mu.Lock()
+	if s.conn.services[s.topic] != s {
+		s.conn.mu.Unlock()
+		return nil
+	}
+	delete(s.conn.services, s.topic)
+	s.conn.mu.Unlock()
+
+	return s.conn.restorable(protocol.Message{MessageType: protocol.Unadvertise, Topic: s.topic})
+}
+
+// serve runs the handler of the service the request is addressed to and
+// sends its reply
+func (c *Conn) serve(req protocol.Message) {
+	c.mu.Lock()
+	svc, ok := c.services[req.Topic]
+	c.mu.Unlock()
+
+	rep := protocol.Message{
+		MessageType: protocol.Reply,
+		Topic:       req.Topic,
+		TxId:        req.TxId,
+	}
+
+	if !ok {
+		rep.Errors = []protocol.Error{{
+			Message: protocol.ErrorServiceTopicNotFound.Error(),
+			Code:    protocol.CodeServiceTopicNotFound,
+		}}
+		c.send(rep)
+		return
+	}
+
+	go func() {
+		content, err := svc.handler(req)
+		if err != nil {
+			rep.Errors = []protocol.Error{{Message: err.Error(), Code: protocol.CodeCouldNotHandleMessage}}
+		} else {
+			rep.Content = content
+		}
+
+		c.send(rep)
+	}()
+}
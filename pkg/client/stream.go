@@ -0,0 +1,410 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+var ErrorStreamClosed = errors.New("stream closed")
+
+// streamBacklog is how many opened streams wait on Accept before further
+// ones are turned away
+const streamBacklog = 16
+
+// Stream is a byte stream to another connection, routed through the node.
+// Each end only sends as many bytes as the other end has room for, so a slow
+// reader holds up the writer instead of the node or the connection.
+//
+// Close closes both directions. The other end reads the remaining data and
+// then io.EOF.
+type Stream struct {
+	conn  *Conn
+	id    string
+	topic string
+
+	// serializes writers so the data of a write is not interleaved
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// received bytes that were not read yet
+	buf []byte
+	// bytes the other end may still send before it needs a window update
+	recvWindow int
+	// bytes read since the last window update
+	consumed int
+	// bytes this end may still send
+	sendWindow int
+	closed     bool
+	// why the stream closed, nil when the other end closed it cleanly
+	err error
+}
+
+// StreamListener accepts the streams opened to an advertised topic
+type StreamListener struct {
+	conn    *Conn
+	topic   string
+	streams chan *Stream
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Listen advertises the topic and accepts the streams other connections
+// open to it. A topic can not be listened on and advertised as a service at
+// the same time.
+func (c *Conn) Listen(topicName string) (*StreamListener, error) {
+	if err := topic.Validate(topicName); err != nil {
+		return nil, err
+	}
+
+	l := &StreamListener{
+		conn:    c,
+		topic:   topicName,
+		streams: make(chan *Stream, streamBacklog),
+		closed:  make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	_, advertised := c.services[topicName]
+	if _, ok := c.listeners[topicName]; ok || advertised {
+		c.mu.Unlock()
+		return nil, topic.ErrorInvalidTopic
+	}
+	c.listeners[topicName] = l
+	c.mu.Unlock()
+
+	err := c.restorable(protocol.Message{MessageType: protocol.Advertise, Topic: topicName})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.listeners, topicName)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Topic returns the topic the listener accepts streams on
+func (l *StreamListener) Topic() string {
+	return l.topic
+}
+
+// Accept waits on the next stream opened to the topic
+func (l *StreamListener) Accept(ctx context.Context) (*Stream, error) {
+	select {
+	case s := <-l.streams:
+		return s, nil
+	case <-l.closed:
+		return nil, ErrorStreamClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.conn.done:
+		return nil, l.conn.Err()
+	}
+}
+
+// Close unadvertises the topic. Streams that were not accepted yet are
+// closed, accepted ones stay open.
+func (l *StreamListener) Close() error {
+	c := l.conn
+
+	c.mu.Lock()
+	if c.listeners[l.topic] != l {
+		c.mu.Unlock()
+		return nil
+	}
+	delete(c.listeners, l.topic)
+	c.mu.Unlock()
+
+	l.once.Do(func() { close(l.closed) })
+	for {
+		select {
+		case s := <-l.streams:
+			s.Close()
+		default:
+			return c.restorable(protocol.Message{MessageType: protocol.Unadvertise, Topic: l.topic})
+		}
+	}
+}
+
+// OpenStream opens a stream to a connection listening on the topic.
+// protocol.ErrorServiceTopicNotFound is returned when nobody listens on it.
+func (c *Conn) OpenStream(ctx context.Context, topicName string) (*Stream, error) {
+	if err := topic.Validate(topicName); err != nil {
+		return nil, err
+	}
+
+	s := c.newStream(strconv.FormatUint(c.lastStreamId.Add(1), 10), topicName, 0)
+
+	// registered before the open is sent, the other end may start writing
+	// before the node confirms it
+	c.mu.Lock()
+	c.streams[s.id] = s
+	c.mu.Unlock()
+
+	_, err := c.call(ctx, protocol.Message{
+		MessageType: protocol.StreamOpen,
+		Topic:       topicName,
+		Headers:     protocol.Headers{StreamId: s.id, Window: uint32(c.opts.StreamWindow)},
+	})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.streams, s.id)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (c *Conn) newStream(id string, topicName string, sendWindow int) *Stream {
+	s := &Stream{
+		conn:       c,
+		id:         id,
+		topic:      topicName,
+		recvWindow: c.opts.StreamWindow,
+		sendWindow: sendWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acceptStream hands a stream opened by another connection to the listener
+// of its topic, or turns it away when there is none
+func (c *Conn) acceptStream(msg protocol.Message) {
+	c.mu.Lock()
+	l, ok := c.listeners[msg.Topic]
+	c.mu.Unlock()
+
+	if !ok {
+		c.rejectStream(msg, protocol.CodeServiceTopicNotFound, protocol.ErrorServiceTopicNotFound)
+		return
+	}
+
+	s := c.newStream(msg.Headers.StreamId, msg.Topic, int(msg.Headers.Window))
+	c.mu.Lock()
+	c.streams[s.id] = s
+	c.mu.Unlock()
+
+	select {
+	case l.streams <- s:
+	default:
+		c.mu.Lock()
+		delete(c.streams, s.id)
+		c.mu.Unlock()
+		c.rejectStream(msg, protocol.CodeCouldNotHandleMessage, fmt.Errorf("%w: too many streams waiting to be accepted", protocol.ErrorCouldNotHandleMessage))
+		return
+	}
+
+	s.sendControl(protocol.StreamWindow, uint32(c.opts.StreamWindow), nil)
+}
+
+func (c *Conn) rejectStream(msg protocol.Message, code protocol.ErrorCode, err error) {
+	c.send(protocol.Message{
+		MessageType: protocol.StreamClose,
+		Topic:       msg.Topic,
+		Headers:     protocol.Headers{StreamId: msg.Headers.StreamId},
+		Errors:      []protocol.Error{{Message: err.Error(), Code: code}},
+	})
+}
+
+// handleStream applies a frame from the other end to its stream
+func (c *Conn) handleStream(msg protocol.Message) {
+	c.mu.Lock()
+	s, ok := c.streams[msg.Headers.StreamId]
+	if ok && msg.MessageType == protocol.StreamClose {
+		delete(c.streams, s.id)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	switch msg.MessageType {
+	case protocol.StreamData:
+		if err := s.receive(msg.Content); err != nil {
+			c.mu.Lock()
+			delete(c.streams, s.id)
+			c.mu.Unlock()
+			s.sendControl(protocol.StreamClose, 0, []protocol.Error{{Message: err.Error(), Code: protocol.CodeMalformedMessage}})
+		}
+	case protocol.StreamWindow:
+		s.mu.Lock()
+		s.sendWindow += int(msg.Headers.Window)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case protocol.StreamClose:
+		s.fail(replyErr(msg))
+	}
+}
+
+// closeStreams fails every stream once the connection is gone
+func (c *Conn) closeStreams(err error) {
+	c.mu.Lock()
+	streams := c.streams
+	c.streams = map[string]*Stream{}
+	c.mu.Unlock()
+
+	for _, s := range streams {
+		s.fail(err)
+	}
+}
+
+// Topic returns the topic the stream was opened to
+func (s *Stream) Topic() string {
+	return s.topic
+}
+
+// receive buffers data from the other end. An end that sends more than it
+// was allowed to breaks the stream, the error is returned so that the other
+// end can be told.
+func (s *Stream) receive(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	if len(data) > s.recvWindow {
+		err := fmt.Errorf("%w: stream data exceeds the window", protocol.ErrorMalformedMessage)
+		s.closeLocked(err)
+		return err
+	}
+
+	s.recvWindow -= len(data)
+	s.buf = append(s.buf, data...)
+	s.cond.Broadcast()
+	return nil
+}
+
+// Read reads data sent by the other end. It returns io.EOF once the other
+// end closed the stream and every byte was read.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	s.consumed += n
+
+	// hand the room back once half of the window was read, not with every
+	// read, to keep the window updates down
+	var update int
+	if !s.closed && s.consumed >= s.conn.opts.StreamWindow/2 {
+		update = s.consumed
+		s.recvWindow += update
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if update > 0 {
+		s.sendControl(protocol.StreamWindow, uint32(update), nil)
+	}
+	return n, nil
+}
+
+// Write sends p to the other end, waiting for it to make room when the
+// window is used up
+func (s *Stream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	maxData := int(s.conn.Hello().MaxFrameSize) - protocol.CHUNK_HEADROOM
+
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			err := s.err
+			s.mu.Unlock()
+			if err == nil {
+				err = ErrorStreamClosed
+			}
+			return written, err
+		}
+		n := min(len(p)-written, s.sendWindow, maxData)
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		err := s.conn.send(protocol.Message{
+			MessageType: protocol.StreamData,
+			Topic:       s.topic,
+			Headers:     protocol.Headers{StreamId: s.id},
+			Content:     p[written : written+n],
+		})
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream in both directions. Data that was not read yet is
+// dropped.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closeLocked(ErrorStreamClosed)
+	s.mu.Unlock()
+
+	s.conn.mu.Lock()
+	delete(s.conn.streams, s.id)
+	s.conn.mu.Unlock()
+
+	return s.sendControl(protocol.StreamClose, 0, nil)
+}
+
+// fail closes the stream because the other end or the connection went away.
+// The data that arrived before can still be read.
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+func (s *Stream) closeLocked(err error) {
+	s.closed = true
+	s.err = err
+	s.buf = nil
+	s.cond.Broadcast()
+}
+
+func (s *Stream) sendControl(messageType protocol.MessageType, window uint32, errs []protocol.Error) error {
+	return s.conn.send(protocol.Message{
+		MessageType: messageType,
+		Topic:       s.topic,
+		Headers:     protocol.Headers{StreamId: s.id, Window: window},
+		Errors:      errs,
+	})
+}
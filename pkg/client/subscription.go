@@ -0,0 +1,96 @@
+package client
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// ErrorSlowSubscriber is reported to the ErrorHandler for every publish
+// dropped because the subscription handlers fell MaxPendingDeliveries
+// behind
+var ErrorSlowSubscriber = errors.New("slow subscriber")
+
+// Subscription receives the messages published to topics matching its
+// pattern
+type Subscription struct {
+	conn    *Conn
+	pattern string
+	handler func(msg protocol.Message)
+	active  atomic.Bool
+}
+
+// Subscribe calls handler for every message published to a topic matching
+// the pattern. Handlers of one connection are called one at a time.
+func (c *Conn) Subscribe(pattern string, handler func(msg protocol.Message)) (*Subscription, error) {
+	if err := topic.ValidatePattern(pattern); err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{conn: c, pattern: pattern, handler: handler}
+	sub.active.Store(true)
+
+	c.mu.Lock()
+	c.subCount[pattern]++
+	first := c.subCount[pattern] == 1
+	c.subs.Insert(pattern, sub)
+	c.mu.Unlock()
+
+	if !first {
+		return sub, nil
+	}
+
+	err := c.restorable(protocol.Message{MessageType: protocol.Subscribe, Topic: pattern})
+	if err != nil {
+		c.removeSubscription(sub)
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// Pattern returns the pattern the subscription was made with
+func (s *Subscription) Pattern() string {
+	return s.pattern
+}
+
+// Unsubscribe stops the delivery of messages to the subscription. The node is
+// only told once no subscription of the connection uses the pattern anymore.
+func (s *Subscription) Unsubscribe() error {
+	if !s.active.Load() {
+		return nil
+	}
+
+	if !s.conn.removeSubscription(s) {
+		return nil
+	}
+
+	return s.conn.restorable(protocol.Message{MessageType: protocol.Unsubscribe, Topic: s.pattern})
+}
+
+// removeSubscription forgets the subscription and reports whether it was the
+// last one using its pattern
+func (c *Conn) removeSubscription(sub *Subscription) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !sub.active.Swap(false) {
+		return false
+	}
+
+	c.subs.Remove(sub.pattern, sub)
+	c.subCount[sub.pattern]--
+	if c.subCount[sub.pattern] > 0 {
+		return false
+	}
+	delete(c.subCount, sub.pattern)
+	return true
+}
+
+func (s *Subscription) deliver(msg protocol.Message) {
+	if s.active.Load() {
+		s.handler(msg)
+	}
+}
@@ -0,0 +1,668 @@
+// Package gossip keeps track of the members of a cluster with a SWIM style
+// protocol. Members probe each other over datagrams and spread what they
+// learn by piggybacking it on the probes, so that every member eventually
+// knows who is alive without any central configuration.
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorClosed = errors.New("memberlist closed")
+
+// maxPiggyback is how many updates ride along with a packet
+const maxPiggyback = 8
+
+// State is what a member is believed to be
+type State uint8
+
+const (
+	Alive   State = iota
+	Suspect       // did not answer a probe, declared dead unless it refutes
+	Dead          // did not refute the suspicion in time
+	Left          // left the cluster on purpose
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	default:
+		return fmt.Sprintf("state(%d)", uint8(s))
+	}
+}
+
+// Member is a node of the cluster
+type Member struct {
+	Id   string
+	Addr string
+	// State of the local member is Alive until it leaves
+	State State
+	// Incarnation is raised by the member itself to refute suspicion, claims
+	// with a higher incarnation win
+	Incarnation uint64
+}
+
+type EventType uint8
+
+const (
+	EventJoin    EventType = iota // a member joined or came back
+	EventSuspect                  // a member is suspected to have failed
+	EventAlive                    // a suspected member refuted the suspicion
+	EventLeave                    // a member left or was declared dead
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventSuspect:
+		return "suspect"
+	case EventAlive:
+		return "alive"
+	case EventLeave:
+		return "leave"
+	default:
+		return fmt.Sprintf("event(%d)", uint8(t))
+	}
+}
+
+// Event is a change of the member list
+type Event struct {
+	Type   EventType
+	Member Member
+}
+
+type Config struct {
+	// Id identifies the member in the cluster, usually the node id
+	Id string
+	// ProbeInterval is how often a member is probed. Defaults to 1s
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long a probed member has to answer before other
+	// members are asked to probe it. Defaults to half the ProbeInterval
+	ProbeTimeout time.Duration
+	// IndirectProbes is how many members are asked to probe a member that
+	// did not answer. Defaults to 3
+	IndirectProbes int
+	// SuspicionTimeout is how long a suspected member has to refute before
+	// it is declared dead. Defaults to 5 probe intervals
+	SuspicionTimeout time.Duration
+	// Retransmits scales how often an update is piggybacked, it is sent
+	// Retransmits * log10(members + 1) times. Defaults to 4
+	Retransmits int
+	// SyncInterval is how often the whole member list is exchanged with a
+	// random member, which repairs whatever piggybacking missed. Defaults to
+	// 30s
+	SyncInterval time.Duration
+	// ReclaimTimeout is how long dead and left members stay in the list, so
+	// that old claims about them can not bring them back. Defaults to 30s
+	ReclaimTimeout time.Duration
+	// Events is called with every change of the member list, one event at a
+	// time in the order they happened
+	Events func(Event)
+}
+
+type member struct {
+	Member
+	// when the state last changed
+	changed time.Time
+	// declares the member dead unless it refutes in time, nil when the
+	// member is not suspected
+	suspicion *time.Timer
+}
+
+type broadcast struct {
+	update    update
+	transmits int
+}
+
+// Memberlist is the local member of a cluster and its view of the others
+type Memberlist struct {
+	config    Config
+	transport Transport
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	members map[string]*member
+	// members left to probe this round, the order is shuffled every round
+	probeOrder []string
+	// callbacks waiting on the acks of pings
+	acks    map[uint32]func()
+	seq     uint32
+	queue   []*broadcast
+	leaving bool
+
+	// signalled when a sync is answered
+	synced chan struct{}
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// New starts the local member on the transport. It is alone until it joins
+// other members or they join it.
+func New(config Config, transport Transport) *Memberlist {
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = time.Second
+	}
+	if config.ProbeTimeout == 0 {
+		config.ProbeTimeout = config.ProbeInterval / 2
+	}
+	if config.IndirectProbes == 0 {
+		config.IndirectProbes = 3
+	}
+	if config.SuspicionTimeout == 0 {
+		config.SuspicionTimeout = 5 * config.ProbeInterval
+	}
+	if config.Retransmits == 0 {
+		config.Retransmits = 4
+	}
+	if config.SyncInterval == 0 {
+		config.SyncInterval = 30 * time.Second
+	}
+	if config.ReclaimTimeout == 0 {
+		config.ReclaimTimeout = 30 * time.Second
+	}
+
+	m := &Memberlist{
+		config:    config,
+		transport: transport,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		members:   map[string]*member{},
+		acks:      map[uint32]func(){},
+		synced:    make(chan struct{}, 1),
+		events:    make(chan Event, 256),
+		done:      make(chan struct{}),
+	}
+	m.members[config.Id] = &member{
+		Member:  Member{Id: config.Id, Addr: transport.Addr(), State: Alive},
+		changed: time.Now(),
+	}
+
+	m.wg.Add(3)
+	go m.receiveLoop()
+	go m.probeLoop()
+	go m.eventLoop()
+	return m
+}
+
+// Id returns the id of the local member
+func (m *Memberlist) Id() string {
+	return m.config.Id
+}
+
+// Addr returns the address the local member gossips on
+func (m *Memberlist) Addr() string {
+	return m.transport.Addr()
+}
+
+// Members returns every member that is known, sorted by id, including the
+// local one as well as dead and left members that were not reclaimed yet
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		members = append(members, mem.Member)
+	}
+	slices.SortFunc(members, func(a, b Member) int { return strings.Compare(a.Id, b.Id) })
+	return members
+}
+
+// Join exchanges member lists with the members at the seed addresses. It
+// retries every probe interval until one of them answered or the context is
+// done.
+func (m *Memberlist) Join(ctx context.Context, seeds ...string) error {
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	for {
+		for _, addr := range seeds {
+			m.sendSync(addr, kindSync)
+		}
+
+		select {
+		case <-m.synced:
+			return nil
+		case <-time.After(m.config.ProbeInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.done:
+			return ErrorClosed
+		}
+	}
+}
+
+// Leave tells the other members that this one is leaving, so that they do
+// not have to detect its failure. The member list should be closed after.
+func (m *Memberlist) Leave() error {
+	m.mu.Lock()
+	m.leaving = true
+	self := m.members[m.config.Id]
+	self.Incarnation++
+	self.State = Left
+	u := updateOf(self)
+	var addrs []string
+	for _, mem := range m.members {
+		if mem.Id != m.config.Id && mem.State != Dead && mem.State != Left {
+			addrs = append(addrs, mem.Addr)
+		}
+	}
+	m.mu.Unlock()
+
+	// nobody would piggyback it once this member is gone, tell everyone
+	var errs []error
+	for _, addr := range addrs {
+		errs = append(errs, m.send(addr, packet{Kind: kindUpdate, Updates: []update{u}}))
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops gossiping and closes the transport. Other members detect the
+// member failed unless it left first.
+func (m *Memberlist) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		err = m.transport.Close()
+
+		m.mu.Lock()
+		for _, mem := range m.members {
+			if mem.suspicion != nil {
+				mem.suspicion.Stop()
+			}
+		}
+		m.mu.Unlock()
+	})
+	m.wg.Wait()
+	return err
+}
+
+func (m *Memberlist) receiveLoop() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case p, ok := <-m.transport.Packets():
+			if !ok {
+				return
+			}
+			m.receive(p)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Memberlist) receive(p Packet) {
+	pk, err := decode(p.Data)
+	if err != nil {
+		fmt.Println("dropped gossip from", p.From, err)
+		return
+	}
+
+	m.mu.Lock()
+	events := m.applyLocked(pk.Updates)
+	m.mu.Unlock()
+	m.emit(events)
+
+	switch pk.Kind {
+	case kindPing:
+		if pk.Target == m.config.Id {
+			m.send(p.From, packet{Kind: kindAck, Seq: pk.Seq})
+		}
+	case kindPingReq:
+		// relay the ack of the target to the member that asked
+		requester := p.From
+		seq := m.expectAck(func() { m.send(requester, packet{Kind: kindAck, Seq: pk.Seq}) })
+		time.AfterFunc(m.config.ProbeTimeout, func() { m.forgetAck(seq) })
+		m.send(pk.TargetAddr, packet{Kind: kindPing, Seq: seq, Target: pk.Target})
+	case kindAck:
+		m.mu.Lock()
+		f, ok := m.acks[pk.Seq]
+		delete(m.acks, pk.Seq)
+		m.mu.Unlock()
+		if ok {
+			f()
+		}
+	case kindSync:
+		m.sendSync(p.From, kindSyncAck)
+	case kindSyncAck:
+		select {
+		case m.synced <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *Memberlist) probeLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.config.ProbeInterval)
+	defer ticker.Stop()
+	syncTicker := time.NewTicker(m.config.SyncInterval)
+	defer syncTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.probe()
+			m.reclaim()
+		case <-syncTicker.C:
+			for _, mem := range m.randomMembers(1, "") {
+				m.sendSync(mem.Addr, kindSync)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// probe pings the next member. When it does not answer in time others are
+// asked to ping it, in case only the way between the two is broken, and
+// when none of them gets an answer within the probe interval the member is
+// suspected.
+func (m *Memberlist) probe() {
+	target, ok := m.nextTarget()
+	if !ok {
+		return
+	}
+
+	acked := make(chan struct{}, 1)
+	seq := m.expectAck(func() { acked <- struct{}{} })
+	defer m.forgetAck(seq)
+
+	m.send(target.Addr, packet{Kind: kindPing, Seq: seq, Target: target.Id})
+	select {
+	case <-acked:
+		return
+	case <-time.After(m.config.ProbeTimeout):
+	case <-m.done:
+		return
+	}
+
+	for _, helper := range m.randomMembers(m.config.IndirectProbes, target.Id) {
+		m.send(helper.Addr, packet{Kind: kindPingReq, Seq: seq, Target: target.Id, TargetAddr: target.Addr})
+	}
+	select {
+	case <-acked:
+		return
+	case <-time.After(m.config.ProbeInterval - m.config.ProbeTimeout):
+	case <-m.done:
+		return
+	}
+
+	suspicion := update{Id: target.Id, Addr: target.Addr, State: Suspect, Incarnation: target.Incarnation}
+	m.mu.Lock()
+	events := m.applyLocked([]update{suspicion})
+	m.mu.Unlock()
+	m.emit(events)
+
+	// give the member a chance to refute in case only the probes were lost
+	m.send(target.Addr, packet{Kind: kindUpdate, Updates: []update{suspicion}})
+}
+
+// nextTarget picks the next member to probe. Every live member is probed
+// once per round, in random order.
+func (m *Memberlist) nextTarget() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(m.probeOrder) > 0 {
+			id := m.probeOrder[0]
+			m.probeOrder = m.probeOrder[1:]
+			if mem, ok := m.members[id]; ok && (mem.State == Alive || mem.State == Suspect) {
+				return mem.Member, true
+			}
+		}
+
+		for id := range m.members {
+			if id != m.config.Id {
+				m.probeOrder = append(m.probeOrder, id)
+			}
+		}
+		m.rand.Shuffle(len(m.probeOrder), func(i, j int) {
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+	}
+	return Member{}, false
+}
+
+// randomMembers picks up to k live members other than this one and except
+func (m *Memberlist) randomMembers(k int, except string) []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var candidates []Member
+	for _, mem := range m.members {
+		if mem.Id != m.config.Id && mem.Id != except && mem.State == Alive {
+			candidates = append(candidates, mem.Member)
+		}
+	}
+	m.rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	return candidates[:min(k, len(candidates))]
+}
+
+// reclaim forgets members that are dead or left for long enough
+func (m *Memberlist) reclaim() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, mem := range m.members {
+		if (mem.State == Dead || mem.State == Left) && id != m.config.Id && time.Since(mem.changed) > m.config.ReclaimTimeout {
+			delete(m.members, id)
+		}
+	}
+}
+
+func (m *Memberlist) expectAck(f func()) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq++
+	m.acks[m.seq] = f
+	return m.seq
+}
+
+func (m *Memberlist) forgetAck(seq uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.acks, seq)
+}
+
+// applyLocked merges claims about members into the list and returns the
+// resulting events. Claims with a higher incarnation win, at the same
+// incarnation suspect beats alive and dead or left beat both.
+func (m *Memberlist) applyLocked(updates []update) []Event {
+	var events []Event
+	for _, u := range updates {
+		if u.Id == m.config.Id {
+			m.refuteLocked(u)
+			continue
+		}
+
+		mem, known := m.members[u.Id]
+		switch u.State {
+		case Alive:
+			if !known {
+				mem = &member{Member: Member{Id: u.Id}}
+				m.members[u.Id] = mem
+			} else if u.Incarnation <= mem.Incarnation {
+				continue
+			}
+
+			prev := mem.State
+			m.setLocked(mem, u)
+			switch {
+			case !known || prev == Dead || prev == Left:
+				events = append(events, Event{EventJoin, mem.Member})
+			case prev == Suspect:
+				events = append(events, Event{EventAlive, mem.Member})
+			}
+
+		case Suspect:
+			// a member nobody vouched for yet is not worth suspecting
+			if !known || u.Incarnation < mem.Incarnation || mem.State != Alive && u.Incarnation == mem.Incarnation {
+				continue
+			}
+			if mem.State == Dead || mem.State == Left {
+				continue
+			}
+
+			m.setLocked(mem, u)
+			incarnation := u.Incarnation
+			mem.suspicion = time.AfterFunc(m.config.SuspicionTimeout, func() { m.suspicionTimeout(u.Id, incarnation) })
+			events = append(events, Event{EventSuspect, mem.Member})
+
+		case Dead, Left:
+			if !known || u.Incarnation < mem.Incarnation || mem.State == Dead || mem.State == Left {
+				continue
+			}
+
+			m.setLocked(mem, u)
+			events = append(events, Event{EventLeave, mem.Member})
+		}
+	}
+	return events
+}
+
+// setLocked applies the claim to the member and passes it on
+func (m *Memberlist) setLocked(mem *member, u update) {
+	if mem.suspicion != nil {
+		mem.suspicion.Stop()
+		mem.suspicion = nil
+	}
+	if u.Addr != "" {
+		mem.Addr = u.Addr
+	}
+	mem.State = u.State
+	mem.Incarnation = u.Incarnation
+	mem.changed = time.Now()
+	m.queueLocked(updateOf(mem))
+}
+
+// refuteLocked answers claims that this member is suspect or dead by raising
+// its incarnation above the claim and telling everyone it is alive
+func (m *Memberlist) refuteLocked(u update) {
+	self := m.members[m.config.Id]
+	if m.leaving || u.Incarnation < self.Incarnation || u.State == Alive && u.Incarnation == self.Incarnation {
+		return
+	}
+
+	self.Incarnation = u.Incarnation + 1
+	m.queueLocked(updateOf(self))
+}
+
+// suspicionTimeout declares the member dead unless it refuted the suspicion
+func (m *Memberlist) suspicionTimeout(id string, incarnation uint64) {
+	m.mu.Lock()
+	mem, ok := m.members[id]
+	if !ok || mem.State != Suspect || mem.Incarnation != incarnation {
+		m.mu.Unlock()
+		return
+	}
+	events := m.applyLocked([]update{{Id: id, Addr: mem.Addr, State: Dead, Incarnation: incarnation}})
+	m.mu.Unlock()
+	m.emit(events)
+}
+
+// queueLocked queues the update to be piggybacked, replacing older updates
+// about the same member
+func (m *Memberlist) queueLocked(u update) {
+	m.queue = slices.DeleteFunc(m.queue, func(b *broadcast) bool { return b.update.Id == u.Id })
+
+	transmits := m.config.Retransmits * int(math.Ceil(math.Log10(float64(len(m.members)+1))))
+	m.queue = append(m.queue, &broadcast{update: u, transmits: max(transmits, 1)})
+}
+
+// piggybackLocked takes the updates to send along with the next packet,
+// the least sent ones first
+func (m *Memberlist) piggybackLocked() []update {
+	slices.SortStableFunc(m.queue, func(a, b *broadcast) int { return b.transmits - a.transmits })
+
+	var updates []update
+	for _, b := range m.queue[:min(maxPiggyback, len(m.queue))] {
+		updates = append(updates, b.update)
+		b.transmits--
+	}
+	m.queue = slices.DeleteFunc(m.queue, func(b *broadcast) bool { return b.transmits <= 0 })
+	return updates
+}
+
+// send piggybacks updates on the packet and sends it to addr
+func (m *Memberlist) send(addr string, p packet) error {
+	m.mu.Lock()
+	p.From = m.config.Id
+	p.Updates = append(p.Updates, m.piggybackLocked()...)
+	m.mu.Unlock()
+
+	data, err := encode(p)
+	if err != nil {
+		return err
+	}
+	return m.transport.WriteTo(data, addr)
+}
+
+// sendSync sends every known member to addr
+func (m *Memberlist) sendSync(addr string, k kind) {
+	m.mu.Lock()
+	updates := make([]update, 0, len(m.members))
+	for _, mem := range m.members {
+		updates = append(updates, updateOf(mem))
+	}
+	m.mu.Unlock()
+
+	if err := m.send(addr, packet{Kind: k, Updates: updates}); err != nil {
+		fmt.Println("could not sync with", addr, err)
+	}
+}
+
+func updateOf(mem *member) update {
+	return update{Id: mem.Id, Addr: mem.Addr, State: mem.State, Incarnation: mem.Incarnation}
+}
+
+// emit hands the events to the Events callback
+func (m *Memberlist) emit(events []Event) {
+	if m.config.Events == nil {
+		return
+	}
+	for _, e := range events {
+		select {
+		case m.events <- e:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Memberlist) eventLoop() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case e := <-m.events:
+			m.config.Events(e)
+		case <-m.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	ProbeInterval:    20 * time.Millisecond,
+	ProbeTimeout:     8 * time.Millisecond,
+	SuspicionTimeout: 200 * time.Millisecond,
+	SyncInterval:     100 * time.Millisecond,
+}
+
+// eventLog records the events of a member
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, e)
+}
+
+func (l *eventLog) has(typ EventType, id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range l.events {
+		if e.Type == typ && e.Member.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// startCluster starts n members on the network, every one joining the first
+func startCluster(t *testing.T, network *Network, n int, configure ...func(*Config)) ([]*Memberlist, []*eventLog) {
+	t.Helper()
+
+	members := make([]*Memberlist, n)
+	logs := make([]*eventLog, n)
+	for i := range members {
+		config := testConfig
+		config.Id = fmt.Sprintf("m%d", i)
+		logs[i] = &eventLog{}
+		config.Events = logs[i].add
+		for _, f := range configure {
+			f(&config)
+		}
+		members[i] = New(config, network.Transport(config.Id+":7946"))
+		t.Cleanup(func() { members[i].Close() })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, m := range members[1:] {
+		if err := m.Join(ctx, members[0].Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return members, logs
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sees reports whether m believes the member with the id is in the state
+func sees(m *Memberlist, id string, state State) bool {
+	for _, mem := range m.Members() {
+		if mem.Id == id {
+			return mem.State == state
+		}
+	}
+	return false
+}
+
+func allAlive(members []*Memberlist) bool {
+	for _, m := range members {
+		list := m.Members()
+		if len(list) != len(members) {
+			return false
+		}
+		for _, mem := range list {
+			if mem.State != Alive {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestJoin(t *testing.T) {
+	network := NewNetwork()
+	members, logs := startCluster(t, network, 5)
+
+	// the members only joined m0 and learn about each other by gossip
+	waitFor(t, "members to converge", func() bool { return allAlive(members) })
+	waitFor(t, "join events", func() bool { return logs[4].has(EventJoin, "m1") })
+}
+
+func TestFailureDetection(t *testing.T) {
+	network := NewNetwork()
+	members, logs := startCluster(t, network, 5)
+	waitFor(t, "members to converge", func() bool { return allAlive(members) })
+
+	// closing the transport without leaving looks like a crash
+	members[2].Close()
+
+	for i, m := range members {
+		if i == 2 {
+			continue
+		}
+		waitFor(t, "m2 to be declared dead", func() bool { return sees(m, "m2", Dead) })
+	}
+	waitFor(t, "suspect and leave events", func() bool { return logs[0].has(EventSuspect, "m2") && logs[0].has(EventLeave, "m2") })
+}
+
+func TestLeave(t *testing.T) {
+	network := NewNetwork()
+	members, logs := startCluster(t, network, 3)
+	waitFor(t, "members to converge", func() bool { return allAlive(members) })
+
+	if err := members[1].Leave(); err != nil {
+		t.Fatal(err)
+	}
+	members[1].Close()
+
+	waitFor(t, "m1 to leave", func() bool { return sees(members[0], "m1", Left) && sees(members[2], "m1", Left) })
+	// members that leave are never suspected
+	if logs[0].has(EventSuspect, "m1") || logs[2].has(EventSuspect, "m1") {
+		t.Fatal("m1 was suspected after leaving")
+	}
+}
+
+func TestPacketLoss(t *testing.T) {
+	network := NewNetwork()
+	members, _ := startCluster(t, network, 5, func(c *Config) { c.SuspicionTimeout = time.Second })
+	waitFor(t, "members to converge", func() bool { return allAlive(members) })
+
+	// indirect probes and refutation keep false positives from turning into
+	// dead members
+	network.SetLoss(0.2)
+	members[3].Close()
+
+	for i, m := range members {
+		if i == 3 {
+			continue
+		}
+		waitFor(t, "m3 to be declared dead", func() bool { return sees(m, "m3", Dead) })
+	}
+	for _, m := range members {
+		for _, mem := range m.Members() {
+			if mem.Id != "m3" && mem.State == Dead {
+				t.Fatalf("%s declared %s dead", m.Id(), mem.Id)
+			}
+		}
+	}
+}
+
+func TestRefute(t *testing.T) {
+	network := NewNetwork()
+	members, logs := startCluster(t, network, 2)
+	waitFor(t, "members to converge", func() bool { return allAlive(members) })
+
+	// a false claim that m1 failed is refuted with a higher incarnation
+	m := members[0]
+	m.mu.Lock()
+	events := m.applyLocked([]update{{Id: "m1", State: Suspect, Incarnation: 0}})
+	m.mu.Unlock()
+	m.emit(events)
+
+	waitFor(t, "m1 to refute", func() bool { return logs[0].has(EventAlive, "m1") })
+	if mem := members[1].Members()[1]; mem.Incarnation == 0 {
+		t.Fatalf("expected incarnation to be raised, got %+v", mem)
+	}
+}
+
+func TestPacketEncoding(t *testing.T) {
+	p := packet{Kind: kindPingReq, Seq: 7, From: "a", Target: "b", TargetAddr: "b:1", Updates: []update{{Id: "c", Addr: "c:1", State: Suspect, Incarnation: 3}}}
+	data, err := encode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != p.Kind || got.Seq != p.Seq || got.Target != p.Target || len(got.Updates) != 1 || got.Updates[0] != p.Updates[0] {
+		t.Fatalf("got %+v, want %+v", got, p)
+	}
+
+	if _, err := decode(data[:len(data)-1]); err == nil {
+		t.Fatal("expected truncated packet to fail")
+	}
+}
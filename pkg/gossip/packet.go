@@ -0,0 +1,82 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+	"github.com/fxamacker/cbor/v2"
+)
+
+var ErrorMalformedPacket = errors.New("malformed gossip packet")
+
+type kind uint8
+
+const (
+	kindPing    kind = iota // ask the target whether it is alive
+	kindPingReq             // ask another member to ping the target
+	kindAck                 // answer a ping, forwarded for a ping-req
+	kindSync                // send the whole member list and ask for the other one
+	kindSyncAck             // answer a sync with the whole member list
+	kindUpdate              // only carries updates, e.g. when leaving
+)
+
+// packet is the content of a Gossip message. Every packet piggybacks some
+// of the recent updates to the member list.
+type packet struct {
+	Kind kind   `cbor:"kind"`
+	Seq  uint32 `cbor:"seq,omitempty"`
+	// From is the id of the sender
+	From string `cbor:"from"`
+	// Target is the member a ping or ping-req is meant for. Pings for
+	// another member, e.g. one that used the address before, are ignored
+	Target     string   `cbor:"target,omitempty"`
+	TargetAddr string   `cbor:"target_addr,omitempty"`
+	Updates    []update `cbor:"updates,omitempty"`
+}
+
+// update is what a member claims about another one
+type update struct {
+	Id          string `cbor:"id"`
+	Addr        string `cbor:"addr"`
+	State       State  `cbor:"state"`
+	Incarnation uint64 `cbor:"incarnation"`
+}
+
+// encode frames the packet as a KGPMP message so that a datagram holds
+// exactly one frame. Gossip is always CBOR.
+func encode(p packet) ([]byte, error) {
+	content, err := cbor.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return protocol.Serialize(protocol.CBOR, protocol.Message{
+		Id:          strconv.FormatUint(uint64(p.Seq), 10),
+		MessageType: protocol.Gossip,
+		Topic:       topic.NodeKeyword,
+		Content:     content,
+	})
+}
+
+func decode(data []byte) (packet, error) {
+	var p packet
+	if len(data) < protocol.PREFIX_SIZE || int(binary.BigEndian.Uint32(data)) != len(data)-protocol.PREFIX_SIZE {
+		return p, fmt.Errorf("%w: length prefix does not match the datagram", ErrorMalformedPacket)
+	}
+
+	var msg protocol.Message
+	if err := protocol.CBOR.Unmarshal(data[protocol.PREFIX_SIZE:], &msg); err != nil {
+		return p, fmt.Errorf("%w: %w", ErrorMalformedPacket, err)
+	}
+	if msg.MessageType != protocol.Gossip {
+		return p, fmt.Errorf("%w: message type %d", ErrorMalformedPacket, msg.MessageType)
+	}
+	if err := cbor.Unmarshal(msg.Content, &p); err != nil {
+		return p, fmt.Errorf("%w: %w", ErrorMalformedPacket, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,95 @@
+package gossip
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+var ErrorTransportClosed = errors.New("transport closed")
+
+// Network is an in memory network to run members on in tests. Packets are
+// dropped with the configured loss probability, when the receiver is gone or
+// when it falls behind reading them.
+type Network struct {
+	mu         sync.Mutex
+	rand       *rand.Rand
+	loss       float64
+	transports map[string]*SimTransport
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		rand:       rand.New(rand.NewSource(1)),
+		transports: map[string]*SimTransport{},
+	}
+}
+
+// SetLoss makes the network drop packets with probability p, between 0 and 1
+func (n *Network) SetLoss(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.loss = p
+}
+
+// Transport attaches a transport with the address to the network
+func (n *Network) Transport(addr string) *SimTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t := &SimTransport{network: n, addr: addr, packets: make(chan Packet, 1024)}
+	n.transports[addr] = t
+	return t
+}
+
+func (n *Network) deliver(from, to string, data []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.transports[from] == nil {
+		return ErrorTransportClosed
+	}
+	t, ok := n.transports[to]
+	if !ok || n.rand.Float64() < n.loss {
+		return nil
+	}
+
+	select {
+	case t.packets <- Packet{From: from, Data: append([]byte(nil), data...)}:
+	default:
+	}
+	return nil
+}
+
+// SimTransport is a transport on a simulated network. Closing it makes the
+// member unreachable like a crashed node.
+type SimTransport struct {
+	network *Network
+	addr    string
+	packets chan Packet
+}
+
+func (t *SimTransport) Addr() string {
+	return t.addr
+}
+
+func (t *SimTransport) WriteTo(data []byte, addr string) error {
+	return t.network.deliver(t.addr, addr, data)
+}
+
+func (t *SimTransport) Packets() <-chan Packet {
+	return t.packets
+}
+
+func (t *SimTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if t.network.transports[t.addr] != t {
+		return nil
+	}
+	delete(t.network.transports, t.addr)
+	close(t.packets)
+	return nil
+}
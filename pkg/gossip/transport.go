@@ -0,0 +1,83 @@
+package gossip
+
+import (
+	"net"
+	"sync"
+)
+
+// Packet is a datagram received by a transport
+type Packet struct {
+	// From is the address of the sender
+	From string
+	Data []byte
+}
+
+// Transport sends and receives the datagrams members gossip with. Delivery
+// is best effort, packets may be lost.
+type Transport interface {
+	// Addr is the address other members reach this one at
+	Addr() string
+	WriteTo(data []byte, addr string) error
+	// Packets delivers received datagrams, it is closed with the transport
+	Packets() <-chan Packet
+	Close() error
+}
+
+// UDPTransport gossips over UDP
+type UDPTransport struct {
+	pc      net.PacketConn
+	packets chan Packet
+	once    sync.Once
+}
+
+// NewUDPTransport listens on the address, e.g. ":7946"
+func NewUDPTransport(addr string) (*UDPTransport, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &UDPTransport{pc: pc, packets: make(chan Packet, 64)}
+	go t.readLoop()
+	return t, nil
+}
+
+func (t *UDPTransport) readLoop() {
+	defer close(t.packets)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := t.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// like the network, drop what the member can not keep up with
+		select {
+		case t.packets <- Packet{From: from.String(), Data: append([]byte(nil), buf[:n]...)}:
+		default:
+		}
+	}
+}
+
+func (t *UDPTransport) Addr() string {
+	return t.pc.LocalAddr().String()
+}
+
+func (t *UDPTransport) WriteTo(data []byte, addr string) error {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = t.pc.WriteTo(data, ua)
+	return err
+}
+
+func (t *UDPTransport) Packets() <-chan Packet {
+	return t.packets
+}
+
+func (t *UDPTransport) Close() error {
+	var err error
+	t.once.Do(func() { err = t.pc.Close() })
+	return err
+}
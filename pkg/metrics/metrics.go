@@ -0,0 +1,322 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything the registry can write
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics of a process. It is an http.Handler serving
+// them to Prometheus.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// register adds the metric, registering a name twice is a programming error
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the Prometheus text format, in the order
+// they were registered
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Counter only goes up
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// Counter registers a counter
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, &single{name: name, help: help, typ: "counter", value: func() float64 { return float64(c.Value()) }})
+	return c
+}
+
+// CounterFunc registers a counter whose value is kept elsewhere and read by
+// f on every scrape
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.register(name, &single{name: name, help: help, typ: "counter", value: f})
+}
+
+// GaugeFunc registers a gauge read by f on every scrape
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.register(name, &single{name: name, help: help, typ: "gauge", value: f})
+}
+
+type single struct {
+	name, help, typ string
+	value           func() float64
+}
+
+func (s *single) write(w *bufio.Writer) {
+	writeHeader(w, s.name, s.help, s.typ)
+	writeSample(w, s.name, "", s.value())
+}
+
+// CounterVec is a counter per value of a label
+type CounterVec struct {
+	counters sync.Map
+}
+
+// With returns the counter for the label value
+func (v *CounterVec) With(value string) *Counter {
+	if c, ok := v.counters.Load(value); ok {
+		return c.(*Counter)
+	}
+	c, _ := v.counters.LoadOrStore(value, &Counter{})
+	return c.(*Counter)
+}
+
+// CounterVec registers a counter per value of the label
+func (r *Registry) CounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{}
+	r.register(name, &vec{name: name, help: help, typ: "counter", label: label, values: func() map[string]float64 {
+		values := map[string]float64{}
+		v.counters.Range(func(key, c any) bool {
+			values[key.(string)] = float64(c.(*Counter).Value())
+			return true
+		})
+		return values
+	}})
+	return v
+}
+
+// GaugeVecFunc registers a gauge per value of the label, f returns the value
+// of every gauge on each scrape
+func (r *Registry) GaugeVecFunc(name, help, label string, f func() map[string]float64) {
+	r.register(name, &vec{name: name, help: help, typ: "gauge", label: label, values: f})
+}
+
+type vec struct {
+	name, help, typ, label string
+	values                 func() map[string]float64
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, v.typ)
+	values := v.values()
+	for _, key := range sortedKeys(values) {
+		writeSample(w, v.name, labelPair(v.label, key), values[key])
+	}
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	// upper bounds of the buckets, +Inf is implied
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	// float64 bits of the sum of all observations
+	sum atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Count returns how many values were observed
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) write(w *bufio.Writer, name, labels string) {
+	if labels != "" {
+		labels += ","
+	}
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		writeSample(w, name+"_bucket", labels+labelPair("le", formatFloat(bound)), float64(cumulative))
+	}
+	count := h.count.Load()
+	writeSample(w, name+"_bucket", labels+labelPair("le", "+Inf"), float64(count))
+	writeSample(w, name+"_sum", strings.TrimSuffix(labels, ","), math.Float64frombits(h.sum.Load()))
+	writeSample(w, name+"_count", strings.TrimSuffix(labels, ","), float64(count))
+}
+
+// Histogram registers a histogram with buckets of the ascending upper bounds
+func (r *Registry) Histogram(name, help string, bounds []float64) *Histogram {
+	h := newHistogram(bounds)
+	r.register(name, &histogramMetric{name: name, help: help, samples: func(w *bufio.Writer) { h.write(w, name, "") }})
+	return h
+}
+
+// HistogramVec is a histogram per value of a label
+type HistogramVec struct {
+	bounds     []float64
+	histograms sync.Map
+}
+
+// With returns the histogram for the label value
+func (v *HistogramVec) With(value string) *Histogram {
+	if h, ok := v.histograms.Load(value); ok {
+		return h.(*Histogram)
+	}
+	h, _ := v.histograms.LoadOrStore(value, newHistogram(v.bounds))
+	return h.(*Histogram)
+}
+
+// HistogramVec registers a histogram per value of the label
+func (r *Registry) HistogramVec(name, help, label string, bounds []float64) *HistogramVec {
+	v := &HistogramVec{bounds: bounds}
+	r.register(name, &histogramMetric{name: name, help: help, samples: func(w *bufio.Writer) {
+		histograms := map[string]*Histogram{}
+		v.histograms.Range(func(key, h any) bool {
+			histograms[key.(string)] = h.(*Histogram)
+			return true
+		})
+		for _, key := range sortedKeys(histograms) {
+			histograms[key].write(w, name, labelPair(label, key))
+		}
+	}})
+	return v
+}
+
+type histogramMetric struct {
+	name, help string
+	samples    func(w *bufio.Writer)
+}
+
+func (h *histogramMetric) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.samples(w)
+}
+
+// ExponentialBuckets returns count upper bounds starting at start, each
+// factor times the one before
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escape(help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func labelPair(name, value string) string {
+	return name + `="` + escape(value, true) + `"`
+}
+
+// escape escapes help texts and, with quotes, label values
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
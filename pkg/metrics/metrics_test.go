@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_events_total", "Events that happened.")
+	c.Add(3)
+	byType := r.CounterVec("test_messages_total", "Messages by type.", "type")
+	byType.With("Publish").Inc()
+	byType.With(`we"ird`).Add(2)
+	r.GaugeFunc("test_connections", "Open connections.", func() float64 { return 2 })
+	h := r.Histogram("test_size", "Sizes\nof things.", []float64{1, 5})
+	for _, v := range []float64{0, 1, 3, 10} {
+		h.Observe(v)
+	}
+	hv := r.HistogramVec("test_seconds", "Durations.", "type", []float64{0.5})
+	hv.With("Request").Observe(0.25)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP test_events_total Events that happened.
+# TYPE test_events_total counter
+test_events_total 3
+# HELP test_messages_total Messages by type.
+# TYPE test_messages_total counter
+test_messages_total{type="Publish"} 1
+test_messages_total{type="we\"ird"} 2
+# HELP test_connections Open connections.
+# TYPE test_connections gauge
+test_connections 2
+# HELP test_size Sizes\nof things.
+# TYPE test_size histogram
+test_size_bucket{le="1"} 2
+test_size_bucket{le="5"} 3
+test_size_bucket{le="+Inf"} 4
+test_size_sum 14
+test_size_count 4
+# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{type="Request",le="0.5"} 1
+test_seconds_bucket{type="Request",le="+Inf"} 1
+test_seconds_sum{type="Request"} 0.25
+test_seconds_count{type="Request"} 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("twice", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a name twice to panic")
+		}
+	}()
+	r.Counter("twice", "")
+}
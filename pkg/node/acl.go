@@ -0,0 +1,84 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/acl"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// actions maps the message types the acl applies to onto acl actions
+var actions = map[protocol.MessageType]acl.Action{
+	protocol.Publish:   acl.Publish,
+	protocol.Subscribe: acl.Subscribe,
+	protocol.Advertise: acl.Advertise,
+	protocol.Request:   acl.Request,
+	// opening a stream is a request to whoever advertises the topic
+	protocol.StreamOpen: acl.Request,
+	protocol.Enqueue:    acl.Enqueue,
+	protocol.Dequeue:    acl.Dequeue,
+	// reading keys is subscribing to them, writing is publishing
+	protocol.Get:            acl.Subscribe,
+	protocol.List:           acl.Subscribe,
+	protocol.Put:            acl.Publish,
+	protocol.Delete:         acl.Publish,
+	protocol.CompareAndSwap: acl.Publish,
+}
+
+// SetACL swaps the policy connections are checked against, nil allows
+// everything. Subscriptions and services that the new policy denies are
+// dropped right away. Links are left alone, see checkACL.
+func (n *Node) SetACL(policy *acl.Policy) {
+	n.acl.Store(policy)
+	if policy == nil {
+		return
+	}
+
+	n.mu.Lock()
+	for _, c := range n.conns {
+		if c.link != nil {
+			continue
+		}
+		subject := c.subject()
+		for pattern := range c.topics {
+			if !policy.Allowed(subject, acl.Subscribe, pattern) {
+				fmt.Println("acl dropped subscription", pattern, "of", c.id)
+				n.unsubscribeLocked(c, pattern)
+			}
+		}
+		for topic := range c.services {
+			if !policy.Allowed(subject, acl.Advertise, topic) {
+				fmt.Println("acl dropped service", topic, "of", c.id)
+				n.unadvertiseLocked(c, topic)
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	n.syncInterest()
+}
+
+// checkACL returns an error when the policy does not allow the connection to
+// send the message. Links are not checked, the interest and messages of a
+// peer were checked by the node the client is connected to.
+func (n *Node) checkACL(c *conn, msg protocol.Message) error {
+	policy := n.acl.Load()
+	if policy == nil || c.link != nil {
+		return nil
+	}
+
+	action, ok := actions[msg.MessageType]
+	if !ok {
+		return nil
+	}
+	return policy.Check(c.subject(), action, msg.Topic)
+}
+
+// canReceive reports whether the connection may be handed a message
+// published to the topic. Subscriptions can be wider than what the policy
+// allows, e.g. /> when /secret/> is denied. Peers are handed everything
+// they have interest in, their node checks its clients.
+func (n *Node) canReceive(c *conn, topic string) bool {
+	policy := n.acl.Load()
+	return policy == nil || c.link != nil || policy.Allowed(c.subject(), acl.Subscribe, topic)
+}
@@ -0,0 +1,139 @@
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/acl"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// dialAs connects and performs the handshake with the client id
+func dialAs(t *testing.T, addr string, clientId string) *testClient {
+	t.Helper()
+
+	tc := dialRaw(t, addr)
+	h := testHello
+	h.ClientId = clientId
+	if _, err := tc.hello(h); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func expectUnauthorized(t *testing.T, rep protocol.Message) {
+	t.Helper()
+
+	if rep.MessageType != protocol.Reply || len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorUnauthorized) {
+		t.Fatalf("expected unauthorized reply, got %+v", rep)
+	}
+}
+
+func TestACL(t *testing.T) {
+	policy, err := acl.Parse([]byte(`{
+		"subjects": {
+			"alice": {
+				"publish":   {"allow": ["/hello/>"]},
+				"subscribe": {"allow": ["/>"], "deny": ["/secret/>"]},
+				"request":   {"allow": ["/echo"]}
+			},
+			"bob": {
+				"publish":   {"allow": ["/>"]},
+				"advertise": {"allow": ["/echo"]}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, addr := startNode(t, Options{ACL: policy})
+
+	alice := dialAs(t, addr, "alice")
+	bob := dialAs(t, addr, "bob")
+
+	// denied operations are answered instead of dropped, even without a tx id
+	alice.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/other"})
+	expectUnauthorized(t, alice.recv())
+	alice.send(protocol.Message{Id: "2", MessageType: protocol.Subscribe, Topic: "/secret/*", TxId: "sub"})
+	expectUnauthorized(t, alice.recv())
+	alice.send(protocol.Message{Id: "3", MessageType: protocol.Advertise, Topic: "/echo", TxId: "adv"})
+	expectUnauthorized(t, alice.recv())
+	bob.send(protocol.Message{Id: "4", MessageType: protocol.Request, Topic: "/echo", TxId: "req"})
+	expectUnauthorized(t, bob.recv())
+	bob.send(protocol.Message{Id: "5", MessageType: protocol.Subscribe, Topic: "/hello", TxId: "sub"})
+	expectUnauthorized(t, bob.recv())
+
+	// the subscription is wider than what alice may see, denied topics are
+	// filtered when delivering
+	alice.subscribe("/>")
+	bob.send(protocol.Message{Id: "6", MessageType: protocol.Publish, Topic: "/secret/plans"})
+	bob.send(protocol.Message{Id: "7", MessageType: protocol.Publish, Topic: "/news"})
+	if m := alice.recv(); m.Id != "7" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	bob.send(protocol.Message{Id: "8", MessageType: protocol.Advertise, Topic: "/echo", TxId: "adv"})
+	if rep := bob.recv(); len(rep.Errors) != 0 {
+		t.Fatalf("unexpected advertise reply %+v", rep)
+	}
+
+	// reloading drops what the new policy no longer allows
+	reloaded, err := acl.Parse([]byte(`{
+		"subjects": {
+			"alice": {"subscribe": {"allow": ["/news"]}},
+			"bob":   {"publish": {"allow": ["/>"]}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetACL(reloaded)
+
+	n.mu.RLock()
+	subs, services := n.subscriptions.Len(), len(n.services)
+	n.mu.RUnlock()
+	if subs != 0 || services != 0 {
+		t.Fatalf("expected subscriptions and services to be dropped, got %d and %d", subs, services)
+	}
+
+	alice.subscribe("/news")
+	bob.send(protocol.Message{Id: "9", MessageType: protocol.Publish, Topic: "/news"})
+	if m := alice.recv(); m.Id != "9" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestACLFederation(t *testing.T) {
+	policy, err := acl.Parse([]byte(`{
+		"subjects": {
+			"alice": {
+				"publish":   {"allow": ["/>"]},
+				"subscribe": {"allow": ["/>"], "deny": ["/secret/>"]}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// links are not checked, each node checks its own clients
+	a, addrA := startNode(t, Options{NodeId: "a", ACL: policy})
+	_, addrB := startNode(t, Options{NodeId: "b", ACL: policy, Peers: []string{addrA}})
+
+	sub := dialAs(t, addrB, "alice")
+	sub.subscribe("/>")
+	waitFor(t, "interest to reach a", func() bool { return a.reaches("/hello/world") })
+
+	pub := dialAs(t, addrA, "alice")
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/secret/plans"})
+	pub.send(protocol.Message{Id: "2", MessageType: protocol.Publish, Topic: "/hello/world"})
+	if m := sub.recv(); m.Id != "2" {
+		t.Fatalf("expected only the allowed message, got %+v", m)
+	}
+
+	mallory := dialAs(t, addrA, "mallory")
+	mallory.send(protocol.Message{Id: "3", MessageType: protocol.Publish, Topic: "/hello/world", TxId: "pub"})
+	expectUnauthorized(t, mallory.recv())
+	sub.expectNothing(100 * time.Millisecond)
+}
@@ -0,0 +1,48 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// authenticate checks the token of the message and, when it is accepted,
+// lets the connection use the node under the identity it belongs to. A
+// failed attempt drops the identity the connection had before. Nodes without
+// an authenticator accept every attempt.
+func (n *Node) authenticate(c *conn, msg protocol.Message) {
+	if n.opts.Authenticator == nil {
+		c.ack(msg)
+		return
+	}
+
+	id, err := n.opts.Authenticator.Authenticate(msg.Headers.AuthToken)
+	if err != nil {
+		c.identity.Store(nil)
+		fmt.Println("connection", c.id, "failed to authenticate:", err)
+		c.replyError(msg, protocol.CodeUnauthorized, fmt.Errorf("%w: %w", protocol.ErrorUnauthorized, err))
+		return
+	}
+
+	c.identity.Store(&id)
+	c.ack(msg)
+}
+
+// authorize returns an error unless the connection is authenticated with a
+// token that has not expired yet
+func (n *Node) authorize(c *conn) error {
+	if n.opts.Authenticator == nil {
+		return nil
+	}
+
+	id := c.identity.Load()
+	if id == nil {
+		return auth.ErrorNotAuthenticated
+	}
+	if id.Expired(time.Now()) {
+		return auth.ErrorExpiredToken
+	}
+	return nil
+}
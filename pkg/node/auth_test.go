@@ -0,0 +1,91 @@
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// authenticate sends an Authenticate message and returns the error the node
+// replied with
+func (tc *testClient) authenticate(token string) error {
+	tc.t.Helper()
+
+	tc.send(protocol.Message{Id: "a", MessageType: protocol.Authenticate, TxId: "auth", Headers: protocol.Headers{AuthToken: token}})
+	rep := tc.recv()
+	if rep.MessageType != protocol.Reply || rep.TxId != "auth" {
+		tc.t.Fatalf("unexpected authenticate reply %+v", rep)
+	}
+	if len(rep.Errors) == 0 {
+		return nil
+	}
+	return rep.Errors[0].Err()
+}
+
+func TestAuthenticate(t *testing.T) {
+	signer := auth.NewHMAC([]byte("key"))
+	_, addr := startNode(t, Options{Authenticator: signer})
+
+	tc := dial(t, addr)
+
+	// nothing but authenticating is allowed before a token was accepted
+	tc.send(protocol.Message{Id: "1", MessageType: protocol.Subscribe, Topic: "/hello", TxId: "sub"})
+	if rep := tc.recv(); len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorUnauthorized) {
+		t.Fatalf("expected unauthorized, got %+v", rep)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"missing", "", auth.ErrorMissingToken.Error()},
+		{"malformed", "not-a-token", auth.ErrorMalformedToken.Error()},
+		{"expired", signer.Sign("alice", time.Now().Add(-time.Minute)), auth.ErrorExpiredToken.Error()},
+		{"forged", auth.NewHMAC([]byte("other")).Sign("alice", time.Time{}), auth.ErrorInvalidToken.Error()},
+	}
+	for _, tt := range tests {
+		err := tc.authenticate(tt.token)
+		if !errors.Is(err, protocol.ErrorUnauthorized) || err.Error() != "unauthorized: "+tt.err {
+			t.Fatalf("%s: expected unauthorized with %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	if err := tc.authenticate(signer.Sign("alice", time.Now().Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	tc.subscribe("/hello")
+
+	// a failed attempt drops the identity the connection had
+	if err := tc.authenticate("not-a-token"); !errors.Is(err, protocol.ErrorUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+	tc.send(protocol.Message{Id: "2", MessageType: protocol.Subscribe, Topic: "/hello", TxId: "sub"})
+	if rep := tc.recv(); len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorUnauthorized) {
+		t.Fatalf("expected unauthorized, got %+v", rep)
+	}
+}
+
+func TestAuthenticationExpires(t *testing.T) {
+	expires := time.Now().Add(100 * time.Millisecond)
+	_, addr := startNode(t, Options{Authenticator: auth.AuthenticatorFunc(func(token string) (auth.Identity, error) {
+		return auth.Identity{Subject: token, Expires: expires}, nil
+	})})
+
+	tc := dial(t, addr)
+	if err := tc.authenticate("alice"); err != nil {
+		t.Fatal(err)
+	}
+	tc.subscribe("/hello")
+
+	time.Sleep(time.Until(expires))
+
+	tc.send(protocol.Message{Id: "1", MessageType: protocol.Subscribe, Topic: "/hello", TxId: "sub"})
+	rep := tc.recv()
+	if len(rep.Errors) != 1 || rep.Errors[0].Err().Error() != "unauthorized: token expired" {
+		t.Fatalf("expected expired token, got %+v", rep)
+	}
+}
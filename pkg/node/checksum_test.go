@@ -0,0 +1,110 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// dialChecksums connects a client that asks for checksums
+func dialChecksums(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	tc := dialRaw(t, addr)
+	hello := testHello
+	hello.Features |= protocol.FeatureChecksums
+	rep, err := tc.hello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Features.Has(protocol.FeatureChecksums) {
+		t.Fatalf("expected the node to agree on checksums, got features %b", rep.Features)
+	}
+	tc.fr.SetChecksums(true)
+	tc.checksums = true
+	return tc
+}
+
+// write sends the message framed with a checksum
+func (tc *testClient) write(msg protocol.Message) {
+	tc.t.Helper()
+
+	tc.conn.Write(tc.frame(msg))
+}
+
+func (tc *testClient) frame(msg protocol.Message) []byte {
+	tc.t.Helper()
+
+	payload, err := protocol.CBOR.Marshal(msg)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	fw := protocol.NewFrameWriter(&buf)
+	fw.SetChecksums(true)
+	if err := fw.WriteFrame(payload); err != nil {
+		tc.t.Fatal(err)
+	}
+	fw.Flush()
+	return buf.Bytes()
+}
+
+func TestChecksums(t *testing.T) {
+	a, addrA := startNode(t, Options{NodeId: "a", Checksums: true})
+	_, addrB := startNode(t, Options{NodeId: "b", Checksums: true, Peers: []string{addrA}})
+
+	// nodes that do not offer checksums are talked to without
+	_, addrC := startNode(t, Options{})
+	hello := testHello
+	hello.Features |= protocol.FeatureChecksums
+	if rep, err := dialRaw(t, addrC).hello(hello); err != nil || rep.Features.Has(protocol.FeatureChecksums) {
+		t.Fatalf("expected no checksums, got %+v %v", rep, err)
+	}
+
+	// the link between the nodes checks every frame of the messages it
+	// forwards as well
+	sub := dialChecksums(t, addrB)
+	sub.subscribe("/weather")
+	waitFor(t, "interest to reach a", func() bool { return a.reaches("/weather") })
+	a.mu.RLock()
+	if len(a.links) != 1 {
+		t.Fatalf("expected a link to b, got %d links", len(a.links))
+	}
+	for _, link := range a.links {
+		if !link.features.Has(protocol.FeatureChecksums) {
+			t.Fatal("expected the link to use checksums")
+		}
+	}
+	a.mu.RUnlock()
+
+	// clients that did not ask for checksums still reach ones that did
+	pub := dial(t, addrA)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/weather", Content: []byte("sunny")})
+	if m := sub.recv(); string(m.Content) != "sunny" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	n, addr := startNode(t, Options{Checksums: true})
+
+	tc := dialChecksums(t, addr)
+	tc.subscribe("/weather")
+
+	frame := tc.frame(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/weather", Content: []byte("sunny")})
+	frame[len(frame)-protocol.CHECKSUM_SIZE-1] ^= 0x01
+	tc.conn.Write(frame)
+
+	rep := tc.recv()
+	if rep.MessageType != protocol.Reply || rep.Topic != topic.NodeKeyword || len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorChecksumMismatch) {
+		t.Fatalf("expected the node to report the mismatch, got %+v", rep)
+	}
+	tc.expectClosed()
+
+	if n.metrics.checksumErrors.Value() != 1 {
+		t.Fatalf("expected one checksum error, got %d", n.metrics.checksumErrors.Value())
+	}
+}
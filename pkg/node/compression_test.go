@@ -0,0 +1,89 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// dialCompressed connects a client that asks for the compressions
+func dialCompressed(t *testing.T, addr string, compression ...string) (*testClient, protocol.Hello) {
+	t.Helper()
+
+	tc := dialRaw(t, addr)
+	hello := testHello
+	hello.Compression = compression
+	rep, err := tc.hello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressor, err := rep.Compressor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.fr.SetCompression(compressor)
+	return tc, rep
+}
+
+func TestCompression(t *testing.T) {
+	_, addr := startNode(t, Options{Compressors: []protocol.Compressor{protocol.Flate, protocol.Gzip}})
+
+	sub, hello := dialCompressed(t, addr, "zstd", "gzip")
+	if !slices.Equal(hello.Compression, []string{"gzip"}) {
+		t.Fatalf("expected gzip to be agreed on, got %v", hello.Compression)
+	}
+	sub.subscribe("/logs")
+
+	// the publisher does not compress, the subscriber gets the message
+	// compressed all the same
+	content := bytes.Repeat([]byte("GET /index.html 200\n"), 1000)
+	pub := dial(t, addr)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/logs", Content: content})
+	if m := sub.recv(); !bytes.Equal(m.Content, content) {
+		t.Fatalf("unexpected message of %d bytes", len(m.Content))
+	}
+
+	pub.send(protocol.Message{Id: "2", MessageType: protocol.Publish, Topic: "/logs", Content: content})
+	sub.fr.SetCompression(nil)
+	if _, err := sub.fr.ReadFrame(); !errors.Is(err, protocol.ErrorMalformedMessage) {
+		t.Fatalf("expected the message to be compressed, got %v", err)
+	}
+
+	// small messages are not worth it
+	sub, _ = dialCompressed(t, addr, "flate")
+	sub.subscribe("/small")
+	pub.send(protocol.Message{Id: "3", MessageType: protocol.Publish, Topic: "/small", Content: []byte("hi")})
+	sub.fr.SetCompression(nil)
+	if m := sub.recv(); string(m.Content) != "hi" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestCompressionNotOffered(t *testing.T) {
+	n, addr := startNode(t, Options{})
+
+	tc, hello := dialCompressed(t, addr, "gzip")
+	if len(hello.Compression) != 0 {
+		t.Fatalf("expected no compression, got %v", hello.Compression)
+	}
+
+	// a compressed frame is malformed when no compression was agreed on
+	payload, err := protocol.CBOR.Marshal(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/logs", Content: bytes.Repeat([]byte("x"), 4096)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	fw := protocol.NewFrameWriter(&buf)
+	fw.SetCompression(protocol.Gzip, 0)
+	fw.WriteFrame(payload)
+	fw.Flush()
+	tc.conn.Write(buf.Bytes())
+	tc.expectClosed()
+
+	if n.metrics.parseErrors.Value() != 1 {
+		t.Fatalf("expected one parse error, got %d", n.metrics.parseErrors.Value())
+	}
+}
@@ -0,0 +1,304 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// conn is a single client connection to the node
+type conn struct {
+	id   string
+	node *Node
+	nc   net.Conn
+
+	writeMu sync.Mutex
+	fw      *protocol.FrameWriter
+
+	// negotiated during the handshake, fixed afterwards
+	codec        protocol.Codec
+	features     protocol.Feature
+	clientId     string
+	maxFrameSize int
+
+	// identity the connection authenticated as, nil until it did
+	identity atomic.Pointer[auth.Identity]
+
+	// set for links to peer nodes, nil for clients. guarded by node.mu
+	// until the handshake is done
+	link *link
+	// node id the other end claimed in its hello, it only becomes a link
+	// once it proved to be that node
+	peerId string
+
+	// subscription patterns of this connection. guarded by node.mu
+	topics map[string]struct{}
+	// service topics this connection advertises. guarded by node.mu
+	services map[string]struct{}
+
+	// set once the handshake is done and the fields it negotiated may be
+	// read by others. guarded by node.mu
+	established bool
+	connected   time.Time
+	stats       traffic
+
+	// frames waiting to be written by writeLoop
+	out outbox
+	// dropped messages the client was not told about yet
+	unnoticed atomic.Uint64
+
+	// unix nanoseconds of the last frame read
+	lastRead atomic.Int64
+	// closed once the connection is served no more
+	done chan struct{}
+}
+
+func (c *conn) serve() {
+	defer c.node.connWg.Done()
+	defer c.nc.Close()
+	defer c.node.removeConn(c)
+	defer c.closeOutbox()
+	defer close(c.done)
+	go c.writeLoop()
+	defer func() {
+		fmt.Println("received total messages", c.stats.messagesIn.Load(), "from", c.id)
+	}()
+
+	fr := protocol.NewFrameReader(c.nc)
+	fr.SetMaxFrameSize(c.node.opts.MaxFrameSize)
+
+	if c.link != nil && c.link.outbound {
+		if err := c.dialHandshake(fr); err != nil {
+			c.node.metrics.handshakeErrors.Inc()
+			fmt.Println("handshake with peer on", c.id, "failed:", err)
+			return
+		}
+	} else {
+		if err := c.tlsHandshake(); err != nil {
+			c.node.metrics.handshakeErrors.Inc()
+			fmt.Println("tls handshake with", c.id, "failed:", err)
+			return
+		}
+		if err := c.handshake(fr); err != nil {
+			c.node.metrics.handshakeErrors.Inc()
+			fmt.Println("handshake with", c.id, "failed:", err)
+			return
+		}
+		if c.peerId != "" {
+			if err := c.authenticatePeer(fr); err != nil {
+				c.node.metrics.handshakeErrors.Inc()
+				fmt.Println("peer", c.peerId, "on", c.id, "failed to authenticate:", err)
+				// tell the other end why and wait on the connection to close
+				c.closeWithError(protocol.CodeUnauthorized, fmt.Errorf("%w: %w", protocol.ErrorUnauthorized, err))
+				io.Copy(io.Discard, c.nc)
+				return
+			}
+		}
+	}
+
+	if c.link != nil && !c.node.addLink(c) {
+		return
+	}
+	c.node.mu.Lock()
+	c.established = true
+	c.node.mu.Unlock()
+
+	if c.features.Has(protocol.FeatureHeartbeats) {
+		go c.heartbeatLoop()
+	}
+
+	for {
+		// connections without heartbeats are closed once idle for as long
+		// as those with heartbeats that stopped answering
+		c.nc.SetReadDeadline(time.Now().Add(c.node.opts.ReadTimeout))
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				fmt.Println("client closed connection")
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.node.metrics.heartbeats.Inc()
+				fmt.Println("closing", c.id, "after it was silent for", c.node.opts.ReadTimeout)
+				c.closeWithError(protocol.CodeHeartbeatTimeout, protocol.ErrorHeartbeatTimeout)
+				c.nc.SetReadDeadline(time.Time{})
+				io.Copy(io.Discard, c.nc)
+				return
+			}
+			if errors.Is(err, protocol.ErrorChecksumMismatch) {
+				c.node.metrics.checksumErrors.Inc()
+				fmt.Println("closing", c.id, "after", err)
+				// nothing after the frame can be trusted, tell the other end
+				// why and ignore it until the connection is closed
+				c.closeWithError(protocol.CodeChecksumMismatch, err)
+				io.Copy(io.Discard, c.nc)
+				return
+			}
+			if errors.Is(err, protocol.ErrorFrameTooLarge) || errors.Is(err, protocol.ErrorMalformedMessage) || errors.Is(err, io.ErrUnexpectedEOF) {
+				c.node.metrics.parseErrors.Inc()
+			}
+			fmt.Println("Error reading from client:", err)
+			return
+		}
+
+		c.countIn(frame)
+
+		var dec protocol.Message
+		if err := c.codec.Unmarshal(frame, &dec); err != nil {
+			c.node.metrics.decodeErrors.Inc()
+			fmt.Println("could not deserialize message", err)
+			return
+		}
+
+		start := time.Now()
+		c.node.handle(c, dec)
+		c.node.metrics.observe(dec.MessageType, start)
+	}
+}
+
+// handshake waits on the hello of the client and answers it with the
+// settings both sides will use. Clients that can not be served are told why
+// before the connection is closed.
+func (c *conn) handshake(fr *protocol.FrameReader) error {
+	c.nc.SetReadDeadline(time.Now().Add(c.node.opts.HandshakeTimeout))
+	defer c.nc.SetReadDeadline(time.Time{})
+
+	remote, err := protocol.ReadHello(fr)
+	if err != nil {
+		c.writeMu.Lock()
+		protocol.RejectHello(c.fw, protocol.CodeMalformedMessage, err)
+		c.writeMu.Unlock()
+		return err
+	}
+
+	local := c.node.hello
+	local.ConnId = c.id
+	hello, code, err := protocol.Negotiate(local, remote)
+	if err == nil {
+		if c.codec, err = hello.Codec(); err != nil {
+			code = protocol.CodeUnsupportedCodec
+		}
+	}
+	var compressor protocol.Compressor
+	if err == nil {
+		if compressor, err = hello.Compressor(); err != nil {
+			code = protocol.CodeMalformedMessage
+		}
+	}
+	if err == nil && remote.NodeId == local.NodeId {
+		code, err = protocol.CodeMalformedMessage, fmt.Errorf("%w: node can not link to itself", protocol.ErrorHandshakeFailed)
+	}
+	if err != nil {
+		c.writeMu.Lock()
+		protocol.RejectHello(c.fw, code, err)
+		c.writeMu.Unlock()
+		return err
+	}
+
+	c.features = hello.Features
+	c.clientId = hello.ClientId
+	// peers send their node id, the connection is a link to them once they
+	// authenticated
+	if remote.NodeId != "" {
+		c.clientId = remote.NodeId
+		c.peerId = remote.NodeId
+	}
+	c.maxFrameSize = int(hello.MaxFrameSize)
+	fr.SetMaxFrameSize(c.maxFrameSize)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.fw.SetMaxFrameSize(c.maxFrameSize)
+	if err := protocol.WriteHello(c.fw, hello); err != nil {
+		return err
+	}
+
+	// the hello itself goes as it is, every frame after it is checked and
+	// compressed as agreed
+	checksums := hello.Features.Has(protocol.FeatureChecksums)
+	fr.SetChecksums(checksums)
+	c.fw.SetChecksums(checksums)
+	fr.SetCompression(compressor)
+	c.fw.SetCompression(compressor, c.node.opts.CompressionThreshold)
+	return nil
+}
+
+// subject is who the acl knows the connection as
+func (c *conn) subject() string {
+	if id := c.identity.Load(); id != nil {
+		return id.Subject
+	}
+	return c.clientId
+}
+
+func (c *conn) send(msg protocol.Message) error {
+	payload, err := c.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.queue(frame{payload: payload})
+}
+
+// sendChunked sends a message generated by the node that may not fit in a
+// frame, in parts when the connection can reassemble them
+func (c *conn) sendChunked(msg protocol.Message) error {
+	if !c.features.Has(protocol.FeatureChunking) {
+		return c.send(msg)
+	}
+
+	payloads, err := protocol.Chunk(c.codec, msg, c.maxFrameSize)
+	if err != nil {
+		return err
+	}
+
+	frames := make([]frame, len(payloads))
+	for i, payload := range payloads {
+		frames[i] = frame{payload: payload}
+	}
+	return c.queue(frames...)
+}
+
+// ack confirms a request that carries a tx id. Messages without a tx id are
+// fire and forget.
+func (c *conn) ack(msg protocol.Message) {
+	c.ackWith(msg, protocol.Headers{})
+}
+
+// ackWith is ack with headers describing the outcome, e.g. a revision
+func (c *conn) ackWith(msg protocol.Message, headers protocol.Headers) {
+	if msg.TxId == "" {
+		return
+	}
+
+	c.reply(msg, headers, nil)
+}
+
+func (c *conn) replyError(msg protocol.Message, code protocol.ErrorCode, err error) {
+	c.reply(msg, protocol.Headers{}, []protocol.Error{{Message: err.Error(), Code: code}})
+}
+
+func (c *conn) reply(msg protocol.Message, headers protocol.Headers, errs []protocol.Error) {
+	rep := protocol.Message{
+		Id:          c.node.nextMessageId(),
+		MessageType: protocol.Reply,
+		Topic:       msg.Topic,
+		TxId:        msg.TxId,
+		Headers:     headers,
+		Errors:      errs,
+		Timestamp:   time.Now().UnixMicro(),
+	}
+
+	if err := c.send(rep); err != nil {
+		fmt.Println("could not send reply to", c.id, err)
+	}
+}
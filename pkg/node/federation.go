@@ -0,0 +1,446 @@
+package node
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// link is the state of a connection to a peer node. Linked nodes tell each
+// other which subscriptions and services they can reach, with the path of
+// nodes the interest travelled, and forward messages along that interest.
+// Apart from that a link is handled like any other connection, the peer
+// subscribes and advertises on behalf of the clients behind it.
+type link struct {
+	// id of the node on the other end
+	nodeId string
+	// whether this node dialed the link
+	outbound bool
+
+	// paths of the subscription patterns and service topics the peer can
+	// reach, from the node of the client to the peer. guarded by node.mu
+	subPaths map[string][]string
+	svcPaths map[string][]string
+
+	// interest this node told the peer about. guarded by node.interestMu
+	sentSubs map[string][]string
+	sentSvcs map[string][]string
+}
+
+func newLink(nodeId string, outbound bool) *link {
+	return &link{
+		nodeId:   nodeId,
+		outbound: outbound,
+		subPaths: map[string][]string{},
+		svcPaths: map[string][]string{},
+		sentSubs: map[string][]string{},
+		sentSvcs: map[string][]string{},
+	}
+}
+
+// connectPeers keeps a link to every configured peer, redialing it
+// PeerRetry after it failed or closed, until the node shuts down. Peers that
+// dialed this node already are not dialed again.
+func (n *Node) connectPeers() {
+	for _, addr := range n.opts.Peers {
+		go func() {
+			var nodeId string
+			for {
+				if !n.linkedTo(nodeId) {
+					id, err := n.dialPeer(addr)
+					if err != nil {
+						fmt.Println("could not dial peer", addr, err)
+					}
+					if id != "" {
+						nodeId = id
+					}
+				}
+				select {
+				case <-time.After(n.opts.PeerRetry):
+				case <-n.done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (n *Node) linkedTo(nodeId string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	_, ok := n.links[nodeId]
+	return ok
+}
+
+// dialPeer links to the node at addr and serves the link until it closes.
+// It returns the id of the peer once the handshake told it.
+func (n *Node) dialPeer(addr string) (string, error) {
+	var nc net.Conn
+	var err error
+	if n.opts.PeerTLSConfig != nil {
+		nc, err = tls.Dial("tcp", addr, n.opts.PeerTLSConfig)
+	} else {
+		nc, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c := n.newConn(nc, newLink("", true))
+	if c == nil {
+		nc.Close()
+		return "", ErrorNodeClosed
+	}
+	fmt.Println("dialed peer", addr, "as", c.id)
+
+	c.serve()
+	return c.link.nodeId, nil
+}
+
+// dialHandshake performs the client side of the handshake on a link this
+// node dialed and presents the PeerToken
+func (c *conn) dialHandshake(fr *protocol.FrameReader) error {
+	n := c.node
+
+	c.nc.SetDeadline(time.Now().Add(n.opts.HandshakeTimeout))
+	defer c.nc.SetDeadline(time.Time{})
+
+	c.writeMu.Lock()
+	err := protocol.WriteHello(c.fw, n.hello)
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	remote, err := protocol.ReadHello(fr)
+	if err != nil {
+		return err
+	}
+	codec, err := remote.Codec()
+	if err != nil {
+		return fmt.Errorf("%w: %w", protocol.ErrorHandshakeFailed, err)
+	}
+	compressor, err := remote.Compressor()
+	if err != nil {
+		return fmt.Errorf("%w: %w", protocol.ErrorHandshakeFailed, err)
+	}
+	if remote.NodeId == "" {
+		return fmt.Errorf("%w: peer did not send its node id", protocol.ErrorHandshakeFailed)
+	}
+
+	c.codec = codec
+	c.features = remote.Features
+	c.clientId = remote.NodeId
+	c.maxFrameSize = int(remote.MaxFrameSize)
+	c.link.nodeId = remote.NodeId
+	checksums := remote.Features.Has(protocol.FeatureChecksums)
+	fr.SetMaxFrameSize(c.maxFrameSize)
+	fr.SetChecksums(checksums)
+	fr.SetCompression(compressor)
+	c.writeMu.Lock()
+	c.fw.SetMaxFrameSize(c.maxFrameSize)
+	c.fw.SetChecksums(checksums)
+	c.fw.SetCompression(compressor, n.opts.CompressionThreshold)
+	c.writeMu.Unlock()
+
+	// the node was dialed on purpose, it is trusted to be who it says
+	c.identity.Store(&auth.Identity{Subject: remote.NodeId})
+
+	if n.opts.PeerToken != "" {
+		return c.send(protocol.Message{
+			Id:          n.nextMessageId(),
+			MessageType: protocol.Authenticate,
+			Headers:     protocol.Headers{AuthToken: n.opts.PeerToken},
+			Timestamp:   time.Now().UnixMicro(),
+		})
+	}
+	return nil
+}
+
+// authenticatePeer makes a connection that sent a node id in its hello a
+// link once it proved to be that node: it has to be authenticated as the
+// node id, either by its client certificate or by the token it presents as
+// its first message. Nodes that authenticate no one take the node id as it
+// is. Without this any client could pose as a peer and learn the interest
+// of the whole node.
+func (c *conn) authenticatePeer(fr *protocol.FrameReader) error {
+	n := c.node
+
+	if n.opts.Authenticator != nil && c.identity.Load() == nil {
+		c.nc.SetReadDeadline(time.Now().Add(n.opts.HandshakeTimeout))
+		defer c.nc.SetReadDeadline(time.Time{})
+
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			return err
+		}
+		c.countIn(frame)
+
+		var msg protocol.Message
+		if err := c.codec.Unmarshal(frame, &msg); err != nil {
+			return err
+		}
+		if msg.MessageType != protocol.Authenticate {
+			return auth.ErrorNotAuthenticated
+		}
+		id, err := n.opts.Authenticator.Authenticate(msg.Headers.AuthToken)
+		if err != nil {
+			return err
+		}
+		c.identity.Store(&id)
+		c.ack(msg)
+	}
+
+	if id := c.identity.Load(); id != nil && id.Subject != c.peerId {
+		return fmt.Errorf("authenticated as %s", id.Subject)
+	}
+
+	n.mu.Lock()
+	c.link = newLink(c.peerId, false)
+	n.mu.Unlock()
+	return nil
+}
+
+// addLink registers the link to its peer. When there are two links to the
+// same peer, e.g. because both nodes dialed each other, both sides keep the
+// one dialed by the node with the smaller id and close the other.
+func (n *Node) addLink(c *conn) bool {
+	n.mu.Lock()
+	old, ok := n.links[c.link.nodeId]
+	if ok && !n.dialedBySmaller(c) && n.dialedBySmaller(old) {
+		n.mu.Unlock()
+		fmt.Println("dropping second link", c.id, "to peer", c.link.nodeId)
+		return false
+	}
+	n.links[c.link.nodeId] = c
+	n.mu.Unlock()
+
+	if ok {
+		fmt.Println("dropping second link", old.id, "to peer", c.link.nodeId)
+		old.nc.Close()
+	}
+	fmt.Println("linked to peer", c.link.nodeId, "on", c.id)
+
+	n.syncInterest()
+	return true
+}
+
+func (n *Node) dialedBySmaller(c *conn) bool {
+	return c.link.outbound == (n.Id() < c.link.nodeId)
+}
+
+// removeLinkLocked forgets the link unless it was replaced already
+func (n *Node) removeLinkLocked(c *conn) {
+	if n.links[c.link.nodeId] == c {
+		delete(n.links, c.link.nodeId)
+	}
+}
+
+// traverse adds this node to the path of a message that is being routed.
+// Messages from clients start a new path. It returns false for messages
+// that passed this node already or went too many hops.
+func (n *Node) traverse(from *conn, msg *protocol.Message) bool {
+	if from.link == nil {
+		msg.Headers.Path = []string{n.Id()}
+		return true
+	}
+
+	path := msg.Headers.Path
+	if len(path) == 0 || len(path) > n.opts.MaxHops || slices.Contains(path, n.Id()) {
+		return false
+	}
+	msg.Headers.Path = append(slices.Clip(path), n.Id())
+	return true
+}
+
+// canForward reports whether a message with the path may be sent over the
+// link. Node local keyword topics never leave the node.
+func (n *Node) canForward(c *conn, topicName string, path []string) bool {
+	return !topic.IsKeyword(topicName) &&
+		len(path) <= n.opts.MaxHops &&
+		!slices.Contains(path, c.link.nodeId)
+}
+
+// peerInterest applies the subscriptions and services a peer tells this node
+// about. It reports whether the message was interest.
+func (n *Node) peerInterest(c *conn, msg protocol.Message) bool {
+	path := msg.Headers.Path
+	// interest that passed this node already would route messages in circles
+	valid := len(path) > 0 && len(path) <= n.opts.MaxHops && !slices.Contains(path, n.Id())
+
+	n.mu.Lock()
+	switch {
+	case msg.MessageType == protocol.Subscribe && valid:
+		n.subscribeLocked(c, msg.Topic)
+		c.link.subPaths[msg.Topic] = path
+	case msg.MessageType == protocol.Subscribe, msg.MessageType == protocol.Unsubscribe:
+		n.unsubscribeLocked(c, msg.Topic)
+	case msg.MessageType == protocol.Advertise && valid:
+		n.advertiseLocked(c, msg.Topic)
+		c.link.svcPaths[msg.Topic] = path
+	case msg.MessageType == protocol.Advertise, msg.MessageType == protocol.Unadvertise:
+		n.unadvertiseLocked(c, msg.Topic)
+	default:
+		n.mu.Unlock()
+		return false
+	}
+	n.mu.Unlock()
+
+	n.syncInterest()
+	return true
+}
+
+// interestRoute is one way to reach subscribers or a service, through a
+// peer or, without via, on this node
+type interestRoute struct {
+	via  *conn
+	path []string
+}
+
+// syncInterest tells every peer about the subscriptions and services it can
+// reach through this node and withdraws the ones it no longer can. Only
+// changes are sent, calls are serialized so that peers see them in order.
+func (n *Node) syncInterest() {
+	n.interestMu.Lock()
+	defer n.interestMu.Unlock()
+
+	type update struct {
+		link *conn
+		msgs []protocol.Message
+	}
+	var updates []update
+
+	n.mu.RLock()
+	subs := n.routesLocked(func(c *conn) map[string]struct{} { return c.topics }, func(l *link) map[string][]string { return l.subPaths })
+	svcs := n.routesLocked(func(c *conn) map[string]struct{} { return c.services }, func(l *link) map[string][]string { return l.svcPaths })
+	for _, c := range n.links {
+		var msgs []protocol.Message
+		msgs = n.diffInterest(msgs, c, subs, c.link.sentSubs, protocol.Subscribe, protocol.Unsubscribe)
+		msgs = n.diffInterest(msgs, c, svcs, c.link.sentSvcs, protocol.Advertise, protocol.Unadvertise)
+		if len(msgs) > 0 {
+			updates = append(updates, update{c, msgs})
+		}
+	}
+	n.mu.RUnlock()
+
+	for _, u := range updates {
+		for _, msg := range u.msgs {
+			if err := u.link.send(msg); err != nil {
+				fmt.Println("could not send interest to peer", u.link.link.nodeId, err)
+				break
+			}
+		}
+	}
+}
+
+// routesLocked collects every way to reach the topics, which are either
+// subscription patterns or service topics
+func (n *Node) routesLocked(topics func(c *conn) map[string]struct{}, paths func(l *link) map[string][]string) map[string][]interestRoute {
+	routes := map[string][]interestRoute{}
+	for _, c := range n.conns {
+		for t := range topics(c) {
+			if topic.IsKeyword(t) {
+				continue
+			}
+			if c.link == nil {
+				routes[t] = append(routes[t], interestRoute{})
+			} else {
+				routes[t] = append(routes[t], interestRoute{via: c, path: paths(c.link)[t]})
+			}
+		}
+	}
+	return routes
+}
+
+// diffInterest appends the messages that bring what the peer knows about
+// the topics up to date. The peer is told the shortest path that does not
+// go through it.
+func (n *Node) diffInterest(msgs []protocol.Message, peer *conn, routes map[string][]interestRoute, sent map[string][]string, add, remove protocol.MessageType) []protocol.Message {
+	want := map[string][]string{}
+	for t, rs := range routes {
+		var best []string
+		found := false
+		for _, r := range rs {
+			if r.via == peer || slices.Contains(r.path, peer.link.nodeId) {
+				continue
+			}
+			if !found || len(r.path) < len(best) {
+				best, found = r.path, true
+			}
+		}
+		if found && len(best) < n.opts.MaxHops {
+			want[t] = append(slices.Clip(best), n.Id())
+		}
+	}
+
+	for t, path := range want {
+		if slices.Equal(sent[t], path) {
+			continue
+		}
+		sent[t] = path
+		msgs = append(msgs, n.interestMessage(add, t, path))
+	}
+	for t := range sent {
+		if _, ok := want[t]; !ok {
+			delete(sent, t)
+			msgs = append(msgs, n.interestMessage(remove, t, nil))
+		}
+	}
+	return msgs
+}
+
+func (n *Node) interestMessage(messageType protocol.MessageType, topicName string, path []string) protocol.Message {
+	return protocol.Message{
+		Id:          n.nextMessageId(),
+		MessageType: messageType,
+		Topic:       topicName,
+		Headers:     protocol.Headers{Path: path},
+		Timestamp:   time.Now().UnixMicro(),
+	}
+}
+
+// seenCache remembers the messages that arrived from peers recently, so that
+// copies which took a second path through the cluster are dropped. It keeps
+// two generations of up to size messages each.
+type seenCache struct {
+	mu   sync.Mutex
+	size int
+	cur  map[string]struct{}
+	prev map[string]struct{}
+}
+
+func newSeenCache(size int) *seenCache {
+	return &seenCache{size: size, cur: map[string]struct{}{}, prev: map[string]struct{}{}}
+}
+
+// add reports whether the message was not seen before
+func (s *seenCache) add(msg protocol.Message) bool {
+	key := strings.Join([]string{msg.Headers.Path[0], msg.Headers.ConnId, msg.Id, strconv.FormatUint(uint64(msg.Headers.Part), 10)}, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.cur[key]; ok {
+		return false
+	}
+	if _, ok := s.prev[key]; ok {
+		return false
+	}
+
+	s.cur[key] = struct{}{}
+	if len(s.cur) >= s.size {
+		s.prev = s.cur
+		s.cur = map[string]struct{}{}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package node
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// waitFor polls the condition until it holds, links and interest are set up
+// in the background
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// reaches reports whether the node forwards messages published to the topic
+// to a peer
+func (n *Node) reaches(topic string) bool {
+	for _, c := range n.subscriptions.Match(topic) {
+		if c.link != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) reachesService(topic string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	_, ok := n.services[topic]
+	return ok
+}
+
+// expectNothing fails when a message arrives within d
+func (tc *testClient) expectNothing(d time.Duration) {
+	tc.t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(d))
+	frame, err := tc.fr.ReadFrame()
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		tc.t.Fatalf("expected nothing, got %q %v", frame, err)
+	}
+}
+
+func TestFederationLine(t *testing.T) {
+	a, addrA := startNode(t, Options{NodeId: "a"})
+	_, addrB := startNode(t, Options{NodeId: "b", Peers: []string{addrA}})
+	_, addrC := startNode(t, Options{NodeId: "c", Peers: []string{addrB}})
+
+	sub := dial(t, addrC)
+	sub.subscribe("/weather/>")
+	svc := dial(t, addrC)
+	svc.advertise("/echo")
+
+	// a only learns about c through b
+	waitFor(t, "interest to reach a", func() bool { return a.reaches("/weather/today") && a.reachesService("/echo") })
+
+	pub := dial(t, addrA)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/weather/today", Content: []byte("sunny")})
+
+	m := sub.recv()
+	if m.MessageType != protocol.Publish || string(m.Content) != "sunny" || !slices.Equal(m.Headers.Path, []string{"a", "b", "c"}) {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	pub.send(protocol.Message{Id: "2", MessageType: protocol.Request, Topic: "/echo", TxId: "tx", Content: []byte("ping")})
+	req := svc.recv()
+	if req.MessageType != protocol.Request || string(req.Content) != "ping" {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	svc.send(protocol.Message{Id: "r", MessageType: protocol.Reply, Topic: req.Topic, TxId: req.TxId, Content: []byte("pong")})
+
+	rep := pub.recv()
+	if rep.MessageType != protocol.Reply || rep.TxId != "tx" || string(rep.Content) != "pong" {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+
+	// interest is withdrawn along the same way
+	sub.conn.Close()
+	waitFor(t, "interest to be withdrawn", func() bool { return !a.reaches("/weather/today") })
+}
+
+func TestFederationMesh(t *testing.T) {
+	listeners := make([]net.Listener, 3)
+	addrs := make([]string, 3)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		listeners[i], addrs[i] = l, l.Addr().String()
+	}
+
+	// every node dials every other one, only one link per pair survives
+	nodes := make([]*Node, 3)
+	for i, id := range []string{"a", "b", "c"} {
+		nodes[i] = New(Options{NodeId: id, Peers: slices.Delete(slices.Clone(addrs), i, i+1)})
+		go nodes[i].Serve(listeners[i])
+		t.Cleanup(func() { stopNode(nodes[i]) })
+	}
+
+	subs := make([]*testClient, 3)
+	for i := range subs {
+		subs[i] = dial(t, addrs[i])
+		subs[i].subscribe("/news")
+	}
+	for _, n := range nodes {
+		waitFor(t, "links to settle", func() bool {
+			n.mu.RLock()
+			defer n.mu.RUnlock()
+			return len(n.links) == 2
+		})
+	}
+	for _, n := range nodes {
+		waitFor(t, "interest to spread", func() bool {
+			peers := 0
+			for _, c := range n.subscriptions.Match("/news") {
+				if c.link != nil {
+					peers++
+				}
+			}
+			return peers == 2
+		})
+	}
+
+	pub := dial(t, addrs[0])
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/news", Content: []byte("extra")})
+
+	// every subscriber sees the message once even though it can take two
+	// ways to each node
+	for _, sub := range subs {
+		if m := sub.recv(); string(m.Content) != "extra" {
+			t.Fatalf("unexpected message %+v", m)
+		}
+	}
+	for _, sub := range subs {
+		sub.expectNothing(200 * time.Millisecond)
+	}
+}
+
+func TestFederationMaxHops(t *testing.T) {
+	a, addrA := startNode(t, Options{NodeId: "a", MaxHops: 1})
+	_, addrB := startNode(t, Options{NodeId: "b", Peers: []string{addrA}, MaxHops: 1})
+	_, addrC := startNode(t, Options{NodeId: "c", Peers: []string{addrB}, MaxHops: 1})
+
+	sub := dial(t, addrC)
+	sub.subscribe("/far")
+	near := dial(t, addrB)
+	near.subscribe("/far")
+
+	waitFor(t, "interest to reach a", func() bool { return a.reaches("/far") })
+
+	pub := dial(t, addrA)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/far", Content: []byte("x")})
+
+	if m := near.recv(); string(m.Content) != "x" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	// c is two hops away from a
+	sub.expectNothing(200 * time.Millisecond)
+}
+
+func TestFederationPeerAuthentication(t *testing.T) {
+	tokens := auth.NewStaticTokens(map[string]string{"user-token": "alice", "peer-token": "b"})
+	a, addrA := startNode(t, Options{NodeId: "a", Authenticator: tokens})
+
+	sub := dial(t, addrA)
+	if err := sub.authenticate("user-token"); err != nil {
+		t.Fatal(err)
+	}
+	sub.subscribe("/secret/>")
+
+	// claiming a node id without proving it is no way to learn the interest
+	// of the node, whatever the connection sends first
+	for _, first := range []protocol.Message{
+		{Id: "1", MessageType: protocol.Subscribe, Topic: "/x", TxId: "sub"},
+		{Id: "2", MessageType: protocol.Authenticate, Headers: protocol.Headers{AuthToken: "wrong"}},
+		{Id: "3", MessageType: protocol.Authenticate, Headers: protocol.Headers{AuthToken: "user-token"}},
+	} {
+		evil := dialRaw(t, addrA)
+		hello := testHello
+		hello.NodeId = "evil"
+		if _, err := evil.hello(hello); err != nil {
+			t.Fatal(err)
+		}
+		evil.send(first)
+
+		rep := evil.recv()
+		if rep.MessageType != protocol.Reply || len(rep.Errors) == 0 || rep.Errors[0].Code != protocol.CodeUnauthorized {
+			t.Fatalf("expected the peer to be rejected, got %+v", rep)
+		}
+		if _, err := evil.fr.ReadFrame(); err != io.EOF {
+			t.Fatalf("expected the connection to be closed, got %v", err)
+		}
+		if a.linkedTo("evil") {
+			t.Fatal("expected no link to evil")
+		}
+	}
+
+	// a peer presenting a token for its node id is linked
+	b, _ := startNode(t, Options{NodeId: "b", Peers: []string{addrA}, PeerToken: "peer-token"})
+	waitFor(t, "b to link to a", func() bool { return a.linkedTo("b") && b.reaches("/secret/plans") })
+}
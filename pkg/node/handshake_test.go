@@ -0,0 +1,61 @@
+package node
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+func TestHandshake(t *testing.T) {
+	n, addr := startNode(t, Options{NodeId: "node-a", MaxFrameSize: 4096})
+
+	tc := dialRaw(t, addr)
+	h := testHello
+	h.Codecs = []string{"nope", "msgpack", "cbor"}
+	h.ClientId = "client"
+	h.MaxFrameSize = 8192
+	h.Features = protocol.DefaultFeatures | 1<<31
+
+	hello, err := tc.hello(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello.NodeId != n.Id() || hello.ConnId == "" || hello.ClientId != "client" {
+		t.Fatalf("unexpected identity in %+v", hello)
+	}
+	if hello.Version != protocol.PROTOCOL_VERSION || hello.MaxFrameSize != 4096 || hello.Features != protocol.DefaultFeatures {
+		t.Fatalf("unexpected settings in %+v", hello)
+	}
+	// the first codec of the client that the node speaks wins
+	if len(hello.Codecs) != 1 || hello.Codecs[0] != "msgpack" {
+		t.Fatalf("unexpected codecs %v", hello.Codecs)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	_, addr := startNode(t, Options{Codecs: []protocol.Codec{protocol.CBOR}})
+
+	tests := []struct {
+		hello protocol.Hello
+		err   error
+	}{
+		{protocol.Hello{Version: 99, MinVersion: 99, Codecs: []string{"cbor"}}, protocol.ErrorUnsupportedVersion},
+		{protocol.Hello{Version: protocol.PROTOCOL_VERSION, Codecs: []string{"json"}}, protocol.ErrorUnsupportedCodec},
+	}
+
+	for _, tt := range tests {
+		tc := dialRaw(t, addr)
+		if _, err := tc.hello(tt.hello); !errors.Is(err, tt.err) || !errors.Is(err, protocol.ErrorHandshakeFailed) {
+			t.Fatalf("expected %v, got %v", tt.err, err)
+		}
+	}
+
+	// anything but a hello as the first frame is rejected
+	tc := dialRaw(t, addr)
+	tc.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/hello"})
+	if _, err := protocol.ReadHello(tc.fr); !errors.Is(err, protocol.ErrorMalformedMessage) {
+		t.Fatalf("expected malformed message, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// heartbeatLoop pings the connection once nothing was read from it for a
+// HeartbeatInterval. serve closes it once nothing was read for ReadTimeout,
+// whatever is on the other end stopped responding
+func (c *conn) heartbeatLoop() {
+	opts := c.node.opts
+	ticker := time.NewTicker(opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		if time.Since(time.Unix(0, c.lastRead.Load())) < opts.HeartbeatInterval {
+			continue
+		}
+		err := c.send(protocol.Message{
+			Id:          c.node.nextMessageId(),
+			MessageType: protocol.Ping,
+			Topic:       topic.NodeKeyword,
+			TxId:        c.node.nextTxId(),
+			Timestamp:   time.Now().UnixMicro(),
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) pong(ping protocol.Message) {
+	err := c.send(protocol.Message{
+		Id:          c.node.nextMessageId(),
+		MessageType: protocol.Pong,
+		Topic:       topic.NodeKeyword,
+		TxId:        ping.TxId,
+		Timestamp:   time.Now().UnixMicro(),
+	})
+	if err != nil {
+		fmt.Println("could not answer ping of", c.id, err)
+	}
+}
+
+// closeWithError tells the other end why the connection is closed, without
+// a tx id, and closes it once that is written
+func (c *conn) closeWithError(code protocol.ErrorCode, err error) {
+	c.send(protocol.Message{
+		Id:          c.node.nextMessageId(),
+		MessageType: protocol.Reply,
+		Topic:       topic.NodeKeyword,
+		Errors:      []protocol.Error{{Message: err.Error(), Code: code}},
+		Timestamp:   time.Now().UnixMicro(),
+	})
+	c.closeWhenWritten()
+}
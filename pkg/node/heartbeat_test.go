@@ -0,0 +1,99 @@
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+var heartbeatOptions = Options{HeartbeatInterval: 20 * time.Millisecond, ReadTimeout: 250 * time.Millisecond}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	n, addr := startNode(t, heartbeatOptions)
+
+	// a client that stops responding is pinged and then closed with the
+	// reason why
+	tc := dial(t, addr)
+	pings := 0
+	for {
+		m := tc.recv()
+		if m.MessageType == protocol.Ping {
+			if m.Topic != topic.NodeKeyword || m.TxId == "" {
+				t.Fatalf("unexpected ping %+v", m)
+			}
+			pings++
+			continue
+		}
+		if m.MessageType != protocol.Reply || len(m.Errors) != 1 || !errors.Is(m.Errors[0].Err(), protocol.ErrorHeartbeatTimeout) {
+			t.Fatalf("unexpected message %+v", m)
+		}
+		break
+	}
+	if pings == 0 {
+		t.Fatal("expected the client to be pinged before it was closed")
+	}
+	tc.expectClosed()
+
+	if n.metrics.heartbeats.Value() != 1 {
+		t.Fatalf("expected one heartbeat timeout, got %d", n.metrics.heartbeats.Value())
+	}
+}
+
+func TestHeartbeatAnswered(t *testing.T) {
+	n, addr := startNode(t, heartbeatOptions)
+
+	tc := dial(t, addr)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		m := tc.recv()
+		if m.MessageType != protocol.Ping {
+			t.Fatalf("unexpected message %+v", m)
+		}
+		tc.send(protocol.Message{Id: "p", MessageType: protocol.Pong, Topic: topic.NodeKeyword, TxId: m.TxId})
+	}
+
+	// the node answers pings as well
+	tc.send(protocol.Message{Id: "1", MessageType: protocol.Ping, Topic: topic.NodeKeyword, TxId: "ping"})
+	for {
+		m := tc.recv()
+		if m.MessageType == protocol.Pong {
+			if m.TxId != "ping" {
+				t.Fatalf("unexpected pong %+v", m)
+			}
+			break
+		}
+		tc.send(protocol.Message{Id: "p", MessageType: protocol.Pong, Topic: topic.NodeKeyword, TxId: m.TxId})
+	}
+
+	if n.metrics.heartbeats.Value() != 0 {
+		t.Fatal("expected a client answering pings to stay connected")
+	}
+}
+
+func TestHeartbeatNotNegotiated(t *testing.T) {
+	_, addr := startNode(t, heartbeatOptions)
+
+	// clients that do not know about heartbeats are not pinged, they stay
+	// connected as long as they are not idle for the read timeout
+	tc := dialRaw(t, addr)
+	hello := testHello
+	hello.Features = protocol.FeatureChunking
+	if _, err := tc.hello(hello); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		tc.subscribe("/still/here")
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// and are closed with the reason why once they are
+	m := tc.recv()
+	if m.MessageType != protocol.Reply || len(m.Errors) != 1 || !errors.Is(m.Errors[0].Err(), protocol.ErrorHeartbeatTimeout) {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	tc.expectClosed()
+}
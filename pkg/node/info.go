@@ -0,0 +1,178 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/gossip"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// startGossip starts the member of the node in the cluster. Changes of the
+// member list are logged before they are passed on to the configured
+// callback.
+func (n *Node) startGossip() {
+	config := n.opts.GossipConfig
+	config.Id = n.Id()
+	events := config.Events
+	config.Events = func(e gossip.Event) {
+		fmt.Println("member", e.Member.Id, "at", e.Member.Addr, e.Type)
+		if events != nil {
+			events(e)
+		}
+	}
+
+	n.members = gossip.New(config, n.opts.Gossip)
+	fmt.Println("node", n.Id(), "gossiping on", n.members.Addr())
+}
+
+// joinCluster joins the cluster through the seeds in the background, it
+// keeps trying until one of them answers
+func (n *Node) joinCluster() {
+	if n.members == nil || len(n.opts.GossipSeeds) == 0 {
+		return
+	}
+
+	go func() {
+		if err := n.members.Join(context.Background(), n.opts.GossipSeeds...); err != nil {
+			fmt.Println("could not join cluster", err)
+		}
+	}()
+}
+
+// Members returns the members of the cluster as the node sees it, nil when
+// the node does not gossip
+func (n *Node) Members() []gossip.Member {
+	if n.members == nil {
+		return nil
+	}
+	return n.members.Members()
+}
+
+// Version of the node, set at build time with
+// -ldflags "-X github.com/bahodge/kgpmp-prototype/pkg/node.Version=1.2.3"
+var Version = "dev"
+
+// traffic counts the frames and their bytes, length prefix included, that
+// went over connections
+type traffic struct {
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+	// published messages dropped because the connection was too slow
+	dropped atomic.Uint64
+}
+
+// countIn counts a frame read from the connection for it and the node
+func (c *conn) countIn(frame []byte) {
+	c.lastRead.Store(time.Now().UnixNano())
+	for _, t := range []*traffic{&c.stats, &c.node.stats} {
+		t.bytesIn.Add(uint64(protocol.PREFIX_SIZE + len(frame)))
+		t.messagesIn.Add(1)
+	}
+}
+
+// countOut counts a frame written to the connection for it and the node
+func (c *conn) countOut(frame []byte) {
+	for _, t := range []*traffic{&c.stats, &c.node.stats} {
+		t.bytesOut.Add(uint64(protocol.PREFIX_SIZE + len(frame)))
+		t.messagesOut.Add(1)
+	}
+}
+
+// Info describes the node, its connections and its cluster
+func (n *Node) Info() protocol.Info {
+	info := protocol.Info{
+		NodeId:          n.Id(),
+		Version:         Version,
+		ProtocolVersion: protocol.PROTOCOL_VERSION,
+		Started:         n.started.UnixMicro(),
+		Uptime:          uint64(time.Since(n.started).Milliseconds()),
+		Subscriptions:   map[string]int{},
+		Services:        map[string]int{},
+		BytesIn:         n.stats.bytesIn.Load(),
+		BytesOut:        n.stats.bytesOut.Load(),
+		MessagesIn:      n.stats.messagesIn.Load(),
+		MessagesOut:     n.stats.messagesOut.Load(),
+		Dropped:         n.stats.dropped.Load(),
+	}
+
+	n.mu.RLock()
+	for _, c := range n.conns {
+		if !c.established {
+			continue
+		}
+
+		ci := protocol.ConnInfo{
+			Id:          c.id,
+			ClientId:    c.clientId,
+			Subject:     c.subject(),
+			RemoteAddr:  c.nc.RemoteAddr().String(),
+			Codec:       c.codec.Name(),
+			Connected:   c.connected.UnixMicro(),
+			BytesIn:     c.stats.bytesIn.Load(),
+			BytesOut:    c.stats.bytesOut.Load(),
+			MessagesIn:  c.stats.messagesIn.Load(),
+			MessagesOut: c.stats.messagesOut.Load(),
+			Dropped:     c.stats.dropped.Load(),
+			Pending:     c.pending(),
+		}
+		if c.link != nil {
+			ci.Peer = c.link.nodeId
+		}
+		for pattern := range c.topics {
+			ci.Subscriptions = append(ci.Subscriptions, pattern)
+			info.Subscriptions[pattern]++
+		}
+		for t := range c.services {
+			ci.Services = append(ci.Services, t)
+			info.Services[t]++
+		}
+		sort.Strings(ci.Subscriptions)
+		sort.Strings(ci.Services)
+		info.Conns = append(info.Conns, ci)
+	}
+	n.mu.RUnlock()
+
+	// conn ids are counters, shorter ones are older
+	sort.Slice(info.Conns, func(i, j int) bool {
+		a, b := info.Conns[i].Id, info.Conns[j].Id
+		return len(a) < len(b) || len(a) == len(b) && a < b
+	})
+
+	for _, m := range n.Members() {
+		info.Members = append(info.Members, protocol.Member{
+			Id:          m.Id,
+			Addr:        m.Addr,
+			State:       m.State.String(),
+			Incarnation: m.Incarnation,
+		})
+	}
+	return info
+}
+
+// info answers a NodeInfo request with the Info of the node, encoded with
+// the codec of the connection
+func (n *Node) info(c *conn, msg protocol.Message) {
+	content, err := protocol.MarshalInfo(c.codec, n.Info())
+	if err != nil {
+		c.replyError(msg, protocol.CodeCouldNotHandleMessage, err)
+		return
+	}
+
+	rep := protocol.Message{
+		Id:          n.nextMessageId(),
+		MessageType: protocol.Reply,
+		Topic:       msg.Topic,
+		TxId:        msg.TxId,
+		Content:     content,
+		Timestamp:   time.Now().UnixMicro(),
+	}
+	if err := c.sendChunked(rep); err != nil {
+		fmt.Println("could not send reply to", c.id, err)
+	}
+}
@@ -0,0 +1,77 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/gossip"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+func TestNodeInfo(t *testing.T) {
+	network := gossip.NewNetwork()
+	config := gossip.Config{ProbeInterval: 20 * time.Millisecond}
+
+	a, addrA := startNode(t, Options{NodeId: "a", Gossip: network.Transport("a:7946"), GossipConfig: config})
+	b, _ := startNode(t, Options{NodeId: "b", Gossip: network.Transport("b:7946"), GossipSeeds: []string{"a:7946"}, GossipConfig: config})
+	t.Cleanup(func() { a.members.Close(); b.members.Close() })
+
+	waitFor(t, "b to join a", func() bool { return len(a.Members()) == 2 })
+
+	tc := dial(t, addrA)
+	tc.send(protocol.Message{Id: "1", MessageType: protocol.NodeInfo, Topic: topic.NodeKeyword, TxId: "info"})
+	rep := tc.recv()
+	if rep.TxId != "info" || len(rep.Errors) != 0 {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+
+	info, err := protocol.UnmarshalInfo(protocol.CBOR, rep.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NodeId != "a" || info.Version != Version || len(info.Members) != 2 || info.Members[1] != (protocol.Member{Id: "b", Addr: "b:7946", State: "alive"}) {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	tc.send(protocol.Message{Id: "2", MessageType: protocol.NodeInfo, Topic: "/info", TxId: "bad"})
+	if rep := tc.recv(); len(rep.Errors) != 1 || rep.Errors[0].Code != protocol.CodeMalformedMessage {
+		t.Fatalf("expected info on another topic to fail, got %+v", rep)
+	}
+}
+
+func TestNodeInfoConns(t *testing.T) {
+	_, addr := startNode(t, Options{NodeId: "info"})
+
+	sub := dial(t, addr)
+	sub.subscribe("/a")
+	sub.subscribe("/b/>")
+	other := dial(t, addr)
+	other.subscribe("/a")
+	svc := dial(t, addr)
+	svc.advertise("/svc")
+
+	tc := dial(t, addr)
+	tc.send(protocol.Message{Id: "1", MessageType: protocol.NodeInfo, Topic: topic.NodeKeyword, TxId: "info"})
+	info, err := protocol.UnmarshalInfo(protocol.CBOR, tc.recv().Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.NodeId != "info" || info.ProtocolVersion != protocol.PROTOCOL_VERSION || info.Started == 0 || len(info.Conns) != 4 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if info.Subscriptions["/a"] != 2 || info.Subscriptions["/b/>"] != 1 || info.Services["/svc"] != 1 {
+		t.Fatalf("unexpected interest %v %v", info.Subscriptions, info.Services)
+	}
+
+	// every acknowledged subscribe is a frame each way
+	c := info.Conns[0]
+	if c.ClientId != testHello.ClientId || c.Codec != "cbor" || len(c.Subscriptions) != 2 || c.MessagesIn != 2 || c.MessagesOut != 2 || c.BytesIn == 0 {
+		t.Fatalf("unexpected conn %+v", c)
+	}
+	// the node counted the request but not yet its reply
+	if info.MessagesIn != 5 || info.MessagesOut != 4 {
+		t.Fatalf("unexpected totals in %d out %d", info.MessagesIn, info.MessagesOut)
+	}
+}
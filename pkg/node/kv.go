@@ -0,0 +1,262 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// kvEvents are the events of a key waiting to be sent to its watchers.
+// guarded by kvmu
+type kvEvents struct {
+	events []kvEvent
+	// a goroutine is sending the events, the others leave them to it
+	sending bool
+}
+
+type kvEvent struct {
+	msg  protocol.Message
+	from *conn
+}
+
+// kvEntry is a key of the key/value store
+type kvEntry struct {
+	value    []byte
+	revision uint64
+	expires  time.Time
+	// deletes the key once its ttl ran out, nil for keys without one
+	timer *time.Timer
+}
+
+// validateKV checks that the topic of a key/value operation addresses a key,
+// or for List a pattern of keys
+func validateKV(msg protocol.Message) error {
+	if msg.MessageType == protocol.List {
+		if err := topic.ValidatePattern(msg.Topic); err != nil {
+			return err
+		}
+	} else if err := topic.Validate(msg.Topic); err != nil {
+		return err
+	}
+
+	if _, _, ok := topic.SplitKV(msg.Topic); !ok {
+		return fmt.Errorf("%w: %q is not a %s/<bucket>/<key> topic", topic.ErrorInvalidTopic, msg.Topic, topic.KVKeyword)
+	}
+	return nil
+}
+
+func (n *Node) kvGet(c *conn, msg protocol.Message) {
+	n.kvmu.Lock()
+	entry, ok := n.kv[msg.Topic]
+	n.kvmu.Unlock()
+
+	if !ok {
+		c.replyError(msg, protocol.CodeKeyNotFound, protocol.ErrorKeyNotFound)
+		return
+	}
+
+	rep := protocol.Message{
+		Id:          n.nextMessageId(),
+		MessageType: protocol.Reply,
+		Topic:       msg.Topic,
+		TxId:        msg.TxId,
+		Headers:     protocol.Headers{Revision: entry.revision, TTL: ttlLeft(entry.expires)},
+		Content:     entry.value,
+		Timestamp:   time.Now().UnixMicro(),
+	}
+	if err := c.sendChunked(rep); err != nil {
+		fmt.Println("could not send reply to", c.id, err)
+	}
+}
+
+// kvPut writes the key. Compare and swap only writes when the current
+// revision of the key is the one in the message.
+func (n *Node) kvPut(c *conn, msg protocol.Message) {
+	// a value cut into parts would be stored one part at a time
+	if msg.IsPart() {
+		c.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: values have to fit in one frame", protocol.ErrorMalformedMessage))
+		return
+	}
+
+	n.kvmu.Lock()
+	old, ok := n.kv[msg.Topic]
+	if msg.MessageType == protocol.CompareAndSwap {
+		var current uint64
+		if ok {
+			current = old.revision
+		}
+		if current != msg.Headers.Revision {
+			n.kvmu.Unlock()
+			c.replyError(msg, protocol.CodeRevisionMismatch, fmt.Errorf("%w: revision is %d", protocol.ErrorRevisionMismatch, current))
+			return
+		}
+	}
+	if ok && old.timer != nil {
+		old.timer.Stop()
+	}
+
+	n.kvRevision++
+	entry := &kvEntry{value: msg.Content, revision: n.kvRevision}
+	if msg.Headers.TTL > 0 {
+		ttl := time.Duration(msg.Headers.TTL) * time.Millisecond
+		entry.expires = time.Now().Add(ttl)
+		key, revision := msg.Topic, entry.revision
+		entry.timer = time.AfterFunc(ttl, func() { n.kvExpire(key, revision) })
+	}
+	n.kv[msg.Topic] = entry
+
+	c.ackWith(msg, protocol.Headers{Revision: entry.revision})
+	n.kvEventLocked(c, protocol.Put, msg.Topic, entry)
+	n.kvmu.Unlock()
+
+	n.kvSendEvents(msg.Topic)
+}
+
+// kvDelete removes the key. A revision in the message makes the delete
+// conditional on it.
+func (n *Node) kvDelete(c *conn, msg protocol.Message) {
+	n.kvmu.Lock()
+	entry, ok := n.kv[msg.Topic]
+	if msg.Headers.Revision != 0 && (!ok || entry.revision != msg.Headers.Revision) {
+		n.kvmu.Unlock()
+		c.replyError(msg, protocol.CodeRevisionMismatch, protocol.ErrorRevisionMismatch)
+		return
+	}
+	if !ok {
+		n.kvmu.Unlock()
+		c.ack(msg)
+		return
+	}
+
+	n.kvDeleteLocked(c, msg.Topic, entry)
+	c.ackWith(msg, protocol.Headers{Revision: n.kvRevision})
+	n.kvmu.Unlock()
+
+	n.kvSendEvents(msg.Topic)
+}
+
+// kvExpire deletes the key unless it was written again since the timer was
+// set
+func (n *Node) kvExpire(key string, revision uint64) {
+	n.kvmu.Lock()
+	entry, ok := n.kv[key]
+	if !ok || entry.revision != revision {
+		n.kvmu.Unlock()
+		return
+	}
+	n.kvDeleteLocked(nil, key, entry)
+	n.kvmu.Unlock()
+
+	n.kvSendEvents(key)
+}
+
+func (n *Node) kvDeleteLocked(from *conn, key string, entry *kvEntry) {
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	delete(n.kv, key)
+
+	n.kvRevision++
+	n.kvEventLocked(from, protocol.Delete, key, &kvEntry{revision: n.kvRevision})
+}
+
+// kvEventLocked queues the event telling the watchers of the key about the
+// change, kvSendEvents sends it once the lock is released. Events are queued
+// in revision order and sent in the order they were queued.
+func (n *Node) kvEventLocked(from *conn, op protocol.MessageType, key string, entry *kvEntry) {
+	event := protocol.Message{
+		Id:          n.nextMessageId(),
+		MessageType: op,
+		Topic:       key,
+		Headers:     protocol.Headers{Revision: entry.revision, TTL: ttlLeft(entry.expires)},
+		Content:     entry.value,
+		Timestamp:   time.Now().UnixMicro(),
+	}
+	if from != nil {
+		event.Headers.ConnId = from.id
+	}
+
+	q, ok := n.kvEvents[key]
+	if !ok {
+		q = &kvEvents{}
+		n.kvEvents[key] = q
+	}
+	q.events = append(q.events, kvEvent{msg: event, from: from})
+}
+
+// kvSendEvents sends the queued events of the key unless another goroutine
+// is at it already. Watchers that are slow to read hold up the events of the
+// key, never the key/value store.
+func (n *Node) kvSendEvents(key string) {
+	n.kvmu.Lock()
+	defer n.kvmu.Unlock()
+
+	q, ok := n.kvEvents[key]
+	if !ok || q.sending {
+		return
+	}
+
+	q.sending = true
+	for len(q.events) > 0 {
+		events := q.events
+		q.events = nil
+
+		n.kvmu.Unlock()
+		for _, e := range events {
+			n.fanOut(e.msg, e.from)
+		}
+		n.kvmu.Lock()
+	}
+	delete(n.kvEvents, key)
+}
+
+// kvList replies with every key matching the pattern, sorted by key
+func (n *Node) kvList(c *conn, msg protocol.Message) {
+	n.kvmu.Lock()
+	var entries []protocol.KVEntry
+	for key, entry := range n.kv {
+		if !topic.Match(msg.Topic, key) {
+			continue
+		}
+
+		e := protocol.KVEntry{Key: key, Value: entry.value, Revision: entry.revision}
+		if !entry.expires.IsZero() {
+			e.Expires = entry.expires.UnixMicro()
+		}
+		entries = append(entries, e)
+	}
+	revision := n.kvRevision
+	n.kvmu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	content, err := protocol.MarshalKVEntries(entries)
+	if err != nil {
+		c.replyError(msg, protocol.CodeCouldNotHandleMessage, err)
+		return
+	}
+
+	rep := protocol.Message{
+		Id:          n.nextMessageId(),
+		MessageType: protocol.Reply,
+		Topic:       msg.Topic,
+		TxId:        msg.TxId,
+		Headers:     protocol.Headers{Revision: revision},
+		Content:     content,
+		Timestamp:   time.Now().UnixMicro(),
+	}
+	if err := c.sendChunked(rep); err != nil {
+		fmt.Println("could not send reply to", c.id, err)
+	}
+}
+
+// ttlLeft returns the milliseconds until the time, 0 for the zero time
+func ttlLeft(expires time.Time) uint32 {
+	if expires.IsZero() {
+		return 0
+	}
+	return uint32(max(time.Until(expires).Milliseconds(), 1))
+}
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// kv sends a key/value operation and returns the reply
+func (tc *testClient) kv(op protocol.MessageType, key string, value string, headers protocol.Headers) protocol.Message {
+	tc.t.Helper()
+
+	tc.send(protocol.Message{Id: "kv", MessageType: op, Topic: key, TxId: "kv", Headers: headers, Content: []byte(value)})
+	rep := tc.recv()
+	if rep.MessageType != protocol.Reply || rep.TxId != "kv" {
+		tc.t.Fatalf("unexpected kv reply %+v", rep)
+	}
+	return rep
+}
+
+func expectKVError(t *testing.T, rep protocol.Message, err error) {
+	t.Helper()
+
+	if len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), err) {
+		t.Fatalf("expected %v, got %+v", err, rep)
+	}
+}
+
+func TestKV(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	c := dial(t, addr)
+	watcher := dial(t, addr)
+	watcher.subscribe("$kv/users/>")
+
+	expectKVError(t, c.kv(protocol.Get, "$kv/users/alice", "", protocol.Headers{}), protocol.ErrorKeyNotFound)
+
+	rev1 := c.kv(protocol.Put, "$kv/users/alice", "v1", protocol.Headers{}).Headers.Revision
+	if rev1 == 0 {
+		t.Fatal("expected a revision")
+	}
+	if e := watcher.recv(); e.MessageType != protocol.Put || e.Topic != "$kv/users/alice" || string(e.Content) != "v1" || e.Headers.Revision != rev1 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	rep := c.kv(protocol.Get, "$kv/users/alice", "", protocol.Headers{})
+	if string(rep.Content) != "v1" || rep.Headers.Revision != rev1 {
+		t.Fatalf("unexpected get reply %+v", rep)
+	}
+
+	// compare and swap only wins with the current revision
+	expectKVError(t, c.kv(protocol.CompareAndSwap, "$kv/users/alice", "v2", protocol.Headers{Revision: rev1 + 100}), protocol.ErrorRevisionMismatch)
+	expectKVError(t, c.kv(protocol.CompareAndSwap, "$kv/users/alice", "v2", protocol.Headers{}), protocol.ErrorRevisionMismatch)
+	rev2 := c.kv(protocol.CompareAndSwap, "$kv/users/alice", "v2", protocol.Headers{Revision: rev1}).Headers.Revision
+	if rev2 <= rev1 {
+		t.Fatalf("expected revision to grow, got %d after %d", rev2, rev1)
+	}
+	if e := watcher.recv(); string(e.Content) != "v2" || e.Headers.Revision != rev2 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if rep := c.kv(protocol.CompareAndSwap, "$kv/users/bob", "b", protocol.Headers{}); len(rep.Errors) != 0 {
+		t.Fatalf("expected create to succeed, got %+v", rep)
+	}
+	watcher.recv()
+	c.kv(protocol.Put, "$kv/other/key", "x", protocol.Headers{})
+
+	rep = c.kv(protocol.List, "$kv/users/*", "", protocol.Headers{})
+	entries, err := protocol.UnmarshalKVEntries(rep.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "$kv/users/alice" || string(entries[0].Value) != "v2" || entries[1].Key != "$kv/users/bob" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	expectKVError(t, c.kv(protocol.Delete, "$kv/users/alice", "", protocol.Headers{Revision: rev1}), protocol.ErrorRevisionMismatch)
+	if rep := c.kv(protocol.Delete, "$kv/users/alice", "", protocol.Headers{Revision: rev2}); len(rep.Errors) != 0 {
+		t.Fatalf("unexpected delete reply %+v", rep)
+	}
+	if e := watcher.recv(); e.MessageType != protocol.Delete || e.Topic != "$kv/users/alice" || e.Headers.Revision <= rev2 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	expectKVError(t, c.kv(protocol.Get, "$kv/users/alice", "", protocol.Headers{}), protocol.ErrorKeyNotFound)
+
+	// keys are written through the store, not published to
+	c.send(protocol.Message{Id: "p", MessageType: protocol.Publish, Topic: "$kv/users/alice", TxId: "pub"})
+	expectKVError(t, c.recv(), protocol.ErrorMalformedMessage)
+	expectKVError(t, c.kv(protocol.Put, "$kv/users", "v", protocol.Headers{}), protocol.ErrorMalformedMessage)
+}
+
+func TestKVTTL(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	c := dial(t, addr)
+	watcher := dial(t, addr)
+	watcher.subscribe("$kv/sessions/*")
+
+	c.kv(protocol.Put, "$kv/sessions/a", "a", protocol.Headers{TTL: 50})
+	if e := watcher.recv(); e.MessageType != protocol.Put || e.Headers.TTL == 0 || e.Headers.TTL > 50 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if rep := c.kv(protocol.Get, "$kv/sessions/a", "", protocol.Headers{}); rep.Headers.TTL == 0 {
+		t.Fatalf("expected ttl in %+v", rep)
+	}
+
+	// writing the key again without a ttl keeps it around
+	c.kv(protocol.Put, "$kv/sessions/b", "b", protocol.Headers{TTL: 50})
+	watcher.recv()
+	c.kv(protocol.Put, "$kv/sessions/b", "b", protocol.Headers{})
+	watcher.recv()
+
+	start := time.Now()
+	if e := watcher.recv(); e.MessageType != protocol.Delete || e.Topic != "$kv/sessions/a" {
+		t.Fatalf("expected expiry event, got %+v", e)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("key expired late")
+	}
+	expectKVError(t, c.kv(protocol.Get, "$kv/sessions/a", "", protocol.Headers{}), protocol.ErrorKeyNotFound)
+
+	time.Sleep(100 * time.Millisecond)
+	if rep := c.kv(protocol.Get, "$kv/sessions/b", "", protocol.Headers{}); len(rep.Errors) != 0 || rep.Headers.TTL != 0 {
+		t.Fatalf("expected b to stay, got %+v", rep)
+	}
+}
+
+func TestKVSlowWatcher(t *testing.T) {
+	_, addr := startNode(t, Options{MaxPending: 4, MaxBlock: 10 * time.Second})
+
+	watcher := dial(t, addr)
+	watcher.subscribe("$kv/b/>")
+
+	// the writer is blocked on the watcher that does not read
+	writer := dial(t, addr)
+	content := make([]byte, floodSize)
+	go func() {
+		for i := 0; i < floodCount; i++ {
+			frame, err := protocol.Serialize(protocol.CBOR, protocol.Message{Id: strconv.Itoa(i), MessageType: protocol.Put, Topic: "$kv/b/big", Content: content})
+			if err != nil {
+				return
+			}
+			if _, err := writer.conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// but the store is not
+	c := dial(t, addr)
+	if rep := c.kv(protocol.Get, "$kv/b/big", "", protocol.Headers{}); len(rep.Errors) != 0 || rep.Headers.Revision == 0 {
+		t.Fatalf("unexpected get reply %+v", rep)
+	}
+
+	// and the watcher gets every event in order once it reads
+	var last uint64
+	for i := 0; i < floodCount; i++ {
+		e := watcher.recv()
+		if e.MessageType != protocol.Put || e.Headers.Revision <= last {
+			t.Fatalf("unexpected event %+v after revision %d", e, last)
+		}
+		last = e.Headers.Revision
+	}
+}
@@ -0,0 +1,145 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/metrics"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// nodeMetrics are updated as the node works, the rest of its metrics are
+// read when they are scraped
+type nodeMetrics struct {
+	received        *metrics.CounterVec
+	routing         *metrics.HistogramVec
+	fanOut          *metrics.Histogram
+	parseErrors     *metrics.Counter
+	decodeErrors    *metrics.Counter
+	handshakeErrors *metrics.Counter
+	slowConsumers   *metrics.Counter
+	heartbeats      *metrics.Counter
+	checksumErrors  *metrics.Counter
+}
+
+// observe counts a message of the type that was handled since start
+func (m *nodeMetrics) observe(messageType protocol.MessageType, start time.Time) {
+	typ := messageType.String()
+	m.received.With(typ).Inc()
+	m.routing.With(typ).Observe(time.Since(start).Seconds())
+}
+
+func (n *Node) registerMetrics() {
+	r := metrics.NewRegistry()
+	n.registry = r
+
+	n.metrics = nodeMetrics{
+		received: r.CounterVec("kgpmp_messages_received_total", "Messages received from connections by message type.", "type"),
+		routing: r.HistogramVec("kgpmp_routing_duration_seconds", "Time it took to handle a received message, including writing it to the connections it was routed to.", "type",
+			metrics.ExponentialBuckets(0.00001, 4, 10)),
+		fanOut: r.Histogram("kgpmp_fanout_size", "Connections a published message was delivered to.",
+			[]float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 1000}),
+		parseErrors:     r.Counter("kgpmp_parse_errors_total", "Connections closed because of a frame that was too large, cut off or could not be decompressed."),
+		decodeErrors:    r.Counter("kgpmp_deserialize_errors_total", "Connections closed because a frame could not be decoded with their codec."),
+		handshakeErrors: r.Counter("kgpmp_handshake_errors_total", "Connections that failed the tls or KGPMP handshake."),
+		slowConsumers:   r.Counter("kgpmp_slow_consumer_disconnects_total", "Connections closed because they could not keep up with their messages."),
+		heartbeats:      r.Counter("kgpmp_heartbeat_timeouts_total", "Connections closed because they stopped answering pings."),
+		checksumErrors:  r.Counter("kgpmp_checksum_errors_total", "Connections closed because a frame failed its checksum."),
+	}
+
+	r.CounterFunc("kgpmp_dropped_messages_total", "Published messages dropped because their subscriber could not keep up.", func() float64 { return float64(n.stats.dropped.Load()) })
+
+	r.CounterFunc("kgpmp_messages_sent_total", "Frames written to connections.", func() float64 { return float64(n.stats.messagesOut.Load()) })
+	r.CounterFunc("kgpmp_received_bytes_total", "Bytes of frames read from connections, length prefixes included.", func() float64 { return float64(n.stats.bytesIn.Load()) })
+	r.CounterFunc("kgpmp_sent_bytes_total", "Bytes of frames written to connections, length prefixes included.", func() float64 { return float64(n.stats.bytesOut.Load()) })
+	r.GaugeFunc("kgpmp_uptime_seconds", "Seconds since the node started.", func() float64 { return time.Since(n.started).Seconds() })
+
+	r.GaugeFunc("kgpmp_connections", "Open connections, clients and links to peers.", func() float64 {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		return float64(len(n.conns))
+	})
+	r.GaugeFunc("kgpmp_peers", "Links to peer nodes.", func() float64 {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		return float64(len(n.links))
+	})
+	r.GaugeFunc("kgpmp_streams", "Open streams.", func() float64 {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		// the map holds both ends of every stream
+		return float64(len(n.streams) / 2)
+	})
+	r.GaugeFunc("kgpmp_pending_requests", "Requests waiting on a reply.", func() float64 {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		return float64(len(n.pending))
+	})
+
+	r.GaugeVecFunc("kgpmp_queue_depth", "Messages waiting in a queue to be dequeued.", "queue", func() map[string]float64 {
+		n.qmu.Lock()
+		defer n.qmu.Unlock()
+
+		depths := map[string]float64{}
+		for name, q := range n.queues {
+			depths[name] = float64(len(q.ready))
+		}
+		return depths
+	})
+	r.GaugeVecFunc("kgpmp_queue_inflight", "Messages of a queue handed to a consumer and not acked yet.", "queue", func() map[string]float64 {
+		n.qmu.Lock()
+		defer n.qmu.Unlock()
+
+		inflight := map[string]float64{}
+		for name, q := range n.queues {
+			inflight[name] = float64(len(q.inflight))
+		}
+		return inflight
+	})
+	r.GaugeFunc("kgpmp_kv_keys", "Keys in the key/value store.", func() float64 {
+		n.kvmu.Lock()
+		defer n.kvmu.Unlock()
+		return float64(len(n.kv))
+	})
+
+	r.GaugeVecFunc("kgpmp_cluster_members", "Members of the cluster by state, as far as the node knows.", "state", func() map[string]float64 {
+		states := map[string]float64{}
+		for _, m := range n.Members() {
+			states[m.State.String()]++
+		}
+		return states
+	})
+}
+
+// Metrics returns a handler serving the metrics of the node in the
+// Prometheus text format, to mount on an existing http server
+func (n *Node) Metrics() http.Handler {
+	return n.registry
+}
+
+// serveMetrics serves the metrics on MetricsAddr, if set
+func (n *Node) serveMetrics() {
+	if n.opts.MetricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", n.registry)
+	server := &http.Server{Addr: n.opts.MetricsAddr, Handler: mux}
+
+	n.mu.Lock()
+	if n.closing.Load() {
+		n.mu.Unlock()
+		return
+	}
+	n.metricsServer = server
+	n.mu.Unlock()
+
+	go func() {
+		fmt.Println("node", n.Id(), "serving metrics on", n.opts.MetricsAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Println("could not serve metrics", err)
+		}
+	}()
+}
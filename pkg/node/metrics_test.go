@@ -0,0 +1,56 @@
+package node
+
+import (
+	"encoding/binary"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// scrape returns the metrics of the node in the Prometheus text format
+func scrape(n *Node) string {
+	rec := httptest.NewRecorder()
+	n.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	n, addr := startNode(t, Options{})
+
+	sub1 := dial(t, addr)
+	sub1.subscribe("/news")
+	sub2 := dial(t, addr)
+	sub2.subscribe("/news")
+
+	pub := dial(t, addr)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/news", Content: []byte("hi")})
+	sub1.recv()
+	sub2.recv()
+	pub.enqueue("/jobs", "a")
+
+	// a frame announcing more than the node takes ends the connection
+	bad := dial(t, addr)
+	prefix := make([]byte, protocol.PREFIX_SIZE)
+	binary.BigEndian.PutUint32(prefix, protocol.MAX_MSG_SIZE+1)
+	bad.conn.Write(prefix)
+
+	waitFor(t, "parse error to be counted", func() bool { return n.metrics.parseErrors.Value() == 1 })
+
+	metrics := scrape(n)
+	for _, want := range []string{
+		`kgpmp_messages_received_total{type="Publish"} 1`,
+		`kgpmp_messages_received_total{type="Subscribe"} 2`,
+		`kgpmp_routing_duration_seconds_count{type="Publish"} 1`,
+		`kgpmp_fanout_size_bucket{le="2"} 1`,
+		`kgpmp_fanout_size_count 1`,
+		`kgpmp_queue_depth{queue="/jobs"} 1`,
+		`kgpmp_parse_errors_total 1`,
+		`kgpmp_connections 3`,
+	} {
+		if !strings.Contains(metrics, want+"\n") {
+			t.Errorf("missing %s in\n%s", want, metrics)
+		}
+	}
+}
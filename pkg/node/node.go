@@ -0,0 +1,696 @@
+package node
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/acl"
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/gossip"
+	"github.com/bahodge/kgpmp-prototype/pkg/metrics"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+type Options struct {
+	// NodeId identifies the node to clients and other nodes. Defaults to a
+	// random id
+	NodeId string
+	// Codecs the node accepts, clients pick one during the handshake.
+	// Defaults to every registered codec
+	Codecs []protocol.Codec
+	// MaxFrameSize is the largest frame the node accepts. Clients may lower
+	// it during the handshake. Defaults to protocol.MAX_MSG_SIZE
+	MaxFrameSize int
+	// HandshakeTimeout bounds how long a new connection has to send its
+	// hello. Defaults to 5 seconds
+	HandshakeTimeout time.Duration
+	// HeartbeatInterval is how long a connection may be idle before the node
+	// pings it. Defaults to 15 seconds
+	HeartbeatInterval time.Duration
+	// ReadTimeout closes a connection once nothing was read from it for that
+	// long, whether pings are sent on it or not. Defaults to three
+	// HeartbeatIntervals
+	ReadTimeout time.Duration
+	// WriteTimeout bounds how long writing to a connection may take.
+	// Defaults to 10 seconds
+	WriteTimeout time.Duration
+	// Checksums offers clients and peers to follow every frame with a
+	// CRC32C, see protocol.FeatureChecksums. Links between two nodes that
+	// both offer it use it.
+	Checksums bool
+	// Compressors the node accepts in order of preference, clients and
+	// peers may pick one during the handshake. None by default
+	Compressors []protocol.Compressor
+	// CompressionThreshold is the size from which on frames are compressed.
+	// Defaults to protocol.DEFAULT_COMPRESSION_THRESHOLD
+	CompressionThreshold int
+	// TLSConfig makes the node only accept tls connections. Connections
+	// that present a client certificate are authenticated as its subject,
+	// see ServerTLSConfig
+	TLSConfig *tls.Config
+	// CertSubject picks the subject a client certificate authenticates as.
+	// Defaults to the common name of the certificate
+	CertSubject func(cert *x509.Certificate) string
+	// Authenticator, when set, keeps connections from doing anything but
+	// authenticating until they present a token it accepts
+	Authenticator auth.Authenticator
+	// ACL restricts the topics connections may publish to, subscribe to,
+	// advertise and send requests to. Connections are known by the subject
+	// they authenticated as or else their client id. Nil allows everything,
+	// SetACL swaps it while the node is running
+	ACL *acl.Policy
+
+	// QueueVisibilityTimeout is how long a consumer has to ack a dequeued
+	// message before it is handed to the next one. Defaults to 30 seconds
+	QueueVisibilityTimeout time.Duration
+	// QueueMaxDeliveries is how often a message is handed out before it is
+	// moved to the dead letter queue of its queue. Defaults to 5
+	QueueMaxDeliveries int
+	// MaxQueueLength caps the messages a queue holds, 0 means no cap
+	MaxQueueLength int
+
+	// RequestTimeout is how long a request handed to a service waits on its
+	// reply, or on the next part of it, before the requester is told it timed
+	// out. Defaults to 30 seconds
+	RequestTimeout time.Duration
+
+	// ValidateParts makes the node hold on to the parts of chunked messages
+	// until every part arrived and only then forward them
+	ValidateParts bool
+	// PartTimeout is how long the node waits on the missing parts of a
+	// message when validating parts. Defaults to 30 seconds
+	PartTimeout time.Duration
+	// MaxPartialBytes caps the content held while validating parts across
+	// all connections. Defaults to 64 MiB
+	MaxPartialBytes int
+
+	// Peers are the addresses of nodes this node keeps a link to. Linked
+	// nodes tell each other which subscriptions and services they can reach
+	// and forward publishes and requests to each other
+	Peers []string
+	// PeerTLSConfig makes the node dial its peers with tls
+	PeerTLSConfig *tls.Config
+	// PeerToken is presented to peers that require authentication. A node
+	// with an Authenticator or a client certificate on the connection only
+	// accepts a link from a peer that authenticated as its node id
+	PeerToken string
+	// PeerRetry is how long to wait before redialing a peer. Defaults to 1
+	// second
+	PeerRetry time.Duration
+	// MaxHops caps how many links a message travels between nodes. Defaults
+	// to 8
+	MaxHops int
+
+	// Gossip, when set, makes the node gossip with other nodes over the
+	// transport about which nodes are alive. NodeInfo requests list them
+	Gossip gossip.Transport
+	// GossipSeeds are the gossip addresses of nodes to join the cluster
+	// through
+	GossipSeeds []string
+	// GossipConfig tunes gossip. Its Id is always the NodeId
+	GossipConfig gossip.Config
+
+	// MaxPending caps the published messages waiting to be written to a
+	// connection. Defaults to 1024
+	MaxPending int
+	// SlowConsumer is what happens to messages published to a connection
+	// that has MaxPending of them waiting. Defaults to BlockPublisher
+	SlowConsumer SlowConsumerPolicy
+	// MaxBlock is how long BlockPublisher makes a publisher wait on a
+	// connection before that one is disconnected. Defaults to 1 second
+	MaxBlock time.Duration
+	// MaxQueued caps the replies, stream data and other frames that are not
+	// published messages waiting to be written to a connection, one that
+	// falls further behind is closed. Defaults to 16384
+	MaxQueued int
+
+	// MetricsAddr, when set, serves the metrics of the node on
+	// http://MetricsAddr/metrics in the Prometheus text format
+	MetricsAddr string
+}
+
+// Node accepts client connections and routes messages between them
+type Node struct {
+	opts Options
+	// hello sent to every client, with the settings the node supports
+	hello protocol.Hello
+
+	mu sync.RWMutex
+	// connections by id
+	conns map[string]*conn
+	// subscription pattern -> connections subscribed to it
+	subscriptions *topic.Trie[*conn]
+	// service topic -> connections advertising it
+	services map[string]*service
+	// node generated tx id -> request waiting on a reply
+	pending map[string]*pendingRequest
+	// conn id and tx id of a chunked request -> node generated tx id, so
+	// that every part follows the first one to the same service
+	chunkedRequests map[string]string
+	// both ends of every open stream, each pointing at the other
+	streams map[streamEnd]streamEnd
+	// links to peer nodes by node id
+	links map[string]*conn
+
+	// serializes telling peers about interest
+	interestMu sync.Mutex
+	// messages from peers that were already routed
+	seen      *seenCache
+	peersOnce sync.Once
+
+	// listeners Serve accepts connections on. guarded by mu
+	listeners []net.Listener
+	// set by Shutdown while holding mu
+	closing atomic.Bool
+	// closed by Shutdown, stops redialing peers
+	done chan struct{}
+	// served connections, Shutdown waits on them
+	connWg sync.WaitGroup
+	// serves MetricsAddr. guarded by mu
+	metricsServer *http.Server
+
+	// members of the cluster, nil when the node does not gossip
+	members *gossip.Memberlist
+
+	started time.Time
+	// traffic of every connection there ever was
+	stats traffic
+
+	registry *metrics.Registry
+	metrics  nodeMetrics
+
+	// parts of chunked messages that are being validated, nil when
+	// ValidateParts is off
+	parts *protocol.Reassembler
+
+	acl atomic.Pointer[acl.Policy]
+
+	qmu sync.Mutex
+	// queues by name, dropped once they hold nothing
+	queues map[string]*queue
+
+	kvmu sync.Mutex
+	// key/value store by $kv topic
+	kv map[string]*kvEntry
+	// bumped by every change of the key/value store
+	kvRevision uint64
+	// events of keys waiting to be sent to the watchers
+	kvEvents map[string]*kvEvents
+
+	lastConnId atomic.Uint64
+	lastMsgId  atomic.Uint64
+	lastTxId   atomic.Uint64
+
+	lastStreamId atomic.Uint64
+
+	lastReceipt atomic.Uint64
+}
+
+func New(opts Options) *Node {
+	if opts.NodeId == "" {
+		opts.NodeId = randomId()
+	}
+	if len(opts.Codecs) == 0 {
+		for _, name := range protocol.Codecs() {
+			codec, _ := protocol.CodecByName(name)
+			opts.Codecs = append(opts.Codecs, codec)
+		}
+	}
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = protocol.MAX_MSG_SIZE
+	}
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = 5 * time.Second
+	}
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = 15 * time.Second
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = 3 * opts.HeartbeatInterval
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 10 * time.Second
+	}
+	if opts.CertSubject == nil {
+		opts.CertSubject = func(cert *x509.Certificate) string { return cert.Subject.CommonName }
+	}
+	if opts.QueueVisibilityTimeout == 0 {
+		opts.QueueVisibilityTimeout = 30 * time.Second
+	}
+	if opts.QueueMaxDeliveries == 0 {
+		opts.QueueMaxDeliveries = 5
+	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = 30 * time.Second
+	}
+	if opts.PartTimeout == 0 {
+		opts.PartTimeout = 30 * time.Second
+	}
+	if opts.MaxPartialBytes == 0 {
+		opts.MaxPartialBytes = 64 * 1024 * 1024
+	}
+	if opts.PeerRetry == 0 {
+		opts.PeerRetry = time.Second
+	}
+	if opts.MaxHops == 0 {
+		opts.MaxHops = 8
+	}
+	if opts.MaxPending == 0 {
+		opts.MaxPending = 1024
+	}
+	if opts.MaxBlock == 0 {
+		opts.MaxBlock = time.Second
+	}
+	if opts.MaxQueued == 0 {
+		opts.MaxQueued = 16384
+	}
+	if opts.CompressionThreshold == 0 {
+		opts.CompressionThreshold = protocol.DEFAULT_COMPRESSION_THRESHOLD
+	}
+
+	features := protocol.DefaultFeatures
+	if opts.Checksums {
+		features |= protocol.FeatureChecksums
+	}
+
+	n := &Node{
+		opts: opts,
+		hello: protocol.Hello{
+			Version:      protocol.PROTOCOL_VERSION,
+			MinVersion:   protocol.MIN_PROTOCOL_VERSION,
+			NodeId:       opts.NodeId,
+			MaxFrameSize: uint32(opts.MaxFrameSize),
+			Features:     features,
+			Compression:  protocol.CompressionNames(opts.Compressors),
+		},
+		conns:           map[string]*conn{},
+		subscriptions:   topic.NewTrie[*conn](),
+		services:        map[string]*service{},
+		pending:         map[string]*pendingRequest{},
+		chunkedRequests: map[string]string{},
+		streams:         map[streamEnd]streamEnd{},
+		links:           map[string]*conn{},
+		seen:            newSeenCache(64 * 1024),
+		queues:          map[string]*queue{},
+		kv:              map[string]*kvEntry{},
+		kvEvents:        map[string]*kvEvents{},
+		started:         time.Now(),
+		done:            make(chan struct{}),
+	}
+
+	for _, codec := range opts.Codecs {
+		n.hello.Codecs = append(n.hello.Codecs, codec.Name())
+	}
+
+	n.acl.Store(opts.ACL)
+	n.registerMetrics()
+
+	if opts.ValidateParts {
+		n.parts = protocol.NewReassembler(opts.PartTimeout, opts.MaxPartialBytes)
+	}
+
+	if opts.Gossip != nil {
+		n.startGossip()
+	}
+
+	return n
+}
+
+// Id returns the id of the node
+func (n *Node) Id() string {
+	return n.opts.NodeId
+}
+
+func randomId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ListenAndServe listens on the tcp address and serves connections until the
+// node shuts down, see Start to serve in the background
+func (n *Node) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !n.track(listener) {
+		listener.Close()
+		return ErrorNodeClosed
+	}
+
+	fmt.Printf("node %s listening on %s accepting %v (tls: %v)\n", n.Id(), listener.Addr(), n.hello.Codecs, n.opts.TLSConfig != nil)
+
+	return n.serve(listener)
+}
+
+// Serve accepts connections on the listener and handles each one in its own
+// goroutine until the node shuts down, which closes the listener. The
+// listener is wrapped in tls when the node has a TLSConfig. The first call
+// also starts dialing the peers, joining the cluster and serving metrics.
+func (n *Node) Serve(listener net.Listener) error {
+	if !n.track(listener) {
+		listener.Close()
+		return ErrorNodeClosed
+	}
+	return n.serve(listener)
+}
+
+// serve is Serve for a listener that is tracked already
+func (n *Node) serve(listener net.Listener) error {
+	if n.opts.TLSConfig != nil {
+		listener = tls.NewListener(listener, n.opts.TLSConfig)
+	}
+
+	n.peersOnce.Do(func() {
+		n.connectPeers()
+		n.joinCluster()
+		n.serveMetrics()
+	})
+
+	// backs off accept errors such as running out of file descriptors
+	var backoff time.Duration
+	for {
+		nc, err := listener.Accept()
+		if err != nil {
+			if n.closing.Load() {
+				return ErrorNodeClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			fmt.Println("could not accept connection, retrying in", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		c := n.newConn(nc, nil)
+		if c == nil {
+			nc.Close()
+			return ErrorNodeClosed
+		}
+		fmt.Println("new connection", c.id)
+
+		go c.serve()
+	}
+}
+
+// newConn registers the connection, link is set for links this node dialed.
+// It returns nil when the node shut down.
+func (n *Node) newConn(nc net.Conn, link *link) *conn {
+	c := &conn{
+		id:        strconv.FormatUint(n.lastConnId.Add(1), 10),
+		node:      n,
+		nc:        nc,
+		link:      link,
+		fw:        protocol.NewFrameWriter(nc),
+		topics:    map[string]struct{}{},
+		services:  map[string]struct{}{},
+		connected: time.Now(),
+		done:      make(chan struct{}),
+	}
+	c.out.cond = sync.NewCond(&c.out.mu)
+	c.lastRead.Store(c.connected.UnixNano())
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closing.Load() {
+		return nil
+	}
+	n.conns[c.id] = c
+	n.connWg.Add(1)
+
+	return c
+}
+
+// removeConn drops the connection and everything it registered with the node
+func (n *Node) removeConn(c *conn) {
+	n.mu.Lock()
+	for topic := range c.topics {
+		n.unsubscribeLocked(c, topic)
+	}
+	for topic := range c.services {
+		n.unadvertiseLocked(c, topic)
+	}
+	orphaned := n.dropPendingLocked(c)
+	streams := n.dropStreamsLocked(c)
+	if c.link != nil {
+		n.removeLinkLocked(c)
+	}
+	delete(n.conns, c.id)
+	n.mu.Unlock()
+
+	n.syncInterest()
+
+	for _, req := range orphaned {
+		req.fail(fmt.Errorf("%w: service disconnected", protocol.ErrorCouldNotHandleMessage))
+	}
+	for _, end := range streams {
+		n.closeStream(end, fmt.Errorf("%w: peer disconnected", protocol.ErrorCouldNotHandleMessage))
+	}
+
+	n.releaseQueues(c)
+}
+
+func (n *Node) nextMessageId() string {
+	return strconv.FormatUint(n.lastMsgId.Add(1), 10)
+}
+
+func (n *Node) nextTxId() string {
+	return "node-" + strconv.FormatUint(n.lastTxId.Add(1), 10)
+}
+
+func (n *Node) handle(c *conn, msg protocol.Message) {
+	switch msg.MessageType {
+	case protocol.Authenticate:
+		n.authenticate(c, msg)
+		return
+	case protocol.Ping:
+		c.pong(msg)
+		return
+	case protocol.Pong:
+		// reading it was all there was to do
+		return
+	}
+	if err := n.authorize(c); err != nil {
+		c.replyError(msg, protocol.CodeUnauthorized, fmt.Errorf("%w: %w", protocol.ErrorUnauthorized, err))
+		return
+	}
+	if err := n.checkACL(c, msg); err != nil {
+		c.replyError(msg, protocol.CodeUnauthorized, fmt.Errorf("%w: %w", protocol.ErrorUnauthorized, err))
+		return
+	}
+
+	if err := validateTopic(msg); err != nil {
+		c.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: %w", protocol.ErrorMalformedMessage, err))
+		return
+	}
+
+	if n.refuseWhileClosing(c, msg) {
+		return
+	}
+
+	if msg.IsPart() && n.parts != nil {
+		n.validatePart(c, msg)
+		return
+	}
+
+	n.route(c, msg)
+}
+
+// route hands the message to the subsystem responsible for its type
+func (n *Node) route(c *conn, msg protocol.Message) {
+	if c.link != nil && n.peerInterest(c, msg) {
+		return
+	}
+
+	switch msg.MessageType {
+	case protocol.Publish:
+		n.publish(c, msg)
+	case protocol.Subscribe:
+		n.subscribe(c, msg.Topic)
+		c.ack(msg)
+		n.syncInterest()
+	case protocol.Unsubscribe:
+		n.unsubscribe(c, msg.Topic)
+		c.ack(msg)
+		n.syncInterest()
+	case protocol.Advertise:
+		n.advertise(c, msg.Topic)
+		c.ack(msg)
+		n.syncInterest()
+	case protocol.Unadvertise:
+		n.unadvertise(c, msg.Topic)
+		c.ack(msg)
+		n.syncInterest()
+	case protocol.Request:
+		n.request(c, msg)
+	case protocol.Reply:
+		n.reply(c, msg)
+	case protocol.Enqueue:
+		n.enqueue(c, msg)
+	case protocol.Dequeue:
+		n.dequeue(c, msg)
+	case protocol.Ack, protocol.Nack:
+		n.settle(c, msg)
+	case protocol.Get:
+		n.kvGet(c, msg)
+	case protocol.Put, protocol.CompareAndSwap:
+		n.kvPut(c, msg)
+	case protocol.Delete:
+		n.kvDelete(c, msg)
+	case protocol.List:
+		n.kvList(c, msg)
+	case protocol.StreamOpen:
+		n.openStream(c, msg)
+	case protocol.StreamData, protocol.StreamWindow, protocol.StreamClose:
+		n.forwardStream(c, msg)
+	case protocol.NodeInfo:
+		n.info(c, msg)
+	default:
+		c.replyError(msg, protocol.CodeCouldNotHandleMessage, protocol.ErrorCouldNotHandleMessage)
+	}
+}
+
+// validateTopic checks the topic of the message against the rules for its
+// message type. Only subscriptions may use wildcards.
+func validateTopic(msg protocol.Message) error {
+	switch msg.MessageType {
+	case protocol.Subscribe, protocol.Unsubscribe:
+		return topic.ValidatePattern(msg.Topic)
+	case protocol.Publish, protocol.Request, protocol.Advertise, protocol.Unadvertise, protocol.StreamOpen:
+		if err := topic.Validate(msg.Topic); err != nil {
+			return err
+		}
+	case protocol.Enqueue, protocol.Dequeue, protocol.Ack, protocol.Nack:
+		if err := topic.Validate(msg.Topic); err != nil {
+			return err
+		}
+		return validateQueue(msg.Topic)
+	case protocol.Get, protocol.Put, protocol.CompareAndSwap, protocol.Delete, protocol.List:
+		return validateKV(msg)
+	case protocol.NodeInfo:
+		if msg.Topic != topic.NodeKeyword {
+			return fmt.Errorf("%w: node info is asked on %q", topic.ErrorInvalidTopic, topic.NodeKeyword)
+		}
+	}
+
+	// only the node publishes to keys, as watch events
+	if msg.MessageType == protocol.Publish && topic.Keyword(msg.Topic) == topic.KVKeyword {
+		return fmt.Errorf("%w: %q is reserved", topic.ErrorInvalidTopic, msg.Topic)
+	}
+
+	// keyword topics are answered by the node, clients cannot serve them
+	if msg.MessageType == protocol.Advertise && topic.IsKeyword(msg.Topic) {
+		return fmt.Errorf("%w: %q is reserved", topic.ErrorInvalidTopic, msg.Topic)
+	}
+	return nil
+}
+
+func (n *Node) subscribe(c *conn, pattern string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.subscribeLocked(c, pattern)
+}
+
+func (n *Node) subscribeLocked(c *conn, pattern string) {
+	n.subscriptions.Insert(pattern, c)
+	c.topics[pattern] = struct{}{}
+}
+
+func (n *Node) unsubscribe(c *conn, pattern string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.unsubscribeLocked(c, pattern)
+}
+
+func (n *Node) unsubscribeLocked(c *conn, pattern string) {
+	delete(c.topics, pattern)
+	if c.link != nil {
+		delete(c.link.subPaths, pattern)
+	}
+	n.subscriptions.Remove(pattern, c)
+}
+
+// publish fans the message out to every connection with a subscription
+// matching its topic, peers included. Messages from peers keep the conn id
+// they were published with and are dropped when they arrive a second time.
+func (n *Node) publish(from *conn, msg protocol.Message) {
+	if from.link == nil {
+		msg.Headers.ConnId = from.id
+	}
+	if !n.traverse(from, &msg) {
+		return
+	}
+	if from.link != nil && !n.seen.add(msg) {
+		return
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixMicro()
+	}
+
+	n.fanOut(msg, from)
+}
+
+// fanOut writes the message to every connection with a subscription matching
+// its topic. The message is encoded once per codec and the same frame is
+// written to every subscriber using it. Peers only get messages that may be
+// forwarded to them and never the ones they sent.
+func (n *Node) fanOut(msg protocol.Message, from *conn) {
+	subs := n.subscriptions.Match(msg.Topic)
+
+	delivered := 0
+	defer func() { n.metrics.fanOut.Observe(float64(delivered)) }()
+
+	if len(subs) == 0 {
+		return
+	}
+
+	// connections can use different codecs, encode once per codec
+	payloads := map[protocol.Codec][]byte{}
+	for _, c := range subs {
+		// a client that can not reassemble parts is better off without them
+		if msg.IsPart() && !c.features.Has(protocol.FeatureChunking) {
+			continue
+		}
+		if !n.canReceive(c, msg.Topic) {
+			continue
+		}
+		if c.link != nil && (c == from || !n.canForward(c, msg.Topic, msg.Headers.Path)) {
+			continue
+		}
+
+		payload, ok := payloads[c.codec]
+		if !ok {
+			var err error
+			payload, err = c.codec.Marshal(msg)
+			if err != nil {
+				fmt.Println("could not serialize message", err)
+				return
+			}
+			payloads[c.codec] = payload
+		}
+
+		if c.publish(payload) {
+			delivered++
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package node
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// startNode runs a node on a random loopback port and returns its address
+func startNode(t *testing.T, opts Options) (*Node, string) {
+	t.Helper()
+
+	n := New(opts)
+	if err := n.Start(context.Background(), "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopNode(n) })
+
+	return n, n.Addr().String()
+}
+
+// stopNode shuts the node down without waiting long on what is in flight
+func stopNode(n *Node) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	n.Shutdown(ctx)
+}
+
+// testClient speaks the raw wire protocol to a node
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	fr   *protocol.FrameReader
+	// frames are sent with checksums
+	checksums bool
+}
+
+// testHello is what a cbor speaking client sends during the handshake
+var testHello = protocol.Hello{
+	Version:    protocol.PROTOCOL_VERSION,
+	MinVersion: protocol.MIN_PROTOCOL_VERSION,
+	Codecs:     []string{"cbor"},
+	Features:   protocol.DefaultFeatures,
+}
+
+// dialRaw connects without performing the handshake
+func dialRaw(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, fr: protocol.NewFrameReader(conn)}
+}
+
+// hello performs the handshake and returns the hello of the node
+func (tc *testClient) hello(h protocol.Hello) (protocol.Hello, error) {
+	tc.t.Helper()
+
+	if err := protocol.WriteHello(protocol.NewFrameWriter(tc.conn), h); err != nil {
+		tc.t.Fatal(err)
+	}
+
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return protocol.ReadHello(tc.fr)
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	tc := dialRaw(t, addr)
+	if _, err := tc.hello(testHello); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func (tc *testClient) send(msg protocol.Message) {
+	tc.t.Helper()
+
+	if tc.checksums {
+		tc.write(msg)
+		return
+	}
+
+	frame, err := protocol.Serialize(protocol.CBOR, msg)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if _, err := tc.conn.Write(frame); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testClient) recv() protocol.Message {
+	tc.t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frame, err := tc.fr.ReadFrame()
+	if err != nil {
+		tc.t.Fatal("recv:", err)
+	}
+
+	var m protocol.Message
+	if err := protocol.CBOR.Unmarshal(frame, &m); err != nil {
+		tc.t.Fatal(err)
+	}
+	return m
+}
+
+// subscribe subscribes and waits for the node to acknowledge it
+func (tc *testClient) subscribe(topic string) {
+	tc.t.Helper()
+
+	tc.send(protocol.Message{Id: "s", MessageType: protocol.Subscribe, Topic: topic, TxId: "sub-" + topic})
+	if rep := tc.recv(); rep.MessageType != protocol.Reply || len(rep.Errors) != 0 {
+		tc.t.Fatalf("unexpected subscribe reply %+v", rep)
+	}
+}
+
+func TestPublishFanOut(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	sub1 := dial(t, addr)
+	sub1.subscribe("/hello/world")
+	sub2 := dial(t, addr)
+	sub2.subscribe("/hello/world")
+	other := dial(t, addr)
+	other.subscribe("/other")
+
+	pub := dial(t, addr)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/hello/world", Content: []byte("hi")})
+	pub.send(protocol.Message{Id: "2", MessageType: protocol.Publish, Topic: "/other", Content: []byte("other")})
+
+	for _, sub := range []*testClient{sub1, sub2} {
+		m := sub.recv()
+		if m.Id != "1" || string(m.Content) != "hi" || m.Headers.ConnId == "" {
+			t.Fatalf("unexpected message %+v", m)
+		}
+	}
+
+	if m := other.recv(); m.Id != "2" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	sub := dial(t, addr)
+	sub.subscribe("/a")
+	sub.subscribe("/b")
+	sub.send(protocol.Message{Id: "u", MessageType: protocol.Unsubscribe, Topic: "/a", TxId: "unsub"})
+	if rep := sub.recv(); rep.TxId != "unsub" {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+
+	pub := dial(t, addr)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/a"})
+	pub.send(protocol.Message{Id: "2", MessageType: protocol.Publish, Topic: "/b"})
+
+	if m := sub.recv(); m.Id != "2" {
+		t.Fatalf("received message for unsubscribed topic %+v", m)
+	}
+}
+
+func TestWildcardSubscriptions(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	sub := dial(t, addr)
+	sub.subscribe("/hello/*")
+	sub.subscribe("/hello/>")
+
+	pub := dial(t, addr)
+	pub.send(protocol.Message{Id: "1", MessageType: protocol.Publish, Topic: "/hello/world"})
+	pub.send(protocol.Message{Id: "2", MessageType: protocol.Publish, Topic: "/hello/big/world"})
+
+	// matching both patterns still only delivers the message once
+	for _, want := range []string{"1", "2"} {
+		if m := sub.recv(); m.Id != want {
+			t.Fatalf("got message %+v, want id %s", m, want)
+		}
+	}
+
+	pub.send(protocol.Message{Id: "3", MessageType: protocol.Publish, Topic: "/hello/*", TxId: "bad"})
+	rep := pub.recv()
+	if rep.TxId != "bad" || len(rep.Errors) != 1 || rep.Errors[0].Code != protocol.CodeMalformedMessage {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+}
+
+func TestValidateParts(t *testing.T) {
+	_, addr := startNode(t, Options{ValidateParts: true})
+
+	sub := dial(t, addr)
+	sub.subscribe("/big")
+	sub.subscribe("/marker")
+
+	parts := protocol.Split(protocol.Message{Id: "big", MessageType: protocol.Publish, Topic: "/big", Content: []byte("abcdef")}, 2)
+
+	pub := dial(t, addr)
+	pub.send(parts[0])
+	pub.send(parts[1])
+	pub.send(protocol.Message{Id: "marker", MessageType: protocol.Publish, Topic: "/marker"})
+
+	// nothing of the incomplete message is forwarded before the rest arrives
+	if m := sub.recv(); m.Id != "marker" {
+		t.Fatalf("got %+v before the message was complete", m)
+	}
+
+	pub.send(parts[2])
+	for i, want := range []string{"ab", "cd", "ef"} {
+		m := sub.recv()
+		if m.Id != "big" || int(m.Headers.Part) != i || m.Headers.TotalParts != 3 || string(m.Content) != want {
+			t.Fatalf("unexpected part %+v", m)
+		}
+	}
+}
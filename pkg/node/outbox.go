@@ -0,0 +1,298 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// SlowConsumerPolicy decides what happens to a message published to a
+// connection that has MaxPending published messages waiting to be written
+type SlowConsumerPolicy uint8
+
+const (
+	// BlockPublisher makes the publisher wait until the connection caught
+	// up, which in turn stops the node from reading the publisher. A
+	// connection that does not catch up within MaxBlock is disconnected
+	BlockPublisher SlowConsumerPolicy = iota
+	// DropOldest drops the published message that waited the longest
+	DropOldest
+	// DropNewest drops the message being published
+	DropNewest
+	// Disconnect drops every published message waiting on the connection
+	// and closes it
+	Disconnect
+)
+
+var slowConsumerPolicyNames = []string{"block", "drop-oldest", "drop-newest", "disconnect"}
+
+func (p SlowConsumerPolicy) String() string {
+	if int(p) < len(slowConsumerPolicyNames) {
+		return slowConsumerPolicyNames[p]
+	}
+	return fmt.Sprintf("SlowConsumerPolicy(%d)", uint8(p))
+}
+
+// ParseSlowConsumerPolicy parses the name of a policy, e.g. "drop-oldest"
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for i, n := range slowConsumerPolicyNames {
+		if n == name {
+			return SlowConsumerPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy %q, expected one of %v", name, slowConsumerPolicyNames)
+}
+
+// disconnectTimeout is how long a connection that is being closed, e.g. a
+// slow consumer, has to take what is left for it
+const disconnectTimeout = time.Second
+
+type frame struct {
+	payload []byte
+	// published messages may be dropped, replies and the like never are
+	published bool
+	// notice stands in for the message telling the client how many of its
+	// messages were dropped, it is encoded when it is written
+	notice bool
+}
+
+// outbox holds the frames waiting to be written to a connection so that a
+// slow reader holds up no one but itself. guarded by mu
+type outbox struct {
+	mu sync.Mutex
+	// signalled when frames are queued or taken and when the outbox closes
+	cond   *sync.Cond
+	frames []frame
+	// published messages in frames
+	published int
+	// a notice is queued and not written yet
+	noticed bool
+	// the connection is gone, nothing is queued or written anymore
+	closed bool
+	// close the connection once the queued frames are written
+	closeAfter bool
+}
+
+// queue queues frames that are never dropped. A connection that has
+// MaxQueued of them waiting already is closed instead.
+func (c *conn) queue(frames ...frame) error {
+	ob := &c.out
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.closed || ob.closeAfter {
+		return net.ErrClosed
+	}
+	if queued := len(ob.frames) - ob.published; queued+len(frames) > c.node.opts.MaxQueued {
+		ob.closed = true
+		ob.frames = nil
+		ob.published = 0
+		ob.cond.Broadcast()
+		c.nc.Close()
+		c.node.metrics.slowConsumers.Inc()
+		fmt.Println("closing slow consumer", c.id, "with", queued, "frames waiting")
+		return fmt.Errorf("%w: %d frames waiting", protocol.ErrorSlowConsumer, queued)
+	}
+	ob.frames = append(ob.frames, frames...)
+	ob.cond.Broadcast()
+	return nil
+}
+
+// publish queues a published message, applying the SlowConsumer policy
+// when the connection has MaxPending of them waiting already. It reports
+// whether the message was queued.
+func (c *conn) publish(payload []byte) bool {
+	n := c.node
+	ob := &c.out
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	policy := n.opts.SlowConsumer
+	if policy == BlockPublisher && ob.published >= n.opts.MaxPending {
+		// the publisher is not read while it waits, so it does not wait for
+		// long. A connection that can not catch up is disconnected
+		expired := false
+		timer := time.AfterFunc(n.opts.MaxBlock, func() {
+			ob.mu.Lock()
+			expired = true
+			ob.cond.Broadcast()
+			ob.mu.Unlock()
+		})
+		for ob.published >= n.opts.MaxPending && !expired && !ob.closed && !ob.closeAfter {
+			ob.cond.Wait()
+		}
+		timer.Stop()
+		if expired {
+			policy = Disconnect
+		}
+	}
+	if ob.closed || ob.closeAfter {
+		return false
+	}
+
+	if ob.published >= n.opts.MaxPending {
+		switch policy {
+		case DropNewest:
+			c.dropLocked(1)
+			return false
+		case DropOldest:
+			for i, f := range ob.frames {
+				if f.published {
+					ob.frames = append(ob.frames[:i], ob.frames[i+1:]...)
+					ob.published--
+					break
+				}
+			}
+			c.dropLocked(1)
+		case Disconnect:
+			kept := ob.frames[:0]
+			for _, f := range ob.frames {
+				if !f.published {
+					kept = append(kept, f)
+				}
+			}
+			ob.frames = kept
+			c.dropLocked(ob.published + 1)
+			ob.published = 0
+			c.closeWhenWrittenLocked()
+			n.metrics.slowConsumers.Inc()
+			fmt.Println("disconnecting slow consumer", c.id)
+			return false
+		}
+	}
+
+	ob.frames = append(ob.frames, frame{payload: payload, published: true})
+	ob.published++
+	ob.cond.Broadcast()
+	return true
+}
+
+// dropLocked counts dropped messages and makes sure the client is told
+func (c *conn) dropLocked(count int) {
+	c.stats.dropped.Add(uint64(count))
+	c.node.stats.dropped.Add(uint64(count))
+	c.unnoticed.Add(uint64(count))
+
+	ob := &c.out
+	if !ob.noticed {
+		ob.frames = append(ob.frames, frame{notice: true})
+		ob.noticed = true
+	}
+}
+
+// pending returns how many frames wait to be written
+func (c *conn) pending() int {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+
+	return len(c.out.frames)
+}
+
+// closeOutbox drops whatever waits on the connection and releases
+// publishers blocked on it
+func (c *conn) closeOutbox() {
+	ob := &c.out
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.closed = true
+	ob.frames = nil
+	ob.published = 0
+	ob.cond.Broadcast()
+}
+
+// closeWhenWritten closes the connection once the frames waiting on it are
+// written, giving the client disconnectTimeout to read them
+func (c *conn) closeWhenWritten() {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+
+	if !c.out.closed && !c.out.closeAfter {
+		c.closeWhenWrittenLocked()
+	}
+}
+
+func (c *conn) closeWhenWrittenLocked() {
+	c.out.closeAfter = true
+	c.nc.SetWriteDeadline(time.Now().Add(disconnectTimeout))
+	c.out.cond.Broadcast()
+}
+
+// writeLoop writes the queued frames to the connection, as many at once as
+// are waiting
+func (c *conn) writeLoop() {
+	ob := &c.out
+	for {
+		ob.mu.Lock()
+		for len(ob.frames) == 0 && !ob.closed && !ob.closeAfter {
+			ob.cond.Wait()
+		}
+		if ob.closed || len(ob.frames) == 0 {
+			closeAfter := ob.closeAfter
+			ob.mu.Unlock()
+			if closeAfter {
+				c.nc.Close()
+			}
+			return
+		}
+		// a connection being closed keeps the deadline it was given
+		deadline := !ob.closeAfter
+		frames := ob.frames
+		ob.frames = nil
+		ob.published = 0
+		for _, f := range frames {
+			if f.notice {
+				ob.noticed = false
+			}
+		}
+		ob.cond.Broadcast()
+		ob.mu.Unlock()
+
+		if deadline {
+			c.nc.SetWriteDeadline(time.Now().Add(c.node.opts.WriteTimeout))
+		}
+		if err := c.writeFrames(frames); err != nil {
+			fmt.Println("could not write to", c.id, err)
+			c.nc.Close()
+			return
+		}
+	}
+}
+
+func (c *conn) writeFrames(frames []frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	for _, f := range frames {
+		if f.notice {
+			payload, err := c.notice()
+			if err != nil {
+				return err
+			}
+			f.payload = payload
+		}
+
+		if err := c.fw.WriteFrame(f.payload); err != nil {
+			return err
+		}
+		c.countOut(f.payload)
+	}
+	return c.fw.Flush()
+}
+
+// notice encodes the message telling the client how many messages published
+// to it were dropped since it was last told
+func (c *conn) notice() ([]byte, error) {
+	err := fmt.Errorf("%w: dropped %d messages", protocol.ErrorSlowConsumer, c.unnoticed.Swap(0))
+	return c.codec.Marshal(protocol.Message{
+		Id:          c.node.nextMessageId(),
+		MessageType: protocol.Reply,
+		Topic:       topic.NodeKeyword,
+		Errors:      []protocol.Error{{Message: err.Error(), Code: protocol.CodeSlowConsumer}},
+		Timestamp:   time.Now().UnixMicro(),
+	})
+}
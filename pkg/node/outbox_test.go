@@ -0,0 +1,174 @@
+package node
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+const (
+	floodCount = 512
+	floodSize  = 64 * 1024
+)
+
+// flood publishes more to the topic than the socket buffers of a
+// subscriber that is not reading hold. It writes in the background since the node may stop reading
+// the publisher.
+func flood(t *testing.T, addr string, topic string) {
+	pub := dial(t, addr)
+	content := make([]byte, floodSize)
+	go func() {
+		for i := 0; i < floodCount; i++ {
+			frame, err := protocol.Serialize(protocol.CBOR, protocol.Message{Id: strconv.Itoa(i), MessageType: protocol.Publish, Topic: topic, Content: content})
+			if err != nil {
+				return
+			}
+			if _, err := pub.conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// slowSubscriber subscribes and then does not read until told to
+func slowSubscriber(t *testing.T, addr string, topic string) *testClient {
+	sub := dial(t, addr)
+	sub.subscribe(topic)
+	return sub
+}
+
+// drain reads messages until the connection closes or nothing arrives for
+// a while
+func (tc *testClient) drain() (msgs []protocol.Message, err error) {
+	for {
+		tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame, err := tc.fr.ReadFrame()
+		if err != nil {
+			return msgs, err
+		}
+
+		var m protocol.Message
+		if err := protocol.CBOR.Unmarshal(frame, &m); err != nil {
+			tc.t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func isNotice(m protocol.Message) bool {
+	return m.MessageType == protocol.Reply && m.Topic == topic.NodeKeyword && len(m.Errors) == 1 && m.Errors[0].Code == protocol.CodeSlowConsumer
+}
+
+func TestSlowConsumer(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{DropNewest, DropOldest, Disconnect} {
+		t.Run(policy.String(), func(t *testing.T) {
+			n, addr := startNode(t, Options{MaxPending: 4, SlowConsumer: policy})
+
+			sub := slowSubscriber(t, addr, "/flood")
+			flood(t, addr, "/flood")
+			waitFor(t, "messages to be dropped", func() bool { return n.Info().Dropped > 0 })
+
+			msgs, err := sub.drain()
+			published, notices := 0, 0
+			for _, m := range msgs {
+				switch {
+				case isNotice(m):
+					if !errors.Is(m.Errors[0].Err(), protocol.ErrorSlowConsumer) {
+						t.Fatalf("unexpected notice %+v", m)
+					}
+					notices++
+				case m.MessageType == protocol.Publish:
+					published++
+				}
+			}
+			if notices == 0 {
+				t.Fatal("the subscriber was not told about the dropped messages")
+			}
+			if published >= floodCount {
+				t.Fatalf("expected messages to be dropped, got all %d", published)
+			}
+
+			switch policy {
+			case DropOldest:
+				// the newest messages are the ones kept
+				last := msgs[len(msgs)-1]
+				if isNotice(last) {
+					last = msgs[len(msgs)-2]
+				}
+				if last.Id != strconv.Itoa(floodCount-1) {
+					t.Fatalf("expected the last message to be delivered, got %q", last.Id)
+				}
+			case Disconnect:
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					t.Fatalf("expected the slow consumer to be disconnected, got %v", err)
+				}
+				if n.metrics.slowConsumers.Value() != 1 {
+					t.Fatalf("expected one disconnect, got %d", n.metrics.slowConsumers.Value())
+				}
+			}
+		})
+	}
+}
+
+func TestBlockPublisher(t *testing.T) {
+	n, addr := startNode(t, Options{MaxPending: 4})
+
+	sub := slowSubscriber(t, addr, "/flood")
+	flood(t, addr, "/flood")
+
+	// the subscriber gets everything, in order, once it reads
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < floodCount; i++ {
+		if m := sub.recv(); m.Id != strconv.Itoa(i) {
+			t.Fatalf("expected message %d, got %+v", i, m)
+		}
+	}
+	if dropped := n.Info().Dropped; dropped != 0 {
+		t.Fatalf("expected nothing to be dropped, got %d", dropped)
+	}
+}
+
+func TestBlockPublisherMaxBlock(t *testing.T) {
+	n, addr := startNode(t, Options{MaxPending: 4, MaxBlock: 100 * time.Millisecond})
+
+	sub := slowSubscriber(t, addr, "/flood")
+	pub := dial(t, addr)
+	content := make([]byte, floodSize)
+	for i := 0; i < floodCount; i++ {
+		pub.send(protocol.Message{Id: strconv.Itoa(i), MessageType: protocol.Publish, Topic: "/flood", Content: content})
+	}
+
+	// the publisher is read again once the subscriber was given up on
+	pub.subscribe("/other")
+	if n.metrics.slowConsumers.Value() != 1 {
+		t.Fatalf("expected one disconnect, got %d", n.metrics.slowConsumers.Value())
+	}
+	if _, err := sub.drain(); !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the slow consumer to be disconnected, got %v", err)
+	}
+}
+
+func TestMaxQueued(t *testing.T) {
+	n, addr := startNode(t, Options{MaxQueued: 8})
+
+	c := dial(t, addr)
+	c.kv(protocol.Put, "$kv/b/big", string(make([]byte, 256*1024)), protocol.Headers{})
+
+	// replies are never dropped, a client that does not read them is closed
+	slow := dial(t, addr)
+	for i := 0; i < 256; i++ {
+		slow.send(protocol.Message{Id: strconv.Itoa(i), MessageType: protocol.Get, Topic: "$kv/b/big", TxId: strconv.Itoa(i)})
+	}
+	waitFor(t, "the client to be closed", func() bool { return n.metrics.slowConsumers.Value() == 1 })
+	// unread replies make the close a reset
+	var netErr net.Error
+	if _, err := slow.drain(); errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("expected the client to be closed, got %v", err)
+	}
+}
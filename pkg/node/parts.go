@@ -0,0 +1,67 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// validatePart holds on to the part until the whole message has arrived and
+// then routes every part in order. Incomplete messages never reach anyone.
+func (n *Node) validatePart(c *conn, msg protocol.Message) {
+	// parts are tracked per connection, ids are only unique per client
+	msg.Headers.ConnId = c.id
+
+	parts, ok, err := n.parts.Collect(msg)
+	if err != nil {
+		code := protocol.CodeIncompleteMessage
+		if errors.Is(err, protocol.ErrorInvalidPart) {
+			code = protocol.CodeMalformedMessage
+		}
+		c.replyError(msg, code, err)
+		return
+	}
+
+	for _, err := range n.parts.Expire() {
+		fmt.Println("dropped incomplete message", err)
+	}
+
+	if !ok {
+		return
+	}
+
+	for _, part := range parts {
+		n.route(c, part)
+	}
+}
+
+func chunkedRequestKey(c *conn, txId string) string {
+	return c.id + "/" + txId
+}
+
+// requestPart forwards a part after the first one of a chunked request to
+// the service that received the first part. Parts of requests that could not
+// be routed are dropped, the requester was already told about it.
+func (n *Node) requestPart(from *conn, msg protocol.Message) {
+	key := chunkedRequestKey(from, msg.TxId)
+	last := msg.Headers.Part == msg.Headers.TotalParts-1
+
+	n.mu.Lock()
+	txId, ok := n.chunkedRequests[key]
+	if last {
+		delete(n.chunkedRequests, key)
+	}
+	req, pending := n.pending[txId]
+	n.mu.Unlock()
+
+	if !ok || !pending {
+		return
+	}
+
+	msg.TxId = txId
+	msg.Headers.ConnId = from.id
+	if err := req.service.send(msg); err != nil {
+		fmt.Println("could not forward request part to", req.service.id, err)
+	}
+}
@@ -0,0 +1,324 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// queue holds enqueued messages until a consumer dequeues and acks them.
+// Messages are handed out in the order they were enqueued, except for
+// messages that come back from a consumer, which go first.
+type queue struct {
+	name  string
+	ready []*queued
+	// receipt -> message a consumer is working on
+	inflight map[string]*queued
+	// dequeues waiting on a message, oldest first
+	waiters []*waiter
+}
+
+type queued struct {
+	msg        protocol.Message
+	deliveries uint32
+	receipt    string
+	consumer   *conn
+	// hands the message back to the queue when the consumer does not ack
+	// it within the visibility timeout
+	timer *time.Timer
+}
+
+// waiter is a dequeue that found the queue empty and waits on a message
+type waiter struct {
+	conn  *conn
+	req   protocol.Message
+	timer *time.Timer
+}
+
+// queueSend is a message to write once the queue lock is released
+type queueSend struct {
+	conn *conn
+	msg  protocol.Message
+}
+
+func (q *queue) empty() bool {
+	return len(q.ready) == 0 && len(q.inflight) == 0 && len(q.waiters) == 0
+}
+
+// deadLetterQueue returns the queue messages of the named queue end up in
+// after too many deliveries, or an empty string for dead letter queues
+func deadLetterQueue(name string) string {
+	if topic.Keyword(name) != "" {
+		return ""
+	}
+	return topic.DeadLetterKeyword + name
+}
+
+// validateQueue checks that the queue may be used. Dead letter queues are the
+// only keyword topics that are queues.
+func validateQueue(name string) error {
+	if kw := topic.Keyword(name); kw != "" && kw != topic.DeadLetterKeyword {
+		return fmt.Errorf("%w: %q is not a queue", topic.ErrorInvalidTopic, name)
+	}
+	return nil
+}
+
+// queueLocked returns the named queue, creating it when it does not exist
+func (n *Node) queueLocked(name string) *queue {
+	q, ok := n.queues[name]
+	if !ok {
+		q = &queue{name: name, inflight: map[string]*queued{}}
+		n.queues[name] = q
+	}
+	return q
+}
+
+// dropIfEmptyLocked forgets queues that hold nothing
+func (n *Node) dropIfEmptyLocked(q *queue) {
+	if q.empty() {
+		delete(n.queues, q.name)
+	}
+}
+
+func (n *Node) nextReceipt() string {
+	return "r-" + strconv.FormatUint(n.lastReceipt.Add(1), 10)
+}
+
+func (n *Node) sendAll(sends []queueSend) {
+	for _, s := range sends {
+		if err := s.conn.send(s.msg); err != nil {
+			fmt.Println("could not deliver queued message to", s.conn.id, err)
+		}
+	}
+}
+
+func (n *Node) enqueue(from *conn, msg protocol.Message) {
+	// the parts would end up with different consumers
+	if msg.IsPart() {
+		from.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: queued messages have to fit in one frame", protocol.ErrorMalformedMessage))
+		return
+	}
+
+	msg.Headers.ConnId = from.id
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixMicro()
+	}
+
+	n.qmu.Lock()
+	q := n.queueLocked(msg.Topic)
+	if n.opts.MaxQueueLength > 0 && len(q.ready)+len(q.inflight) >= n.opts.MaxQueueLength {
+		n.dropIfEmptyLocked(q)
+		n.qmu.Unlock()
+		from.replyError(msg, protocol.CodeQueueFull, protocol.ErrorQueueFull)
+		return
+	}
+	sends := n.pushLocked(q, &queued{msg: msg}, false)
+	n.qmu.Unlock()
+
+	n.sendAll(sends)
+	from.ack(msg)
+}
+
+// dequeue hands the next message of the queue to the connection. When the
+// queue is empty the dequeue waits up to Headers.Wait milliseconds for one.
+func (n *Node) dequeue(c *conn, msg protocol.Message) {
+	if msg.TxId == "" {
+		c.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: dequeue without tx_id", protocol.ErrorMalformedMessage))
+		return
+	}
+
+	n.qmu.Lock()
+	q := n.queueLocked(msg.Topic)
+
+	if len(q.ready) > 0 {
+		item := q.ready[0]
+		q.ready[0] = nil
+		q.ready = q.ready[1:]
+		rep := n.deliverLocked(q, item, c, msg)
+		n.qmu.Unlock()
+
+		n.sendAll([]queueSend{{c, rep}})
+		return
+	}
+
+	if msg.Headers.Wait == 0 {
+		n.dropIfEmptyLocked(q)
+		n.qmu.Unlock()
+		c.replyError(msg, protocol.CodeQueueEmpty, protocol.ErrorQueueEmpty)
+		return
+	}
+
+	w := &waiter{conn: c, req: msg}
+	w.timer = time.AfterFunc(time.Duration(msg.Headers.Wait)*time.Millisecond, func() {
+		n.expireWaiter(q.name, w)
+	})
+	q.waiters = append(q.waiters, w)
+	n.qmu.Unlock()
+}
+
+// expireWaiter tells a dequeue that nothing arrived while it waited
+func (n *Node) expireWaiter(name string, w *waiter) {
+	n.qmu.Lock()
+	q, ok := n.queues[name]
+	if !ok || !removeWaiter(q, w) {
+		// a message was handed to it in the meantime
+		n.qmu.Unlock()
+		return
+	}
+	n.dropIfEmptyLocked(q)
+	n.qmu.Unlock()
+
+	w.conn.replyError(w.req, protocol.CodeQueueEmpty, protocol.ErrorQueueEmpty)
+}
+
+func removeWaiter(q *queue, w *waiter) bool {
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pushLocked hands the message to the oldest waiting dequeue or adds it to
+// the queue. Messages coming back from a consumer go to the front.
+func (n *Node) pushLocked(q *queue, item *queued, front bool) []queueSend {
+	if len(q.waiters) > 0 {
+		w := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		w.timer.Stop()
+		return []queueSend{{w.conn, n.deliverLocked(q, item, w.conn, w.req)}}
+	}
+
+	if front {
+		q.ready = append([]*queued{item}, q.ready...)
+	} else {
+		q.ready = append(q.ready, item)
+	}
+	return nil
+}
+
+// deliverLocked marks the message as being worked on by the connection and
+// returns the reply to its dequeue
+func (n *Node) deliverLocked(q *queue, item *queued, c *conn, req protocol.Message) protocol.Message {
+	item.deliveries++
+	item.receipt = n.nextReceipt()
+	item.consumer = c
+	q.inflight[item.receipt] = item
+
+	receipt := item.receipt
+	item.timer = time.AfterFunc(n.opts.QueueVisibilityTimeout, func() {
+		n.redeliver(q.name, receipt)
+	})
+
+	rep := item.msg
+	rep.MessageType = protocol.Reply
+	rep.Topic = q.name
+	rep.TxId = req.TxId
+	rep.Headers.Receipt = item.receipt
+	rep.Headers.Deliveries = item.deliveries
+	return rep
+}
+
+// returnLocked hands a message the consumer gave up on back to its queue, or
+// to the dead letter queue once it was delivered too often
+func (n *Node) returnLocked(q *queue, item *queued) []queueSend {
+	item.timer.Stop()
+	delete(q.inflight, item.receipt)
+	item.receipt = ""
+	item.consumer = nil
+
+	dlq := deadLetterQueue(q.name)
+	if dlq != "" && item.deliveries >= uint32(n.opts.QueueMaxDeliveries) {
+		fmt.Println("dead lettering message", item.msg.Id, "of", q.name, "after", item.deliveries, "deliveries")
+		item.deliveries = 0
+		sends := n.pushLocked(n.queueLocked(dlq), item, false)
+		n.dropIfEmptyLocked(q)
+		return sends
+	}
+
+	return n.pushLocked(q, item, true)
+}
+
+// redeliver returns a message whose visibility timeout ran out
+func (n *Node) redeliver(name string, receipt string) {
+	n.qmu.Lock()
+	q, ok := n.queues[name]
+	if !ok {
+		n.qmu.Unlock()
+		return
+	}
+	item, ok := q.inflight[receipt]
+	if !ok {
+		// acked or nacked in the meantime
+		n.qmu.Unlock()
+		return
+	}
+	sends := n.returnLocked(q, item)
+	n.qmu.Unlock()
+
+	n.sendAll(sends)
+}
+
+// settle acks or nacks the message with the receipt of the request
+func (n *Node) settle(c *conn, msg protocol.Message) {
+	n.qmu.Lock()
+	q, ok := n.queues[msg.Topic]
+	var item *queued
+	if ok {
+		item = q.inflight[msg.Headers.Receipt]
+	}
+	if item == nil || item.consumer != c {
+		n.qmu.Unlock()
+		c.replyError(msg, protocol.CodeUnknownReceipt, protocol.ErrorUnknownReceipt)
+		return
+	}
+
+	var sends []queueSend
+	if msg.MessageType == protocol.Ack {
+		item.timer.Stop()
+		delete(q.inflight, item.receipt)
+		n.dropIfEmptyLocked(q)
+	} else {
+		sends = n.returnLocked(q, item)
+	}
+	n.qmu.Unlock()
+
+	n.sendAll(sends)
+	c.ack(msg)
+}
+
+// releaseQueues hands back every message the connection was working on and
+// drops its waiting dequeues
+func (n *Node) releaseQueues(c *conn) {
+	var sends []queueSend
+
+	n.qmu.Lock()
+	// waiters go first so that no message is handed back to this connection
+	for _, q := range n.queues {
+		for i := 0; i < len(q.waiters); i++ {
+			if w := q.waiters[i]; w.conn == c {
+				w.timer.Stop()
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				i--
+			}
+		}
+	}
+	for _, q := range n.queues {
+		for _, item := range q.inflight {
+			if item.consumer == c {
+				sends = append(sends, n.returnLocked(q, item)...)
+			}
+		}
+	}
+	for _, q := range n.queues {
+		n.dropIfEmptyLocked(q)
+	}
+	n.qmu.Unlock()
+
+	n.sendAll(sends)
+}
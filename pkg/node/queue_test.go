@@ -0,0 +1,171 @@
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+func (tc *testClient) enqueue(queue string, content string) {
+	tc.t.Helper()
+
+	tc.send(protocol.Message{Id: content, MessageType: protocol.Enqueue, Topic: queue, TxId: "enq-" + content, Content: []byte(content)})
+	if rep := tc.recv(); rep.TxId != "enq-"+content || len(rep.Errors) != 0 {
+		tc.t.Fatalf("unexpected enqueue reply %+v", rep)
+	}
+}
+
+// dequeue sends a dequeue that waits up to wait on the node and returns the
+// reply
+func (tc *testClient) dequeue(queue string, wait time.Duration) protocol.Message {
+	tc.t.Helper()
+
+	tc.send(protocol.Message{Id: "d", MessageType: protocol.Dequeue, Topic: queue, TxId: "deq", Headers: protocol.Headers{Wait: uint32(wait / time.Millisecond)}})
+	rep := tc.recv()
+	if rep.MessageType != protocol.Reply || rep.TxId != "deq" {
+		tc.t.Fatalf("unexpected dequeue reply %+v", rep)
+	}
+	return rep
+}
+
+func (tc *testClient) settle(msgType protocol.MessageType, rep protocol.Message) error {
+	tc.t.Helper()
+
+	tc.send(protocol.Message{Id: "s", MessageType: msgType, Topic: rep.Topic, TxId: "settle", Headers: protocol.Headers{Receipt: rep.Headers.Receipt}})
+	ack := tc.recv()
+	if ack.TxId != "settle" {
+		tc.t.Fatalf("unexpected settle reply %+v", ack)
+	}
+	if len(ack.Errors) > 0 {
+		return ack.Errors[0].Err()
+	}
+	return nil
+}
+
+func expectQueued(t *testing.T, rep protocol.Message, content string, deliveries uint32) {
+	t.Helper()
+
+	if len(rep.Errors) != 0 || string(rep.Content) != content || rep.Headers.Receipt == "" || rep.Headers.Deliveries != deliveries {
+		t.Fatalf("expected %q on delivery %d, got %+v", content, deliveries, rep)
+	}
+}
+
+func TestQueueCompetingConsumers(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	producer := dial(t, addr)
+	c1 := dial(t, addr)
+	c2 := dial(t, addr)
+
+	if rep := c1.dequeue("/jobs", 0); len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorQueueEmpty) {
+		t.Fatalf("expected empty queue, got %+v", rep)
+	}
+
+	producer.enqueue("/jobs", "1")
+	producer.enqueue("/jobs", "2")
+	producer.enqueue("/jobs", "3")
+
+	m1 := c1.dequeue("/jobs", 0)
+	expectQueued(t, m1, "1", 1)
+	m2 := c2.dequeue("/jobs", 0)
+	expectQueued(t, m2, "2", 1)
+	if m1.Headers.ConnId == "" || m1.Headers.Receipt == m2.Headers.Receipt {
+		t.Fatalf("unexpected headers %+v and %+v", m1.Headers, m2.Headers)
+	}
+
+	if err := c1.settle(protocol.Ack, m1); err != nil {
+		t.Fatal(err)
+	}
+	// receipts are tied to the consumer and only good once
+	if err := c2.settle(protocol.Ack, m1); !errors.Is(err, protocol.ErrorUnknownReceipt) {
+		t.Fatalf("expected unknown receipt, got %v", err)
+	}
+	if err := c1.settle(protocol.Ack, m2); !errors.Is(err, protocol.ErrorUnknownReceipt) {
+		t.Fatalf("expected unknown receipt, got %v", err)
+	}
+
+	// a nacked message goes ahead of the rest
+	if err := c2.settle(protocol.Nack, m2); err != nil {
+		t.Fatal(err)
+	}
+	expectQueued(t, c1.dequeue("/jobs", 0), "2", 2)
+	expectQueued(t, c1.dequeue("/jobs", 0), "3", 1)
+
+	// a waiting dequeue gets the next message enqueued
+	c2.send(protocol.Message{Id: "d", MessageType: protocol.Dequeue, Topic: "/jobs", TxId: "deq", Headers: protocol.Headers{Wait: 2000}})
+	time.Sleep(20 * time.Millisecond)
+	producer.enqueue("/jobs", "4")
+	expectQueued(t, c2.recv(), "4", 1)
+
+	start := time.Now()
+	if rep := c2.dequeue("/jobs", 50*time.Millisecond); len(rep.Errors) != 1 || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expected dequeue to wait and come back empty, got %+v", rep)
+	}
+}
+
+func TestQueueRedelivery(t *testing.T) {
+	_, addr := startNode(t, Options{QueueVisibilityTimeout: 50 * time.Millisecond})
+
+	producer := dial(t, addr)
+	c1 := dial(t, addr)
+	c2 := dial(t, addr)
+
+	producer.enqueue("/jobs", "slow")
+	m := c1.dequeue("/jobs", 0)
+	expectQueued(t, m, "slow", 1)
+
+	// not acked within the visibility timeout
+	expectQueued(t, c2.dequeue("/jobs", time.Second), "slow", 2)
+	if err := c1.settle(protocol.Ack, m); !errors.Is(err, protocol.ErrorUnknownReceipt) {
+		t.Fatalf("expected expired receipt, got %v", err)
+	}
+
+	// messages of a consumer that goes away are handed out again
+	c2.conn.Close()
+	expectQueued(t, c1.dequeue("/jobs", time.Second), "slow", 3)
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	n, addr := startNode(t, Options{QueueMaxDeliveries: 2, MaxQueueLength: 1})
+
+	producer := dial(t, addr)
+	consumer := dial(t, addr)
+
+	producer.enqueue("/jobs", "poison")
+	producer.send(protocol.Message{Id: "full", MessageType: protocol.Enqueue, Topic: "/jobs", TxId: "full"})
+	if rep := producer.recv(); len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorQueueFull) {
+		t.Fatalf("expected full queue, got %+v", rep)
+	}
+
+	for i := uint32(1); i <= 2; i++ {
+		m := consumer.dequeue("/jobs", 0)
+		expectQueued(t, m, "poison", i)
+		if err := consumer.settle(protocol.Nack, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rep := consumer.dequeue("/jobs", 0); len(rep.Errors) != 1 {
+		t.Fatalf("expected message to be dead lettered, got %+v", rep)
+	}
+	m := consumer.dequeue("$dlq/jobs", 0)
+	expectQueued(t, m, "poison", 1)
+	if err := consumer.settle(protocol.Ack, m); err != nil {
+		t.Fatal(err)
+	}
+
+	n.qmu.Lock()
+	queues := len(n.queues)
+	n.qmu.Unlock()
+	if queues != 0 {
+		t.Fatalf("expected empty queues to be dropped, %d left", queues)
+	}
+
+	// other keywords are not queues
+	producer.send(protocol.Message{Id: "kw", MessageType: protocol.Enqueue, Topic: "$node", TxId: "kw"})
+	if rep := producer.recv(); len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorMalformedMessage) {
+		t.Fatalf("expected malformed message, got %+v", rep)
+	}
+}
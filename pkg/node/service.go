@@ -0,0 +1,265 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// service is a topic advertised by one or more connections. Requests are
+// handed to the advertisers in round robin order.
+type service struct {
+	conns []*conn
+	next  int
+}
+
+// pickServiceLocked picks the connection to hand a request with the path
+// to. Clients of this node take turns and go before peers, of the peers the
+// one closest to an advertiser is picked. Nil is returned when the request
+// can not go anywhere without running in circles.
+func (n *Node) pickServiceLocked(svc *service, topic string, path []string) *conn {
+	var local []*conn
+	var closest *conn
+	for _, c := range svc.conns {
+		if c.link == nil {
+			local = append(local, c)
+			continue
+		}
+		if !n.canForward(c, topic, path) {
+			continue
+		}
+		if closest == nil || len(c.link.svcPaths[topic]) < len(closest.link.svcPaths[topic]) {
+			closest = c
+		}
+	}
+
+	if len(local) > 0 {
+		c := local[svc.next%len(local)]
+		svc.next++
+		return c
+	}
+	return closest
+}
+
+// pendingRequest is a request that was forwarded to a service and is waiting
+// on its reply
+type pendingRequest struct {
+	requester *conn
+	service   *conn
+	// tx id the requester used, restored on the reply
+	txId  string
+	topic string
+	// expires the request when the service does not reply in time
+	timer *time.Timer
+}
+
+func (n *Node) advertise(c *conn, topic string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.advertiseLocked(c, topic)
+}
+
+func (n *Node) advertiseLocked(c *conn, topic string) {
+	if _, ok := c.services[topic]; ok {
+		return
+	}
+
+	svc, ok := n.services[topic]
+	if !ok {
+		svc = &service{}
+		n.services[topic] = svc
+	}
+	svc.conns = append(svc.conns, c)
+	c.services[topic] = struct{}{}
+}
+
+func (n *Node) unadvertise(c *conn, topic string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.unadvertiseLocked(c, topic)
+}
+
+func (n *Node) unadvertiseLocked(c *conn, topic string) {
+	if _, ok := c.services[topic]; !ok {
+		return
+	}
+	delete(c.services, topic)
+	if c.link != nil {
+		delete(c.link.svcPaths, topic)
+	}
+
+	svc := n.services[topic]
+	for i, sc := range svc.conns {
+		if sc == c {
+			svc.conns = append(svc.conns[:i], svc.conns[i+1:]...)
+			break
+		}
+	}
+	if len(svc.conns) == 0 {
+		delete(n.services, topic)
+	}
+}
+
+// request forwards the message to a connection advertising its topic, which
+// may be a peer that can reach the service. The tx id is swapped for one
+// generated by the node so that requests from different clients can never
+// collide.
+func (n *Node) request(from *conn, msg protocol.Message) {
+	if msg.TxId == "" {
+		from.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: request without tx_id", protocol.ErrorMalformedMessage))
+		return
+	}
+
+	if msg.IsPart() && msg.Headers.Part > 0 {
+		n.requestPart(from, msg)
+		return
+	}
+
+	orig := msg
+	if !n.traverse(from, &msg) {
+		from.replyError(orig, protocol.CodeServiceTopicNotFound, fmt.Errorf("%w: request went in circles", protocol.ErrorServiceTopicNotFound))
+		return
+	}
+
+	n.mu.Lock()
+	var target *conn
+	if svc, ok := n.services[msg.Topic]; ok {
+		target = n.pickServiceLocked(svc, msg.Topic, msg.Headers.Path)
+	}
+	if target == nil {
+		n.mu.Unlock()
+		from.replyError(orig, protocol.CodeServiceTopicNotFound, protocol.ErrorServiceTopicNotFound)
+		return
+	}
+
+	txId := n.nextTxId()
+	n.pending[txId] = &pendingRequest{
+		requester: from,
+		service:   target,
+		txId:      msg.TxId,
+		topic:     msg.Topic,
+		timer:     time.AfterFunc(n.opts.RequestTimeout, func() { n.expireRequest(txId) }),
+	}
+	if msg.IsPart() {
+		n.chunkedRequests[chunkedRequestKey(from, msg.TxId)] = txId
+	}
+	n.mu.Unlock()
+
+	msg.TxId = txId
+	if from.link == nil {
+		msg.Headers.ConnId = from.id
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixMicro()
+	}
+
+	if err := target.send(msg); err != nil {
+		n.mu.Lock()
+		n.forgetRequestLocked(txId)
+		n.mu.Unlock()
+
+		fmt.Println("could not forward request to", target.id, err)
+		from.replyError(orig, protocol.CodeCouldNotHandleMessage, protocol.ErrorCouldNotHandleMessage)
+	}
+}
+
+// reply routes a reply from a service back to the connection that made the
+// request. The request stops pending with the last part of a chunked reply.
+func (n *Node) reply(from *conn, msg protocol.Message) {
+	n.mu.Lock()
+	req, ok := n.pending[msg.TxId]
+	if !ok || req.service != from {
+		n.mu.Unlock()
+		// answering a peer would have it answer the answer
+		if from.link != nil {
+			fmt.Println("dropped reply from peer", from.link.nodeId, "tx_id", msg.TxId, msg.Errors)
+			return
+		}
+		from.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: no pending request for tx_id %q", protocol.ErrorMalformedMessage, msg.TxId))
+		return
+	}
+	if !msg.IsPart() || msg.Headers.Part == msg.Headers.TotalParts-1 {
+		n.forgetRequestLocked(msg.TxId)
+	} else {
+		// a chunked reply has as long for every part
+		req.timer.Reset(n.opts.RequestTimeout)
+	}
+	n.mu.Unlock()
+
+	msg.TxId = req.txId
+	if from.link == nil {
+		msg.Headers.ConnId = from.id
+	}
+	if err := req.requester.send(msg); err != nil {
+		fmt.Println("could not deliver reply to", req.requester.id, err)
+	}
+}
+
+// dropPendingLocked forgets every pending request made by or waiting on the
+// connection. The requests that were waiting on it are returned so that the
+// requesters can be told their service went away.
+func (n *Node) dropPendingLocked(c *conn) []*pendingRequest {
+	var orphaned []*pendingRequest
+	for txId, req := range n.pending {
+		if req.requester == c || req.service == c {
+			req.timer.Stop()
+			delete(n.pending, txId)
+		}
+		if req.service == c && req.requester != c {
+			orphaned = append(orphaned, req)
+		}
+	}
+	for key, txId := range n.chunkedRequests {
+		if _, ok := n.pending[txId]; !ok {
+			delete(n.chunkedRequests, key)
+		}
+	}
+	return orphaned
+}
+
+// expireRequest tells the requester that the service did not reply in time
+// and forgets the request, a reply arriving later has nowhere to go
+func (n *Node) expireRequest(txId string) {
+	n.mu.Lock()
+	req, ok := n.pending[txId]
+	if !ok {
+		n.mu.Unlock()
+		return
+	}
+	n.forgetRequestLocked(txId)
+	n.mu.Unlock()
+
+	fmt.Println("request", txId, "to", req.service.id, "timed out")
+	req.requester.replyError(
+		protocol.Message{Topic: req.topic, TxId: req.txId},
+		protocol.CodeRequestTimeout,
+		protocol.ErrorRequestTimeout,
+	)
+}
+
+// forgetRequestLocked stops waiting on the reply to the request, including
+// the parts of it the requester has yet to send
+func (n *Node) forgetRequestLocked(txId string) {
+	req, ok := n.pending[txId]
+	if !ok {
+		return
+	}
+	req.timer.Stop()
+	delete(n.pending, txId)
+
+	key := chunkedRequestKey(req.requester, req.txId)
+	if n.chunkedRequests[key] == txId {
+		delete(n.chunkedRequests, key)
+	}
+}
+
+func (req *pendingRequest) fail(err error) {
+	req.requester.replyError(
+		protocol.Message{Topic: req.topic, TxId: req.txId},
+		protocol.CodeCouldNotHandleMessage,
+		err,
+	)
+}
@@ -0,0 +1,123 @@
+package node
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+func (tc *testClient) advertise(topic string) {
+	tc.t.Helper()
+
+	tc.send(protocol.Message{Id: "a", MessageType: protocol.Advertise, Topic: topic, TxId: "adv-" + topic})
+	if rep := tc.recv(); rep.MessageType != protocol.Reply || len(rep.Errors) != 0 {
+		tc.t.Fatalf("unexpected advertise reply %+v", rep)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	svc := dial(t, addr)
+	svc.advertise("/echo")
+
+	// two requesters using the same tx id must not see each other's replies
+	req1 := dial(t, addr)
+	req2 := dial(t, addr)
+	req1.send(protocol.Message{Id: "1", MessageType: protocol.Request, Topic: "/echo", TxId: "tx", Content: []byte("one")})
+	req2.send(protocol.Message{Id: "1", MessageType: protocol.Request, Topic: "/echo", TxId: "tx", Content: []byte("two")})
+
+	for i := 0; i < 2; i++ {
+		req := svc.recv()
+		if req.MessageType != protocol.Request || req.TxId == "tx" {
+			t.Fatalf("unexpected request %+v", req)
+		}
+		svc.send(protocol.Message{Id: "r", MessageType: protocol.Reply, Topic: req.Topic, TxId: req.TxId, Content: req.Content})
+	}
+
+	for want, c := range map[string]*testClient{"one": req1, "two": req2} {
+		rep := c.recv()
+		if rep.MessageType != protocol.Reply || rep.TxId != "tx" || string(rep.Content) != want {
+			t.Fatalf("unexpected reply %+v, want content %q", rep, want)
+		}
+	}
+}
+
+func TestRequestServiceNotFound(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	req := dial(t, addr)
+	req.send(protocol.Message{Id: "1", MessageType: protocol.Request, Topic: "/nobody", TxId: "tx"})
+
+	rep := req.recv()
+	if rep.TxId != "tx" || len(rep.Errors) != 1 || rep.Errors[0].Code != protocol.CodeServiceTopicNotFound {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+	if !errors.Is(rep.Errors[0].Err(), protocol.ErrorServiceTopicNotFound) {
+		t.Fatalf("unexpected error %v", rep.Errors[0].Err())
+	}
+}
+
+func TestUnadvertiseAndServiceDisconnect(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	svc := dial(t, addr)
+	svc.advertise("/svc")
+	svc.send(protocol.Message{Id: "u", MessageType: protocol.Unadvertise, Topic: "/svc", TxId: "unadv"})
+	svc.recv()
+
+	req := dial(t, addr)
+	req.send(protocol.Message{Id: "1", MessageType: protocol.Request, Topic: "/svc", TxId: "tx1"})
+	if rep := req.recv(); len(rep.Errors) != 1 || rep.Errors[0].Code != protocol.CodeServiceTopicNotFound {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+
+	// a service going away answers the requests it never replied to
+	svc.advertise("/svc")
+	req.send(protocol.Message{Id: "2", MessageType: protocol.Request, Topic: "/svc", TxId: "tx2"})
+	svc.recv()
+	svc.conn.Close()
+
+	rep := req.recv()
+	if rep.TxId != "tx2" || len(rep.Errors) != 1 || rep.Errors[0].Code != protocol.CodeCouldNotHandleMessage {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	n, addr := startNode(t, Options{RequestTimeout: 100 * time.Millisecond})
+
+	svc := dial(t, addr)
+	svc.advertise("/slow")
+
+	// a service that never replies holds up neither the requester nor the
+	// node, chunked requests included
+	req := dial(t, addr)
+	req.send(protocol.Message{Id: "1", MessageType: protocol.Request, Topic: "/slow", TxId: "tx"})
+	req.send(protocol.Message{Id: "2", MessageType: protocol.Request, Topic: "/slow", TxId: "chunked", Headers: protocol.Headers{Part: 0, TotalParts: 2}, Content: []byte("half")})
+
+	for range 2 {
+		rep := req.recv()
+		if rep.TxId != "tx" && rep.TxId != "chunked" || len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorRequestTimeout) {
+			t.Fatalf("unexpected reply %+v", rep)
+		}
+	}
+
+	n.mu.RLock()
+	pending, chunked := len(n.pending), len(n.chunkedRequests)
+	n.mu.RUnlock()
+	if pending != 0 || chunked != 0 {
+		t.Fatalf("expected the requests to be forgotten, %d pending and %d chunked", pending, chunked)
+	}
+
+	// the reply is too late
+	first := svc.recv()
+	svc.send(protocol.Message{Id: "r", MessageType: protocol.Reply, Topic: first.Topic, TxId: first.TxId})
+	svc.recv()
+	if rep := svc.recv(); len(rep.Errors) != 1 || rep.Errors[0].Code != protocol.CodeMalformedMessage {
+		t.Fatalf("expected the late reply to be refused, got %+v", rep)
+	}
+	req.expectNothing(100 * time.Millisecond)
+}
@@ -0,0 +1,198 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+// ErrorNodeClosed is returned by Serve and friends once the node shut down
+var ErrorNodeClosed = errors.New("node closed")
+
+// drainInterval is how often Shutdown checks whether the node drained
+const drainInterval = 10 * time.Millisecond
+
+// Start listens on the tcp address and serves connections in the background
+// until the node shuts down. It returns once the node is listening, ctx only
+// bounds how long that may take.
+func (n *Node) Start(ctx context.Context, addr string) error {
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !n.track(listener) {
+		listener.Close()
+		return ErrorNodeClosed
+	}
+
+	fmt.Printf("node %s listening on %s accepting %v (tls: %v)\n", n.Id(), listener.Addr(), n.hello.Codecs, n.opts.TLSConfig != nil)
+
+	go func() {
+		if err := n.serve(listener); !errors.Is(err, ErrorNodeClosed) {
+			fmt.Println("node", n.Id(), "stopped serving", listener.Addr(), err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address of the first listener the node serves, nil when
+// it serves none
+func (n *Node) Addr() net.Addr {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if len(n.listeners) == 0 {
+		return nil
+	}
+	return n.listeners[0].Addr()
+}
+
+// track adds a listener for Shutdown to close, it reports false when the
+// node shut down already
+func (n *Node) track(listener net.Listener) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closing.Load() {
+		return false
+	}
+	n.listeners = append(n.listeners, listener)
+	return true
+}
+
+// Shutdown stops accepting connections, tells the clients the node shuts
+// down and waits for the replies to pending requests, the acks of dequeued
+// messages and what waits to be written to drain before it closes every
+// connection. New requests, dequeues and streams are refused meanwhile.
+// When ctx is done first the connections are closed right away and its
+// error is returned.
+func (n *Node) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	if n.closing.Load() {
+		n.mu.Unlock()
+		return ErrorNodeClosed
+	}
+	n.closing.Store(true)
+	listeners := n.listeners
+	var clients []*conn
+	for _, c := range n.conns {
+		if c.established && c.link == nil {
+			clients = append(clients, c)
+		}
+	}
+	metricsServer := n.metricsServer
+	n.mu.Unlock()
+
+	fmt.Println("node", n.Id(), "shutting down")
+
+	close(n.done)
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	if n.members != nil {
+		n.members.Leave()
+		n.members.Close()
+	}
+
+	for _, c := range clients {
+		c.send(protocol.Message{
+			Id:          n.nextMessageId(),
+			MessageType: protocol.Shutdown,
+			Topic:       topic.NodeKeyword,
+			Timestamp:   time.Now().UnixMicro(),
+		})
+	}
+
+	err := n.drain(ctx)
+
+	n.mu.RLock()
+	conns := make([]*conn, 0, len(n.conns))
+	for _, c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.mu.RUnlock()
+
+	for _, c := range conns {
+		if err != nil {
+			c.nc.Close()
+		} else {
+			c.closeWhenWritten()
+		}
+	}
+	n.connWg.Wait()
+
+	return err
+}
+
+// drain waits until nothing is in flight anymore or ctx is done
+func (n *Node) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for !n.drained() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// drained reports whether no request waits on a reply, no dequeued message
+// on an ack and no connection on frames to be written
+func (n *Node) drained() bool {
+	n.mu.RLock()
+	pending := len(n.pending)
+	conns := make([]*conn, 0, len(n.conns))
+	for _, c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.mu.RUnlock()
+
+	if pending > 0 {
+		return false
+	}
+
+	n.qmu.Lock()
+	inflight := 0
+	for _, q := range n.queues {
+		inflight += len(q.inflight)
+	}
+	n.qmu.Unlock()
+
+	if inflight > 0 {
+		return false
+	}
+
+	for _, c := range conns {
+		if c.pending() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// refuseWhileClosing refuses messages that start work the node would have to
+// wait on while it shuts down
+func (n *Node) refuseWhileClosing(c *conn, msg protocol.Message) bool {
+	if !n.closing.Load() {
+		return false
+	}
+
+	switch msg.MessageType {
+	case protocol.Request, protocol.Dequeue, protocol.StreamOpen:
+		c.replyError(msg, protocol.CodeShuttingDown, protocol.ErrorShuttingDown)
+		return true
+	}
+	return false
+}
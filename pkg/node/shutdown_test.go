@@ -0,0 +1,97 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+	"github.com/bahodge/kgpmp-prototype/pkg/topic"
+)
+
+func shutdownAsync(n *Node, timeout time.Duration) chan error {
+	errc := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		errc <- n.Shutdown(ctx)
+	}()
+	return errc
+}
+
+func (tc *testClient) expectShutdown() {
+	tc.t.Helper()
+
+	if m := tc.recv(); m.MessageType != protocol.Shutdown || m.Topic != topic.NodeKeyword {
+		tc.t.Fatalf("expected the node to announce its shutdown, got %+v", m)
+	}
+}
+
+func (tc *testClient) expectClosed() {
+	tc.t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tc.fr.ReadFrame(); !errors.Is(err, io.EOF) {
+		tc.t.Fatalf("expected the node to close the connection, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	n, addr := startNode(t, Options{})
+
+	svc := dial(t, addr)
+	svc.advertise("/echo")
+	req := dial(t, addr)
+	req.send(protocol.Message{Id: "1", MessageType: protocol.Request, Topic: "/echo", TxId: "before", Content: []byte("hi")})
+	forwarded := svc.recv()
+
+	errc := shutdownAsync(n, 5*time.Second)
+	svc.expectShutdown()
+	req.expectShutdown()
+
+	// new requests are refused while the one in flight may finish
+	req.send(protocol.Message{Id: "2", MessageType: protocol.Request, Topic: "/echo", TxId: "after"})
+	if rep := req.recv(); rep.TxId != "after" || len(rep.Errors) != 1 || !errors.Is(rep.Errors[0].Err(), protocol.ErrorShuttingDown) {
+		t.Fatalf("expected the request to be refused, got %+v", rep)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("expected the node to stop accepting connections")
+	}
+
+	svc.send(protocol.Message{Id: "r", MessageType: protocol.Reply, Topic: forwarded.Topic, TxId: forwarded.TxId, Content: forwarded.Content})
+	if rep := req.recv(); rep.TxId != "before" || string(rep.Content) != "hi" {
+		t.Fatalf("unexpected reply %+v", rep)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	req.expectClosed()
+	svc.expectClosed()
+
+	if err := n.Start(context.Background(), "127.0.0.1:0"); !errors.Is(err, ErrorNodeClosed) {
+		t.Fatalf("expected a closed node not to start again, got %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	n, addr := startNode(t, Options{})
+
+	producer := dial(t, addr)
+	producer.enqueue("/jobs", "a")
+	consumer := dial(t, addr)
+	if rep := consumer.dequeue("/jobs", 0); string(rep.Content) != "a" {
+		t.Fatalf("unexpected dequeue reply %+v", rep)
+	}
+
+	// the consumer never acks, the node gives up on it at the deadline
+	errc := shutdownAsync(n, 100*time.Millisecond)
+	consumer.expectShutdown()
+	if err := <-errc; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the shutdown to run out of time, got %v", err)
+	}
+	consumer.expectClosed()
+}
@@ -0,0 +1,134 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// streamEnd is one end of a stream, the connection and the id it knows the
+// stream by
+type streamEnd struct {
+	conn *conn
+	id   string
+}
+
+func (n *Node) nextStreamId() string {
+	return "node-" + strconv.FormatUint(n.lastStreamId.Add(1), 10)
+}
+
+// openStream connects the stream to a connection advertising its topic. The
+// node only routes stream frames, the windows are kept by the two ends.
+func (n *Node) openStream(from *conn, msg protocol.Message) {
+	if msg.Headers.StreamId == "" {
+		from.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: stream open without stream_id", protocol.ErrorMalformedMessage))
+		return
+	}
+
+	opener := streamEnd{from, msg.Headers.StreamId}
+	open := msg
+	if !n.traverse(from, &open) {
+		from.replyError(msg, protocol.CodeServiceTopicNotFound, fmt.Errorf("%w: stream went in circles", protocol.ErrorServiceTopicNotFound))
+		return
+	}
+
+	n.mu.Lock()
+	if _, ok := n.streams[opener]; ok {
+		n.mu.Unlock()
+		from.replyError(msg, protocol.CodeMalformedMessage, fmt.Errorf("%w: stream_id %q is in use", protocol.ErrorMalformedMessage, opener.id))
+		return
+	}
+	var target *conn
+	if svc, ok := n.services[msg.Topic]; ok {
+		target = n.pickServiceLocked(svc, msg.Topic, open.Headers.Path)
+	}
+	if target == nil {
+		n.mu.Unlock()
+		from.replyError(msg, protocol.CodeServiceTopicNotFound, protocol.ErrorServiceTopicNotFound)
+		return
+	}
+	acceptor := streamEnd{target, n.nextStreamId()}
+	n.streams[opener] = acceptor
+	n.streams[acceptor] = opener
+	n.mu.Unlock()
+
+	open.TxId = ""
+	open.Headers.StreamId = acceptor.id
+	if from.link == nil {
+		open.Headers.ConnId = from.id
+	}
+	if open.Timestamp == 0 {
+		open.Timestamp = time.Now().UnixMicro()
+	}
+
+	if err := acceptor.conn.send(open); err != nil {
+		n.mu.Lock()
+		delete(n.streams, opener)
+		delete(n.streams, acceptor)
+		n.mu.Unlock()
+
+		fmt.Println("could not open stream to", acceptor.conn.id, err)
+		from.replyError(msg, protocol.CodeCouldNotHandleMessage, protocol.ErrorCouldNotHandleMessage)
+		return
+	}
+
+	from.ack(msg)
+}
+
+// forwardStream hands data, window updates and closes to the other end of
+// the stream. Frames of streams that are already closed are dropped, the
+// other end may have closed it while they were on the way.
+func (n *Node) forwardStream(from *conn, msg protocol.Message) {
+	n.mu.Lock()
+	peer, ok := n.streams[streamEnd{from, msg.Headers.StreamId}]
+	if ok && msg.MessageType == protocol.StreamClose {
+		delete(n.streams, streamEnd{from, msg.Headers.StreamId})
+		delete(n.streams, peer)
+	}
+	n.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	msg.Headers.StreamId = peer.id
+	if from.link == nil {
+		msg.Headers.ConnId = from.id
+	}
+	if err := peer.conn.send(msg); err != nil {
+		fmt.Println("could not forward stream frame to", peer.conn.id, err)
+	}
+}
+
+// dropStreamsLocked forgets every stream of the connection and returns the
+// other ends, which have to be told that the stream is gone
+func (n *Node) dropStreamsLocked(c *conn) []streamEnd {
+	var peers []streamEnd
+	for end, peer := range n.streams {
+		if end.conn != c {
+			continue
+		}
+		delete(n.streams, end)
+		delete(n.streams, peer)
+		if peer.conn != c {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// closeStream tells the end that the other end went away
+func (n *Node) closeStream(end streamEnd, err error) {
+	msg := protocol.Message{
+		Id:          n.nextMessageId(),
+		MessageType: protocol.StreamClose,
+		Headers:     protocol.Headers{StreamId: end.id},
+		Errors:      []protocol.Error{{Message: err.Error(), Code: protocol.CodeCouldNotHandleMessage}},
+		Timestamp:   time.Now().UnixMicro(),
+	}
+	if err := end.conn.send(msg); err != nil {
+		fmt.Println("could not close stream of", end.conn.id, err)
+	}
+}
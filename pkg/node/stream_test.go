@@ -0,0 +1,73 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+func TestStream(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	opener := dial(t, addr)
+	opener.send(protocol.Message{Id: "1", MessageType: protocol.StreamOpen, Topic: "/files", TxId: "open", Headers: protocol.Headers{StreamId: "1", Window: 10}})
+	if rep := opener.recv(); len(rep.Errors) != 1 || rep.Errors[0].Code != protocol.CodeServiceTopicNotFound {
+		t.Fatalf("unexpected reply to open without listener %+v", rep)
+	}
+
+	acceptor := dial(t, addr)
+	acceptor.advertise("/files")
+
+	opener.send(protocol.Message{Id: "2", MessageType: protocol.StreamOpen, Topic: "/files", TxId: "open", Headers: protocol.Headers{StreamId: "1", Window: 10}})
+	if rep := opener.recv(); rep.TxId != "open" || len(rep.Errors) != 0 {
+		t.Fatalf("unexpected reply to open %+v", rep)
+	}
+
+	open := acceptor.recv()
+	if open.MessageType != protocol.StreamOpen || open.TxId != "" || open.Headers.Window != 10 || open.Headers.StreamId == "" {
+		t.Fatalf("unexpected open %+v", open)
+	}
+	id := open.Headers.StreamId
+
+	// each end keeps using its own id
+	opener.send(protocol.Message{Id: "3", MessageType: protocol.StreamData, Headers: protocol.Headers{StreamId: "1"}, Content: []byte("hello")})
+	if data := acceptor.recv(); data.MessageType != protocol.StreamData || data.Headers.StreamId != id || string(data.Content) != "hello" {
+		t.Fatalf("unexpected data %+v", data)
+	}
+
+	acceptor.send(protocol.Message{Id: "4", MessageType: protocol.StreamWindow, Headers: protocol.Headers{StreamId: id, Window: 5}})
+	if win := opener.recv(); win.MessageType != protocol.StreamWindow || win.Headers.StreamId != "1" || win.Headers.Window != 5 {
+		t.Fatalf("unexpected window %+v", win)
+	}
+
+	opener.send(protocol.Message{Id: "5", MessageType: protocol.StreamClose, Headers: protocol.Headers{StreamId: "1"}})
+	if cl := acceptor.recv(); cl.MessageType != protocol.StreamClose || cl.Headers.StreamId != id {
+		t.Fatalf("unexpected close %+v", cl)
+	}
+
+	// the stream is gone, late frames of the other end are dropped
+	acceptor.send(protocol.Message{Id: "6", MessageType: protocol.StreamData, Headers: protocol.Headers{StreamId: id}, Content: []byte("late")})
+	opener.send(protocol.Message{Id: "7", MessageType: protocol.StreamOpen, Topic: "/files", TxId: "again", Headers: protocol.Headers{StreamId: "1"}})
+	if rep := opener.recv(); rep.TxId != "again" || len(rep.Errors) != 0 {
+		t.Fatalf("expected the id to be free again, got %+v", rep)
+	}
+}
+
+func TestStreamPeerDisconnected(t *testing.T) {
+	_, addr := startNode(t, Options{})
+
+	acceptor := dial(t, addr)
+	acceptor.advertise("/logs")
+
+	opener := dial(t, addr)
+	opener.send(protocol.Message{Id: "1", MessageType: protocol.StreamOpen, Topic: "/logs", TxId: "open", Headers: protocol.Headers{StreamId: "1"}})
+	opener.recv()
+	acceptor.recv()
+
+	acceptor.conn.Close()
+
+	cl := opener.recv()
+	if cl.MessageType != protocol.StreamClose || cl.Headers.StreamId != "1" || len(cl.Errors) != 1 {
+		t.Fatalf("unexpected close %+v", cl)
+	}
+}
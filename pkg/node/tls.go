@@ -0,0 +1,66 @@
+package node
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+)
+
+// ServerTLSConfig loads the certificate and key the node presents to
+// clients. When clientCAFile is set clients have to present a certificate
+// signed by one of the CAs in it.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// tlsHandshake completes the tls handshake of the connection, if it is one,
+// and authenticates it as the subject of the client certificate
+func (c *conn) tlsHandshake() error {
+	tc, ok := c.nc.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	tc.SetDeadline(time.Now().Add(c.node.opts.HandshakeTimeout))
+	defer tc.SetDeadline(time.Time{})
+
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	id := auth.Identity{Subject: c.node.opts.CertSubject(certs[0]), Expires: certs[0].NotAfter}
+	c.identity.Store(&id)
+	return nil
+}
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/internal/testcert"
+	"github.com/bahodge/kgpmp-prototype/pkg/acl"
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// dialTLS connects with tls and performs the tls handshake
+func dialTLS(t *testing.T, addr string, config *tls.Config) (*testClient, error) {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, fr: protocol.NewFrameReader(conn)}, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := testcert.NewCA("ca")
+	server := ca.Issue("node", "127.0.0.1")
+	alice := ca.Issue("alice")
+	stranger := testcert.NewCA("other ca").Issue("alice")
+
+	policy, err := acl.Parse([]byte(`{"subjects": {"alice": {"subscribe": {"allow": ["/>"]}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startNode(t, Options{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{server.TLS},
+			ClientCAs:    ca.Pool(),
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+		// the certificate is as good as a token
+		Authenticator: auth.NewStaticTokens(nil),
+		ACL:           policy,
+	})
+
+	tc, err := dialTLS(t, addr, &tls.Config{RootCAs: ca.Pool(), Certificates: []tls.Certificate{alice.TLS}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.hello(testHello); err != nil {
+		t.Fatal(err)
+	}
+	tc.subscribe("/hello")
+
+	// without a trusted client certificate the handshake never completes
+	for _, certs := range [][]tls.Certificate{nil, {stranger.TLS}} {
+		tc, err := dialTLS(t, addr, &tls.Config{RootCAs: ca.Pool(), Certificates: certs})
+		if err == nil {
+			_, err = tc.hello(testHello)
+		}
+		if err == nil {
+			t.Fatalf("expected client with %d certificates to be rejected", len(certs))
+		}
+	}
+
+	// plain tcp is not accepted either
+	if _, err := dialRaw(t, addr).hello(testHello); err == nil {
+		t.Fatal("expected plain connection to be rejected")
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	ca := testcert.NewCA("ca")
+	server := ca.Issue("node", "127.0.0.1")
+
+	dir := t.TempDir()
+	files := map[string][]byte{"ca.pem": ca.CertPEM, "cert.pem": server.CertPEM, "key.pem": server.KeyPEM, "empty.pem": nil}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	config, err := ServerTLSConfig(path("cert.pem"), path("key.pem"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 || config.ClientAuth != tls.NoClientCert {
+		t.Fatalf("unexpected config %+v", config)
+	}
+
+	config, err = ServerTLSConfig(path("cert.pem"), path("key.pem"), path("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Fatalf("expected client certificates to be required, got %+v", config)
+	}
+
+	if _, err := ServerTLSConfig(path("cert.pem"), path("key.pem"), path("empty.pem")); err == nil {
+		t.Fatal("expected ca file without certificates to fail")
+	}
+	if _, err := ServerTLSConfig(path("key.pem"), path("cert.pem"), ""); err == nil {
+		t.Fatal("expected swapped cert and key to fail")
+	}
+}
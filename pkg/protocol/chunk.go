@@ -0,0 +1,269 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CHUNK_HEADROOM is the room senders leave in every frame for the headers a
+// node adds or rewrites when it forwards the message, e.g. conn_id and tx_id
+const CHUNK_HEADROOM = 1024
+
+var (
+	ErrorInvalidPart     = errors.New("invalid message part")
+	ErrorPartTimeout     = errors.New("timed out waiting on message parts")
+	ErrorReassemblyLimit = errors.New("too many bytes waiting on reassembly")
+)
+
+// ReassemblyError is returned when the parts of a chunked message can not be
+// put back together. Err is one of ErrorInvalidPart, ErrorPartTimeout or
+// ErrorReassemblyLimit.
+type ReassemblyError struct {
+	Id       string
+	Received int
+	Total    int
+	Err      error
+}
+
+func (e *ReassemblyError) Error() string {
+	return fmt.Sprintf("message %s: %v (%d/%d parts)", e.Id, e.Err, e.Received, e.Total)
+}
+
+func (e *ReassemblyError) Unwrap() error {
+	return e.Err
+}
+
+// Split cuts the content of the message into parts of at most chunkSize
+// bytes. Every part carries all other fields of the message so it can be
+// routed on its own. A message that fits in one chunk is returned as is.
+func Split(msg Message, chunkSize int) []Message {
+	if chunkSize <= 0 || len(msg.Content) <= chunkSize {
+		return []Message{msg}
+	}
+
+	total := (len(msg.Content) + chunkSize - 1) / chunkSize
+	parts := make([]Message, 0, total)
+	for i := 0; i < total; i++ {
+		end := min((i+1)*chunkSize, len(msg.Content))
+
+		part := msg
+		part.Content = msg.Content[i*chunkSize : end]
+		part.Headers.Part = uint32(i)
+		part.Headers.TotalParts = uint32(total)
+		parts = append(parts, part)
+	}
+
+	return parts
+}
+
+// Chunk encodes the message with the codec into as many payloads as needed
+// to keep each one at or below maxFrameSize. Codecs that expand content,
+// like JSON does with base64, are accounted for by shrinking the chunks until
+// they fit.
+func Chunk(codec Codec, msg Message, maxFrameSize int) ([][]byte, error) {
+	payload, err := codec.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) <= maxFrameSize {
+		return [][]byte{payload}, nil
+	}
+
+	// everything but the content has to fit in every part
+	empty := msg
+	empty.Content = nil
+	empty.Headers.Part = ^uint32(0)
+	empty.Headers.TotalParts = ^uint32(0)
+	overhead, err := codec.Marshal(empty)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := maxFrameSize - len(overhead) - 16
+	for chunkSize > 0 {
+		parts := Split(msg, chunkSize)
+		payloads := make([][]byte, 0, len(parts))
+		largest := 0
+		for _, part := range parts {
+			p, err := codec.Marshal(part)
+			if err != nil {
+				return nil, err
+			}
+			largest = max(largest, len(p))
+			payloads = append(payloads, p)
+		}
+
+		if largest <= maxFrameSize {
+			return payloads, nil
+		}
+
+		// shrink proportionally to how much the codec grew the content
+		chunkSize = chunkSize*(maxFrameSize-len(overhead))/(largest-len(overhead)) - 16
+	}
+
+	return nil, fmt.Errorf("%w: headers alone are %d bytes, max is %d", ErrorFrameTooLarge, len(overhead), maxFrameSize)
+}
+
+// Join puts parts that were made by Split back together. The parts must be
+// complete and ordered by part index.
+func Join(parts []Message) Message {
+	msg := parts[0]
+	msg.Headers.Part = 0
+	msg.Headers.TotalParts = 0
+
+	size := 0
+	for _, part := range parts {
+		size += len(part.Content)
+	}
+
+	msg.Content = make([]byte, 0, size)
+	for _, part := range parts {
+		msg.Content = append(msg.Content, part.Content...)
+	}
+
+	return msg
+}
+
+// Reassembler collects the parts of chunked messages until every part has
+// arrived. Messages are identified by the connection they came from and
+// their id. Parts of a message that does not complete within the timeout are
+// dropped, as are new messages once maxBytes of content is waiting. It is
+// safe for concurrent use.
+type Reassembler struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	maxBytes int
+	size     int
+	partials map[string]*partial
+
+	// now is swapped out by tests
+	now func() time.Time
+}
+
+type partial struct {
+	id       string
+	parts    []Message
+	received int
+	size     int
+	started  time.Time
+}
+
+func NewReassembler(timeout time.Duration, maxBytes int) *Reassembler {
+	return &Reassembler{
+		timeout:  timeout,
+		maxBytes: maxBytes,
+		partials: map[string]*partial{},
+		now:      time.Now,
+	}
+}
+
+func partKey(msg Message) string {
+	return msg.Headers.ConnId + "/" + msg.Headers.ClientId + "/" + msg.Id
+}
+
+// Add collects the part and returns the joined message once it is complete.
+// Messages that are not chunked are returned right away.
+func (r *Reassembler) Add(msg Message) (Message, bool, error) {
+	parts, ok, err := r.Collect(msg)
+	if !ok || err != nil {
+		return Message{}, ok, err
+	}
+
+	return Join(parts), true, nil
+}
+
+// Collect is like Add but returns the parts in order instead of joining
+// them, which lets a node verify a message is complete and still forward it
+// in frames that fit the wire.
+func (r *Reassembler) Collect(msg Message) ([]Message, bool, error) {
+	if !msg.IsPart() {
+		return []Message{msg}, true, nil
+	}
+
+	total := int(msg.Headers.TotalParts)
+	if int(msg.Headers.Part) >= total {
+		return nil, false, &ReassemblyError{Id: msg.Id, Total: total, Err: ErrorInvalidPart}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := partKey(msg)
+	p, ok := r.partials[key]
+	if ok && p.started.Add(r.timeout).Before(r.now()) {
+		r.dropLocked(key, p)
+		ok = false
+	}
+	if !ok {
+		p = &partial{id: msg.Id, parts: make([]Message, total), started: r.now()}
+		r.partials[key] = p
+	}
+
+	if len(p.parts) != total {
+		r.dropLocked(key, p)
+		return nil, false, &ReassemblyError{Id: msg.Id, Received: p.received, Total: total, Err: ErrorInvalidPart}
+	}
+
+	if r.maxBytes > 0 && r.size+len(msg.Content) > r.maxBytes {
+		r.dropLocked(key, p)
+		return nil, false, &ReassemblyError{Id: msg.Id, Received: p.received, Total: total, Err: ErrorReassemblyLimit}
+	}
+
+	// duplicates are ignored
+	slot := &p.parts[msg.Headers.Part]
+	if slot.Headers.TotalParts != 0 {
+		return nil, false, nil
+	}
+	*slot = msg
+	p.received++
+	p.size += len(msg.Content)
+	r.size += len(msg.Content)
+
+	if p.received < total {
+		return nil, false, nil
+	}
+
+	r.dropLocked(key, p)
+	return p.parts, true, nil
+}
+
+// Expire drops every message that has been waiting on parts for longer than
+// the timeout and returns an error for each of them
+func (r *Reassembler) Expire() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	deadline := r.now().Add(-r.timeout)
+	for key, p := range r.partials {
+		if p.started.Before(deadline) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		p := r.partials[key]
+		r.dropLocked(key, p)
+		errs = append(errs, &ReassemblyError{Id: p.id, Received: p.received, Total: len(p.parts), Err: ErrorPartTimeout})
+	}
+	return errs
+}
+
+// Pending returns the number of messages waiting on parts and the bytes of
+// content they hold
+func (r *Reassembler) Pending() (messages int, bytes int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.partials), r.size
+}
+
+func (r *Reassembler) dropLocked(key string, p *partial) {
+	delete(r.partials, key)
+	r.size -= p.size
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChunkAndReassemble(t *testing.T) {
+	content := make([]byte, 300_000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	msg := Message{Id: "big", MessageType: Publish, Topic: "/big", Headers: Headers{ConnId: "1"}, Content: content}
+
+	// json turns content into base64, the parts still have to fit
+	for _, codec := range []Codec{CBOR, Msgpack, JSON} {
+		payloads, err := Chunk(codec, msg, 64*1024)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		if len(payloads) < 5 {
+			t.Fatalf("%s: expected the message to be chunked, got %d parts", codec.Name(), len(payloads))
+		}
+
+		r := NewReassembler(time.Second, 0)
+		// deliver the parts in reverse, with a duplicate thrown in
+		payloads = append(payloads, payloads[len(payloads)-1])
+		var got Message
+		complete := false
+		for i := len(payloads) - 1; i >= 0; i-- {
+			if len(payloads[i]) > 64*1024 {
+				t.Fatalf("%s: part %d is %d bytes", codec.Name(), i, len(payloads[i]))
+			}
+
+			var part Message
+			if err := codec.Unmarshal(payloads[i], &part); err != nil {
+				t.Fatal(err)
+			}
+
+			m, ok, err := r.Add(part)
+			if err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+			if ok {
+				if complete {
+					t.Fatalf("%s: message completed twice", codec.Name())
+				}
+				got, complete = m, true
+			}
+		}
+
+		if !complete || !bytes.Equal(got.Content, content) || got.Topic != "/big" || got.IsPart() {
+			t.Fatalf("%s: message was not reassembled", codec.Name())
+		}
+		if n, size := r.Pending(); n != 0 || size != 0 {
+			t.Fatalf("%s: reassembler still holds %d messages, %d bytes", codec.Name(), n, size)
+		}
+	}
+}
+
+func TestChunkSmallMessage(t *testing.T) {
+	payloads, err := Chunk(CBOR, Message{Id: "1", Content: []byte("small")}, MAX_MSG_SIZE)
+	if err != nil || len(payloads) != 1 {
+		t.Fatalf("expected a single payload, got %d, %v", len(payloads), err)
+	}
+
+	_, err = Chunk(CBOR, Message{Id: "1", Topic: string(make([]byte, 100)), Content: make([]byte, 200)}, 64)
+	if !errors.Is(err, ErrorFrameTooLarge) {
+		t.Fatalf("expected frame too large, got %v", err)
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	now := time.Now()
+	r := NewReassembler(time.Second, 0)
+	r.now = func() time.Time { return now }
+
+	parts := Split(Message{Id: "1", Content: []byte("abcdef")}, 2)
+	if _, ok, err := r.Add(parts[0]); ok || err != nil {
+		t.Fatalf("unexpected result %v %v", ok, err)
+	}
+
+	now = now.Add(2 * time.Second)
+	errs := r.Expire()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrorPartTimeout) {
+		t.Fatalf("expected a timeout, got %v", errs)
+	}
+
+	var rerr *ReassemblyError
+	if !errors.As(errs[0], &rerr) || rerr.Id != "1" || rerr.Received != 1 || rerr.Total != 3 {
+		t.Fatalf("unexpected error %#v", errs[0])
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	r := NewReassembler(time.Second, 10)
+
+	parts := Split(Message{Id: "1", Content: make([]byte, 30)}, 8)
+	r.Add(parts[0])
+	if _, _, err := r.Add(parts[1]); !errors.Is(err, ErrorReassemblyLimit) {
+		t.Fatalf("expected reassembly limit, got %v", err)
+	}
+	if n, size := r.Pending(); n != 0 || size != 0 {
+		t.Fatalf("message over the limit was kept, %d messages, %d bytes", n, size)
+	}
+
+	bad := parts[0]
+	bad.Headers.Part = 10
+	if _, _, err := r.Add(bad); !errors.Is(err, ErrorInvalidPart) {
+		t.Fatalf("expected invalid part, got %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// CodecID is the content type identifier of a codec. It is small enough to be
+// carried on the wire so that peers can agree on an encoding.
+type CodecID uint8
+
+const (
+	CodecIDUnknown CodecID = iota
+	CodecIDCBOR
+	CodecIDMsgpack
+	CodecIDJSON
+	CodecIDCapnp
+)
+
+var (
+	ErrorUnknownCodec   = errors.New("unknown codec")
+	ErrorCodecConflict  = errors.New("codec already registered")
+	ErrorInvalidCodecID = errors.New("invalid codec id")
+)
+
+// Codec turns a Message into bytes and back. Implementations must be safe for
+// concurrent use.
+type Codec interface {
+	// Name is the unique, human readable name of the codec (e.g. "cbor")
+	Name() string
+	// ID is the content type identifier sent on the wire
+	ID() CodecID
+	// Marshal encodes the message without the length prefix
+	Marshal(msg Message) ([]byte, error)
+	// Unmarshal decodes data that has already had the length prefix removed
+	Unmarshal(data []byte, m *Message) error
+}
+
+// ValueCodec is implemented by codecs that can encode any value, not just
+// messages. Content generated by the node, like the reply to NodeInfo, is
+// encoded with it and falls back to CBOR for codecs that can not.
+type ValueCodec interface {
+	MarshalValue(v any) ([]byte, error)
+	UnmarshalValue(data []byte, v any) error
+}
+
+// MarshalValue encodes v with the codec, or CBOR when the codec is not a
+// ValueCodec
+func MarshalValue(c Codec, v any) ([]byte, error) {
+	if vc, ok := c.(ValueCodec); ok {
+		return vc.MarshalValue(v)
+	}
+	return cbor.Marshal(v)
+}
+
+// UnmarshalValue decodes what MarshalValue encoded with the same codec
+func UnmarshalValue(c Codec, data []byte, v any) error {
+	if vc, ok := c.(ValueCodec); ok {
+		return vc.UnmarshalValue(data, v)
+	}
+	return cbor.Unmarshal(data, v)
+}
+
+// AppendCodec is implemented by codecs that can encode a message into a
+// buffer they are handed, so that the caller can reuse it
+type AppendCodec interface {
+	AppendMarshal(dst []byte, msg Message) ([]byte, error)
+}
+
+// AppendMarshal appends msg encoded with the codec to dst, going through
+// Marshal when the codec is not an AppendCodec
+func AppendMarshal(c Codec, dst []byte, msg Message) ([]byte, error) {
+	if ac, ok := c.(AppendCodec); ok {
+		return ac.AppendMarshal(dst, msg)
+	}
+	payload, err := c.Marshal(msg)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, payload...), nil
+}
+
+var (
+	codecsMu     sync.RWMutex
+	codecsByName = map[string]Codec{}
+	codecsByID   = map[CodecID]Codec{}
+)
+
+// RegisterCodec makes a codec available by name and id. Registering a codec
+// whose name or id is already taken returns ErrorCodecConflict.
+func RegisterCodec(c Codec) error {
+	if c.ID() == CodecIDUnknown {
+		return ErrorInvalidCodecID
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if _, ok := codecsByName[c.Name()]; ok {
+		return fmt.Errorf("%w: %s", ErrorCodecConflict, c.Name())
+	}
+	if _, ok := codecsByID[c.ID()]; ok {
+		return fmt.Errorf("%w: id %d", ErrorCodecConflict, c.ID())
+	}
+
+	codecsByName[c.Name()] = c
+	codecsByID[c.ID()] = c
+	return nil
+}
+
+// MustRegisterCodec is like RegisterCodec but panics on error. It is meant to
+// be called from init functions.
+func MustRegisterCodec(c Codec) {
+	if err := RegisterCodec(c); err != nil {
+		panic(err)
+	}
+}
+
+// CodecByName looks up a registered codec by its name
+func CodecByName(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// CodecByID looks up a registered codec by its content type id
+func CodecByID(id CodecID) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecsByID[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrorUnknownCodec, id)
+	}
+	return c, nil
+}
+
+// Codecs returns the names of all registered codecs in sorted order
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	names := make([]string, 0, len(codecsByName))
+	for name := range codecsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Serialize encodes the message with the codec and prefixes it with its length
+// so that it is ready to be written to a connection.
+func Serialize(c Codec, msg Message) ([]byte, error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+
+	frame, err := AppendFrame(*buf, c, msg)
+	if err != nil {
+		return nil, err
+	}
+	*buf = frame
+	return bytes.Clone(frame), nil
+}
+
+var (
+	CBOR    Codec = cborCodec{}
+	Msgpack Codec = msgpackCodec{}
+	JSON    Codec = jsonCodec{}
+)
+
+func init() {
+	MustRegisterCodec(CBOR)
+	MustRegisterCodec(Msgpack)
+	MustRegisterCodec(JSON)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return "cbor" }
+func (cborCodec) ID() CodecID  { return CodecIDCBOR }
+
+func (cborCodec) Marshal(msg Message) ([]byte, error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+
+	*buf = AppendCBOR(*buf, msg)
+	return bytes.Clone(*buf), nil
+}
+
+func (cborCodec) AppendMarshal(dst []byte, msg Message) ([]byte, error) {
+	return AppendCBOR(dst, msg), nil
+}
+
+func (cborCodec) Unmarshal(data []byte, m *Message) error {
+	return cbor.Unmarshal(data, m)
+}
+
+func (cborCodec) MarshalValue(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) UnmarshalValue(data []byte, v any) error {
+	return cbor.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) ID() CodecID  { return CodecIDMsgpack }
+
+func (msgpackCodec) Marshal(msg Message) ([]byte, error) {
+	return msgpack.Marshal(msg)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, m *Message) error {
+	return msgpack.Unmarshal(data, m)
+}
+
+func (msgpackCodec) MarshalValue(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) UnmarshalValue(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) ID() CodecID  { return CodecIDJSON }
+
+func (jsonCodec) Marshal(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, m *Message) error {
+	return json.Unmarshal(data, m)
+}
+
+func (jsonCodec) MarshalValue(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) UnmarshalValue(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
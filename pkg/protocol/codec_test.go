@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	m := Message{
+		Id:          "1",
+		MessageType: Publish,
+		Topic:       "/hello/world",
+		TxId:        "tx",
+		Headers:     Headers{ClientId: "client"},
+		Content:     []byte("hello world"),
+		Errors:      []Error{{Message: "oops", Code: CodeMalformedMessage}},
+		Timestamp:   1234,
+	}
+
+	for _, name := range []string{"cbor", "msgpack", "json"} {
+		codec, err := CodecByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := codec.Marshal(m)
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", name, err)
+		}
+
+		var dec Message
+		if err := codec.Unmarshal(data, &dec); err != nil {
+			t.Fatalf("%s: unmarshal: %v", name, err)
+		}
+
+		if !reflect.DeepEqual(m, dec) {
+			t.Fatalf("%s: got %+v, want %+v", name, dec, m)
+		}
+
+		byID, err := CodecByID(codec.ID())
+		if err != nil || byID != codec {
+			t.Fatalf("%s: lookup by id returned %v, %v", name, byID, err)
+		}
+	}
+}
+
+func TestRegisterCodecConflict(t *testing.T) {
+	if err := RegisterCodec(CBOR); !errors.Is(err, ErrorCodecConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	if _, err := CodecByName("nope"); !errors.Is(err, ErrorUnknownCodec) {
+		t.Fatalf("expected unknown codec, got %v", err)
+	}
+}
+
+// messageOnly is a codec that can not encode values
+type messageOnly struct{ Codec }
+
+func TestValueRoundTrip(t *testing.T) {
+	info := Info{
+		NodeId:        "a",
+		Subscriptions: map[string]int{"/a": 2},
+		Conns:         []ConnInfo{{Id: "1", Codec: "json", BytesIn: 10}},
+	}
+
+	for _, codec := range []Codec{CBOR, Msgpack, JSON, messageOnly{JSON}} {
+		data, err := MarshalInfo(codec, info)
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", codec.Name(), err)
+		}
+
+		dec, err := UnmarshalInfo(codec, data)
+		if err != nil {
+			t.Fatalf("%s: unmarshal: %v", codec.Name(), err)
+		}
+		if !reflect.DeepEqual(info, dec) {
+			t.Fatalf("%s: got %+v, want %+v", codec.Name(), dec, info)
+		}
+	}
+}
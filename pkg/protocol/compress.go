@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var ErrorUnknownCompression = errors.New("unknown compression")
+
+// Compressor compresses the payload of frames. Implementations must be safe
+// for concurrent use.
+type Compressor interface {
+	// Name is the unique name the compression is negotiated by (e.g.
+	// "flate")
+	Name() string
+	// Compress appends the compressed src to dst
+	Compress(dst []byte, src []byte) ([]byte, error)
+	// Decompress returns the decompressed src. Content that grows past max
+	// bytes fails with ErrorFrameTooLarge, a small frame can not make the
+	// reader allocate more than it accepts.
+	Decompress(src []byte, max int) ([]byte, error)
+}
+
+// Flate is raw DEFLATE and Gzip the same wrapped in a gzip header and
+// trailer. Both favor speed over ratio.
+var (
+	Flate Compressor = &flateCompressor{}
+	Gzip  Compressor = &gzipCompressor{}
+)
+
+var compressors = map[string]Compressor{
+	Flate.Name(): Flate,
+	Gzip.Name():  Gzip,
+}
+
+// CompressorByName looks up a compressor by its name
+func CompressorByName(name string) (Compressor, error) {
+	c, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorUnknownCompression, name)
+	}
+	return c, nil
+}
+
+// Compressions returns the names of every compressor in sorted order
+func Compressions() []string {
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CompressionNames returns the names of the compressors
+func CompressionNames(cs []Compressor) []string {
+	names := make([]string, 0, len(cs))
+	for _, c := range cs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// decompress reads r into a new slice unless it holds more than max bytes
+func decompress(r io.Reader, max int) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorMalformedMessage, err)
+	}
+	if n > int64(max) {
+		return nil, fmt.Errorf("%w: decompresses to more than %d bytes", ErrorFrameTooLarge, max)
+	}
+	return buf.Bytes(), nil
+}
+
+// flateCompressor keeps the writers and readers around, setting one up costs
+// far more than compressing a small frame
+type flateCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *flateCompressor) Name() string {
+	return "flate"
+}
+
+func (c *flateCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(buf, flate.BestSpeed)
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(src []byte, max int) ([]byte, error) {
+	r, _ := c.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else {
+		r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	}
+	defer c.readers.Put(r)
+
+	return decompress(r, max)
+}
+
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := c.writers.Get().(*gzip.Writer)
+	if w == nil {
+		w, _ = gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(src []byte, max int) ([]byte, error) {
+	r, _ := c.readers.Get().(*gzip.Reader)
+	var err error
+	if r == nil {
+		r, err = gzip.NewReader(bytes.NewReader(src))
+	} else {
+		err = r.Reset(bytes.NewReader(src))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorMalformedMessage, err)
+	}
+	defer c.readers.Put(r)
+
+	return decompress(r, max)
+}
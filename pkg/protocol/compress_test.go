@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	content := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 1000)
+
+	for _, name := range Compressions() {
+		c, err := CompressorByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// compressed content is appended to what is already there
+		compressed, err := c.Compress([]byte("head"), content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(compressed, []byte("head")) || len(compressed) >= len(content)/10 {
+			t.Fatalf("%s: compressed %d bytes to %d", name, len(content), len(compressed))
+		}
+
+		got, err := c.Decompress(compressed[4:], len(content))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("%s: round trip failed: %v", name, err)
+		}
+
+		// a frame may not decompress to more than the reader accepts
+		if _, err := c.Decompress(compressed[4:], len(content)-1); !errors.Is(err, ErrorFrameTooLarge) {
+			t.Fatalf("%s: expected frame too large, got %v", name, err)
+		}
+		if _, err := c.Decompress([]byte("not compressed at all"), len(content)); !errors.Is(err, ErrorMalformedMessage) {
+			t.Fatalf("%s: expected malformed message, got %v", name, err)
+		}
+	}
+
+	if _, err := CompressorByName("zstd"); !errors.Is(err, ErrorUnknownCompression) {
+		t.Fatalf("expected unknown compression, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// CBOR major types, shifted into the top three bits of the initial byte
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+)
+
+// MAX_POOLED_BUFFER_SIZE is the largest buffer PutBuffer keeps, a single
+// large message should not pin its buffer for good
+const MAX_POOLED_BUFFER_SIZE = 64 * 1024
+
+var buffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// GetBuffer takes an empty buffer from a pool. Hand it back with PutBuffer
+// once nothing refers to its bytes anymore.
+func GetBuffer() *[]byte {
+	b := buffers.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// PutBuffer returns a buffer taken with GetBuffer to the pool
+func PutBuffer(b *[]byte) {
+	if cap(*b) > MAX_POOLED_BUFFER_SIZE {
+		return
+	}
+	buffers.Put(b)
+}
+
+// AppendFrame appends msg encoded with the codec and prefixed with its length
+// to dst. The prefix is reserved up front and filled in once the length is
+// known, so the payload is never copied.
+func AppendFrame(dst []byte, c Codec, msg Message) ([]byte, error) {
+	start := len(dst)
+	dst, err := AppendMarshal(c, append(dst, 0, 0, 0, 0), msg)
+	if err != nil {
+		return dst[:start], err
+	}
+
+	size := len(dst) - start - PREFIX_SIZE
+	if size > MAX_MSG_SIZE {
+		return dst[:start], fmt.Errorf("%w: %d bytes, max is %d", ErrorFrameTooLarge, size, MAX_MSG_SIZE)
+	}
+	binary.BigEndian.PutUint32(dst[start:], uint32(size))
+	return dst, nil
+}
+
+// AppendCBOR appends msg encoded as CBOR to dst. It writes the very bytes
+// cbor.Marshal writes for a Message but skips the reflection, encoding into
+// a buffer with room to spare does not allocate. Fields added to Message or
+// Headers have to be added here as well, TestAppendCBOR catches the ones
+// that are not.
+func AppendCBOR(dst []byte, msg Message) []byte {
+	headers := msg.Headers.fields()
+
+	// id, message_type and topic are always there
+	fields := 3
+	for _, present := range [...]bool{msg.TxId != "", headers > 0, len(msg.Content) > 0, len(msg.Errors) > 0, msg.Timestamp != 0} {
+		if present {
+			fields++
+		}
+	}
+
+	dst = appendHead(dst, cborMap, uint64(fields))
+	dst = appendText(appendText(dst, "id"), msg.Id)
+	dst = appendHead(appendText(dst, "message_type"), cborUint, uint64(msg.MessageType))
+	dst = appendText(appendText(dst, "topic"), msg.Topic)
+	if msg.TxId != "" {
+		dst = appendText(appendText(dst, "tx_id"), msg.TxId)
+	}
+	if headers > 0 {
+		dst = msg.Headers.appendCBOR(appendText(dst, "headers"), headers)
+	}
+	if len(msg.Content) > 0 {
+		dst = appendText(dst, "content")
+		dst = append(appendHead(dst, cborBytes, uint64(len(msg.Content))), msg.Content...)
+	}
+	if len(msg.Errors) > 0 {
+		dst = appendHead(appendText(dst, "errors"), cborArray, uint64(len(msg.Errors)))
+		for _, e := range msg.Errors {
+			dst = e.appendCBOR(dst)
+		}
+	}
+	if msg.Timestamp != 0 {
+		dst = appendInt(appendText(dst, "timestamp"), msg.Timestamp)
+	}
+	return dst
+}
+
+func (e Error) appendCBOR(dst []byte) []byte {
+	fields := 0
+	if e.Message != "" {
+		fields++
+	}
+	if e.Code != CodeNoError {
+		fields++
+	}
+
+	dst = appendHead(dst, cborMap, uint64(fields))
+	if e.Message != "" {
+		dst = appendText(appendText(dst, "message"), e.Message)
+	}
+	if e.Code != CodeNoError {
+		dst = appendHead(appendText(dst, "code"), cborUint, uint64(e.Code))
+	}
+	return dst
+}
+
+// fields counts the headers that are set, none meaning the headers are left
+// out of the message
+func (h *Headers) fields() int {
+	n := 0
+	for _, present := range [...]bool{
+		h.ClientId != "", h.ConnId != "", h.AuthToken != "", h.Part != 0,
+		h.TotalParts != 0, h.Receipt != "", h.Deliveries != 0, h.Wait != 0,
+		h.Revision != 0, h.TTL != 0, h.StreamId != "", h.Window != 0,
+		len(h.Path) > 0,
+	} {
+		if present {
+			n++
+		}
+	}
+	return n
+}
+
+func (h *Headers) appendCBOR(dst []byte, fields int) []byte {
+	dst = appendHead(dst, cborMap, uint64(fields))
+	dst = appendTextField(dst, "client_id", h.ClientId)
+	dst = appendTextField(dst, "conn_id", h.ConnId)
+	dst = appendTextField(dst, "auth_token", h.AuthToken)
+	dst = appendUintField(dst, "part", uint64(h.Part))
+	dst = appendUintField(dst, "total_parts", uint64(h.TotalParts))
+	dst = appendTextField(dst, "receipt", h.Receipt)
+	dst = appendUintField(dst, "deliveries", uint64(h.Deliveries))
+	dst = appendUintField(dst, "wait", uint64(h.Wait))
+	dst = appendUintField(dst, "revision", h.Revision)
+	dst = appendUintField(dst, "ttl", uint64(h.TTL))
+	dst = appendTextField(dst, "stream_id", h.StreamId)
+	dst = appendUintField(dst, "window", uint64(h.Window))
+	if len(h.Path) > 0 {
+		dst = appendHead(appendText(dst, "path"), cborArray, uint64(len(h.Path)))
+		for _, node := range h.Path {
+			dst = appendText(dst, node)
+		}
+	}
+	return dst
+}
+
+// appendTextField appends the key and value unless the value is empty
+func appendTextField(dst []byte, key string, value string) []byte {
+	if value == "" {
+		return dst
+	}
+	return appendText(appendText(dst, key), value)
+}
+
+// appendUintField appends the key and value unless the value is 0
+func appendUintField(dst []byte, key string, value uint64) []byte {
+	if value == 0 {
+		return dst
+	}
+	return appendHead(appendText(dst, key), cborUint, value)
+}
+
+func appendText(dst []byte, s string) []byte {
+	return append(appendHead(dst, cborText, uint64(len(s))), s...)
+}
+
+func appendInt(dst []byte, v int64) []byte {
+	if v < 0 {
+		// -1 - v, without overflowing on the smallest int64
+		return appendHead(dst, cborNegInt, uint64(^v))
+	}
+	return appendHead(dst, cborUint, uint64(v))
+}
+
+// appendHead appends the initial byte of a data item of the major type with
+// the argument n in the shortest form
+func appendHead(dst []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(dst, major|byte(n))
+	case n <= 0xff:
+		return append(dst, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, major|27), n)
+	}
+}
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// fill sets every field of v to something other than its zero value
+func fill(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := range v.NumField() {
+			fill(v.Field(i))
+		}
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 2, 2))
+		for i := range v.Len() {
+			fill(v.Index(i))
+		}
+	case reflect.String:
+		v.SetString("set")
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(7)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		v.SetInt(7)
+	default:
+		panic("fill does not know " + v.Kind().String())
+	}
+}
+
+func TestAppendCBOR(t *testing.T) {
+	var full Message
+	fill(reflect.ValueOf(&full).Elem())
+
+	long := strings.Repeat("x", 70_000)
+	msgs := []Message{
+		{},
+		full,
+		{Id: "1", MessageType: Publish, Topic: "/hello/world", Content: []byte("hello world"), Timestamp: 1234},
+		{Id: "2", MessageType: Reply, TxId: "tx", Errors: []Error{{}, {Message: "oops"}, {Code: CodeQueueFull}}},
+		{Headers: Headers{Part: 1, TotalParts: 2}, Content: []byte{}},
+		{Headers: Headers{Path: []string{"a", "b", "c"}, Revision: math.MaxUint64, Window: math.MaxUint32}},
+		{Timestamp: -1},
+		{Timestamp: -25},
+		{Timestamp: math.MinInt64},
+		{Timestamp: math.MaxInt64},
+		{Topic: strings.Repeat("t", 23), Id: strings.Repeat("i", 24)},
+		{Topic: strings.Repeat("t", 255), Id: strings.Repeat("i", 256)},
+		{Topic: long[:65535], Content: []byte(long)},
+		{MessageType: MessageType(255), Headers: Headers{Wait: 24, TTL: 256, Deliveries: 65536}},
+	}
+
+	for i, msg := range msgs {
+		want, err := cbor.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := AppendCBOR([]byte("prefix"), msg)
+		if !bytes.HasPrefix(got, []byte("prefix")) || !bytes.Equal(got[len("prefix"):], want) {
+			t.Fatalf("message %d: got %x, want %x", i, got[len("prefix"):], want)
+		}
+
+		var dec Message
+		if err := CBOR.Unmarshal(got[len("prefix"):], &dec); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+}
+
+func TestAppendCBORAllocs(t *testing.T) {
+	msg := Message{
+		Id:          "1",
+		MessageType: Publish,
+		Topic:       "/hello/world",
+		Headers:     Headers{ClientId: "client", Path: []string{"node-1"}},
+		Content:     []byte("hello world"),
+		Errors:      []Error{{Message: "oops", Code: CodeMalformedMessage}},
+		Timestamp:   1234,
+	}
+
+	buf := make([]byte, 0, 256)
+	if allocs := testing.AllocsPerRun(100, func() { buf = AppendCBOR(buf[:0], msg) }); allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { buf, _ = AppendFrame(buf[:0], CBOR, msg) }); allocs != 0 {
+		t.Fatalf("expected no allocations framing, got %v", allocs)
+	}
+}
+
+func TestAppendFrame(t *testing.T) {
+	msg := Message{Id: "1", MessageType: Publish, Topic: "/hello/world", Content: []byte("hello world")}
+
+	// codecs that can not append go through Marshal
+	for _, codec := range []Codec{CBOR, JSON} {
+		payload, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := PrefixWithLength(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := AppendFrame([]byte("prefix"), codec, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append([]byte("prefix"), want...)) {
+			t.Fatalf("%s: got %x, want %x", codec.Name(), got, want)
+		}
+
+		frame, err := Serialize(codec, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, want) {
+			t.Fatalf("%s: serialized %x, want %x", codec.Name(), frame, want)
+		}
+	}
+
+	got, err := AppendFrame([]byte("prefix"), CBOR, Message{Content: make([]byte, MAX_MSG_SIZE)})
+	if !errors.Is(err, ErrorFrameTooLarge) {
+		t.Fatalf("expected the frame to be too large, got %v", err)
+	}
+	if string(got) != "prefix" {
+		t.Fatalf("expected dst to be left as it was, got %d bytes", len(got))
+	}
+}
+
+func TestPutBufferDropsLargeBuffers(t *testing.T) {
+	large := make([]byte, 0, MAX_POOLED_BUFFER_SIZE+1)
+	PutBuffer(&large)
+
+	// the pool may hand out anything it holds, but never the large buffer
+	for range 10 {
+		if b := GetBuffer(); cap(*b) > MAX_POOLED_BUFFER_SIZE {
+			t.Fatalf("got a pooled buffer of %d bytes", cap(*b))
+		}
+	}
+}
+
+var benchmarkMessage = Message{
+	Id:          "1234",
+	MessageType: Reply,
+	Topic:       "/hello/world",
+	TxId:        "sometxid - 1234",
+	Headers:     Headers{ClientId: "client"},
+	Content:     []byte("hello world"),
+	Timestamp:   1718000000000000,
+}
+
+func BenchmarkMarshalCBOR(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := cbor.Marshal(benchmarkMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendCBOR(b *testing.B) {
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = AppendCBOR(buf[:0], benchmarkMessage)
+	}
+}
+
+// BenchmarkPrefixWithLength encodes and prefixes frames the way Serialize
+// used to
+func BenchmarkPrefixWithLength(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		payload, err := cbor.Marshal(benchmarkMessage)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := PrefixWithLength(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendFrame(b *testing.B) {
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = AppendFrame(buf[:0], CBOR, benchmarkMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
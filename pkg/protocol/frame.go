@@ -0,0 +1,225 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// PREFIX_SIZE is the number of bytes of the length prefix in front of every
+// frame
+const PREFIX_SIZE = 4
+
+// The top bits of the prefix are flags, the rest is the size of the payload
+// on the wire. FLAG_COMPRESSED marks a compressed payload and FLAG_CHECKSUM a
+// frame followed by a CHECKSUM_SIZE trailer holding the CRC32C of the prefix
+// and the payload as it was sent.
+const (
+	FLAG_COMPRESSED uint32 = 1 << 31
+	FLAG_CHECKSUM   uint32 = 1 << 30
+	SIZE_MASK       uint32 = 1<<30 - 1
+	CHECKSUM_SIZE          = 4
+)
+
+// DEFAULT_COMPRESSION_THRESHOLD is the size from which on frames are
+// compressed, smaller ones rarely get any smaller
+const DEFAULT_COMPRESSION_THRESHOLD = 1024
+
+var ErrorFrameTooLarge = errors.New("frame is too large")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// FrameReader reads length prefixed frames from a stream
+type FrameReader struct {
+	r       *bufio.Reader
+	maxSize int
+	prefix  [PREFIX_SIZE]byte
+	trailer [CHECKSUM_SIZE]byte
+	// every frame has to carry a checksum
+	checksums  bool
+	compressor Compressor
+}
+
+// NewFrameReader returns a reader that rejects frames larger than
+// MAX_MSG_SIZE
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		r:       bufio.NewReaderSize(r, 64*1024),
+		maxSize: MAX_MSG_SIZE,
+	}
+}
+
+// SetMaxFrameSize changes the largest frame the reader accepts
+func (fr *FrameReader) SetMaxFrameSize(size int) {
+	fr.maxSize = size
+}
+
+// SetChecksums makes the reader reject frames without a checksum. Frames
+// that carry one are verified either way.
+func (fr *FrameReader) SetChecksums(required bool) {
+	fr.checksums = required
+}
+
+// SetCompression sets the compressor compressed frames are decompressed
+// with. Compressed frames are refused without one.
+func (fr *FrameReader) SetCompression(c Compressor) {
+	fr.compressor = c
+}
+
+// ReadFrame reads the next frame and returns its payload without the prefix.
+// The returned slice is owned by the caller and is not touched by later
+// reads.
+//
+// io.EOF is only returned when the stream ends between two frames, a stream
+// that ends in the middle of a frame returns io.ErrUnexpectedEOF. A prefix
+// announcing more than the max frame size returns ErrorFrameTooLarge without
+// reading the payload and a frame that fails its checksum returns
+// ErrorChecksumMismatch, the stream can not be recovered after either.
+// Compressed frames are returned decompressed, they may not decompress to
+// more than the max frame size either.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	if _, err := io.ReadFull(fr.r, fr.prefix[:]); err != nil {
+		return nil, err
+	}
+
+	prefix := binary.BigEndian.Uint32(fr.prefix[:])
+	size := prefix & SIZE_MASK
+	if uint64(size) > uint64(fr.maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes, max is %d", ErrorFrameTooLarge, size, fr.maxSize)
+	}
+	if fr.checksums && prefix&FLAG_CHECKSUM == 0 {
+		return nil, fmt.Errorf("%w: frame has no checksum", ErrorChecksumMismatch)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if prefix&FLAG_CHECKSUM != 0 {
+		if _, err := io.ReadFull(fr.r, fr.trailer[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		want := binary.BigEndian.Uint32(fr.trailer[:])
+		got := crc32.Update(crc32.Checksum(fr.prefix[:], castagnoli), castagnoli, frame)
+		if got != want {
+			return nil, fmt.Errorf("%w: frame of %d bytes has crc %08x, expected %08x", ErrorChecksumMismatch, size, got, want)
+		}
+	}
+
+	if prefix&FLAG_COMPRESSED != 0 {
+		if fr.compressor == nil {
+			return nil, fmt.Errorf("%w: compressed frame without agreeing on a compression", ErrorMalformedMessage)
+		}
+		return fr.compressor.Decompress(frame, fr.maxSize)
+	}
+
+	return frame, nil
+}
+
+// Buffered returns the number of bytes that have been read from the stream
+// but not returned as frames yet
+func (fr *FrameReader) Buffered() int {
+	return fr.r.Buffered()
+}
+
+// FrameWriter writes length prefixed frames to a stream. Frames are batched
+// in a buffer and only reach the stream once the buffer fills up or Flush is
+// called.
+type FrameWriter struct {
+	w         *bufio.Writer
+	maxSize   int
+	prefix    [PREFIX_SIZE]byte
+	trailer   [CHECKSUM_SIZE]byte
+	checksums bool
+
+	compressor Compressor
+	threshold  int
+	// holds the last compressed payload
+	scratch []byte
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{
+		w:       bufio.NewWriterSize(w, 64*1024),
+		maxSize: MAX_MSG_SIZE,
+	}
+}
+
+// SetMaxFrameSize changes the largest frame the writer accepts
+func (fw *FrameWriter) SetMaxFrameSize(size int) {
+	fw.maxSize = size
+}
+
+// SetChecksums makes the writer follow every frame with its checksum
+func (fw *FrameWriter) SetChecksums(enabled bool) {
+	fw.checksums = enabled
+}
+
+// SetCompression makes the writer compress frames of at least threshold
+// bytes with c. Frames that do not get smaller are sent as they are, nil
+// turns compression off.
+func (fw *FrameWriter) SetCompression(c Compressor, threshold int) {
+	fw.compressor = c
+	fw.threshold = threshold
+}
+
+// WriteFrame prefixes the payload with its length and buffers it
+func (fw *FrameWriter) WriteFrame(payload []byte) error {
+	if len(payload) > fw.maxSize || uint64(len(payload)) > uint64(SIZE_MASK) {
+		return fmt.Errorf("%w: %d bytes, max is %d", ErrorFrameTooLarge, len(payload), fw.maxSize)
+	}
+
+	var prefix uint32
+	if fw.compressor != nil && len(payload) >= fw.threshold {
+		compressed, err := fw.compressor.Compress(fw.scratch[:0], payload)
+		if err != nil {
+			return err
+		}
+		fw.scratch = compressed
+		if len(compressed) < len(payload) {
+			payload = compressed
+			prefix |= FLAG_COMPRESSED
+		}
+	}
+
+	prefix |= uint32(len(payload))
+	if fw.checksums {
+		prefix |= FLAG_CHECKSUM
+	}
+	binary.BigEndian.PutUint32(fw.prefix[:], prefix)
+	if _, err := fw.w.Write(fw.prefix[:]); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(payload); err != nil {
+		return err
+	}
+	if !fw.checksums {
+		return nil
+	}
+
+	crc := crc32.Update(crc32.Checksum(fw.prefix[:], castagnoli), castagnoli, payload)
+	binary.BigEndian.PutUint32(fw.trailer[:], crc)
+	_, err := fw.w.Write(fw.trailer[:])
+	return err
+}
+
+// Flush writes every buffered frame to the stream
+func (fw *FrameWriter) Flush() error {
+	return fw.w.Flush()
+}
+
+// Buffered returns the number of bytes waiting to be flushed
+func (fw *FrameWriter) Buffered() int {
+	return fw.w.Buffered()
+}
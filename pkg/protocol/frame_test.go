@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf)
+
+	payloads := [][]byte{[]byte("one"), {}, bytes.Repeat([]byte("x"), 100_000), []byte("four")}
+	for i, p := range payloads {
+		if err := fw.WriteFrame(p); err != nil {
+			t.Fatal(err)
+		}
+
+		// small frames are batched until flushed or the buffer fills up
+		if i == 1 && (buf.Len() != 0 || fw.Buffered() != 2*PREFIX_SIZE+3) {
+			t.Fatalf("expected frames to be buffered, %d bytes written", buf.Len())
+		}
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := NewFrameReader(&buf)
+	var frames [][]byte
+	for {
+		frame, err := fr.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+
+	if len(frames) != len(payloads) {
+		t.Fatalf("got %d frames, want %d", len(frames), len(payloads))
+	}
+	for i := range payloads {
+		if !bytes.Equal(frames[i], payloads[i]) {
+			t.Fatalf("frame %d does not match", i)
+		}
+	}
+
+	// returned frames are owned by the caller
+	frames[0][0] = 'X'
+	if !bytes.Equal(frames[3], []byte("four")) {
+		t.Fatal("frames alias each other")
+	}
+}
+
+func TestFrameReaderRejectsLargePrefix(t *testing.T) {
+	// a 4 GiB prefix must fail immediately instead of buffering forever
+	fr := NewFrameReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}))
+	if _, err := fr.ReadFrame(); !errors.Is(err, ErrorFrameTooLarge) {
+		t.Fatalf("expected frame too large, got %v", err)
+	}
+
+	fr = NewFrameReader(bytes.NewReader([]byte{0, 0, 0, 9, 1, 2, 3}))
+	fr.SetMaxFrameSize(8)
+	if _, err := fr.ReadFrame(); !errors.Is(err, ErrorFrameTooLarge) {
+		t.Fatalf("expected frame too large, got %v", err)
+	}
+
+	fw := NewFrameWriter(io.Discard)
+	if err := fw.WriteFrame(make([]byte, MAX_MSG_SIZE+1)); !errors.Is(err, ErrorFrameTooLarge) {
+		t.Fatalf("expected frame too large, got %v", err)
+	}
+
+	if _, err := NewMessageParser().Parse([]byte{0xff, 0xff, 0xff, 0xff}); !errors.Is(err, ErrorFrameTooLarge) {
+		t.Fatalf("expected frame too large from parser, got %v", err)
+	}
+}
+
+func TestFrameReaderTruncated(t *testing.T) {
+	fr := NewFrameReader(bytes.NewReader([]byte{0, 0, 0, 5, 1, 2}))
+	if _, err := fr.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+
+	fr = NewFrameReader(bytes.NewReader([]byte{0, 0}))
+	if _, err := fr.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestFrameChecksums(t *testing.T) {
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf)
+	fw.SetChecksums(true)
+	for _, p := range [][]byte{[]byte("one"), {}} {
+		if err := fw.WriteFrame(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 2*(PREFIX_SIZE+CHECKSUM_SIZE)+3 {
+		t.Fatalf("expected every frame to carry a checksum, got %d bytes", buf.Len())
+	}
+	wire := bytes.Clone(buf.Bytes())
+
+	// readers verify checksums whether they require them or not
+	for _, required := range []bool{true, false} {
+		fr := NewFrameReader(bytes.NewReader(wire))
+		fr.SetChecksums(required)
+		if frame, err := fr.ReadFrame(); err != nil || string(frame) != "one" {
+			t.Fatalf("unexpected frame %q %v", frame, err)
+		}
+		if frame, err := fr.ReadFrame(); err != nil || len(frame) != 0 {
+			t.Fatalf("unexpected frame %q %v", frame, err)
+		}
+	}
+
+	// flipping a bit in the size, the payload or the checksum is noticed, the
+	// high bytes of the prefix only make the frame too large
+	for i := PREFIX_SIZE - 1; i < PREFIX_SIZE+3+CHECKSUM_SIZE; i++ {
+		corrupt := bytes.Clone(wire)
+		corrupt[i] ^= 0x01
+		fr := NewFrameReader(bytes.NewReader(corrupt))
+		fr.SetChecksums(true)
+		if _, err := fr.ReadFrame(); !errors.Is(err, ErrorChecksumMismatch) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("byte %d: expected a checksum mismatch, got %v", i, err)
+		}
+	}
+
+	// a reader that requires checksums refuses frames without
+	fr := NewFrameReader(bytes.NewReader([]byte{0, 0, 0, 1, 'x'}))
+	fr.SetChecksums(true)
+	if _, err := fr.ReadFrame(); !errors.Is(err, ErrorChecksumMismatch) {
+		t.Fatalf("expected a missing checksum to be refused, got %v", err)
+	}
+}
+
+// benchmarkFrames writes and reads frames of log lines, which compress about
+// as well as typical json or text content
+func benchmarkFrames(size int, b *testing.B, configure func(fw *FrameWriter, fr *FrameReader)) {
+	line := []byte(`{"level":"info","path":"/index.html","status":200,"took_ms":12}` + "\n")
+	payload := bytes.Repeat(line, size/len(line)+1)[:size]
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf)
+	fr := NewFrameReader(&buf)
+	configure(fw, fr)
+
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		if err := fw.WriteFrame(payload); err != nil {
+			b.Fatal(err)
+		}
+		if err := fw.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := fr.ReadFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func plainFrames(fw *FrameWriter, fr *FrameReader) {}
+
+func checksumFrames(fw *FrameWriter, fr *FrameReader) {
+	fw.SetChecksums(true)
+	fr.SetChecksums(true)
+}
+
+func compressedFrames(c Compressor) func(fw *FrameWriter, fr *FrameReader) {
+	return func(fw *FrameWriter, fr *FrameReader) {
+		fw.SetCompression(c, DEFAULT_COMPRESSION_THRESHOLD)
+		fr.SetCompression(c)
+	}
+}
+
+func BenchmarkFrames64(b *testing.B)           { benchmarkFrames(64, b, plainFrames) }
+func BenchmarkFrames64Checksums(b *testing.B)  { benchmarkFrames(64, b, checksumFrames) }
+func BenchmarkFrames64K(b *testing.B)          { benchmarkFrames(64*1024, b, plainFrames) }
+func BenchmarkFrames64KChecksums(b *testing.B) { benchmarkFrames(64*1024, b, checksumFrames) }
+func BenchmarkFrames64KFlate(b *testing.B)     { benchmarkFrames(64*1024, b, compressedFrames(Flate)) }
+func BenchmarkFrames64KGzip(b *testing.B)      { benchmarkFrames(64*1024, b, compressedFrames(Gzip)) }
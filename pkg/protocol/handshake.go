@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// PROTOCOL_VERSION is the version of KGPMP spoken by this package and
+// MIN_PROTOCOL_VERSION the oldest one it still understands
+const (
+	PROTOCOL_VERSION     uint16 = 1
+	MIN_PROTOCOL_VERSION uint16 = 1
+)
+
+// HandshakeCodec encodes the hello frames, the Hello inside them is always
+// CBOR. Every peer has to understand it because nothing else has been agreed
+// on yet.
+var HandshakeCodec = CBOR
+
+var ErrorHandshakeFailed = errors.New("handshake failed")
+
+// Feature is a bit set of optional protocol features
+type Feature uint32
+
+const (
+	// FeatureChunking lets messages larger than the max frame size be sent
+	// in parts
+	FeatureChunking Feature = 1 << iota
+	// FeatureHeartbeats lets either side Ping the other when the connection
+	// is idle and close it when the Pong never comes
+	FeatureHeartbeats
+	// FeatureChecksums follows every frame after the handshake with a CRC32C
+	// trailer. It costs a pass over every frame so it is left out of the
+	// DefaultFeatures, both sides have to ask for it.
+	FeatureChecksums
+)
+
+// DefaultFeatures are the features this package uses unless told otherwise
+const DefaultFeatures = FeatureChunking | FeatureHeartbeats
+
+func (f Feature) Has(other Feature) bool {
+	return f&other == other
+}
+
+// Hello is the content of the first frame each side of a connection sends.
+//
+// The client sends every codec it can speak in order of preference, the
+// largest frame it accepts, the features it supports and the compressions it
+// would like to use in order of preference. The node answers with the
+// version, the single codec, the frame size, the features and the compression
+// if any that both sides will use from then on, or with an Error when the
+// peers can not talk to each other. Not agreeing on a compression is fine,
+// frames are sent uncompressed then.
+type Hello struct {
+	Version      uint16   `cbor:"version"`
+	MinVersion   uint16   `cbor:"min_version,omitempty"`
+	Codecs       []string `cbor:"codecs,omitempty"`
+	ClientId     string   `cbor:"client_id,omitempty"`
+	NodeId       string   `cbor:"node_id,omitempty"`
+	ConnId       string   `cbor:"conn_id,omitempty"`
+	MaxFrameSize uint32   `cbor:"max_frame_size,omitempty"`
+	Features     Feature  `cbor:"features,omitempty"`
+	Compression  []string `cbor:"compression,omitempty"`
+}
+
+// Codec returns the negotiated codec of a node hello
+func (h Hello) Codec() (Codec, error) {
+	if len(h.Codecs) == 0 {
+		return nil, ErrorUnsupportedCodec
+	}
+	return CodecByName(h.Codecs[0])
+}
+
+// Compressor returns the negotiated compressor of a node hello, nil when the
+// frames are not compressed
+func (h Hello) Compressor() (Compressor, error) {
+	if len(h.Compression) == 0 {
+		return nil, nil
+	}
+	return CompressorByName(h.Compression[0])
+}
+
+// HelloMessage wraps the hello in a message ready to be encoded with the
+// HandshakeCodec
+func HelloMessage(h Hello) (Message, error) {
+	content, err := cbor.Marshal(h)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		Id:          "hello",
+		MessageType: Handshake,
+		Headers:     Headers{ClientId: h.ClientId, ConnId: h.ConnId},
+		Content:     content,
+		Timestamp:   time.Now().UnixMicro(),
+	}, nil
+}
+
+// ReadHello reads and decodes the hello frame of the peer. Errors the peer
+// put in the hello are returned as go errors.
+func ReadHello(fr *FrameReader) (Hello, error) {
+	frame, err := fr.ReadFrame()
+	if err != nil {
+		return Hello{}, err
+	}
+
+	var msg Message
+	if err := HandshakeCodec.Unmarshal(frame, &msg); err != nil {
+		return Hello{}, fmt.Errorf("%w: %w", ErrorHandshakeFailed, err)
+	}
+	if msg.MessageType != Handshake {
+		return Hello{}, fmt.Errorf("%w: expected hello, got message type %d", ErrorHandshakeFailed, msg.MessageType)
+	}
+	if len(msg.Errors) > 0 {
+		return Hello{}, fmt.Errorf("%w: %w", ErrorHandshakeFailed, msg.Errors[0].Err())
+	}
+
+	var h Hello
+	if err := cbor.Unmarshal(msg.Content, &h); err != nil {
+		return Hello{}, fmt.Errorf("%w: %w", ErrorHandshakeFailed, err)
+	}
+	return h, nil
+}
+
+// WriteHello writes the hello to the peer and flushes it
+func WriteHello(fw *FrameWriter, h Hello) error {
+	msg, err := HelloMessage(h)
+	if err != nil {
+		return err
+	}
+
+	return writeHandshake(fw, msg)
+}
+
+// RejectHello tells the peer why the handshake failed
+func RejectHello(fw *FrameWriter, code ErrorCode, err error) error {
+	return writeHandshake(fw, Message{
+		Id:          "hello",
+		MessageType: Handshake,
+		Errors:      []Error{{Message: err.Error(), Code: code}},
+		Timestamp:   time.Now().UnixMicro(),
+	})
+}
+
+func writeHandshake(fw *FrameWriter, msg Message) error {
+	payload, err := HandshakeCodec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := fw.WriteFrame(payload); err != nil {
+		return err
+	}
+	return fw.Flush()
+}
+
+// Negotiate picks the settings a node with the local hello uses for a client
+// that sent remote. The returned error carries the code the client should be
+// rejected with.
+func Negotiate(local Hello, remote Hello) (Hello, ErrorCode, error) {
+	version := min(local.Version, remote.Version)
+	if version < max(local.MinVersion, remote.MinVersion) || version == 0 {
+		return Hello{}, CodeUnsupportedVersion, fmt.Errorf("%w: node speaks %d-%d, client speaks %d-%d",
+			ErrorUnsupportedVersion, local.MinVersion, local.Version, remote.MinVersion, remote.Version)
+	}
+
+	var codec string
+	for _, name := range remote.Codecs {
+		if slices.Contains(local.Codecs, name) {
+			codec = name
+			break
+		}
+	}
+	if codec == "" {
+		return Hello{}, CodeUnsupportedCodec, fmt.Errorf("%w: node speaks %v, client speaks %v",
+			ErrorUnsupportedCodec, local.Codecs, remote.Codecs)
+	}
+
+	frameSize := local.MaxFrameSize
+	if remote.MaxFrameSize != 0 && remote.MaxFrameSize < frameSize {
+		frameSize = remote.MaxFrameSize
+	}
+
+	var compression []string
+	for _, name := range remote.Compression {
+		if slices.Contains(local.Compression, name) {
+			compression = []string{name}
+			break
+		}
+	}
+
+	return Hello{
+		Version:      version,
+		MinVersion:   local.MinVersion,
+		Codecs:       []string{codec},
+		ClientId:     remote.ClientId,
+		NodeId:       local.NodeId,
+		ConnId:       local.ConnId,
+		MaxFrameSize: frameSize,
+		Features:     local.Features & remote.Features,
+		Compression:  compression,
+	}, CodeNoError, nil
+}
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := Hello{
+		Version:      3,
+		MinVersion:   2,
+		Codecs:       []string{"cbor", "msgpack"},
+		NodeId:       "node",
+		ConnId:       "conn",
+		MaxFrameSize: 4096,
+		Features:     FeatureChunking,
+		Compression:  []string{"flate", "gzip"},
+	}
+
+	tests := []struct {
+		name   string
+		remote Hello
+		want   Hello
+		code   ErrorCode
+	}{
+		{
+			name:   "older client",
+			remote: Hello{Version: 2, MinVersion: 1, Codecs: []string{"json", "msgpack", "cbor"}, ClientId: "c"},
+			want:   Hello{Version: 2, MinVersion: 2, Codecs: []string{"msgpack"}, ClientId: "c", NodeId: "node", ConnId: "conn", MaxFrameSize: 4096},
+		},
+		{
+			name:   "newer client with smaller frames",
+			remote: Hello{Version: 9, MinVersion: 1, Codecs: []string{"cbor"}, MaxFrameSize: 1024, Features: FeatureChunking | 1<<8},
+			want:   Hello{Version: 3, MinVersion: 2, Codecs: []string{"cbor"}, NodeId: "node", ConnId: "conn", MaxFrameSize: 1024, Features: FeatureChunking},
+		},
+		{
+			name:   "compressing client",
+			remote: Hello{Version: 3, Codecs: []string{"cbor"}, Compression: []string{"zstd", "gzip", "flate"}},
+			want:   Hello{Version: 3, MinVersion: 2, Codecs: []string{"cbor"}, NodeId: "node", ConnId: "conn", MaxFrameSize: 4096, Compression: []string{"gzip"}},
+		},
+		{
+			name:   "no common compression",
+			remote: Hello{Version: 3, Codecs: []string{"cbor"}, Compression: []string{"zstd"}},
+			want:   Hello{Version: 3, MinVersion: 2, Codecs: []string{"cbor"}, NodeId: "node", ConnId: "conn", MaxFrameSize: 4096},
+		},
+		{
+			name:   "client too old",
+			remote: Hello{Version: 1, MinVersion: 1, Codecs: []string{"cbor"}},
+			code:   CodeUnsupportedVersion,
+		},
+		{
+			name:   "client too new",
+			remote: Hello{Version: 5, MinVersion: 4, Codecs: []string{"cbor"}},
+			code:   CodeUnsupportedVersion,
+		},
+		{
+			name:   "no common codec",
+			remote: Hello{Version: 3, Codecs: []string{"json"}},
+			code:   CodeUnsupportedCodec,
+		},
+	}
+
+	for _, tt := range tests {
+		got, code, err := Negotiate(local, tt.remote)
+		if code != tt.code {
+			t.Fatalf("%s: got code %d, want %d (%v)", tt.name, code, tt.code, err)
+		}
+		if tt.code != CodeNoError {
+			if !errors.Is(err, Error{Code: tt.code}.Err()) {
+				t.Fatalf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got.Version != tt.want.Version || got.MinVersion != tt.want.MinVersion || got.Codecs[0] != tt.want.Codecs[0] ||
+			got.ClientId != tt.want.ClientId || got.NodeId != tt.want.NodeId || got.ConnId != tt.want.ConnId ||
+			got.MaxFrameSize != tt.want.MaxFrameSize || got.Features != tt.want.Features || !slices.Equal(got.Compression, tt.want.Compression) {
+			t.Fatalf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf)
+	fr := NewFrameReader(&buf)
+
+	sent := Hello{Version: PROTOCOL_VERSION, Codecs: []string{"cbor"}, ClientId: "c", MaxFrameSize: 1024, Features: DefaultFeatures}
+	if err := WriteHello(fw, sent); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadHello(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != sent.Version || got.ClientId != "c" || got.MaxFrameSize != 1024 || got.Features != DefaultFeatures {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+	if c, err := got.Codec(); err != nil || c != CBOR {
+		t.Fatalf("unexpected codec %v, %v", c, err)
+	}
+
+	if err := RejectHello(fw, CodeUnsupportedCodec, ErrorUnsupportedCodec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHello(fr); !errors.Is(err, ErrorUnsupportedCodec) || !errors.Is(err, ErrorHandshakeFailed) {
+		t.Fatalf("expected unsupported codec, got %v", err)
+	}
+}
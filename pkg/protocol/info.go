@@ -0,0 +1,84 @@
+package protocol
+
+// Info describes a node, it is the content of the reply to a NodeInfo
+// request and encoded with the codec of the connection
+type Info struct {
+	NodeId string `cbor:"node_id"`
+	// Version of the node software
+	Version         string `cbor:"version"`
+	ProtocolVersion uint16 `cbor:"protocol_version"`
+	// Started is when the node started in unix microseconds
+	Started int64 `cbor:"started"`
+	// Uptime is how many milliseconds the node has been running
+	Uptime uint64 `cbor:"uptime"`
+
+	// Subscriptions counts the connections subscribed to each pattern
+	Subscriptions map[string]int `cbor:"subscriptions,omitempty"`
+	// Services counts the connections advertising each service topic
+	Services map[string]int `cbor:"services,omitempty"`
+
+	// traffic of every connection since the node started, including the
+	// ones that are gone
+	BytesIn     uint64 `cbor:"bytes_in"`
+	BytesOut    uint64 `cbor:"bytes_out"`
+	MessagesIn  uint64 `cbor:"messages_in"`
+	MessagesOut uint64 `cbor:"messages_out"`
+	// Dropped counts the published messages dropped because their
+	// subscriber could not keep up
+	Dropped uint64 `cbor:"dropped"`
+
+	// Conns are the open connections, clients and links to peers, sorted
+	// by id
+	Conns []ConnInfo `cbor:"conns,omitempty"`
+	// Members is the cluster as the node sees it, empty when the node does
+	// not gossip
+	Members []Member `cbor:"members,omitempty"`
+}
+
+// ConnInfo describes a connection of a node
+type ConnInfo struct {
+	Id       string `cbor:"id"`
+	ClientId string `cbor:"client_id,omitempty"`
+	// Subject the connection authenticated as
+	Subject    string `cbor:"subject,omitempty"`
+	RemoteAddr string `cbor:"remote_addr"`
+	Codec      string `cbor:"codec"`
+	// Peer is the id of the node on the other end of a link
+	Peer string `cbor:"peer,omitempty"`
+	// Connected is when the connection was accepted or dialed in unix
+	// microseconds
+	Connected int64 `cbor:"connected"`
+
+	Subscriptions []string `cbor:"subscriptions,omitempty"`
+	Services      []string `cbor:"services,omitempty"`
+
+	BytesIn     uint64 `cbor:"bytes_in"`
+	BytesOut    uint64 `cbor:"bytes_out"`
+	MessagesIn  uint64 `cbor:"messages_in"`
+	MessagesOut uint64 `cbor:"messages_out"`
+	Dropped     uint64 `cbor:"dropped"`
+	// Pending is how many frames wait to be written to the connection
+	Pending int `cbor:"pending"`
+}
+
+// Member is a node of the cluster
+type Member struct {
+	Id   string `cbor:"id"`
+	Addr string `cbor:"addr"`
+	// State is alive, suspect, dead or left
+	State       string `cbor:"state"`
+	Incarnation uint64 `cbor:"incarnation"`
+}
+
+// MarshalInfo encodes the content of a NodeInfo reply
+func MarshalInfo(c Codec, info Info) ([]byte, error) {
+	return MarshalValue(c, info)
+}
+
+// UnmarshalInfo decodes the content of a NodeInfo reply that was encoded
+// with the codec
+func UnmarshalInfo(c Codec, content []byte) (Info, error) {
+	var info Info
+	err := UnmarshalValue(c, content, &info)
+	return info, err
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import "github.com/fxamacker/cbor/v2"
+
+// KVEntry is a key of the key/value store of a node as returned by List
+type KVEntry struct {
+	// Key is the topic of the entry, $kv/<bucket>/<key>
+	Key      string `cbor:"key"`
+	Value    []byte `cbor:"value,omitempty"`
+	Revision uint64 `cbor:"revision"`
+	// Expires is when the key expires in unix microseconds, 0 if it never
+	// does
+	Expires int64 `cbor:"expires,omitempty"`
+}
+
+// MarshalKVEntries encodes entries as the content of a List reply. The list
+// is always CBOR, whatever codec the connection uses.
+func MarshalKVEntries(entries []KVEntry) ([]byte, error) {
+	return cbor.Marshal(entries)
+}
+
+// UnmarshalKVEntries decodes the content of a List reply
+func UnmarshalKVEntries(content []byte) ([]KVEntry, error) {
+	var entries []KVEntry
+	if len(content) == 0 {
+		return entries, nil
+	}
+	if err := cbor.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
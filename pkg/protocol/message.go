@@ -1,13 +1,10 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
-
-	"github.com/fxamacker/cbor/v2"
-	"github.com/vmihailenco/msgpack/v5"
+	"fmt"
+	"strings"
 )
 
 const MAX_MSG_SIZE = 1024 * 1024
@@ -15,16 +12,51 @@ const MAX_MSG_SIZE = 1024 * 1024
 type MessageType uint8
 
 const (
-	Unsupported MessageType = iota
-	Request                 // Send a request to a service topic
-	Reply                   // Send a reply from a service topic
-	Advertise               // Initiate a service topic
-	Unadvertise             // Close a service topic
-	Publish                 // Publish a message to a topic
-	Subscribe               // Subscribe to messages on a topic
-	Unsubscribe             // Unsubscribe from a topic
+	Unsupported    MessageType = iota
+	Request                    // Send a request to a service topic
+	Reply                      // Send a reply from a service topic
+	Advertise                  // Initiate a service topic
+	Unadvertise                // Close a service topic
+	Publish                    // Publish a message to a topic
+	Subscribe                  // Subscribe to messages on a topic
+	Unsubscribe                // Unsubscribe from a topic
+	Handshake                  // Exchange hellos when a connection opens
+	Authenticate               // Authenticate the connection with Headers.AuthToken
+	Enqueue                    // Add a message to a queue
+	Dequeue                    // Take the next message from a queue
+	Ack                        // Confirm a dequeued message was handled
+	Nack                       // Hand a dequeued message back to its queue
+	Get                        // Read a key of the node's key/value store
+	Put                        // Write a key, also the type of put watch events
+	Delete                     // Delete a key, also the type of delete watch events
+	List                       // Read every key matching a pattern
+	CompareAndSwap             // Write a key if its revision did not change
+	StreamOpen                 // Open a byte stream to a connection advertising the topic
+	StreamData                 // Bytes of a stream
+	StreamWindow               // Let the other end of a stream send Headers.Window more bytes
+	StreamClose                // Close a stream, with Errors when it failed
+	Gossip                     // Membership gossip between nodes, sent in datagrams
+	NodeInfo                   // Ask the node on topic $node about itself and the cluster
+	Shutdown                   // Tell clients on topic $node that the node shuts down
+	Ping                       // Check an idle connection is alive, answered with a Pong
+	Pong                       // Answer a Ping with its TxId
 )
 
+var messageTypeNames = []string{
+	"Unsupported", "Request", "Reply", "Advertise", "Unadvertise", "Publish",
+	"Subscribe", "Unsubscribe", "Handshake", "Authenticate", "Enqueue",
+	"Dequeue", "Ack", "Nack", "Get", "Put", "Delete", "List", "CompareAndSwap",
+	"StreamOpen", "StreamData", "StreamWindow", "StreamClose", "Gossip",
+	"NodeInfo", "Shutdown", "Ping", "Pong",
+}
+
+func (t MessageType) String() string {
+	if int(t) < len(messageTypeNames) {
+		return messageTypeNames[t]
+	}
+	return fmt.Sprintf("MessageType(%d)", uint8(t))
+}
+
 type ErrorCode uint8
 
 const (
@@ -33,6 +65,19 @@ const (
 	CodeCouldNotHandleMessage
 	CodeMalformedMessage
 	CodeUnauthorized
+	CodeIncompleteMessage
+	CodeUnsupportedVersion
+	CodeUnsupportedCodec
+	CodeQueueEmpty
+	CodeQueueFull
+	CodeUnknownReceipt
+	CodeKeyNotFound
+	CodeRevisionMismatch
+	CodeSlowConsumer
+	CodeShuttingDown
+	CodeHeartbeatTimeout
+	CodeChecksumMismatch
+	CodeRequestTimeout
 )
 
 var (
@@ -40,8 +85,42 @@ var (
 	ErrorCouldNotHandleMessage = errors.New("could not handle message")
 	ErrorMalformedMessage      = errors.New("malformed message")
 	ErrorUnauthorized          = errors.New("unauthorized")
+	ErrorIncompleteMessage     = errors.New("incomplete message")
+	ErrorUnsupportedVersion    = errors.New("unsupported protocol version")
+	ErrorUnsupportedCodec      = errors.New("unsupported codec")
+	ErrorQueueEmpty            = errors.New("queue is empty")
+	ErrorQueueFull             = errors.New("queue is full")
+	ErrorUnknownReceipt        = errors.New("unknown or expired receipt")
+	ErrorKeyNotFound           = errors.New("key not found")
+	ErrorRevisionMismatch      = errors.New("revision mismatch")
+	ErrorSlowConsumer          = errors.New("slow consumer")
+	ErrorShuttingDown          = errors.New("node is shutting down")
+	ErrorHeartbeatTimeout      = errors.New("missed heartbeats")
+	ErrorChecksumMismatch      = errors.New("checksum mismatch")
+	ErrorRequestTimeout        = errors.New("request timed out")
 )
 
+// codeErrors maps every error code to the error it stands for
+var codeErrors = map[ErrorCode]error{
+	CodeServiceTopicNotFound:  ErrorServiceTopicNotFound,
+	CodeCouldNotHandleMessage: ErrorCouldNotHandleMessage,
+	CodeMalformedMessage:      ErrorMalformedMessage,
+	CodeUnauthorized:          ErrorUnauthorized,
+	CodeIncompleteMessage:     ErrorIncompleteMessage,
+	CodeUnsupportedVersion:    ErrorUnsupportedVersion,
+	CodeUnsupportedCodec:      ErrorUnsupportedCodec,
+	CodeQueueEmpty:            ErrorQueueEmpty,
+	CodeQueueFull:             ErrorQueueFull,
+	CodeUnknownReceipt:        ErrorUnknownReceipt,
+	CodeKeyNotFound:           ErrorKeyNotFound,
+	CodeRevisionMismatch:      ErrorRevisionMismatch,
+	CodeSlowConsumer:          ErrorSlowConsumer,
+	CodeShuttingDown:          ErrorShuttingDown,
+	CodeHeartbeatTimeout:      ErrorHeartbeatTimeout,
+	CodeChecksumMismatch:      ErrorChecksumMismatch,
+	CodeRequestTimeout:        ErrorRequestTimeout,
+}
+
 // type Message struct {
 // 	ID       string          `msgpack:"id" json:"id" cbor:"id"`
 // 	Op       KoboldOperation `msgpack:"op" json:"op" cbor:"op"`
@@ -67,102 +146,77 @@ type Error struct {
 	Code    ErrorCode `cbor:"code,omitempty"`
 }
 
-type Headers struct {
-	ClientId  string `cbor:"client_id,omitempty"`
-	ConnId    string `cbor:"conn_id,omitempty"`
-	AuthToken string `cbor:"auth_token,omitempty"`
-}
-
-func PrefixWithLength(payload []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	// Check if payload exceeds maximum message size
-	if len(payload) > MAX_MSG_SIZE {
-		return nil, errors.New("message is too large")
+// Err converts the error into a go error that can be compared against the
+// Error* variables with errors.Is
+func (e Error) Err() error {
+	if e.Code == CodeNoError {
+		if e.Message == "" {
+			return nil
+		}
+		return errors.New(e.Message)
 	}
 
-	// Write payload length prefix to the buffer
-	bytesBigEndian := make([]byte, 4)
-	binary.BigEndian.PutUint32(bytesBigEndian, uint32(len(payload)))
-	_, err := buf.Write(bytesBigEndian)
-	if err != nil {
-		return nil, err
+	base, ok := codeErrors[e.Code]
+	if !ok {
+		return fmt.Errorf("error code %d: %s", e.Code, e.Message)
 	}
 
-	_, err = buf.Write(payload)
-	if err != nil {
-		return nil, err
+	// messages usually already start with the error the code stands for
+	message := strings.TrimPrefix(strings.TrimPrefix(e.Message, base.Error()), ": ")
+	if message == "" {
+		return base
 	}
-
-	return buf.Bytes(), nil
-
+	return fmt.Errorf("%w: %s", base, message)
 }
 
-func SerializeCBOR(msg Message) ([]byte, error) {
-	var payload []byte
-	var err error
-
-	payload, err = cbor.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Check if payload exceeds maximum message size
-	if len(payload) > MAX_MSG_SIZE {
-		return nil, errors.New("message is too large")
-	}
-
-	return PrefixWithLength(payload)
-}
-
-func DeserializeCBOR(data []byte, m *Message) error {
-	// in this case we assume that we already have chopped off the first 4 bytes
-	// as part of the parsing step. we now just need to Unmarshal cbor
-	return cbor.Unmarshal(data, m)
-}
-
-func SerializeMsgpack(msg Message) ([]byte, error) {
-	var payload []byte
-	var err error
-
-	payload, err = msgpack.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Check if payload exceeds maximum message size
-	if len(payload) > MAX_MSG_SIZE {
-		return nil, errors.New("message is too large")
-	}
-
-	return PrefixWithLength(payload)
+type Headers struct {
+	ClientId  string `cbor:"client_id,omitempty"`
+	ConnId    string `cbor:"conn_id,omitempty"`
+	AuthToken string `cbor:"auth_token,omitempty"`
+	// Part is the index of this part of a chunked message, starting at 0
+	Part uint32 `cbor:"part,omitempty"`
+	// TotalParts is the number of parts of a chunked message. Messages that
+	// are not chunked leave it at 0
+	TotalParts uint32 `cbor:"total_parts,omitempty"`
+	// Receipt identifies a dequeued message when it is acked or nacked
+	Receipt string `cbor:"receipt,omitempty"`
+	// Deliveries counts how often a dequeued message was handed out
+	Deliveries uint32 `cbor:"deliveries,omitempty"`
+	// Wait is how many milliseconds a dequeue may wait on an empty queue
+	Wait uint32 `cbor:"wait,omitempty"`
+	// Revision of a key/value entry. Compare and swap expects the current
+	// revision of the key here, 0 meaning the key must not exist
+	Revision uint64 `cbor:"revision,omitempty"`
+	// TTL is how many milliseconds a key lives after it was written, 0
+	// meaning forever
+	TTL uint32 `cbor:"ttl,omitempty"`
+	// StreamId identifies a stream on the connection. Each end knows the
+	// stream by its own id, the node translates between them
+	StreamId string `cbor:"stream_id,omitempty"`
+	// Window is how many bytes of stream data the sender is ready to take,
+	// the initial window on open and an increment afterwards
+	Window uint32 `cbor:"window,omitempty"`
+	// Path lists the nodes a message passed through, starting with the node
+	// it entered the cluster at, so its length is the hop count. For the
+	// interest nodes exchange it lists the nodes between the subscriber and
+	// the sender
+	Path []string `cbor:"path,omitempty"`
 }
 
-func DeserializeMsgpack(data []byte, m *Message) error {
-	// in this case we assume that we already have chopped off the first 4 bytes
-	// as part of the parsing step. we now just need to Unmarshal cbor
-	return msgpack.Unmarshal(data, m)
+// IsPart reports whether the message is one part of a chunked message
+func (m Message) IsPart() bool {
+	return m.Headers.TotalParts > 1
 }
 
-func SerializeJSON(msg Message) ([]byte, error) {
-	var payload []byte
-	var err error
-
-	payload, err = json.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-
+// PrefixWithLength copies the payload behind its length prefix. Encoding
+// with AppendFrame saves the copy.
+func PrefixWithLength(payload []byte) ([]byte, error) {
 	// Check if payload exceeds maximum message size
 	if len(payload) > MAX_MSG_SIZE {
-		return nil, errors.New("message is too large")
+		return nil, fmt.Errorf("%w: %d bytes, max is %d", ErrorFrameTooLarge, len(payload), MAX_MSG_SIZE)
 	}
 
-	// Write payload length prefix to the buffer
-	return PrefixWithLength(payload)
-}
-
-func DeserializeJSON(data []byte, m *Message) error {
-	// in this case we assume that we already have chopped off the first 4 bytes
-	// as part of the parsing step. we now just need to Unmarshal json
-	return json.Unmarshal(data, m)
+	frame := make([]byte, PREFIX_SIZE, PREFIX_SIZE+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	return append(frame, payload...), nil
 }
@@ -0,0 +1,13 @@
+package protocol
+
+import "testing"
+
+func TestMessageTypeString(t *testing.T) {
+	// the names have to keep up with the message types
+	if Pong.String() != "Pong" || Publish.String() != "Publish" {
+		t.Fatalf("names are out of sync, got %s and %s", Pong, Publish)
+	}
+	if s := MessageType(200).String(); s != "MessageType(200)" {
+		t.Fatalf("unexpected name of unknown type %s", s)
+	}
+}
@@ -1,12 +1,15 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/binary"
+	"fmt"
 )
 
 type MessageParser struct {
 	buffer []byte
+	// parsed is how much of the buffer the messages handed out last take up
+	parsed   int
+	messages [][]byte
 }
 
 func NewMessageParser() *MessageParser {
@@ -15,38 +18,65 @@ func NewMessageParser() *MessageParser {
 	}
 }
 
-// Extracts raw message bytes from a byte slice and puts it into bytes
+// Extracts raw message bytes from a byte slice and puts it into bytes. The
+// messages are the caller's to keep, ParseNoCopy does without copying them.
 func (p *MessageParser) Parse(data []byte) ([][]byte, error) {
+	messages, err := p.ParseNoCopy(data)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	// copy the messages out of the buffer, all of them into one allocation
+	size := 0
+	for _, m := range messages {
+		size += len(m)
+	}
+	buf := make([]byte, 0, size)
+	kept := make([][]byte, len(messages))
+	for i, m := range messages {
+		start := len(buf)
+		buf = append(buf, m...)
+		kept[i] = buf[start:len(buf):len(buf)]
+	}
+	return kept, nil
+}
+
+// ParseNoCopy is Parse for callers that are done with the messages before
+// they parse again. The messages point into the parser's buffer and are only
+// valid until the next call, like the bytes of a bufio.Scanner, so that
+// parsing does not allocate once the buffer grew large enough.
+func (p *MessageParser) ParseNoCopy(data []byte) ([][]byte, error) {
 	// this should be removed when reading from network connection or in the
 	// case where messages could be split between multiple chunks
-	var messages [][]byte
 
-	// Append incoming data to the buffer
-	p.buffer = append(p.buffer, data...)
+	// Drop the messages handed out last time and append incoming data to
+	// what is left of the buffer
+	n := copy(p.buffer, p.buffer[p.parsed:])
+	p.buffer = append(p.buffer[:n], data...)
+	p.parsed = 0
+	p.messages = p.messages[:0]
 
 	// Parse complete messages from the buffer
-	for len(p.buffer) >= 4 {
+	for len(p.buffer)-p.parsed >= PREFIX_SIZE {
 		// Read the length prefix
-		var messageLength uint32
-		if err := binary.Read(bytes.NewReader(p.buffer[:4]), binary.BigEndian, &messageLength); err != nil {
-			return nil, err
+		messageLength := binary.BigEndian.Uint32(p.buffer[p.parsed:])
+
+		// A prefix this large would make us buffer forever
+		if messageLength > MAX_MSG_SIZE {
+			return nil, fmt.Errorf("%w: %d bytes, max is %d", ErrorFrameTooLarge, messageLength, MAX_MSG_SIZE)
 		}
 
 		// Check if the buffer contains the complete message
-		if len(p.buffer) >= int(messageLength)+4 {
-			// Slice the buffer to extract message content
-			message := p.buffer[4 : 4+messageLength]
-
-			// Append the message to the list of parsed messages
-			messages = append(messages, message)
-
-			// Remove the parsed message from the buffer
-			p.buffer = p.buffer[4+messageLength:]
-		} else {
+		end := p.parsed + PREFIX_SIZE + int(messageLength)
+		if len(p.buffer) < end {
 			// Incomplete message in the buffer, wait for more data
 			break
 		}
+
+		// Slice the buffer to extract message content
+		p.messages = append(p.messages, p.buffer[p.parsed+PREFIX_SIZE:end:end])
+		p.parsed = end
 	}
 
-	return messages, nil
+	return p.messages, nil
 }
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+)
+
+func frames(count int) []byte {
+	var data []byte
+	for i := range count {
+		data, _ = AppendFrame(data, CBOR, Message{Id: fmt.Sprint(i), MessageType: Publish, Topic: "/hello/world"})
+	}
+	return data
+}
+
+func TestMessageParser(t *testing.T) {
+	data := frames(10)
+	p := NewMessageParser()
+
+	// feed the frames a few bytes at a time so that they are split up
+	parsed := 0
+	for start := 0; start < len(data); start += 7 {
+		messages, err := p.Parse(data[start:min(start+7, len(data))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, payload := range messages {
+			var msg Message
+			if err := CBOR.Unmarshal(payload, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Id != fmt.Sprint(parsed) {
+				t.Fatalf("expected message %d, got %+v", parsed, msg)
+			}
+			parsed++
+		}
+	}
+	if parsed != 10 {
+		t.Fatalf("expected 10 messages, got %d", parsed)
+	}
+}
+
+func TestMessageParserKeepsMessages(t *testing.T) {
+	data := frames(10)
+	p := NewMessageParser()
+
+	// messages from Parse survive the calls after it, those from
+	// ParseNoCopy do not have to
+	var kept [][]byte
+	half := len(data) / 2
+	for _, chunk := range [][]byte{data[:half], data[half:]} {
+		messages, err := p.Parse(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, messages...)
+	}
+	for range 3 {
+		if _, err := p.ParseNoCopy(frames(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(kept) != 10 {
+		t.Fatalf("expected 10 messages, got %d", len(kept))
+	}
+	for i, payload := range kept {
+		var msg Message
+		if err := CBOR.Unmarshal(payload, &msg); err != nil || msg.Id != fmt.Sprint(i) {
+			t.Fatalf("message %d changed: %+v %v", i, msg, err)
+		}
+	}
+}
+
+func TestMessageParserAllocs(t *testing.T) {
+	data := frames(10)
+	p := NewMessageParser()
+
+	// the first call grows the buffers
+	half := len(data) / 2
+	p.ParseNoCopy(data[:half])
+	p.ParseNoCopy(data[half:])
+
+	allocs := testing.AllocsPerRun(100, func() {
+		p.ParseNoCopy(data[:half])
+		p.ParseNoCopy(data[half:])
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	benchmarkParse(b, (*MessageParser).Parse)
+}
+
+func BenchmarkParseNoCopy(b *testing.B) {
+	benchmarkParse(b, (*MessageParser).ParseNoCopy)
+}
+
+func benchmarkParse(b *testing.B, parse func(*MessageParser, []byte) ([][]byte, error)) {
+	b.ReportAllocs()
+	data := frames(100)
+	p := NewMessageParser()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		messages, err := parse(p, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(messages) != 100 {
+			b.Fatalf("expected 100 messages, got %d", len(messages))
+		}
+	}
+}
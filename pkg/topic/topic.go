@@ -0,0 +1,216 @@
+// Package topic defines what a legal KGPMP topic looks like and how
+// subscription patterns are matched against the topics messages are
+// published to.
+//
+// A topic is made of segments separated by "/" and always starts with a "/",
+// e.g. "/hello/world". Topics that are handled by the node itself instead
+// start with a keyword such as "$node".
+//
+// Subscription patterns may additionally use wildcards as whole segments:
+//
+//	/hello/*  matches exactly one segment, /hello/world but not /hello/a/b
+//	/hello/>  matches one or more trailing segments, /hello/a and /hello/a/b
+//
+// Wildcards never match a keyword, so "/>" does not match "$node".
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	Separator      = "/"
+	SingleWildcard = "*"
+	TailWildcard   = ">"
+	KeywordPrefix  = "$"
+
+	// MaxLength is the longest topic or pattern in bytes
+	MaxLength = 255
+)
+
+// NodeKeyword addresses the node the client is currently connected to
+const NodeKeyword = "$node"
+
+// DeadLetterKeyword prefixes the queues that hold messages which were
+// delivered too often, e.g. $dlq/jobs for the queue /jobs
+const DeadLetterKeyword = "$dlq"
+
+// KVKeyword prefixes the keys of the key/value store of the node,
+// $kv/<bucket>/<key> where the key may have several segments
+const KVKeyword = "$kv"
+
+var keywords = map[string]bool{
+	NodeKeyword:       true,
+	DeadLetterKeyword: true,
+	KVKeyword:         true,
+}
+
+var (
+	ErrorEmptyTopic      = errors.New("topic is empty")
+	ErrorTopicTooLong    = errors.New("topic is too long")
+	ErrorInvalidTopic    = errors.New("invalid topic")
+	ErrorWildcardInTopic = errors.New("wildcards are only allowed in subscriptions")
+	ErrorUnknownKeyword  = errors.New("unknown topic keyword")
+)
+
+// IsKeyword reports whether the topic or pattern is addressed to a keyword
+// such as $node
+func IsKeyword(topic string) bool {
+	return strings.HasPrefix(topic, KeywordPrefix)
+}
+
+// Keyword returns the keyword the topic starts with or an empty string
+func Keyword(topic string) string {
+	if !IsKeyword(topic) {
+		return ""
+	}
+	kw, _, _ := strings.Cut(topic, Separator)
+	return kw
+}
+
+// KV returns the topic of the key in the bucket
+func KV(bucket, key string) string {
+	return KVKeyword + Separator + bucket + Separator + key
+}
+
+// SplitKV returns the bucket and key of a key/value topic or pattern
+func SplitKV(topic string) (bucket, key string, ok bool) {
+	rest, ok := strings.CutPrefix(topic, KVKeyword+Separator)
+	if !ok {
+		return "", "", false
+	}
+	bucket, key, ok = strings.Cut(rest, Separator)
+	return bucket, key, ok && bucket != "" && key != ""
+}
+
+// Validate checks that the topic is legal to publish or send a request to.
+// It may not contain wildcards.
+func Validate(topic string) error {
+	_, err := split(topic, false)
+	return err
+}
+
+// ValidatePattern checks that the pattern is legal to subscribe to
+func ValidatePattern(pattern string) error {
+	_, err := split(pattern, true)
+	return err
+}
+
+// Match reports whether the topic matches the subscription pattern. Invalid
+// topics and patterns never match.
+func Match(pattern, topic string) bool {
+	p, err := split(pattern, true)
+	if err != nil {
+		return false
+	}
+	t, err := split(topic, false)
+	if err != nil {
+		return false
+	}
+
+	for i, seg := range p {
+		switch {
+		case seg == TailWildcard:
+			return len(t) > i && !(i == 0 && IsKeyword(t[0]))
+		case i >= len(t):
+			return false
+		case seg == SingleWildcard:
+			if i == 0 && IsKeyword(t[0]) {
+				return false
+			}
+		case seg != t[i]:
+			return false
+		}
+	}
+
+	return len(p) == len(t)
+}
+
+// Covers reports whether every topic matched by other is also matched by
+// pattern. Both may contain wildcards. Invalid patterns never cover anything.
+func Covers(pattern, other string) bool {
+	p, err := split(pattern, true)
+	if err != nil {
+		return false
+	}
+	o, err := split(other, true)
+	if err != nil {
+		return false
+	}
+
+	for i, seg := range p {
+		switch {
+		case seg == TailWildcard:
+			return len(o) > i && !(i == 0 && IsKeyword(o[0]))
+		case i >= len(o):
+			return false
+		case o[i] == TailWildcard:
+			// other reaches deeper than pattern does
+			return false
+		case seg == SingleWildcard:
+			if i == 0 && IsKeyword(o[0]) {
+				return false
+			}
+		case seg != o[i]:
+			return false
+		}
+	}
+
+	return len(p) == len(o)
+}
+
+// split validates the topic and breaks it into segments. The keyword of a
+// keyword topic is kept as the first segment.
+func split(topic string, wildcards bool) ([]string, error) {
+	if topic == "" {
+		return nil, ErrorEmptyTopic
+	}
+	if len(topic) > MaxLength {
+		return nil, ErrorTopicTooLong
+	}
+
+	var segments []string
+	if IsKeyword(topic) {
+		segments = strings.Split(topic, Separator)
+		if !keywords[segments[0]] {
+			return nil, fmt.Errorf("%w: %q", ErrorUnknownKeyword, segments[0])
+		}
+	} else {
+		if !strings.HasPrefix(topic, Separator) {
+			return nil, fmt.Errorf("%w: %q must start with %q", ErrorInvalidTopic, topic, Separator)
+		}
+		segments = strings.Split(topic[len(Separator):], Separator)
+	}
+
+	for i, seg := range segments {
+		if i == 0 && IsKeyword(seg) {
+			continue
+		}
+		if seg == "" {
+			return nil, fmt.Errorf("%w: %q has an empty segment", ErrorInvalidTopic, topic)
+		}
+
+		if seg == SingleWildcard || seg == TailWildcard {
+			if !wildcards {
+				return nil, fmt.Errorf("%w: %q", ErrorWildcardInTopic, topic)
+			}
+			if seg == TailWildcard && i != len(segments)-1 {
+				return nil, fmt.Errorf("%w: %q must be the last segment of %q", ErrorInvalidTopic, TailWildcard, topic)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(seg, KeywordPrefix) {
+			return nil, fmt.Errorf("%w: %q may only start a topic", ErrorInvalidTopic, KeywordPrefix)
+		}
+		for _, r := range seg {
+			if r <= ' ' || r == 0x7f || r == '*' || r == '>' {
+				return nil, fmt.Errorf("%w: %q contains %q", ErrorInvalidTopic, topic, r)
+			}
+		}
+	}
+
+	return segments, nil
+}
@@ -0,0 +1,199 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []string{"/hello", "/hello/world", "/a-b/c_d/1.2", "$node", "$node/info"}
+	for _, topic := range valid {
+		if err := Validate(topic); err != nil {
+			t.Errorf("%q: unexpected error %v", topic, err)
+		}
+	}
+
+	invalid := map[string]error{
+		"":                                    ErrorEmptyTopic,
+		"hello":                               ErrorInvalidTopic,
+		"/":                                   ErrorInvalidTopic,
+		"/hello/":                             ErrorInvalidTopic,
+		"/hello//world":                       ErrorInvalidTopic,
+		"/hello world":                        ErrorInvalidTopic,
+		"/a/$node":                            ErrorInvalidTopic,
+		"/a*":                                 ErrorInvalidTopic,
+		"/hello/*":                            ErrorWildcardInTopic,
+		"/hello/>":                            ErrorWildcardInTopic,
+		"$nope":                               ErrorUnknownKeyword,
+		"/" + string(make([]byte, MaxLength)): ErrorTopicTooLong,
+	}
+	for topic, want := range invalid {
+		if err := Validate(topic); !errors.Is(err, want) {
+			t.Errorf("%q: got %v, want %v", topic, err, want)
+		}
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	for _, pattern := range []string{"/hello/*", "/hello/>", "/*/world", "/>", "$node/>"} {
+		if err := ValidatePattern(pattern); err != nil {
+			t.Errorf("%q: unexpected error %v", pattern, err)
+		}
+	}
+
+	for _, pattern := range []string{"/>/world", "/hello/>/", "/he*"} {
+		if err := ValidatePattern(pattern); !errors.Is(err, ErrorInvalidTopic) {
+			t.Errorf("%q: got %v, want %v", pattern, err, ErrorInvalidTopic)
+		}
+	}
+}
+
+var matchCases = []struct {
+	pattern string
+	topic   string
+	match   bool
+}{
+	{"/hello/world", "/hello/world", true},
+	{"/hello/world", "/hello", false},
+	{"/hello", "/hello/world", false},
+	{"/hello/*", "/hello/world", true},
+	{"/hello/*", "/hello/world/again", false},
+	{"/hello/*", "/hello", false},
+	{"/*/world", "/hello/world", true},
+	{"/hello/>", "/hello/world", true},
+	{"/hello/>", "/hello/world/again", true},
+	{"/hello/>", "/hello", false},
+	{"/>", "/anything/at/all", true},
+	{"/>", "$node", false},
+	{"/*", "$node", false},
+	{"$node", "$node", true},
+	{"$node/>", "$node/info", true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range matchCases {
+		if got := Match(tc.pattern, tc.topic); got != tc.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", tc.pattern, tc.topic, got, tc.match)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	// a pattern covers every topic it matches
+	for _, tc := range matchCases {
+		if got := Covers(tc.pattern, tc.topic); got != tc.match {
+			t.Errorf("Covers(%q, %q) = %v, want %v", tc.pattern, tc.topic, got, tc.match)
+		}
+	}
+
+	tests := []struct {
+		pattern, other string
+		covers         bool
+	}{
+		{"/a/>", "/a/*", true},
+		{"/a/>", "/a/>", true},
+		{"/a/>", "/a/*/c", true},
+		{"/a/*", "/a/*", true},
+		{"/a/*", "/a/>", false},
+		{"/a/b", "/a/*", false},
+		{"/a/*/c", "/a/>", false},
+		{"/>", "$node/>", false},
+		{"$node/>", "$node/*", true},
+		{"/a/>", "/a", false},
+	}
+	for _, tc := range tests {
+		if got := Covers(tc.pattern, tc.other); got != tc.covers {
+			t.Errorf("Covers(%q, %q) = %v, want %v", tc.pattern, tc.other, got, tc.covers)
+		}
+	}
+}
+
+func TestTrieMatchesLikeMatch(t *testing.T) {
+	for _, tc := range matchCases {
+		trie := NewTrie[string]()
+		if err := trie.Insert(tc.pattern, "v"); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(trie.Match(tc.topic)) == 1; got != tc.match {
+			t.Errorf("trie %q against %q = %v, want %v", tc.pattern, tc.topic, got, tc.match)
+		}
+	}
+}
+
+func TestTrie(t *testing.T) {
+	trie := NewTrie[int]()
+	for i, pattern := range []string{"/a/b", "/a/*", "/a/>", "/a/b"} {
+		if err := trie.Insert(pattern, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a value subscribed through several patterns is only returned once
+	trie.Insert("/a/*", 0)
+
+	got := trie.Match("/a/b")
+	sort.Ints(got)
+	if fmt.Sprint(got) != "[0 1 2 3]" {
+		t.Fatalf("unexpected match %v", got)
+	}
+	if trie.Len() != 5 {
+		t.Fatalf("unexpected len %d", trie.Len())
+	}
+
+	if !trie.Remove("/a/b", 0) || trie.Remove("/a/b", 0) {
+		t.Fatal("remove should report presence")
+	}
+	trie.Remove("/a/b", 3)
+	trie.Remove("/a/*", 1)
+	trie.Remove("/a/*", 0)
+
+	if got := trie.Match("/a/b"); fmt.Sprint(got) != "[2]" {
+		t.Fatalf("unexpected match %v", got)
+	}
+	if patterns := trie.Patterns(); fmt.Sprint(patterns) != "[/a/>]" {
+		t.Fatalf("unexpected patterns %v", patterns)
+	}
+
+	trie.Remove("/a/>", 2)
+	if len(trie.root.children) != 0 {
+		t.Fatal("empty branches were not pruned")
+	}
+}
+
+func benchmarkTrieMatch(subscriptions int, b *testing.B) {
+	trie := NewTrie[int]()
+	for i := 0; i < subscriptions; i++ {
+		var pattern string
+		switch i % 10 {
+		case 0:
+			pattern = fmt.Sprintf("/service/%d/*", i)
+		case 1:
+			pattern = fmt.Sprintf("/service/%d/>", i)
+		default:
+			pattern = fmt.Sprintf("/service/%d/events", i)
+		}
+		if err := trie.Insert(pattern, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+	trie.Insert("/service/*/events", -1)
+	trie.Insert("/>", -2)
+
+	topics := make([]string, 1024)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("/service/%d/events", (i*7919)%subscriptions)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(trie.Match(topics[i%len(topics)])) == 0 {
+			b.Fatal("no match")
+		}
+	}
+}
+
+func BenchmarkTrieMatch1000(b *testing.B)   { benchmarkTrieMatch(1_000, b) }
+func BenchmarkTrieMatch10000(b *testing.B)  { benchmarkTrieMatch(10_000, b) }
+func BenchmarkTrieMatch100000(b *testing.B) { benchmarkTrieMatch(100_000, b) }
@@ -0,0 +1,199 @@
+package topic
+
+import "sync"
+
+// Trie stores values under subscription patterns and finds every value whose
+// pattern matches a topic. It is safe for concurrent use.
+type Trie[T comparable] struct {
+	mu   sync.RWMutex
+	root *trieNode[T]
+	len  int
+}
+
+type trieNode[T comparable] struct {
+	children map[string]*trieNode[T]
+	// values subscribed to the pattern that ends at this node
+	values map[T]struct{}
+}
+
+func newTrieNode[T comparable]() *trieNode[T] {
+	return &trieNode[T]{children: map[string]*trieNode[T]{}}
+}
+
+func NewTrie[T comparable]() *Trie[T] {
+	return &Trie[T]{root: newTrieNode[T]()}
+}
+
+// Insert adds the value under the pattern. Inserting the same value under the
+// same pattern twice is a no-op.
+func (t *Trie[T]) Insert(pattern string, v T) error {
+	segments, err := split(pattern, true)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for _, seg := range segments {
+		child, ok := n.children[seg]
+		if !ok {
+			child = newTrieNode[T]()
+			n.children[seg] = child
+		}
+		n = child
+	}
+
+	if n.values == nil {
+		n.values = map[T]struct{}{}
+	}
+	if _, ok := n.values[v]; !ok {
+		n.values[v] = struct{}{}
+		t.len++
+	}
+
+	return nil
+}
+
+// Remove deletes the value from the pattern and prunes empty branches. It
+// reports whether the value was present.
+func (t *Trie[T]) Remove(pattern string, v T) bool {
+	segments, err := split(pattern, true)
+	if err != nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := make([]*trieNode[T], 0, len(segments)+1)
+	n := t.root
+	path = append(path, n)
+	for _, seg := range segments {
+		child, ok := n.children[seg]
+		if !ok {
+			return false
+		}
+		n = child
+		path = append(path, n)
+	}
+
+	if _, ok := n.values[v]; !ok {
+		return false
+	}
+	delete(n.values, v)
+	t.len--
+
+	// walk back up removing nodes that no longer lead anywhere
+	for i := len(segments) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if len(child.values) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, segments[i])
+	}
+
+	return true
+}
+
+// Match returns every value with a pattern matching the topic. A value that
+// is subscribed under several matching patterns is only returned once.
+func (t *Trie[T]) Match(topic string) []T {
+	segments, err := split(topic, false)
+	if err != nil {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var matched []*trieNode[T]
+	matched = t.root.match(segments, 0, matched)
+
+	switch len(matched) {
+	case 0:
+		return nil
+	case 1:
+		values := make([]T, 0, len(matched[0].values))
+		for v := range matched[0].values {
+			values = append(values, v)
+		}
+		return values
+	}
+
+	seen := map[T]struct{}{}
+	var values []T
+	for _, n := range matched {
+		for v := range n.values {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Len returns the number of pattern/value pairs in the trie
+func (t *Trie[T]) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.len
+}
+
+// Patterns returns every pattern that has at least one value
+func (t *Trie[T]) Patterns() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var patterns []string
+	t.root.walk("", func(pattern string, n *trieNode[T]) {
+		if len(n.values) > 0 {
+			patterns = append(patterns, pattern)
+		}
+	})
+	return patterns
+}
+
+func (n *trieNode[T]) walk(prefix string, fn func(pattern string, n *trieNode[T])) {
+	for seg, child := range n.children {
+		pattern := prefix + Separator + seg
+		if prefix == "" && IsKeyword(seg) {
+			pattern = seg
+		}
+		fn(pattern, child)
+		child.walk(pattern, fn)
+	}
+}
+
+// match collects every node with values whose pattern matches segments[i:]
+func (n *trieNode[T]) match(segments []string, i int, matched []*trieNode[T]) []*trieNode[T] {
+	if i == len(segments) {
+		if len(n.values) > 0 {
+			matched = append(matched, n)
+		}
+		return matched
+	}
+
+	seg := segments[i]
+	// wildcards never match keywords
+	wild := !(i == 0 && IsKeyword(seg))
+
+	if child, ok := n.children[seg]; ok {
+		matched = child.match(segments, i+1, matched)
+	}
+	if !wild {
+		return matched
+	}
+	if child, ok := n.children[SingleWildcard]; ok {
+		matched = child.match(segments, i+1, matched)
+	}
+	if child, ok := n.children[TailWildcard]; ok && len(child.values) > 0 {
+		matched = append(matched, child)
+	}
+
+	return matched
+}
@@ -0,0 +1,208 @@
+package protos
+
+import (
+	"capnproto.org/go/capnp/v3"
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+// CapnpCodec adapts KoboldMessage to the protocol.Codec interface. Every
+// field of protocol.Message has a counterpart in the schema, a message comes
+// out of a round trip the way it went in.
+var CapnpCodec protocol.Codec = capnpCodec{}
+
+func init() {
+	protocol.MustRegisterCodec(CapnpCodec)
+}
+
+type capnpCodec struct{}
+
+func (capnpCodec) Name() string         { return "capnp" }
+func (capnpCodec) ID() protocol.CodecID { return protocol.CodecIDCapnp }
+
+func (capnpCodec) Marshal(m protocol.Message) ([]byte, error) {
+	msg, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	kmsg, err := NewRootKoboldMessage(seg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := kmsg.SetId(m.Id); err != nil {
+		return nil, err
+	}
+	if err := kmsg.SetTopic(m.Topic); err != nil {
+		return nil, err
+	}
+	if err := kmsg.SetTxId(m.TxId); err != nil {
+		return nil, err
+	}
+	if err := kmsg.SetContent(m.Content); err != nil {
+		return nil, err
+	}
+	kmsg.SetMessageType(uint8(m.MessageType))
+	kmsg.SetTimestamp(m.Timestamp)
+
+	headers, err := kmsg.NewHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if err := marshalHeaders(headers, m.Headers); err != nil {
+		return nil, err
+	}
+
+	if len(m.Errors) > 0 {
+		errs, err := kmsg.NewErrors(int32(len(m.Errors)))
+		if err != nil {
+			return nil, err
+		}
+		for i, e := range m.Errors {
+			if err := errs.At(i).SetErrorMessage(e.Message); err != nil {
+				return nil, err
+			}
+			errs.At(i).SetCode(uint8(e.Code))
+		}
+	}
+
+	return msg.Marshal()
+}
+
+func marshalHeaders(headers Headers, h protocol.Headers) error {
+	if err := headers.SetClientId(h.ClientId); err != nil {
+		return err
+	}
+	if err := headers.SetConnId(h.ConnId); err != nil {
+		return err
+	}
+	if err := headers.SetAuthToken(h.AuthToken); err != nil {
+		return err
+	}
+	if err := headers.SetReceipt(h.Receipt); err != nil {
+		return err
+	}
+	if err := headers.SetStreamId(h.StreamId); err != nil {
+		return err
+	}
+	headers.SetPart(h.Part)
+	headers.SetTotalParts(h.TotalParts)
+	headers.SetDeliveries(h.Deliveries)
+	headers.SetWait(h.Wait)
+	headers.SetRevision(h.Revision)
+	headers.SetTtl(h.TTL)
+	headers.SetWindow(h.Window)
+
+	if len(h.Path) == 0 {
+		return nil
+	}
+	path, err := headers.NewPath(int32(len(h.Path)))
+	if err != nil {
+		return err
+	}
+	for i, node := range h.Path {
+		if err := path.Set(i, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (capnpCodec) Unmarshal(data []byte, m *protocol.Message) error {
+	msg, err := capnp.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	kmsg, err := ReadRootKoboldMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	dec := protocol.Message{
+		MessageType: protocol.MessageType(kmsg.MessageType()),
+		Timestamp:   kmsg.Timestamp(),
+	}
+	if dec.Id, err = kmsg.Id(); err != nil {
+		return err
+	}
+	if dec.Topic, err = kmsg.Topic(); err != nil {
+		return err
+	}
+	if dec.TxId, err = kmsg.TxId(); err != nil {
+		return err
+	}
+
+	content, err := kmsg.Content()
+	if err != nil {
+		return err
+	}
+	// content points into the capnp arena which is backed by data, copy it so
+	// the message outlives the frame it was decoded from
+	dec.Content = append([]byte(nil), content...)
+
+	headers, err := kmsg.Headers()
+	if err != nil {
+		return err
+	}
+	if dec.Headers, err = unmarshalHeaders(headers); err != nil {
+		return err
+	}
+
+	errs, err := kmsg.Errors()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < errs.Len(); i++ {
+		message, err := errs.At(i).ErrorMessage()
+		if err != nil {
+			return err
+		}
+		dec.Errors = append(dec.Errors, protocol.Error{Message: message, Code: protocol.ErrorCode(errs.At(i).Code())})
+	}
+
+	*m = dec
+	return nil
+}
+
+func unmarshalHeaders(headers Headers) (protocol.Headers, error) {
+	h := protocol.Headers{
+		Part:       headers.Part(),
+		TotalParts: headers.TotalParts(),
+		Deliveries: headers.Deliveries(),
+		Wait:       headers.Wait(),
+		Revision:   headers.Revision(),
+		TTL:        headers.Ttl(),
+		Window:     headers.Window(),
+	}
+
+	var err error
+	if h.ClientId, err = headers.ClientId(); err != nil {
+		return h, err
+	}
+	if h.ConnId, err = headers.ConnId(); err != nil {
+		return h, err
+	}
+	if h.AuthToken, err = headers.AuthToken(); err != nil {
+		return h, err
+	}
+	if h.Receipt, err = headers.Receipt(); err != nil {
+		return h, err
+	}
+	if h.StreamId, err = headers.StreamId(); err != nil {
+		return h, err
+	}
+
+	path, err := headers.Path()
+	if err != nil {
+		return h, err
+	}
+	for i := 0; i < path.Len(); i++ {
+		node, err := path.At(i)
+		if err != nil {
+			return h, err
+		}
+		h.Path = append(h.Path, node)
+	}
+	return h, nil
+}
@@ -0,0 +1,60 @@
+package protos
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	msgs := []protocol.Message{
+		{},
+		{
+			Id:          "1",
+			MessageType: protocol.Reply,
+			Topic:       "/hello/world",
+			TxId:        "tx",
+			Headers: protocol.Headers{
+				ClientId:   "client",
+				ConnId:     "conn",
+				AuthToken:  "token",
+				Part:       1,
+				TotalParts: 2,
+				Receipt:    "receipt",
+				Deliveries: 3,
+				Wait:       4,
+				Revision:   1 << 40,
+				TTL:        5,
+				StreamId:   "stream",
+				Window:     6,
+				Path:       []string{"a", "b"},
+			},
+			Content:   []byte("hello world"),
+			Errors:    []protocol.Error{{Message: "oops", Code: protocol.CodeMalformedMessage}, {}},
+			Timestamp: -1234,
+		},
+	}
+
+	codec, err := protocol.CodecByName("capnp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range msgs {
+		data, err := codec.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// decoding overwrites what was there
+		dec := protocol.Message{Topic: "/stale", Headers: protocol.Headers{Path: []string{"stale"}}}
+		if err := codec.Unmarshal(data, &dec); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(m, dec) {
+			t.Fatalf("got %+v, want %+v", dec, m)
+		}
+	}
+}
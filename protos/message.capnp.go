@@ -15,12 +15,12 @@ type KoboldMessage capnp.Struct
 const KoboldMessage_TypeID = 0xa99b87f2a92d7eed
 
 func NewKoboldMessage(s *capnp.Segment) (KoboldMessage, error) {
-	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 4})
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 6})
 	return KoboldMessage(st), err
 }
 
 func NewRootKoboldMessage(s *capnp.Segment) (KoboldMessage, error) {
-	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 4})
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 6})
 	return KoboldMessage(st), err
 }
 
@@ -123,12 +123,75 @@ func (s KoboldMessage) SetContent(v []byte) error {
 	return capnp.Struct(s).SetData(3, v)
 }
 
+func (s KoboldMessage) MessageType() uint8 {
+	return capnp.Struct(s).Uint8(0)
+}
+
+func (s KoboldMessage) SetMessageType(v uint8) {
+	capnp.Struct(s).SetUint8(0, v)
+}
+
+func (s KoboldMessage) Headers() (Headers, error) {
+	p, err := capnp.Struct(s).Ptr(4)
+	return Headers(p.Struct()), err
+}
+
+func (s KoboldMessage) HasHeaders() bool {
+	return capnp.Struct(s).HasPtr(4)
+}
+
+func (s KoboldMessage) SetHeaders(v Headers) error {
+	return capnp.Struct(s).SetPtr(4, capnp.Struct(v).ToPtr())
+}
+
+// NewHeaders sets the headers field to a newly
+// allocated Headers struct, preferring placement in s's segment.
+func (s KoboldMessage) NewHeaders() (Headers, error) {
+	ss, err := NewHeaders(capnp.Struct(s).Segment())
+	if err != nil {
+		return Headers{}, err
+	}
+	err = capnp.Struct(s).SetPtr(4, capnp.Struct(ss).ToPtr())
+	return ss, err
+}
+
+func (s KoboldMessage) Errors() (Error_List, error) {
+	p, err := capnp.Struct(s).Ptr(5)
+	return Error_List(p.List()), err
+}
+
+func (s KoboldMessage) HasErrors() bool {
+	return capnp.Struct(s).HasPtr(5)
+}
+
+func (s KoboldMessage) SetErrors(v Error_List) error {
+	return capnp.Struct(s).SetPtr(5, v.ToPtr())
+}
+
+// NewErrors sets the errors field to a newly
+// allocated Error_List, preferring placement in s's segment.
+func (s KoboldMessage) NewErrors(n int32) (Error_List, error) {
+	l, err := NewError_List(capnp.Struct(s).Segment(), n)
+	if err != nil {
+		return Error_List{}, err
+	}
+	err = capnp.Struct(s).SetPtr(5, l.ToPtr())
+	return l, err
+}
+func (s KoboldMessage) Timestamp() int64 {
+	return int64(capnp.Struct(s).Uint64(8))
+}
+
+func (s KoboldMessage) SetTimestamp(v int64) {
+	capnp.Struct(s).SetUint64(8, uint64(v))
+}
+
 // KoboldMessage_List is a list of KoboldMessage.
 type KoboldMessage_List = capnp.StructList[KoboldMessage]
 
 // NewKoboldMessage creates a new list of KoboldMessage.
 func NewKoboldMessage_List(s *capnp.Segment, sz int32) (KoboldMessage_List, error) {
-	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 4}, sz)
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 16, PointerCount: 6}, sz)
 	return capnp.StructList[KoboldMessage](l), err
 }
 
@@ -139,33 +202,396 @@ func (f KoboldMessage_Future) Struct() (KoboldMessage, error) {
 	p, err := f.Future.Ptr()
 	return KoboldMessage(p.Struct()), err
 }
+func (p KoboldMessage_Future) Headers() Headers_Future {
+	return Headers_Future{Future: p.Future.Field(4, nil)}
+}
+
+type Headers capnp.Struct
+
+// Headers_TypeID is the unique identifier for the type Headers.
+const Headers_TypeID = 0x9ba1bf42a5b9cd53
+
+func NewHeaders(s *capnp.Segment) (Headers, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 32, PointerCount: 6})
+	return Headers(st), err
+}
+
+func NewRootHeaders(s *capnp.Segment) (Headers, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 32, PointerCount: 6})
+	return Headers(st), err
+}
+
+func ReadRootHeaders(msg *capnp.Message) (Headers, error) {
+	root, err := msg.Root()
+	return Headers(root.Struct()), err
+}
+
+func (s Headers) String() string {
+	str, _ := text.Marshal(0x9ba1bf42a5b9cd53, capnp.Struct(s))
+	return str
+}
+
+func (s Headers) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Headers) DecodeFromPtr(p capnp.Ptr) Headers {
+	return Headers(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Headers) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Headers) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Headers) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Headers) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Headers) ClientId() (string, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return p.Text(), err
+}
+
+func (s Headers) HasClientId() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Headers) ClientIdBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return p.TextBytes(), err
+}
+
+func (s Headers) SetClientId(v string) error {
+	return capnp.Struct(s).SetText(0, v)
+}
+
+func (s Headers) ConnId() (string, error) {
+	p, err := capnp.Struct(s).Ptr(1)
+	return p.Text(), err
+}
+
+func (s Headers) HasConnId() bool {
+	return capnp.Struct(s).HasPtr(1)
+}
+
+func (s Headers) ConnIdBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(1)
+	return p.TextBytes(), err
+}
+
+func (s Headers) SetConnId(v string) error {
+	return capnp.Struct(s).SetText(1, v)
+}
+
+func (s Headers) AuthToken() (string, error) {
+	p, err := capnp.Struct(s).Ptr(2)
+	return p.Text(), err
+}
+
+func (s Headers) HasAuthToken() bool {
+	return capnp.Struct(s).HasPtr(2)
+}
+
+func (s Headers) AuthTokenBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(2)
+	return p.TextBytes(), err
+}
+
+func (s Headers) SetAuthToken(v string) error {
+	return capnp.Struct(s).SetText(2, v)
+}
+
+func (s Headers) Part() uint32 {
+	return capnp.Struct(s).Uint32(0)
+}
+
+func (s Headers) SetPart(v uint32) {
+	capnp.Struct(s).SetUint32(0, v)
+}
+
+func (s Headers) TotalParts() uint32 {
+	return capnp.Struct(s).Uint32(4)
+}
+
+func (s Headers) SetTotalParts(v uint32) {
+	capnp.Struct(s).SetUint32(4, v)
+}
+
+func (s Headers) Receipt() (string, error) {
+	p, err := capnp.Struct(s).Ptr(3)
+	return p.Text(), err
+}
+
+func (s Headers) HasReceipt() bool {
+	return capnp.Struct(s).HasPtr(3)
+}
+
+func (s Headers) ReceiptBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(3)
+	return p.TextBytes(), err
+}
+
+func (s Headers) SetReceipt(v string) error {
+	return capnp.Struct(s).SetText(3, v)
+}
+
+func (s Headers) Deliveries() uint32 {
+	return capnp.Struct(s).Uint32(8)
+}
+
+func (s Headers) SetDeliveries(v uint32) {
+	capnp.Struct(s).SetUint32(8, v)
+}
+
+func (s Headers) Wait() uint32 {
+	return capnp.Struct(s).Uint32(12)
+}
+
+func (s Headers) SetWait(v uint32) {
+	capnp.Struct(s).SetUint32(12, v)
+}
+
+func (s Headers) Revision() uint64 {
+	return capnp.Struct(s).Uint64(16)
+}
+
+func (s Headers) SetRevision(v uint64) {
+	capnp.Struct(s).SetUint64(16, v)
+}
+
+func (s Headers) Ttl() uint32 {
+	return capnp.Struct(s).Uint32(24)
+}
+
+func (s Headers) SetTtl(v uint32) {
+	capnp.Struct(s).SetUint32(24, v)
+}
+
+func (s Headers) StreamId() (string, error) {
+	p, err := capnp.Struct(s).Ptr(4)
+	return p.Text(), err
+}
+
+func (s Headers) HasStreamId() bool {
+	return capnp.Struct(s).HasPtr(4)
+}
+
+func (s Headers) StreamIdBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(4)
+	return p.TextBytes(), err
+}
+
+func (s Headers) SetStreamId(v string) error {
+	return capnp.Struct(s).SetText(4, v)
+}
+
+func (s Headers) Window() uint32 {
+	return capnp.Struct(s).Uint32(28)
+}
+
+func (s Headers) SetWindow(v uint32) {
+	capnp.Struct(s).SetUint32(28, v)
+}
+
+func (s Headers) Path() (capnp.TextList, error) {
+	p, err := capnp.Struct(s).Ptr(5)
+	return capnp.TextList(p.List()), err
+}
+
+func (s Headers) HasPath() bool {
+	return capnp.Struct(s).HasPtr(5)
+}
+
+func (s Headers) SetPath(v capnp.TextList) error {
+	return capnp.Struct(s).SetPtr(5, v.ToPtr())
+}
+
+// NewPath sets the path field to a newly
+// allocated capnp.TextList, preferring placement in s's segment.
+func (s Headers) NewPath(n int32) (capnp.TextList, error) {
+	l, err := capnp.NewTextList(capnp.Struct(s).Segment(), n)
+	if err != nil {
+		return capnp.TextList{}, err
+	}
+	err = capnp.Struct(s).SetPtr(5, l.ToPtr())
+	return l, err
+}
+
+// Headers_List is a list of Headers.
+type Headers_List = capnp.StructList[Headers]
+
+// NewHeaders creates a new list of Headers.
+func NewHeaders_List(s *capnp.Segment, sz int32) (Headers_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 32, PointerCount: 6}, sz)
+	return capnp.StructList[Headers](l), err
+}
+
+// Headers_Future is a wrapper for a Headers promised by a client call.
+type Headers_Future struct{ *capnp.Future }
+
+func (f Headers_Future) Struct() (Headers, error) {
+	p, err := f.Future.Ptr()
+	return Headers(p.Struct()), err
+}
+
+type Error capnp.Struct
+
+// Error_TypeID is the unique identifier for the type Error.
+const Error_TypeID = 0xf1250b47e6210cbd
+
+func NewError(s *capnp.Segment) (Error, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+	return Error(st), err
+}
+
+func NewRootError(s *capnp.Segment) (Error, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+	return Error(st), err
+}
+
+func ReadRootError(msg *capnp.Message) (Error, error) {
+	root, err := msg.Root()
+	return Error(root.Struct()), err
+}
+
+func (s Error) String() string {
+	str, _ := text.Marshal(0xf1250b47e6210cbd, capnp.Struct(s))
+	return str
+}
+
+func (s Error) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Error) DecodeFromPtr(p capnp.Ptr) Error {
+	return Error(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Error) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Error) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Error) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Error) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Error) ErrorMessage() (string, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return p.Text(), err
+}
+
+func (s Error) HasErrorMessage() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Error) ErrorMessageBytes() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return p.TextBytes(), err
+}
+
+func (s Error) SetErrorMessage(v string) error {
+	return capnp.Struct(s).SetText(0, v)
+}
+
+func (s Error) Code() uint8 {
+	return capnp.Struct(s).Uint8(0)
+}
+
+func (s Error) SetCode(v uint8) {
+	capnp.Struct(s).SetUint8(0, v)
+}
+
+// Error_List is a list of Error.
+type Error_List = capnp.StructList[Error]
+
+// NewError creates a new list of Error.
+func NewError_List(s *capnp.Segment, sz int32) (Error_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1}, sz)
+	return capnp.StructList[Error](l), err
+}
+
+// Error_Future is a wrapper for a Error promised by a client call.
+type Error_Future struct{ *capnp.Future }
+
+func (f Error_Future) Struct() (Error, error) {
+	p, err := f.Future.Ptr()
+	return Error(p.Struct()), err
+}
 
-const schema_e945d32308a30635 = "x\xda<\xcc1K#A\x00\x05\xe0\xf7f6\xc9\x15" +
-	"\x09\x97%9\xeeH\x93\x81\xeb\x0e\xee\xce\x08\x82\xa4\xd1" +
-	"\x08\x16\"\x82\xd3\x8b\xb8\xd9\x9d$\x8b\xc9\xcc\xb2;\xa0" +
-	"\x95\x96\x82\xad\xa5\x82\x85U~\x84\xa5\xbf@\xf0/\x88" +
-	"\x85\x85\xfe\x81\x95(Z\xbe\xef\xf1^\xf3j=\xe85" +
-	"~\x0a\x08\xfd\xabR-\x9fO\xfe\xce_\xcf.\xe7\x08" +
-	"\x7f\xb0\\\xa9\xde|\xfb}\xbf\xf9\x84JP\x03z/" +
-	"\x1d\xb6\xc8Z\x8b\xec\xb6\x06|\xc4j\x99\xe5\xce\xbb\xe2" +
-	"\xffL\x9a\xa2\x88\xc6\xe6_\x1ce6\xebo\xbb\xa1\x9b" +
-	"&;\x0b\x93c\xb3K\xea\x80\xa2\xdc\xbf\xb8\xd6\xb7\x0f" +
-	"\xe7w\xd0\x81\xe0`\x89\xac\x03=\xf6EY\xf8\xc8&" +
-	"Q\x9e\xd4\xd4\xe1\xfbP\xcd>\xde\xd4\xc8\xe5\xca\xe7\x91" +
-	"-F&O\xedX\xa5v\xe4\xd4\xd0\xf8#c\xac\x8a" +
-	"\xa7\xa9\xb1\xbeP\x91M\xd6\x94u\x89)\x00\xdd\x94\x01" +
-	"\x10\x10\x08\xa3\x0e\xa0\xf7$\xf5D0$\xdb\\\xa0Y" +
-	"\x06\xf4\x81\xa4\x9e\x0a\x86B\xb4)\x800\xfd\x03\xe8D" +
-	"Rg\x82\xa1\x94mJ \x9cm\x00z\"\xa9\xbd\xa0" +
-	"L\x13\xd6!X\x07\xbb\xdeei\xfc\x99\xbe\xfb\xe3\xad" +
-	"\xaf\xea4v\xd6\x1b\xeb\xd9\x80`\x03|\x0b\x00\x00\xff" +
-	"\xff\x8a\xabR\xee"
+const schema_e945d32308a30635 = "x\xdat\x94\xdf\x8b\xdcT\x18\x86\xdf\xf7\x9cdf\xb6" +
+	"\x9d\xednLD\xe8\xcdF\xc5\x8b\x16\xb4\xae\xd5\x9b\xbd" +
+	"YY(\xb6j\xa1\xa7\xd9\x0b\x11\x95f'gwc" +
+	"g\x9319\xed\xae\x17\xba\x15\x0a\xa2\xb4P\x10\xa1\xa5" +
+	"\x15-Z\xb0\x7f\x80\x17\x05\x8b(\x8a7\x0a\x8a?h" +
+	"\xc5b\x85\"V,X\xef%r\xb2\x9dL+x9" +
+	"\xcf\xbc\xf9\xf2\x9d\xef{r\x1e\xfe\x9c\x8f;\xd3\xe3K" +
+	"\x84P\x93n\xab\x8a\xbe\xbepn\xee\x93\xb3\xa7\xa1\xee" +
+	"\xa6S=\xd6z\xbfs\xffw\xbb\xae\xc3m\xb5\x01\xef" +
+	"\xd4\x1f\xe0\xf4;\xbf\x08\xb0\xba\xf1\xea\x83\xe7\xff~\xfd" +
+	"\xf4y\x9b\x13\xff\xc9\xed\xfcHn%\xe0\x7f*\xa7v" +
+	"\xfe#\xbf$X]\xec\xde\xfb\xdb\x13\x9b\x1f\xb8i\xe3" +
+	"\xbc-\xce6\xe0_v\x7f\x02\xfd+\xee*\xba\xd5\xa0" +
+	"\xc8M^\xeeX\x11\xba,\xe3%\xfdP/\x1ed\x83" +
+	"\x99\xdd:\x9eHtQ\xaaG\xa5\x038\xb6\xf8\xf3|" +
+	"\x12\x88\x9e\xa3d\xb4LA\x8f\x0ch\xb9\xe6\x0c\x10\x1d" +
+	"\xb0\xbco\xb9\x10\x01\x05\xe0\xa7\xdc\x0fD\xcb\x96\x1b\x0a" +
+	"R\x06\x94\x80\xff\x12\xb7\x03Q\xdf\xe25\x1bw\x18\xd0" +
+	"\x01\xfcC|\x16\x88\x8c\xe5G,we@\x17\xf0_" +
+	"\xe1\x1c\x10\xadY~\xd4\xf2\x96\x08\xd8\x02\xfc\xd7\xea\xfc" +
+	"\x11\xcb\x8fY\xde\x96A}\xb67\xea\xfaG-?a" +
+	"yG\x04\xec\x00\xfe\xf1\xba\xfdc\x96\x9f\xb4|\xac\x15" +
+	"p\x0c\xf0\xdf\xe6}@t\xc2\xf23\x96or\x02n" +
+	"\x02\xfcSu\xfe\xa4\xe5\x1fX\xbe\xb9\x1dp3\xe0\x9f" +
+	"\xad\x8f{\xc6\xf2\x0f-\xef\xba\x01\xbb\x80\x7f\xae~\xef" +
+	"{\x96\x7fL\xc1\xaa\xd7Ouf\xf6$\x00\xd8\x85`" +
+	"\x17\x9c\xed\xe5Y\xb6'\x19\xfe\xac\xe2Cfy>?" +
+	"\xa8\xc1l\xc8&\x06qa\xd8\x81`\x07\xacLn\xe2" +
+	"\xfe\xbe\xb8\x804\xe5\x10\xae\x17\xba\xa7\xd3\x81i\xaa$" +
+	"\xba\x9f\x1e\xd6E\x0a\xa9\x9b\xd0\xc4j\x9c\x8e\xca\x14\xfa" +
+	"pZ\xa6y\x06\x80c\x10\x1c\x03\xdb\xc6\xf4\x9b\xffK" +
+	"S\xe8x\xe5\xceVW\xd3,\xc9W\x9bz\x83\xd8," +
+	"s\x0b\xb8O\xb2\x8el\x01\x1bs\xe4\x1d\xe6<\x95/" +
+	"\xe4\xfdd\xaferI+\x87\xa2z\xe1\xadw\xd5\xc5" +
+	"\x1f\xdf\xfc\x02\xca\x11\xac\xdf\x81i\xce\x88\xaa4q\x96" +
+	"\xc4E\xd2\x0e\x0f\xd6\x0f\x85+\x1b\x95\xc2\xc5\xbc\x08M" +
+	"\x11g\xe5\xa2.\xd2l)L\xb3\xc5<\\\xd0fU" +
+	"\xeb,\xdc\x18l\x19\xc6Y2\x1bfy\xa2K\x15\x0e" +
+	"%\xf5\xbe\xdd\x0a\xa8\xaf$\xd5\xa5\x91\xa1\xde\x0f\x8f\x00" +
+	"\xea\x1bI\xf5\xf3HO\xef\xf2v@}/\xa9\xae\x0a" +
+	"zrCN\xef\xca\x1c\xa0.I\xaak\x82tj1" +
+	"\xbd_\x17\x00uUR\xfdi\xadtj+\xbd\xeb6" +
+	"xMR\xfde\x95tk%\xbd\x1b3\x80\xfa]2" +
+	"rj!\xb9!$\xedw\xb0\xdfz\xd1\xa5\xa0L\x9b" +
+	"\xfdO\x99|\x90\xf6\x9a\xcd\x9b\xb5\x91\x1a\xeb\xbd<3" +
+	":3\x1c\x87\xe08X\xdd\x9a\xcc<\xda/\x0f4[" +
+	"\x10l\x81\xeb\xcb:\xb6\x1f)'G\xb7\x08\xc8Ip" +
+	"V\x17E^\x94\xc3\x8dM\x8e\xae\x03\xb0\xde\x9dIW" +
+	"ti\xe2\x15p@\x17\x82.\xf8?7\xc1\xae\xa2\x90" +
+	"y\xa1:\xcd\x88\xb7\xcdy\xdb\xa6\xd4nI5/8" +
+	"\x1c\xb1\xb2\xd3|ZR=#\xb8~\xab\xd9z\xf77" +
+	"\x8f\xef\xb8\xe7\xae\x03\x17>\xbbm\xf7\x1e_\xac\xea\xfe" +
+	"\xf6\xea\x12\x136\xd9\xcc\xa0\x97'\xcd\xe9\xfe\x1d\x00\xc6" +
+	"R\x18\x83"
 
 func RegisterSchema(reg *schemas.Registry) {
 	reg.Register(&schemas.Schema{
 		String: schema_e945d32308a30635,
 		Nodes: []uint64{
+			0x9ba1bf42a5b9cd53,
 			0xa99b87f2a92d7eed,
+			0xf1250b47e6210cbd,
 		},
 		Compressed: true,
 	})
@@ -1,88 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/bahodge/kgpmp-prototype/pkg/acl"
+	"github.com/bahodge/kgpmp-prototype/pkg/auth"
+	"github.com/bahodge/kgpmp-prototype/pkg/client"
+	"github.com/bahodge/kgpmp-prototype/pkg/gossip"
+	"github.com/bahodge/kgpmp-prototype/pkg/node"
 	"github.com/bahodge/kgpmp-prototype/pkg/protocol"
 )
 
-func handleRequest(conn net.Conn) {
-	totalMessages := 0
-	defer conn.Close()
-	defer func() {
-		fmt.Println("received total messages", totalMessages)
-
-	}()
-	// Create a new message parser for each client connection
-	parser := protocol.NewMessageParser()
-
-	// Buffer to store incoming data from the client
-	chunk := make([]byte, 1024*1024)
-
-	for {
-		// Read data from the client
-		n, err := conn.Read(chunk)
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("client closed connection")
-				return
-			}
-			fmt.Println("Error reading from client:", err)
-			continue
-		}
+// RunNode serves until it is interrupted, then shuts the node down giving
+// what is in flight up to shutdownTimeout to drain
+func RunNode(addr string, opts node.Options, aclFile string, shutdownTimeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		// Parse complete messages from the received data
-		messages, err := parser.Parse(chunk[:n])
+	if aclFile != "" {
+		policy, err := acl.LoadFile(aclFile)
 		if err != nil {
-			fmt.Println("Error parsing messages:", err)
-			return
+			log.Fatal(err)
 		}
+		opts.ACL = policy
+	}
 
-		// Process the parsed messages
-		for _, message := range messages {
-			var dec protocol.Message
-			err := protocol.DeserializeCBOR(message, &dec)
+	n := node.New(opts)
+	if aclFile != "" {
+		go acl.WatchFile(ctx, aclFile, time.Second, func(policy *acl.Policy, err error) {
 			if err != nil {
-				fmt.Fprintln(os.Stdout, []any{"could not deserialize messagge", err}...)
+				fmt.Println("could not reload acl, keeping the previous one:", err)
 				return
 			}
-
-			totalMessages++
-		}
+			n.SetACL(policy)
+			fmt.Println("reloaded acl from", aclFile)
+		})
 	}
-}
-
-func RunNode(addr string) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
+	if err := n.Start(ctx, addr); err != nil {
 		log.Fatal(err)
 	}
-	defer listener.Close()
-
-	fmt.Printf("node listening on %s\n", addr)
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatal(err)
-		}
 
-		fmt.Println("new connection")
+	<-ctx.Done()
+	// a second interrupt kills the node right away
+	stop()
 
-		go handleRequest(conn)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := n.Shutdown(shutdownCtx); err != nil {
+		fmt.Println("closed connections before they drained:", err)
 	}
-
 }
 
-var msgId int
-
-func RunPub(addr string, topic string) {
-	conn, err := net.Dial("tcp", addr)
+func RunPub(addr string, topic string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
 	if err != nil {
 		log.Fatal("could not reach addr", err)
 	}
@@ -97,33 +80,17 @@ func RunPub(addr string, topic string) {
 
 	for i := 0; i < 50_000; i++ {
 		start := time.Now()
-		m := protocol.Message{
-			Id:          fmt.Sprintf("%d", i),
-			MessageType: protocol.Publish,
-			Topic:       topic,
-			TxId:        "",
-			Headers:     protocol.Headers{},
-			Content:     []byte("hello world"),
-			Errors:      []protocol.Error{},
-			Timestamp:   time.Now().UnixMicro(),
-		}
-
-		s, err := protocol.SerializeCBOR(m)
-		if err != nil {
-			log.Fatal("could not serialize message", err)
-
-		}
-
-		// fmt.Println("s", s)
+		content := []byte("hello world")
 
 		// Note there there is no chunking, we are just sending 1 message at a time.
 		// this does not perform optimally
-		n, err := conn.Write(s)
+		err := conn.Publish(topic, content)
 		if err != nil {
-			log.Fatal("could not write buf", err)
+			log.Fatal("could not publish", err)
 		}
 
-		bytesOut += n
+		msgsOut++
+		bytesOut += len(content)
 		rtts = append(rtts, time.Since(start))
 	}
 
@@ -148,7 +115,7 @@ func RunPub(addr string, topic string) {
 	avg := float64(sum) / float64(len(rtts))
 	fmt.Println("total roundtrips", len(rtts))
 	fmt.Println("total requests sent", requests)
-	fmt.Println("total bytes sent", bytesOut)
+	fmt.Println("total content bytes sent", bytesOut)
 	fmt.Println("total messages sent", msgsOut)
 	fmt.Println("total replies received", replies)
 	fmt.Println("total messages sent/received", replies+requests)
@@ -159,23 +126,537 @@ func RunPub(addr string, topic string) {
 	fmt.Println("msgs per second", int64(float64(time.Second)/avg))
 }
 
-func RunSub(addr string, topic string, clientId string) {
-	// TODO
+func RunSub(addr string, topic string, clientId string, opts client.Options) {
+	opts.ClientId = clientId
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	received := 0
+	_, err = conn.Subscribe(topic, func(msg protocol.Message) {
+		received++
+		fmt.Printf("[%s] id=%s conn=%s %s\n", msg.Topic, msg.Id, msg.Headers.ConnId, msg.Content)
+	})
+	if err != nil {
+		log.Fatal("could not subscribe", err)
+	}
+
+	fmt.Printf("subscribed to %s as %s\n", topic, clientId)
+
+	<-conn.Done()
+	fmt.Println(conn.Err())
+	fmt.Println("total messages received", received)
+}
+
+// RunReq sends a single request to a service topic and prints the reply
+func RunReq(addr string, topic string, content string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	rep, err := conn.Request(ctx, topic, []byte(content))
+	if err != nil {
+		fmt.Println("error:", err)
+	} else {
+		fmt.Printf("[%s] %s\n", rep.Topic, rep.Content)
+	}
+	fmt.Println("round trip", time.Since(start))
+}
+
+// RunRep advertises a service topic and replies to every request with the
+// content it was sent
+func RunRep(addr string, topic string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	var replies atomic.Int64
+	_, err = conn.Advertise(topic, func(req protocol.Message) ([]byte, error) {
+		fmt.Printf("[%s] request tx=%s conn=%s %s\n", req.Topic, req.TxId, req.Headers.ConnId, req.Content)
+		replies.Add(1)
+		return req.Content, nil
+	})
+	if err != nil {
+		log.Fatal("could not advertise", err)
+	}
+
+	fmt.Printf("advertising %s\n", topic)
+
+	<-conn.Done()
+	fmt.Println(conn.Err())
+	fmt.Println("total replies sent", replies.Load())
+}
+
+// RunEnq adds a message to a queue
+func RunEnq(addr string, queue string, content string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Enqueue(queue, []byte(content)); err != nil {
+		log.Fatal("could not enqueue", err)
+	}
+}
+
+// RunDeq takes messages from a queue one at a time, printing and acking each
+func RunDeq(addr string, queue string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	fmt.Printf("consuming %s\n", queue)
+
+	handled := 0
+	for {
+		m, err := conn.Dequeue(context.Background(), queue)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+
+		fmt.Printf("[%s] id=%s deliveries=%d %s\n", m.Topic, m.Id, m.Headers.Deliveries, m.Content)
+		if err := m.Ack(); err != nil {
+			fmt.Println("could not ack", err)
+		}
+		handled++
+	}
+	fmt.Println("total messages handled", handled)
+}
+
+// RunKV runs a single operation on a bucket of the key/value store. watch
+// prints every change to the bucket until the connection closes.
+func RunKV(addr string, bucket string, op string, args []string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	kv, err := conn.KV(bucket)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch {
+	case op == "get" && len(args) > 0:
+		entry, err := kv.Get(ctx, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s rev=%d %s\n", entry.Key, entry.Revision, entry.Value)
+	case op == "put" && len(args) > 1:
+		rev, err := kv.Put(ctx, args[0], []byte(args[1]))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s rev=%d\n", args[0], rev)
+	case op == "del" && len(args) > 0:
+		if err := kv.Delete(ctx, args[0]); err != nil {
+			log.Fatal(err)
+		}
+	case op == "list":
+		entries, err := kv.List(ctx, ">")
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s rev=%d %s\n", entry.Key, entry.Revision, entry.Value)
+		}
+	case op == "watch":
+		_, err := kv.Watch(">", func(e client.KVEvent) {
+			if e.Deleted {
+				fmt.Printf("%s rev=%d deleted\n", e.Key, e.Revision)
+				return
+			}
+			fmt.Printf("%s rev=%d %s\n", e.Key, e.Revision, e.Value)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		<-conn.Done()
+		fmt.Println(conn.Err())
+	default:
+		log.Fatalf("unknown kv operation %s %v", op, args)
+	}
+}
+
+// RunListen accepts the streams opened to the topic one after the other and
+// copies each to stdout
+func RunListen(addr string, topic string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	l, err := conn.Listen(topic)
+	if err != nil {
+		log.Fatal("could not listen", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "listening on %s\n", topic)
+
+	for {
+		s, err := l.Accept(context.Background())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+
+		n, err := io.Copy(os.Stdout, s)
+		s.Close()
+		fmt.Fprintf(os.Stderr, "received %d bytes (%v)\n", n, err)
+	}
+}
+
+// RunStream opens a stream to the topic, sends stdin over it and copies what
+// comes back to stdout
+func RunStream(addr string, topic string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	s, err := conn.OpenStream(ctx, topic)
+	cancel()
+	if err != nil {
+		log.Fatal("could not open stream", err)
+	}
+
+	go io.Copy(os.Stdout, s)
+
+	n, err := io.Copy(s, os.Stdin)
+	s.Close()
+	fmt.Fprintf(os.Stderr, "sent %d bytes (%v)\n", n, err)
+}
+
+// RunInfo prints what the node tells about itself, its connections and its
+// cluster
+func RunInfo(addr string, opts client.Options) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		log.Fatal("could not reach addr", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := conn.NodeInfo(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	uptime := time.Duration(info.Uptime) * time.Millisecond
+	fmt.Printf("node %s version %s protocol %d up %v\n", info.NodeId, info.Version, info.ProtocolVersion, uptime.Round(time.Second))
+	fmt.Printf("in %d messages %d bytes, out %d messages %d bytes, dropped %d messages\n", info.MessagesIn, info.BytesIn, info.MessagesOut, info.BytesOut, info.Dropped)
+
+	fmt.Printf("\n%d connections\n", len(info.Conns))
+	for _, c := range info.Conns {
+		who := "client"
+		if c.ClientId != "" {
+			who += " " + c.ClientId
+		}
+		if c.Peer != "" {
+			who = "peer " + c.Peer
+		}
+		if c.Subject != "" && c.Subject != c.ClientId {
+			who += " as " + c.Subject
+		}
+		fmt.Printf("  %s %s from %s %s, in %d/%dB out %d/%dB\n", c.Id, who, c.RemoteAddr, c.Codec, c.MessagesIn, c.BytesIn, c.MessagesOut, c.BytesOut)
+		if c.Dropped > 0 || c.Pending > 0 {
+			fmt.Printf("    %d pending, dropped %d messages\n", c.Pending, c.Dropped)
+		}
+		if len(c.Subscriptions) > 0 {
+			fmt.Printf("    subscribed %s\n", strings.Join(c.Subscriptions, " "))
+		}
+		if len(c.Services) > 0 {
+			fmt.Printf("    advertises %s\n", strings.Join(c.Services, " "))
+		}
+	}
+
+	printCounts("subscriptions", info.Subscriptions)
+	printCounts("services", info.Services)
+
+	if len(info.Members) > 0 {
+		fmt.Printf("\n%d members\n", len(info.Members))
+		for _, m := range info.Members {
+			fmt.Printf("  %s %s %s incarnation %d\n", m.Id, m.Addr, m.State, m.Incarnation)
+		}
+	}
+}
+
+// printCounts prints the connections per topic sorted by topic
+func printCounts(title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+
+	topics := make([]string, 0, len(counts))
+	for t := range counts {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	fmt.Printf("\n%s\n", title)
+	for _, t := range topics {
+		fmt.Printf("  %s %d\n", t, counts[t])
+	}
+}
+
+// RunToken prints a token for the subject signed with the hmac or jwt key
+// that expires after ttl, or never when ttl is 0
+func RunToken(subject string, ttl time.Duration, hmacKey []byte, jwtKey []byte) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	switch {
+	case hmacKey != nil:
+		fmt.Println(auth.NewHMAC(hmacKey).Sign(subject, expires))
+	case jwtKey != nil:
+		claims := auth.Claims{Subject: subject, IssuedAt: time.Now().Unix()}
+		if !expires.IsZero() {
+			claims.ExpiresAt = expires.Unix()
+		}
+		token, err := auth.NewJWT(jwtKey).Sign(claims)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+	default:
+		log.Fatal("token needs -hmac-key-file or -jwt-key-file")
+	}
+}
+
+// readKey reads a key file, an empty path means no key
+func readKey(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	key, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return bytes.TrimSpace(key)
 }
 
 func main() {
-	if len(os.Args) > 2 && os.Args[1] == "node" {
-		RunNode(os.Args[2])
+	codecName := flag.String("codec", "cbor", fmt.Sprintf("message encoding %v", protocol.Codecs()))
+	token := flag.String("token", "", "token clients authenticate with")
+	tokenFile := flag.String("token-file", "", "file of subjects and static tokens the node accepts")
+	hmacKeyFile := flag.String("hmac-key-file", "", "key of the hmac signed tokens the node accepts")
+	jwtKeyFile := flag.String("jwt-key-file", "", "key of the HS256 jwts the node accepts")
+	aclFile := flag.String("acl", "", "acl policy of the node, reloaded when the file changes")
+	useTLS := flag.Bool("tls", false, "connect to the node with tls")
+	tlsCert := flag.String("tls-cert", "", "certificate the node or client presents")
+	tlsKey := flag.String("tls-key", "", "key of the certificate")
+	tlsCA := flag.String("tls-ca", "", "CAs the client trusts, or for a node the CAs client certificates must be signed by")
+	nodeId := flag.String("node-id", "", "id of the node, random by default")
+	peers := flag.String("peers", "", "comma separated addresses of the nodes a node links to")
+	gossipAddr := flag.String("gossip", "", "udp address a node gossips about cluster membership on, e.g. :7946")
+	metricsAddr := flag.String("metrics", "", "address a node serves prometheus metrics on at /metrics, e.g. :9090")
+	maxPending := flag.Int("max-pending", 0, "published messages a node queues per connection, 1024 by default")
+	heartbeat := flag.Duration("heartbeat", 0, "how long a connection may be idle before it is pinged, 15s by default")
+	readTimeout := flag.Duration("read-timeout", 0, "how long nothing may be read from a connection before it is closed, three heartbeats by default")
+	writeTimeout := flag.Duration("write-timeout", 0, "how long writing to a connection may take, 10s by default")
+	requestTimeout := flag.Duration("request-timeout", 0, "how long a node waits on a service to reply to a request, 30s by default")
+	compression := flag.String("compression", "", fmt.Sprintf("comma separated compressions to use in order of preference %v", protocol.Compressions()))
+	compressionThreshold := flag.Int("compression-threshold", 0, "size from which on frames are compressed, 1024 bytes by default")
+	checksums := flag.Bool("checksums", false, "follow every frame with a crc32c when the other end agrees")
+	reconnect := flag.Bool("reconnect", false, "reconnect clients that lost the node and restore their subscriptions")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long a node that is interrupted waits on replies and acks in flight before it closes the connections")
+	slowConsumer := flag.String("slow-consumer", "block", "what a node does when a connection has max-pending messages queued: block, drop-oldest, drop-newest or disconnect")
+	maxBlock := flag.Duration("max-block", 0, "how long a node that blocks publishers makes them wait on a connection before it is disconnected, 1s by default")
+	gossipSeeds := flag.String("gossip-seeds", "", "comma separated gossip addresses of nodes to join the cluster through")
+	flag.Parse()
+
+	codec, err := protocol.CodecByName(*codecName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var compressors []protocol.Compressor
+	if *compression != "" {
+		for _, name := range strings.Split(*compression, ",") {
+			c, err := protocol.CompressorByName(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			compressors = append(compressors, c)
+		}
+	}
+	opts := client.Options{Codec: codec, AuthToken: *token, HeartbeatInterval: *heartbeat, ReadTimeout: *readTimeout, WriteTimeout: *writeTimeout, Checksums: *checksums}
+	opts.Compressors, opts.CompressionThreshold = compressors, *compressionThreshold
+	if *reconnect {
+		opts.Reconnect = true
+		opts.StateHandler = func(state client.State, err error) {
+			if err != nil {
+				fmt.Println(state, err)
+				return
+			}
+			fmt.Println(state)
+		}
+	}
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		opts.TLSConfig, err = client.TLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	hmacKey := readKey(*hmacKeyFile)
+	jwtKey := readKey(*jwtKeyFile)
+
+	args := flag.Args()
+	if len(args) > 1 && args[0] == "node" {
+		var authenticators []auth.Authenticator
+		if *tokenFile != "" {
+			tokens, err := auth.LoadTokenFile(*tokenFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			authenticators = append(authenticators, tokens)
+		}
+		if hmacKey != nil {
+			authenticators = append(authenticators, auth.NewHMAC(hmacKey))
+		}
+		if jwtKey != nil {
+			authenticators = append(authenticators, auth.NewJWT(jwtKey))
+		}
+		if len(authenticators) > 1 {
+			log.Fatal("only one of -token-file, -hmac-key-file and -jwt-key-file can be used")
+		}
+
+		var authenticator auth.Authenticator
+		if len(authenticators) == 1 {
+			authenticator = authenticators[0]
+		}
+		var tlsConfig *tls.Config
+		if *tlsCert != "" {
+			tlsConfig, err = node.ServerTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		nodeOpts := node.Options{
+			NodeId:        *nodeId,
+			Authenticator: authenticator,
+			TLSConfig:     tlsConfig,
+			// peers are dialed like a client would with the same flags
+			PeerTLSConfig: opts.TLSConfig,
+			PeerToken:     *token,
+			MetricsAddr:   *metricsAddr,
+			MaxPending:    *maxPending,
+			MaxBlock:      *maxBlock,
+
+			HeartbeatInterval: *heartbeat,
+			ReadTimeout:       *readTimeout,
+			WriteTimeout:      *writeTimeout,
+			RequestTimeout:    *requestTimeout,
+			Checksums:         *checksums,
+
+			Compressors:          compressors,
+			CompressionThreshold: *compressionThreshold,
+		}
+		nodeOpts.SlowConsumer, err = node.ParseSlowConsumerPolicy(*slowConsumer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *peers != "" {
+			nodeOpts.Peers = strings.Split(*peers, ",")
+		}
+		if *gossipAddr != "" {
+			nodeOpts.Gossip, err = gossip.NewUDPTransport(*gossipAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *gossipSeeds != "" {
+			nodeOpts.GossipSeeds = strings.Split(*gossipSeeds, ",")
+		}
+		RunNode(args[1], nodeOpts, *aclFile, *shutdownTimeout)
+		os.Exit(0)
+	}
+	if len(args) > 2 && args[0] == "pub" {
+		RunPub(args[1], args[2], opts)
+		os.Exit(0)
+	}
+	if len(args) > 3 && args[0] == "sub" {
+		RunSub(args[1], args[2], args[3], opts)
+		os.Exit(0)
+	}
+	if len(args) > 3 && args[0] == "req" {
+		RunReq(args[1], args[2], args[3], opts)
 		os.Exit(0)
 	}
-	if len(os.Args) > 3 && os.Args[1] == "pub" {
-		RunPub(os.Args[2], os.Args[3])
+	if len(args) > 2 && args[0] == "rep" {
+		RunRep(args[1], args[2], opts)
 		os.Exit(0)
 	}
-	if len(os.Args) > 3 && os.Args[1] == "sub" {
-		RunSub(os.Args[2], os.Args[3], os.Args[4])
+	if len(args) > 3 && args[0] == "enq" {
+		RunEnq(args[1], args[2], args[3], opts)
+		os.Exit(0)
+	}
+	if len(args) > 2 && args[0] == "deq" {
+		RunDeq(args[1], args[2], opts)
+		os.Exit(0)
+	}
+	if len(args) > 3 && args[0] == "kv" {
+		RunKV(args[1], args[2], args[3], args[4:], opts)
+		os.Exit(0)
+	}
+	if len(args) > 2 && args[0] == "listen" {
+		RunListen(args[1], args[2], opts)
+		os.Exit(0)
+	}
+	if len(args) > 2 && args[0] == "stream" {
+		RunStream(args[1], args[2], opts)
+		os.Exit(0)
+	}
+	if len(args) > 1 && args[0] == "info" {
+		RunInfo(args[1], opts)
+		os.Exit(0)
+	}
+	if len(args) > 2 && args[0] == "token" {
+		ttl, err := time.ParseDuration(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		RunToken(args[1], ttl, hmacKey, jwtKey)
 		os.Exit(0)
 	}
-	fmt.Fprintf(os.Stderr, "Usage: pubsub server|client <URL> <TOPIC> <CONTENT>\n")
+	fmt.Fprintf(os.Stderr, "Usage: pubsub [FLAGS] <COMMAND> <URL> [ARGS]\n")
+	fmt.Fprintf(os.Stderr, "  node <URL>\n")
+	fmt.Fprintf(os.Stderr, "  pub <URL> <TOPIC>\n")
+	fmt.Fprintf(os.Stderr, "  sub <URL> <TOPIC> <CLIENT_ID>\n")
+	fmt.Fprintf(os.Stderr, "  req <URL> <TOPIC> <CONTENT>\n")
+	fmt.Fprintf(os.Stderr, "  rep <URL> <TOPIC>\n")
+	fmt.Fprintf(os.Stderr, "  enq <URL> <QUEUE> <CONTENT>\n")
+	fmt.Fprintf(os.Stderr, "  deq <URL> <QUEUE>\n")
+	fmt.Fprintf(os.Stderr, "  kv <URL> <BUCKET> get|put|del|list|watch [KEY] [VALUE]\n")
+	fmt.Fprintf(os.Stderr, "  listen <URL> <TOPIC>\n")
+	fmt.Fprintf(os.Stderr, "  stream <URL> <TOPIC>\n")
+	fmt.Fprintf(os.Stderr, "  info <URL>\n")
+	fmt.Fprintf(os.Stderr, "  token <SUBJECT> <TTL>\n")
+	flag.PrintDefaults()
 	os.Exit(1)
 }